@@ -1,7 +1,6 @@
 package main
 
 import (
-	"bufio"
 	"flag"
 	"fmt"
 	"log"
@@ -11,6 +10,8 @@ import (
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
 )
 
 type Config struct {
@@ -35,26 +36,29 @@ func worker(id int, config Config, stats *Stats, done chan bool) {
 		done <- true
 		return
 	}
-	reader := bufio.NewReader(conn)
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
 	defer conn.Close()
 
 	start := time.Now()
-	cmd := ""
 	for time.Since(start) < config.Duration {
 		startTime := time.Now()
 		key := rand.IntN(100) // Use same random key for both
 		if rand.Float64() < config.ReadRatio {
-			cmd = fmt.Sprintf("GET key%d", key)
+			writer.WriteCommand("GET", fmt.Sprintf("key%d", key))
 		} else {
-			cmd = fmt.Sprintf("SET key%d value%d", key, key)
+			writer.WriteCommand("SET", fmt.Sprintf("key%d", key), fmt.Sprintf("value%d", key))
 		}
-		_, err := conn.Write([]byte(cmd + "\n"))
-		if err != nil {
+		if err := writer.Flush(); err != nil {
 			log.Printf("Worker %d: Failed to write: %v", id, err)
 			atomic.AddUint64(&stats.Errors, 1)
-			continue
+			break
+		}
+		if _, err := reader.ReadValue(); err != nil {
+			log.Printf("Worker %d: Failed to read: %v", id, err)
+			atomic.AddUint64(&stats.Errors, 1)
+			break
 		}
-		_, _ = reader.ReadString('\n')
 		atomic.AddUint64(&stats.TotalOperations, 1)
 		stats.mutex.Lock()
 		stats.Latencies = append(stats.Latencies, time.Since(startTime))
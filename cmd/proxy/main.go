@@ -0,0 +1,109 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/proxy"
+	"github.com/kartikey-singh/redis/internal/sharding"
+)
+
+func main() {
+	fmt.Println("🔀 Starting Proxy ...")
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	port := flag.Int("port", 7379, "Port to listen on")
+	backends := flag.String("backends", "localhost:6379", "Comma-separated client addresses of the servers to shard over")
+	backendsFile := flag.String("backends-file", "", "File listing a server address per line, read again on SIGHUP (overrides -backends)")
+	vnodes := flag.Int("vnodes", sharding.DefaultVirtualNodes, "Points each server gets on the consistent-hash ring")
+	timeout := flag.Int("timeout-ms", int(proxy.DefaultTimeout/time.Millisecond), "Milliseconds a request to a server may take")
+	flag.Parse()
+
+	addrs := splitList(*backends)
+	if *backendsFile != "" {
+		var err error
+		if addrs, err = readBackends(*backendsFile); err != nil {
+			log.Fatal("Backends file error: ", err)
+		}
+	}
+	p, err := proxy.New(proxy.Config{
+		Backends:     addrs,
+		VirtualNodes: *vnodes,
+		Timeout:      time.Duration(*timeout) * time.Millisecond,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *backendsFile != "" {
+		go reloadOnHangup(p, *backendsFile)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	fmt.Printf("📡 Proxy address: %s, sharding over %v\n", addr, p.Backends())
+	fmt.Println("📝 Supported commands:")
+	fmt.Println("   - SET key value [EX seconds] | GET key : Sent to the key's server")
+	fmt.Println("   - MGET key [key ...] | DEL key [key ...] : Split between the keys' servers")
+	fmt.Println("   - KEYS | SIZE | FLUSH : Sent to every server, replies merged")
+	fmt.Println("   - PING | HELLO [2|3] : Answered by the proxy")
+	if *backendsFile != "" {
+		fmt.Printf("   Send SIGHUP to reload the servers from %s\n", *backendsFile)
+	}
+	fmt.Printf("\n🔗 Connect with: redis-cli -p %d\n", *port)
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	if err := p.Start(addr); err != nil {
+		log.Fatal("Proxy error:", err)
+	}
+}
+
+// reloadOnHangup replaces the proxy's servers with those in the file at path
+// on every SIGHUP. Clients stay connected.
+func reloadOnHangup(p *proxy.Proxy, path string) {
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	for range hangup {
+		addrs, err := readBackends(path)
+		if err == nil {
+			err = p.SetBackends(addrs)
+		}
+		if err != nil {
+			log.Printf("Keeping the current servers, reload failed: %v", err)
+		}
+	}
+}
+
+// readBackends reads a server address per line. Blank lines and lines
+// starting with # are skipped.
+func readBackends(path string) ([]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var addrs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			addrs = append(addrs, line)
+		}
+	}
+	return addrs, scanner.Err()
+}
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/sentinel"
+)
+
+func main() {
+	fmt.Println("🛡️  Starting Sentinel ...")
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	port := flag.Int("port", 26379, "Port to listen on")
+	name := flag.String("name", "mymaster", "Name clients ask for the master by")
+	masterAddr := flag.String("master", "localhost:6379", "Client address of the master to monitor")
+	quorum := flag.Int("quorum", 0, "Sentinels that must agree the master is down before a failover (0 for a majority of them)")
+	peers := flag.String("peers", "", "Comma-separated client addresses of the other sentinels")
+	downAfter := flag.Int("down-after-ms", 30000, "Milliseconds without a reply before an instance is considered down")
+	failoverTimeout := flag.Int("failover-timeout-ms", 180000, "Milliseconds a failover may take, and to wait before retrying one")
+	flag.Parse()
+
+	cfg := sentinel.Config{
+		Name:            *name,
+		MasterAddr:      *masterAddr,
+		Quorum:          *quorum,
+		DownAfter:       time.Duration(*downAfter) * time.Millisecond,
+		FailoverTimeout: time.Duration(*failoverTimeout) * time.Millisecond,
+	}
+	for _, peer := range strings.Split(*peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			cfg.Peers = append(cfg.Peers, peer)
+		}
+	}
+	if cfg.Quorum == 0 {
+		cfg.Quorum = (len(cfg.Peers)+1)/2 + 1
+	}
+	s, err := sentinel.New(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	fmt.Printf("📡 Sentinel address: %s\n", addr)
+	fmt.Println("📝 Supported commands:")
+	fmt.Println("   - PING                                   : Test connection")
+	fmt.Println("   - SENTINEL get-master-addr-by-name name  : Current master's address")
+	fmt.Println("   - SENTINEL replicas name                 : Known replicas of the master")
+	fmt.Println("   - SENTINEL myid                          : This sentinel's run ID")
+	fmt.Printf("\n🔗 Connect with: redis-cli -p %d\n", *port)
+	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
+
+	if err := s.Start(addr); err != nil {
+		log.Fatal("Sentinel error:", err)
+	}
+}
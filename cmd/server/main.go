@@ -4,8 +4,16 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/kartikey-singh/redis/internal/cache"
+	"github.com/kartikey-singh/redis/internal/cluster"
+	"github.com/kartikey-singh/redis/internal/raft"
+	"github.com/kartikey-singh/redis/internal/replication"
 	"github.com/kartikey-singh/redis/internal/server"
 )
 
@@ -13,28 +21,102 @@ func main() {
 	fmt.Println("🚀 Starting Application Server ...")
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 
-	// Create cache with 10,000 item limit
-	c := cache.New(10000)
-
 	// Create server
 	port := flag.Int("port", 6379, "Port to listen on")
-	role := flag.String("role", "standalone", "Role: master, slave or standalone")
+	role := flag.String("role", "standalone", "Role: master, slave, standalone or raft")
 	masterAddr := flag.String("master", "localhost:6380", "Master address")
 	replicationPort := flag.Int("replication-port", 6380, "Replication port")
+	minReplicas := flag.Int("min-replicas-to-write", 0, "Refuse writes unless this many replicas are healthy (0 disables)")
+	minReplicasMaxLag := flag.Int("min-replicas-max-lag", 10, "Seconds since a replica's last ACK for it to count towards min-replicas-to-write")
+	serveStaleData := flag.Bool("replica-serve-stale-data", true, "Let a replica serve reads while its master link is down")
+	outputBufferLimit := flag.String("replica-output-buffer-limit", "256mb 64mb 60", "Disconnect replicas whose unsent stream passes <hard> bytes, or <soft> bytes for <seconds>")
+	raftAddr := flag.String("raft-addr", "localhost:6380", "This node's Raft address, as the other nodes reach it (raft role)")
+	raftPeers := flag.String("raft-peers", "", "Comma-separated Raft addresses of the other nodes (raft role)")
+	clusterMode := flag.Bool("cluster", false, "Serve only the hash slots this node owns and redirect clients with MOVED")
+	clusterConfig := flag.String("cluster-config-file", "", "File listing each node's address and the slots it serves (cluster mode)")
+	clusterAnnounce := flag.String("cluster-announce-addr", "", "Address other nodes and clients reach this node at (cluster mode, default 127.0.0.1:<port>)")
+	clusterBusPort := flag.Int("cluster-bus-port", 0, "Port nodes gossip on (cluster mode, default <port>+10000)")
+	clusterNodeTimeout := flag.Int("cluster-node-timeout", int(cluster.DefaultNodeTimeout/time.Millisecond), "Milliseconds a node may go unreachable before it is failing (cluster mode)")
+	raftSnapshotThreshold := flag.Uint64("raft-snapshot-threshold", raft.DefaultSnapshotThreshold, "Entries a Raft node applies between snapshots of the cache (raft role)")
 	flag.Parse()
+	limits, err := replication.ParseOutputBufferLimits(*outputBufferLimit)
+	if err != nil {
+		log.Fatal("Invalid -replica-output-buffer-limit: ", err)
+	}
+	// Create cache with 10,000 item limit. Raft nodes get no limit: each
+	// would evict keys of its own and their data would drift apart.
+	maxKeys := 10000
+	if *role == "raft" {
+		maxKeys = 0
+	}
+	c := cache.New(maxKeys)
+
 	addr := fmt.Sprintf(":%d", *port)
-	srv := server.New(addr, c, *role, *masterAddr, *replicationPort)
+	var srv *server.Server
+	if *role == "raft" {
+		node, err := startRaft(c, *raftAddr, *raftPeers, *port, *raftSnapshotThreshold)
+		if err != nil {
+			log.Fatal("Raft error: ", err)
+		}
+		srv = server.NewRaft(addr, c, node)
+	} else {
+		srv = server.New(addr, c, *role, *masterAddr, *replicationPort)
+	}
+	if *clusterMode {
+		if *role == "raft" {
+			log.Fatal("-cluster can't be combined with the raft role")
+		}
+		announce := *clusterAnnounce
+		if announce == "" {
+			announce = fmt.Sprintf("127.0.0.1:%d", *port)
+		}
+		busPort := *clusterBusPort
+		if busPort == 0 {
+			busPort = *port + 10000
+		}
+		host, _, err := net.SplitHostPort(announce)
+		if err != nil {
+			log.Fatal("Invalid -cluster-announce-addr: ", err)
+		}
+		cl, err := loadCluster(cluster.Config{
+			Addr:        announce,
+			BusAddr:     net.JoinHostPort(host, strconv.Itoa(busPort)),
+			ReplAddr:    net.JoinHostPort(host, strconv.Itoa(*replicationPort)),
+			NodeTimeout: time.Duration(*clusterNodeTimeout) * time.Millisecond,
+		}, *clusterConfig)
+		if err != nil {
+			log.Fatal("Cluster config error: ", err)
+		}
+		srv.SetCluster(cl)
+	}
+	srv.SetMinReplicas(*minReplicas, time.Duration(*minReplicasMaxLag)*time.Second)
+	srv.SetReplicaOutputBufferLimits(limits)
+	srv.SetReplicaServeStaleData(*serveStaleData)
 
 	fmt.Printf("📡 Server address: %s\n", addr)
 	fmt.Println("📝 Supported commands:")
 	fmt.Println("   - SET key value  : Store a key-value pair")
 	fmt.Println("   - GET key        : Retrieve a value")
-	fmt.Println("   - DEL key        : Delete a key")
+	fmt.Println("   - DEL key [key]  : Delete keys")
 	fmt.Println("   - KEYS           : List all keys")
 	fmt.Println("   - SIZE           : Get cache size")
 	fmt.Println("   - FLUSH          : Clear all data")
 	fmt.Println("   - PING           : Test connection")
-	fmt.Printf("\n🔗 Connect with: nc localhost:%d\n", *port)
+	fmt.Println("   - HELLO [2|3]    : Negotiate RESP2 or RESP3")
+	fmt.Println("   - ROLE           : Show replication role and link state")
+	fmt.Println("   - INFO [section] : Server and replication details")
+	fmt.Println("   - WAIT n timeout : Wait for n replicas to acknowledge your writes")
+	fmt.Println("   - REPLICAOF host port | NO ONE : Follow a master's replication port, or promote")
+	fmt.Println("   - CLUSTER SLOTS|SHARDS|NODES|KEYSLOT|ADDSLOTS|SETSLOT : Inspect or change the cluster's slots")
+	fmt.Println("   - CLUSTER MEET ip port|REPLICATE id : Join nodes to the cluster, or make this node a replica")
+	fmt.Println("   - MIGRATE host port key 0 timeout : Move keys to another node, keeping their TTL")
+	if *role == "raft" {
+		fmt.Println("   Writes on a Raft follower reply REDIRECT host:port with the leader's address")
+	}
+	if *clusterMode {
+		fmt.Println("   Keys of slots served elsewhere reply MOVED slot host:port, or ASK while the slot moves")
+	}
+	fmt.Printf("\n🔗 Connect with: redis-cli -p %d (or nc localhost %d for inline commands)\n", *port, *port)
 	fmt.Println("━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━━")
 	log.Printf("Role: %s, Master address: %s, Replication port: %d", *role, *masterAddr, *replicationPort)
 
@@ -43,3 +125,54 @@ func main() {
 		log.Fatal("Server error:", err)
 	}
 }
+
+// loadCluster creates the cluster view of the node cfg describes, with the
+// layout in the config file at path if there is one
+func loadCluster(cfg cluster.Config, path string) (*cluster.Cluster, error) {
+	cl := cluster.New(cfg)
+	if path == "" {
+		return cl, nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if err := cl.LoadConfig(f); err != nil {
+		return nil, err
+	}
+	return cl, nil
+}
+
+// startRaft starts this node's member of a Raft group. It serves the other
+// nodes on the port of raftAddr, and tells them clients reach it on the
+// host of raftAddr and clientPort.
+func startRaft(c *cache.Cache, raftAddr, peers string, clientPort int, snapshotThreshold uint64) (*raft.Node, error) {
+	host, raftPort, err := net.SplitHostPort(raftAddr)
+	if err != nil {
+		return nil, err
+	}
+	transport := raft.NewTCPTransport(raft.DefaultRPCTimeout)
+	cfg := raft.Config{
+		ID:         raftAddr,
+		ClientAddr: net.JoinHostPort(host, fmt.Sprint(clientPort)),
+		Transport:  transport,
+
+		SnapshotThreshold: snapshotThreshold,
+	}
+	for _, peer := range strings.Split(peers, ",") {
+		if peer = strings.TrimSpace(peer); peer != "" {
+			cfg.Peers = append(cfg.Peers, peer)
+		}
+	}
+	node, err := raft.NewNode(c, cfg)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		if err := transport.Listen(":"+raftPort, node); err != nil {
+			log.Fatal("Raft transport error: ", err)
+		}
+	}()
+	return node, nil
+}
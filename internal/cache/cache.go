@@ -11,6 +11,31 @@ type Cache struct {
 	maxSize     int
 	lruList     *LRUList
 	stopCleanup chan struct{} // Channel to signal background cleanup goroutine to stop
+	hook        func(Event)   // called for every change, with lock held
+	replicaMode bool          // never remove keys on our own, see SetReplicaMode
+
+	// Index of the keys by group, see IndexBy
+	group  func(key string) int
+	groups map[int]map[string]struct{}
+}
+
+// EventType says what kind of change an Event describes
+type EventType int
+
+const (
+	EventSet    EventType = iota + 1
+	EventDelete           // removed by Delete
+	EventExpire           // removed because its TTL ran out
+	EventEvict            // removed to make room for another key
+	EventFlush
+)
+
+// Event describes one change to the cache
+type Event struct {
+	Type      EventType
+	Key       string
+	Value     string
+	ExpiresAt time.Time // for EventSet, zero if the key does not expire
 }
 
 type CacheEntry struct {
@@ -50,14 +75,43 @@ func (c *Cache) backgroundCleanup() {
 func (c *Cache) cleanupExpiredKeys() {
 	c.lock.Lock()
 	defer c.lock.Unlock()
+	if c.replicaMode {
+		return
+	}
 	// Check if any TTL is expired - if so, delete the key
 	for key, entry := range c.data {
 		if entry.ExpiryTime.Before(time.Now()) && !entry.ExpiryTime.IsZero() {
-			c.deleteWithoutLocking(key)
+			c.deleteWithoutLocking(key, EventExpire)
 		}
 	}
 }
 
+// SetHook registers fn to be called for every change to the cache, in the
+// order the changes happen, including keys the cache expires or evicts by
+// itself. fn runs with the cache locked, so it must be quick and must not
+// call back into the cache. nil removes the hook.
+func (c *Cache) SetHook(fn func(Event)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.hook = fn
+}
+
+// SetReplicaMode turns replica mode on or off. In replica mode the cache
+// never removes keys by itself: expired keys are hidden from reads but kept
+// until the master deletes them, and maxSize is not enforced, since the
+// master evicts for us.
+func (c *Cache) SetReplicaMode(on bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.replicaMode = on
+}
+
+func (c *Cache) emit(ev Event) {
+	if c.hook != nil {
+		c.hook(ev)
+	}
+}
+
 func (c *Cache) Close() {
 	close(c.stopCleanup)
 }
@@ -73,7 +127,9 @@ func (c *Cache) Get(key string) (string, bool) {
 		c.lruList.MoveToFront(entry.lruNode)
 		return entry.Value, true
 	}
-	c.deleteWithoutLocking(key)
+	if !c.replicaMode {
+		c.deleteWithoutLocking(key, EventExpire)
+	}
 	return "", false
 }
 
@@ -89,7 +145,9 @@ func (c *Cache) GetWithTTL(key string) (string, time.Duration, bool) {
     
     // Check expiration
     if !entry.ExpiryTime.IsZero() && time.Now().After(entry.ExpiryTime) {
-        c.deleteWithoutLocking(key)
+        if !c.replicaMode {
+            c.deleteWithoutLocking(key, EventExpire)
+        }
         return "", 0, false
     }
     
@@ -107,24 +165,32 @@ func (c *Cache) GetWithTTL(key string) (string, time.Duration, bool) {
 }
 
 func (c *Cache) SetWithTTL(key string, value string, ttl time.Duration) {
+	var expiresAt time.Time
+	if ttl > 0 {
+		expiresAt = time.Now().Add(ttl)
+	}
+	c.SetWithDeadline(key, value, expiresAt)
+}
+
+// SetWithDeadline stores a key that expires at an absolute time, like
+// PEXPIREAT. A zero expiresAt means the key does not expire.
+func (c *Cache) SetWithDeadline(key string, value string, expiresAt time.Time) {
 	c.lock.Lock()
 	defer c.lock.Unlock()
 	// If the key already exists, update the value and move the node to the front
 	if entry, ok := c.data[key]; ok {
 		entry.Value = value
-		entry.ExpiryTime = time.Time{}
-		if ttl > 0 {
-			entry.ExpiryTime = time.Now().Add(ttl)
-		}
+		entry.ExpiryTime = expiresAt
 		c.lruList.MoveToFront(entry.lruNode)
+		c.emit(Event{Type: EventSet, Key: key, Value: value, ExpiresAt: expiresAt})
 		return
 	}
 	// If the cache is full, remove the least recently used node
-	if c.maxSize > 0 && len(c.data) >= c.maxSize {
+	if c.maxSize > 0 && len(c.data) >= c.maxSize && !c.replicaMode {
 		// Check if any TTL is expired - if so, delete the key
 		for key, entry := range c.data {
 			if entry.ExpiryTime.Before(time.Now()) && !entry.ExpiryTime.IsZero() {
-				c.deleteWithoutLocking(key)
+				c.deleteWithoutLocking(key, EventExpire)
 			}
 		}
 		// If the cache is still full, remove the least recently used node
@@ -134,17 +200,17 @@ func (c *Cache) SetWithTTL(key string, value string, ttl time.Duration) {
 				panic("Failed to remove least recently used node")
 			}
 			delete(c.data, node.Key)
+			c.indexRemove(node.Key)
+			c.emit(Event{Type: EventEvict, Key: node.Key})
 		}
 	}
-	var expiresAt time.Time
-	if ttl > 0 {
-		expiresAt = time.Now().Add(ttl)
-	}
 	c.data[key] = &CacheEntry{
 		Value:      value,
 		lruNode:    c.lruList.AddToFront(key),
 		ExpiryTime: expiresAt,
 	}
+	c.indexAdd(key)
+	c.emit(Event{Type: EventSet, Key: key, Value: value, ExpiresAt: expiresAt})
 }
 
 func (c *Cache) Set(key string, value string) {
@@ -163,10 +229,12 @@ func (c *Cache) Delete(key string) bool {
 	}
 	c.lruList.Remove(entry.lruNode)
 	delete(c.data, key)
+	c.indexRemove(key)
+	c.emit(Event{Type: EventDelete, Key: key})
 	return true
 }
 
-func (c *Cache) deleteWithoutLocking(key string) {
+func (c *Cache) deleteWithoutLocking(key string, reason EventType) {
 	entry, ok := c.data[key]
 	if !ok {
 		return
@@ -176,6 +244,8 @@ func (c *Cache) deleteWithoutLocking(key string) {
 	}
 	c.lruList.Remove(entry.lruNode)
 	delete(c.data, key)
+	c.indexRemove(key)
+	c.emit(Event{Type: reason, Key: key})
 }
 
 // Keys returns all keys in the cache
@@ -202,6 +272,10 @@ func (c *Cache) Flush() {
 		Tail: nil,
 		Size: 0,
 	}
+	if c.group != nil {
+		c.groups = make(map[int]map[string]struct{})
+	}
+	c.emit(Event{Type: EventFlush})
 }
 
 // Size returns the number of keys in the cache
@@ -210,3 +284,38 @@ func (c *Cache) Size() int {
 	defer c.lock.RUnlock()
 	return len(c.data)
 }
+
+// SnapshotEntry is one live key in a Snapshot
+type SnapshotEntry struct {
+	Key       string
+	Value     string
+	ExpiresAt time.Time // zero if the key does not expire
+}
+
+// Snapshot returns every live key with its value and expiry time, read
+// under a single lock so the result is a consistent point-in-time copy.
+// It does not touch the LRU order.
+func (c *Cache) Snapshot() []SnapshotEntry {
+	return c.SnapshotWith(nil)
+}
+
+// SnapshotWith is Snapshot, but also calls fn, if not nil, while the lock is
+// held. No change, and so no hook call, can happen between the snapshot and
+// fn.
+func (c *Cache) SnapshotWith(fn func()) []SnapshotEntry {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	if fn != nil {
+		fn()
+	}
+
+	now := time.Now()
+	entries := make([]SnapshotEntry, 0, len(c.data))
+	for key, entry := range c.data {
+		if !entry.ExpiryTime.IsZero() && !entry.ExpiryTime.After(now) {
+			continue
+		}
+		entries = append(entries, SnapshotEntry{Key: key, Value: entry.Value, ExpiresAt: entry.ExpiryTime})
+	}
+	return entries
+}
@@ -33,6 +33,27 @@ func TestBasicOperations(t *testing.T) {
 	}
 }
 
+func TestBinarySafeKeysAndValues(t *testing.T) {
+	c := New(1000)
+
+	key := "key with spaces\x00\r\n"
+	value := "\x00\xff  value\nwith newline"
+	c.Set(key, value)
+
+	got, found := c.Get(key)
+	if !found {
+		t.Fatal("expected to find binary key")
+	}
+	if got != value {
+		t.Errorf("expected %q, got %q", value, got)
+	}
+
+	// A key differing only after the NUL byte is a different key
+	if _, found := c.Get("key with spaces\x00"); found {
+		t.Error("prefix of binary key should not be found")
+	}
+}
+
 func TestGetNonExistent(t *testing.T) {
 	c := New(1000)
 
@@ -409,3 +430,157 @@ func BenchmarkCacheMixed(b *testing.B) {
 		}
 	})
 }
+
+func TestSnapshot(t *testing.T) {
+	c := New(10)
+	defer c.Close()
+
+	c.Set("plain", "a")
+	c.SetWithTTL("expiring", "b", time.Minute)
+	c.SetWithTTL("expired", "c", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	entries := c.Snapshot()
+	if len(entries) != 2 {
+		t.Fatalf("expected 2 live entries, got %d: %+v", len(entries), entries)
+	}
+	byKey := make(map[string]SnapshotEntry)
+	for _, e := range entries {
+		byKey[e.Key] = e
+	}
+	if e := byKey["plain"]; e.Value != "a" || !e.ExpiresAt.IsZero() {
+		t.Errorf("unexpected entry for plain: %+v", e)
+	}
+	if e := byKey["expiring"]; e.Value != "b" || time.Until(e.ExpiresAt) <= 0 || time.Until(e.ExpiresAt) > time.Minute {
+		t.Errorf("unexpected entry for expiring: %+v", e)
+	}
+}
+
+func TestHookReportsEveryChange(t *testing.T) {
+	c := New(2)
+	defer c.Close()
+	var events []Event
+	c.SetHook(func(ev Event) { events = append(events, ev) })
+
+	deadline := time.Now().Add(10 * time.Millisecond)
+	c.SetWithDeadline("a", "1", deadline)
+	c.Set("b", "2")
+	c.Delete("b")
+	c.Delete("missing") // nothing happened, nothing to report
+	time.Sleep(20 * time.Millisecond)
+	c.Get("a") // lazily expired
+	c.Set("x", "1")
+	c.Set("y", "2")
+	c.Set("z", "3") // evicts x
+	c.Flush()
+
+	want := []Event{
+		{Type: EventSet, Key: "a", Value: "1", ExpiresAt: deadline},
+		{Type: EventSet, Key: "b", Value: "2"},
+		{Type: EventDelete, Key: "b"},
+		{Type: EventExpire, Key: "a"},
+		{Type: EventSet, Key: "x", Value: "1"},
+		{Type: EventSet, Key: "y", Value: "2"},
+		{Type: EventEvict, Key: "x"},
+		{Type: EventSet, Key: "z", Value: "3"},
+		{Type: EventFlush},
+	}
+	if len(events) != len(want) {
+		t.Fatalf("expected %d events, got %d: %+v", len(want), len(events), events)
+	}
+	for i := range want {
+		if events[i] != want[i] {
+			t.Errorf("event %d: got %+v, want %+v", i, events[i], want[i])
+		}
+	}
+
+	// Background cleanup reports expiry too
+	events = nil
+	c.SetWithTTL("gone", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	c.cleanupExpiredKeys()
+	if len(events) != 2 || events[1] != (Event{Type: EventExpire, Key: "gone"}) {
+		t.Errorf("expected an expire event from cleanup, got %+v", events)
+	}
+}
+
+func TestReplicaModeNeverRemovesKeys(t *testing.T) {
+	c := New(2)
+	defer c.Close()
+	c.SetReplicaMode(true)
+
+	c.SetWithTTL("expired", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+
+	// Hidden from reads...
+	if _, found := c.Get("expired"); found {
+		t.Error("Get should hide a logically expired key")
+	}
+	if _, _, found := c.GetWithTTL("expired"); found {
+		t.Error("GetWithTTL should hide a logically expired key")
+	}
+	if len(c.Keys()) != 0 {
+		t.Error("Keys should hide a logically expired key")
+	}
+	// ...but still there until the master deletes it
+	c.cleanupExpiredKeys()
+	if c.Size() != 1 {
+		t.Errorf("replica mode should keep the expired key, size is %d", c.Size())
+	}
+
+	// The master decides what to evict, so maxSize is not enforced
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if c.Size() != 3 {
+		t.Errorf("replica mode should not evict, size is %d", c.Size())
+	}
+
+	c.SetReplicaMode(false)
+	if _, found := c.Get("expired"); found || c.Size() != 2 {
+		t.Errorf("out of replica mode the expired key should go, size is %d", c.Size())
+	}
+}
+
+func TestIndexBy(t *testing.T) {
+	c := New(3)
+	defer c.Close()
+	c.Set("a1", "v")
+	byLetter := func(key string) int { return int(key[0]) }
+	c.IndexBy(byLetter) // indexes a1, already there
+
+	c.Set("a2", "v")
+	c.Set("b1", "v")
+	c.Set("a2", "w") // updating a key doesn't index it twice
+	if got := c.GroupSize('a'); got != 2 {
+		t.Errorf("GroupSize(a) = %d, want 2", got)
+	}
+	if got := c.GroupKeys('a', 1); len(got) != 1 || got[0][0] != 'a' {
+		t.Errorf("GroupKeys(a, 1) = %v", got)
+	}
+
+	c.Set("b2", "v") // evicts a1
+	c.Delete("b1")
+	c.SetWithTTL("c1", "v", time.Millisecond)
+	time.Sleep(5 * time.Millisecond)
+	if c.Exists("c1") {
+		t.Error("Exists reports an expired key")
+	}
+	c.cleanupExpiredKeys()
+	for group, want := range map[int]int{'a': 1, 'b': 1, 'c': 0} {
+		if got := c.GroupSize(group); got != want {
+			t.Errorf("GroupSize(%c) = %d, want %d", group, got, want)
+		}
+	}
+	if got := c.GroupKeys('b', 10); len(got) != 1 || got[0] != "b2" {
+		t.Errorf("GroupKeys(b, 10) = %v", got)
+	}
+
+	c.Flush()
+	if got := c.GroupSize('b'); got != 0 {
+		t.Errorf("GroupSize(b) after Flush = %d", got)
+	}
+	c.Set("b3", "v")
+	if !c.Exists("b3") || c.GroupSize('b') != 1 {
+		t.Error("keys set after Flush are not indexed")
+	}
+}
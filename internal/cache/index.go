@@ -0,0 +1,80 @@
+package cache
+
+import "time"
+
+// IndexBy makes the cache keep an index of its keys by group(key), so the
+// keys of one group can be listed and counted without going through the
+// whole cache. Cluster mode groups keys by hash slot. Keys already in the
+// cache are indexed at once; nil drops the index.
+func (c *Cache) IndexBy(group func(key string) int) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.group = group
+	c.groups = nil
+	if group == nil {
+		return
+	}
+	c.groups = make(map[int]map[string]struct{})
+	for key := range c.data {
+		c.indexAdd(key)
+	}
+}
+
+// GroupKeys returns up to count keys of a group, in no particular order.
+// Like Size, it counts keys that have expired but are not removed yet.
+func (c *Cache) GroupKeys(group, count int) []string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	keys := make([]string, 0, min(count, len(c.groups[group])))
+	for key := range c.groups[group] {
+		if len(keys) == count {
+			break
+		}
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+// GroupSize returns the number of keys in a group
+func (c *Cache) GroupSize(group int) int {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return len(c.groups[group])
+}
+
+// Exists reports whether key is in the cache and not expired, without
+// touching the LRU order
+func (c *Cache) Exists(key string) bool {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	entry, ok := c.data[key]
+	return ok && (entry.ExpiryTime.IsZero() || entry.ExpiryTime.After(time.Now()))
+}
+
+// indexAdd adds a new key to the index, if there is one. Callers must hold
+// lock.
+func (c *Cache) indexAdd(key string) {
+	if c.group == nil {
+		return
+	}
+	g := c.group(key)
+	keys := c.groups[g]
+	if keys == nil {
+		keys = make(map[string]struct{})
+		c.groups[g] = keys
+	}
+	keys[key] = struct{}{}
+}
+
+// indexRemove removes a key from the index, if there is one. Callers must
+// hold lock.
+func (c *Cache) indexRemove(key string) {
+	if c.group == nil {
+		return
+	}
+	g := c.group(key)
+	delete(c.groups[g], key)
+	if len(c.groups[g]) == 0 {
+		delete(c.groups, g)
+	}
+}
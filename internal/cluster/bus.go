@@ -0,0 +1,36 @@
+package cluster
+
+// messageType is what a message on the cluster bus is for
+type messageType int
+
+const (
+	msgPing        messageType = iota
+	msgPong                    // the answer to every message but an AuthRequest
+	msgMeet                    // a ping from a node we don't know yet
+	msgFail                    // Failed is failing
+	msgAuthRequest             // a replica asks for a vote to replace its master
+	msgAuthAck                 // the answer to an AuthRequest
+)
+
+// message is what nodes send each other over the cluster bus. Every message
+// describes its sender, as a master or as its master's replica, and carries
+// gossip about the other nodes the sender knows.
+type message struct {
+	Type                      messageType
+	Sender                    string // ID
+	Addr, BusAddr, ReplAddr   string
+	Master                    string // ID of the sender's master, if it is a replica
+	CurrentEpoch, ConfigEpoch uint64
+	Slots                     []SlotRange // of the sender, or of its master
+	Offset                    int64
+	Gossip                    []gossip
+	Failed                    string // ID of the failed node in a Fail
+	Epoch                     uint64 // of the election in an AuthRequest or AuthAck
+	Granted                   bool   // in an AuthAck
+}
+
+// gossip is what a node knows about another node
+type gossip struct {
+	ID, Addr, BusAddr, ReplAddr string
+	PFail, Fail                 bool
+}
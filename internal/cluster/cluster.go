@@ -0,0 +1,459 @@
+// Package cluster keeps a node's view of a Redis Cluster style cluster:
+// keys hash to one of SlotCount slots, and each slot is served by one
+// master, which may have replicas.
+//
+// Nodes can be told the layout by a config file, but find each other and
+// agree on who serves what by gossip over the cluster bus, a port of their
+// own like the replication port. A node joins with Meet, and every node then
+// pings every other, telling it about itself and the nodes it knows. Slots
+// claimed with AddSlots spread with the pings. Every master has a config
+// epoch, and when two masters claim a slot the greater epoch wins.
+//
+// A node that doesn't answer pings for NodeTimeout is suspected to be
+// failing (PFAIL). Once a majority of the masters serving slots suspect it,
+// it is failed (FAIL) and every node is told. The replicas of a failed
+// master then stand for election in a new epoch, and the first voted for by
+// a majority of masters takes over its slots with that epoch.
+//
+// A slot moves to another node while it is in use, like in Redis: its owner
+// marks it migrating to the node, which marks it importing from the owner.
+// Keys are then moved one by one, and the slot is given to the new node,
+// which takes a new config epoch so its claim wins on every node.
+package cluster
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/gobrpc"
+)
+
+// DefaultNodeTimeout is how long a node may go without answering pings
+// before it is suspected to be failing
+const DefaultNodeTimeout = 15 * time.Second
+
+// Config describes this node
+type Config struct {
+	Addr     string // host:port clients connect to, which names the node
+	BusAddr  string // host:port of the cluster bus, "" to not gossip
+	ReplAddr string // host:port replicas replicate from
+
+	// NodeTimeout is DefaultNodeTimeout if zero
+	NodeTimeout time.Duration
+}
+
+// Node describes a node of the cluster
+type Node struct {
+	ID       string
+	Addr     string // host:port clients connect to
+	BusAddr  string // host:port of the cluster bus, "" if unknown
+	ReplAddr string // host:port replicas replicate from, "" if unknown
+	Myself   bool
+	MasterID string      // the master of a replica, "" for a master
+	Slots    []SlotRange // in order
+
+	ConfigEpoch  uint64
+	Offset       int64 // replication offset, as the node last told us
+	PFail, Fail  bool
+	PingSent     time.Time // of the oldest ping not answered yet, zero if none
+	PongReceived time.Time
+
+	// Slots moving to, or from, other nodes by their ID. Only known for
+	// this node.
+	Migrating map[int]string
+	Importing map[int]string
+}
+
+// SlotInfo is who serves a slot, as this node sees it
+type SlotInfo struct {
+	OwnerID, OwnerAddr string // empty if no node serves the slot
+	MigratingTo        string // address of the node our slot is moving to
+	ImportingFrom      string // address of the node the slot is moving to us from
+}
+
+type node struct {
+	id, addr, busAddr, replAddr string
+	master                      string // ID of a replica's master
+	configEpoch                 uint64
+	offset                      int64
+
+	pfail, fail  bool
+	failTime     time.Time
+	failReports  map[string]time.Time // when each master last said it was failing, by ID
+	pingSent     time.Time
+	lastPing     time.Time
+	pinging      bool // a ping is on its way
+	pongReceived time.Time
+	votedTime    time.Time // when we last voted for one of its replicas
+}
+
+// Cluster is one node's view of the cluster, safe for concurrent use
+type Cluster struct {
+	cfg Config
+	// The cluster bus, on which nodes send each other messages, answered
+	// by messages
+	bus       *gobrpc.Client[message, message]
+	busServer *gobrpc.Server[message, message]
+
+	mu     sync.RWMutex
+	myself *node
+	nodes  map[string]*node // by ID
+	slots  [SlotCount]*node // owner of each slot, nil if none
+
+	migrating map[int]*node // our slots moving to another node
+	importing map[int]*node // slots moving to us from another node
+
+	currentEpoch  uint64
+	lastVoteEpoch uint64
+	offset        int64                 // ours, as of the last tick
+	handshakes    map[string]*handshake // nodes being met, by bus address
+	election      election
+
+	// Role changes for the replication, run in order outside mu
+	repl    Replication
+	changes []func(Replication)
+	changed chan struct{}
+	stop    chan struct{}
+	closed  bool
+}
+
+// Replication is what the node replicates with, told by the cluster when
+// the node must change role
+type Replication interface {
+	// Promote turns the node, a replica, into a master
+	Promote()
+	// Follow makes the node a replica of the master replicating from addr
+	Follow(addr string)
+	// Offset returns the node's replication offset
+	Offset() int64
+}
+
+// New creates the view of the node cfg describes, alone in its cluster and
+// serving no slots
+func New(cfg Config) *Cluster {
+	if cfg.NodeTimeout <= 0 {
+		cfg.NodeTimeout = DefaultNodeTimeout
+	}
+	myself := &node{id: nodeID(cfg.Addr), addr: cfg.Addr, busAddr: cfg.BusAddr, replAddr: cfg.ReplAddr}
+	return &Cluster{
+		cfg:        cfg,
+		bus:        gobrpc.NewClient[message, message](cfg.NodeTimeout),
+		busServer:  gobrpc.NewServer[message, message]("cluster bus"),
+		myself:     myself,
+		nodes:      map[string]*node{myself.id: myself},
+		migrating:  make(map[int]*node),
+		importing:  make(map[int]*node),
+		handshakes: make(map[string]*handshake),
+		changed:    make(chan struct{}, 1),
+		stop:       make(chan struct{}),
+	}
+}
+
+// nodeID derives a node's ID from its address, so that every node gives
+// the same ID to a node it was told about
+func nodeID(addr string) string {
+	sum := sha1.Sum([]byte(addr))
+	return hex.EncodeToString(sum[:])
+}
+
+// MyID returns the ID of this node
+func (c *Cluster) MyID() string {
+	return c.myself.id
+}
+
+// AddNode adds the node clients reach at addr, if it isn't known yet, and
+// returns its ID
+func (c *Cluster) AddNode(addr string) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.addNode(nodeID(addr), addr).id
+}
+
+// addNode adds the node with ID id if it isn't known yet. Callers must hold
+// mu.
+func (c *Cluster) addNode(id, addr string) *node {
+	n, ok := c.nodes[id]
+	if !ok {
+		n = &node{id: id, addr: addr, failReports: make(map[string]time.Time)}
+		c.nodes[id] = n
+	}
+	return n
+}
+
+// AddSlots makes this node serve slots, all of which must be free. Either
+// every slot is added or none is.
+func (c *Cluster) AddSlots(slots ...int) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	seen := make(map[int]bool, len(slots))
+	for _, slot := range slots {
+		if slot < 0 || slot >= SlotCount {
+			return errors.New("Invalid or out of range slot")
+		}
+		if seen[slot] {
+			return fmt.Errorf("Slot %d specified multiple times", slot)
+		}
+		seen[slot] = true
+		if c.slots[slot] != nil {
+			return fmt.Errorf("Slot %d is already busy", slot)
+		}
+	}
+	if c.myself.master != "" {
+		return errors.New("Only masters can serve slots")
+	}
+	for _, slot := range slots {
+		c.slots[slot] = c.myself
+	}
+	return nil
+}
+
+// LoadConfig reads a layout of the cluster: a line per node with the
+// address clients reach it at, optionally followed by @ and its cluster bus
+// port, and then the slots it serves, each a slot or a start-end range.
+// Blank lines and lines starting with # are skipped.
+//
+//	127.0.0.1:7000@17000 0-5460
+//	127.0.0.1:7001@17001 5461-10922
+//	127.0.0.1:7002@17002 10923-16383
+//
+// This node is the line with its own address, if there is one. Nodes with
+// a bus port are gossiped with.
+func (c *Cluster) LoadConfig(r io.Reader) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		addr, busPort, hasBus := strings.Cut(fields[0], "@")
+		var busAddr string
+		if hasBus {
+			host, _, err := net.SplitHostPort(addr)
+			if port, perr := strconv.Atoi(busPort); err != nil || perr != nil || port <= 0 || port > 65535 {
+				return fmt.Errorf("cluster config line %d: invalid address %s", line, fields[0])
+			}
+			busAddr = net.JoinHostPort(host, busPort)
+		}
+		n := c.addNode(nodeID(addr), addr)
+		if n != c.myself && busAddr != "" {
+			n.busAddr = busAddr
+		}
+		for _, field := range fields[1:] {
+			r, err := ParseSlotRange(field)
+			if err != nil {
+				return fmt.Errorf("cluster config line %d: %w", line, err)
+			}
+			for slot := r.Start; slot <= r.End; slot++ {
+				if owner := c.slots[slot]; owner != nil && owner != n {
+					return fmt.Errorf("cluster config line %d: slot %d is already served by %s", line, slot, owner.addr)
+				}
+				c.slots[slot] = n
+			}
+		}
+	}
+	return scanner.Err()
+}
+
+// Owner returns the ID and address of the node serving slot, or false if
+// no node does
+func (c *Cluster) Owner(slot int) (id, addr string, ok bool) {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	n := c.slots[slot]
+	if n == nil {
+		return "", "", false
+	}
+	return n.id, n.addr, true
+}
+
+// Slot returns who serves slot
+func (c *Cluster) Slot(slot int) SlotInfo {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	var info SlotInfo
+	if n := c.slots[slot]; n != nil {
+		info.OwnerID, info.OwnerAddr = n.id, n.addr
+	}
+	if n := c.migrating[slot]; n != nil {
+		info.MigratingTo = n.addr
+	}
+	if n := c.importing[slot]; n != nil {
+		info.ImportingFrom = n.addr
+	}
+	return info
+}
+
+// SetMigrating marks one of our slots as moving to the node with ID id
+func (c *Cluster) SetMigrating(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.lookup(id)
+	if err != nil {
+		return err
+	}
+	if c.slots[slot] != c.myself {
+		return fmt.Errorf("I'm not the owner of hash slot %d", slot)
+	}
+	if n == c.myself {
+		return errors.New("Can't migrate a slot to myself")
+	}
+	c.migrating[slot] = n
+	return nil
+}
+
+// SetImporting marks a slot of another node as moving to us from the node
+// with ID id
+func (c *Cluster) SetImporting(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.lookup(id)
+	if err != nil {
+		return err
+	}
+	if c.slots[slot] == c.myself {
+		return fmt.Errorf("I'm already the owner of hash slot %d", slot)
+	}
+	if n == c.myself {
+		return errors.New("Can't import a slot from myself")
+	}
+	c.importing[slot] = n
+	return nil
+}
+
+// SetStable clears a slot's migrating or importing state
+func (c *Cluster) SetStable(slot int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+}
+
+// SetOwner gives a slot to the node with ID id, which ends its migration.
+// A node given a slot it was importing takes a new config epoch, so that
+// its claim wins over the old owner's.
+func (c *Cluster) SetOwner(slot int, id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.lookup(id)
+	if err != nil {
+		return err
+	}
+	if n == c.myself && c.importing[slot] != nil {
+		c.currentEpoch++
+		c.myself.configEpoch = c.currentEpoch
+	}
+	c.slots[slot] = n
+	delete(c.migrating, slot)
+	delete(c.importing, slot)
+	return nil
+}
+
+// Replicate makes this node a replica of the master with ID id. A master
+// must not serve slots to become a replica.
+func (c *Cluster) Replicate(id string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n, err := c.lookup(id)
+	if err != nil {
+		return err
+	}
+	switch {
+	case n == c.myself:
+		return errors.New("Can't replicate myself")
+	case n.master != "":
+		return errors.New("I can only replicate a master, not a replica.")
+	case c.myself.master == "" && c.serves(c.myself):
+		return errors.New("To set a master the node must be empty and without assigned slots.")
+	case n.replAddr == "":
+		return fmt.Errorf("I don't know where to replicate node %s from", id)
+	}
+	c.follow(n)
+	return nil
+}
+
+// lookup returns the node with ID id. Callers must hold mu.
+func (c *Cluster) lookup(id string) (*node, error) {
+	n, ok := c.nodes[id]
+	if !ok {
+		return nil, fmt.Errorf("I don't know about node %s", id)
+	}
+	return n, nil
+}
+
+// serves reports whether n serves a slot. Callers must hold mu.
+func (c *Cluster) serves(n *node) bool {
+	return slices.Contains(c.slots[:], n)
+}
+
+// slotRanges returns the slots n serves. Callers must hold mu.
+func (c *Cluster) slotRanges(n *node) []SlotRange {
+	var ranges []SlotRange
+	for slot, owner := range c.slots {
+		if owner != n {
+			continue
+		}
+		if last := len(ranges) - 1; last >= 0 && ranges[last].End == slot-1 {
+			ranges[last].End = slot
+		} else {
+			ranges = append(ranges, SlotRange{Start: slot, End: slot})
+		}
+	}
+	return ranges
+}
+
+// CurrentEpoch returns the greatest epoch this node has seen
+func (c *Cluster) CurrentEpoch() uint64 {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return c.currentEpoch
+}
+
+// Nodes returns every known node, sorted by address
+func (c *Cluster) Nodes() []Node {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	nodes := make([]Node, 0, len(c.nodes))
+	for _, n := range c.nodes {
+		info := Node{
+			ID:           n.id,
+			Addr:         n.addr,
+			BusAddr:      n.busAddr,
+			ReplAddr:     n.replAddr,
+			Myself:       n == c.myself,
+			MasterID:     n.master,
+			Slots:        c.slotRanges(n),
+			ConfigEpoch:  n.configEpoch,
+			Offset:       n.offset,
+			PFail:        n.pfail,
+			Fail:         n.fail,
+			PingSent:     n.pingSent,
+			PongReceived: n.pongReceived,
+		}
+		if info.Myself {
+			info.Offset = c.offset
+			info.Migrating = make(map[int]string, len(c.migrating))
+			for slot, to := range c.migrating {
+				info.Migrating[slot] = to.id
+			}
+			info.Importing = make(map[int]string, len(c.importing))
+			for slot, from := range c.importing {
+				info.Importing[slot] = from.id
+			}
+		}
+		nodes = append(nodes, info)
+	}
+	slices.SortFunc(nodes, func(a, b Node) int { return strings.Compare(a.Addr, b.Addr) })
+	return nodes
+}
@@ -0,0 +1,208 @@
+package cluster
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCRC16(t *testing.T) {
+	if got := crc16("123456789"); got != 0x31c3 {
+		t.Errorf("crc16(123456789) = %#x, want 0x31c3", got)
+	}
+}
+
+func TestKeySlot(t *testing.T) {
+	// Slots as Redis computes them
+	for key, want := range map[string]int{
+		"foo":   12182,
+		"bar":   5061,
+		"hello": 866,
+		"":      0,
+	} {
+		if got := KeySlot(key); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d", key, got, want)
+		}
+	}
+
+	// Only the first non-empty {hashtag} is hashed
+	for key, tag := range map[string]string{
+		"{user1000}.following": "user1000",
+		"foo{bar}{zap}":        "bar",
+		"foo{{bar}}zap":        "{bar",
+		"foo{}{bar}":           "foo{}{bar}",
+		"foo{bar":              "foo{bar",
+	} {
+		if got, want := KeySlot(key), KeySlot(tag); got != want {
+			t.Errorf("KeySlot(%q) = %d, want %d, the slot of %q", key, got, want, tag)
+		}
+	}
+}
+
+func TestParseSlotRange(t *testing.T) {
+	for s, want := range map[string]SlotRange{
+		"0":         {0, 0},
+		"16383":     {16383, 16383},
+		"100-200":   {100, 200},
+		"5461-5461": {5461, 5461},
+	} {
+		if got, err := ParseSlotRange(s); err != nil || got != want {
+			t.Errorf("ParseSlotRange(%q) = %v, %v, want %v", s, got, err, want)
+		}
+	}
+	for _, s := range []string{"", "-1", "16384", "a", "200-100", "1-", "1-16384"} {
+		if _, err := ParseSlotRange(s); err == nil {
+			t.Errorf("ParseSlotRange(%q) succeeded", s)
+		}
+	}
+}
+
+func TestLoadConfig(t *testing.T) {
+	c := New(Config{Addr: "127.0.0.1:7001"})
+	config := `
+# three nodes
+127.0.0.1:7000 0-5460
+127.0.0.1:7001 5461-10922 16383
+127.0.0.1:7002 10923-16382
+127.0.0.1:7003@17003
+`
+	if err := c.LoadConfig(strings.NewReader(config)); err != nil {
+		t.Fatal(err)
+	}
+
+	nodes := c.Nodes()
+	if len(nodes) != 4 {
+		t.Fatalf("got %d nodes, want 4", len(nodes))
+	}
+	want := []struct {
+		addr   string
+		myself bool
+		slots  string
+	}{
+		{"127.0.0.1:7000", false, "[0-5460]"},
+		{"127.0.0.1:7001", true, "[5461-10922 16383]"},
+		{"127.0.0.1:7002", false, "[10923-16382]"},
+		{"127.0.0.1:7003", false, "[]"},
+	}
+	for i, n := range nodes {
+		if n.Addr != want[i].addr || n.Myself != want[i].myself || fmtSlots(n.Slots) != want[i].slots {
+			t.Errorf("node %d: got %s myself=%v slots %s, want %+v", i, n.Addr, n.Myself, fmtSlots(n.Slots), want[i])
+		}
+	}
+	if nodes[3].BusAddr != "127.0.0.1:17003" || nodes[0].BusAddr != "" {
+		t.Errorf("bus addresses: got %q and %q", nodes[3].BusAddr, nodes[0].BusAddr)
+	}
+	if nodes[1].ID != c.MyID() || len(c.MyID()) != 40 {
+		t.Errorf("MyID = %q, want the 40 character ID of 127.0.0.1:7001", c.MyID())
+	}
+
+	// Every node derives the same IDs from the same config
+	other := New(Config{Addr: "127.0.0.1:7000"})
+	other.LoadConfig(strings.NewReader(config))
+	for i, n := range other.Nodes() {
+		if n.ID != nodes[i].ID {
+			t.Errorf("node %s has ID %s on one node and %s on another", n.Addr, nodes[i].ID, n.ID)
+		}
+	}
+
+	if id, addr, ok := c.Owner(KeySlot("foo")); !ok || addr != "127.0.0.1:7002" || id != nodes[2].ID {
+		t.Errorf("Owner of foo's slot = %s %s %v, want 127.0.0.1:7002", id, addr, ok)
+	}
+	if _, _, ok := c.Owner(16383); !ok {
+		t.Error("slot 16383 has no owner")
+	}
+
+	for _, config := range []string{
+		"127.0.0.1:7000 0-100\n127.0.0.1:7001 100\n", // overlap
+		"127.0.0.1:7000 0-16384\n",
+		"127.0.0.1:7000 x\n",
+		"127.0.0.1:7000@x\n",
+	} {
+		if err := New(Config{Addr: "127.0.0.1:7000"}).LoadConfig(strings.NewReader(config)); err == nil {
+			t.Errorf("LoadConfig(%q) succeeded", config)
+		}
+	}
+}
+
+func TestAddSlots(t *testing.T) {
+	c := New(Config{Addr: "127.0.0.1:7000"})
+	c.LoadConfig(strings.NewReader("127.0.0.1:7001 0-99\n"))
+
+	if err := c.AddSlots(100, 101, 102, 200); err != nil {
+		t.Fatal(err)
+	}
+	if id, _, ok := c.Owner(101); !ok || id != c.MyID() {
+		t.Errorf("slot 101 is not ours after AddSlots")
+	}
+
+	// Nothing is added when one slot can't be
+	for _, slots := range [][]int{{300, 50}, {300, 300}, {300, SlotCount}, {300, 100}} {
+		if err := c.AddSlots(slots...); err == nil {
+			t.Errorf("AddSlots(%v) succeeded", slots)
+		}
+		if _, _, ok := c.Owner(300); ok {
+			t.Fatalf("AddSlots(%v) added slot 300 despite failing", slots)
+		}
+	}
+
+	for _, n := range c.Nodes() {
+		if n.Myself && fmtSlots(n.Slots) != "[100-102 200]" {
+			t.Errorf("our slots: got %s", fmtSlots(n.Slots))
+		}
+	}
+}
+
+func TestSlotMigration(t *testing.T) {
+	source := New(Config{Addr: "127.0.0.1:7000"})
+	source.LoadConfig(strings.NewReader("127.0.0.1:7000 0-100\n127.0.0.1:7001\n"))
+	targetID := nodeID("127.0.0.1:7001")
+
+	for _, err := range []error{
+		source.SetMigrating(200, targetID),    // not ours
+		source.SetMigrating(5, "nosuchnode"),  // unknown node
+		source.SetMigrating(5, source.MyID()), // to ourselves
+		source.SetImporting(5, targetID),      // already ours
+		source.SetOwner(5, "nosuchnode"),      // unknown node
+	} {
+		if err == nil {
+			t.Error("expected an error")
+		}
+	}
+
+	if err := source.SetMigrating(5, targetID); err != nil {
+		t.Fatal(err)
+	}
+	if info := source.Slot(5); info.OwnerID != source.MyID() || info.MigratingTo != "127.0.0.1:7001" || info.ImportingFrom != "" {
+		t.Errorf("Slot(5) while migrating: %+v", info)
+	}
+	for _, n := range source.Nodes() {
+		if n.Myself && n.Migrating[5] != targetID {
+			t.Errorf("Nodes doesn't report slot 5 migrating: %+v", n.Migrating)
+		}
+	}
+	if err := source.SetOwner(5, targetID); err != nil {
+		t.Fatal(err)
+	}
+	if info := source.Slot(5); info.OwnerAddr != "127.0.0.1:7001" || info.MigratingTo != "" {
+		t.Errorf("Slot(5) once moved: %+v", info)
+	}
+
+	// And back, importing this time
+	if err := source.SetImporting(5, targetID); err != nil {
+		t.Fatal(err)
+	}
+	if info := source.Slot(5); info.ImportingFrom != "127.0.0.1:7001" {
+		t.Errorf("Slot(5) while importing: %+v", info)
+	}
+	source.SetStable(5)
+	if info := source.Slot(5); info.ImportingFrom != "" || info.OwnerAddr != "127.0.0.1:7001" {
+		t.Errorf("Slot(5) once stable: %+v", info)
+	}
+}
+
+func fmtSlots(slots []SlotRange) string {
+	parts := make([]string, len(slots))
+	for i, r := range slots {
+		parts[i] = r.String()
+	}
+	return "[" + strings.Join(parts, " ") + "]"
+}
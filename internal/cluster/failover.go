@@ -0,0 +1,112 @@
+package cluster
+
+import (
+	"log"
+	"math/rand/v2"
+	"time"
+)
+
+// election is a replica's bid to take over its failed master's slots
+type election struct {
+	start time.Time // when to ask for votes, after a delay that lets the replica with the most data go first
+	epoch uint64    // the epoch asked for, 0 until asked
+	votes map[string]bool
+}
+
+// failover stands for election once our master has failed, and takes over
+// its slots once a majority of the masters voted for us. It returns the
+// messages to send. Callers must hold mu.
+func (c *Cluster) failover(now time.Time) []outgoing {
+	me := c.myself
+	if me.master == "" {
+		return nil
+	}
+	master := c.nodes[me.master]
+	if master == nil || !master.fail || !c.serves(master) {
+		c.election = election{}
+		return nil
+	}
+	timeout := c.cfg.NodeTimeout
+	e := &c.election
+	if e.start.IsZero() || now.Sub(e.start) > 4*timeout {
+		// Replicas further behind, or with a greater ID if as far, wait
+		// longer, so the one with the most data is likely elected and
+		// replicas rarely split the votes
+		delay := timeout / 10
+		rank := 0
+		for _, n := range c.nodes {
+			if n != me && n.master == master.id && !n.fail && (n.offset > c.offset || n.offset == c.offset && n.id < me.id) {
+				rank++
+			}
+		}
+		*e = election{start: now.Add(delay + rand.N(delay) + time.Duration(rank)*timeout/2)}
+		return nil
+	}
+	if now.Before(e.start) || now.Sub(e.start) > 2*timeout {
+		return nil
+	}
+	if e.epoch == 0 {
+		c.currentEpoch++
+		e.epoch = c.currentEpoch
+		e.votes = make(map[string]bool)
+		log.Printf("Asking for votes to replace %s in epoch %d", master.addr, e.epoch)
+		m := c.message(msgAuthRequest)
+		m.Epoch = e.epoch
+		return c.broadcast(m)
+	}
+	if len(e.votes) < c.quorum() {
+		return nil
+	}
+
+	log.Printf("Elected to replace %s in epoch %d", master.addr, e.epoch)
+	for slot, owner := range c.slots {
+		if owner == master {
+			c.slots[slot] = me
+		}
+	}
+	me.master = ""
+	me.configEpoch = e.epoch
+	c.election = election{}
+	c.change(Replication.Promote)
+	return c.broadcast(c.message(msgPong))
+}
+
+// countVote counts a master's vote for us in the election in epoch.
+// Callers must hold mu.
+func (c *Cluster) countVote(voter *node, epoch uint64) {
+	if c.election.epoch != 0 && c.election.epoch == epoch && c.serves(voter) {
+		c.election.votes[voter.id] = true
+	}
+}
+
+// vote decides whether this master votes for the replica asking in m to
+// replace its failed master. It votes once per epoch, and not again for a
+// replica of the same master for twice NodeTimeout, so that a single
+// replica is elected. Callers must hold mu.
+func (c *Cluster) vote(m *message, now time.Time) bool {
+	me := c.myself
+	if me.master != "" || !c.serves(me) || m.Epoch < c.currentEpoch || m.Epoch <= c.lastVoteEpoch {
+		return false
+	}
+	candidate, master := c.nodes[m.Sender], c.nodes[m.Master]
+	if candidate == nil || master == nil || candidate.master != master.id || !master.fail {
+		return false
+	}
+	if now.Sub(master.votedTime) < 2*c.cfg.NodeTimeout {
+		return false
+	}
+	// A slot claimed may have moved on since, to a master with a greater
+	// epoch. The failed master's own epoch doesn't count: it may have
+	// changed after the candidate last heard from it.
+	for _, r := range m.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			if owner := c.slots[slot]; owner != nil && owner != master && owner.configEpoch > m.ConfigEpoch {
+				return false
+			}
+		}
+	}
+	c.lastVoteEpoch = m.Epoch
+	master.votedTime = now
+	log.Printf("Voting for %s to replace %s in epoch %d", candidate.addr, master.addr, m.Epoch)
+	return true
+}
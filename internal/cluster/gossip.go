@@ -0,0 +1,404 @@
+package cluster
+
+import (
+	"log"
+	"net"
+	"time"
+)
+
+// handshake is a node being met, known only by its bus address until it
+// answers
+type handshake struct {
+	started time.Time
+	sending bool
+}
+
+// outgoing is a message to send to a node once mu is released
+type outgoing struct {
+	busAddr string
+	to      *node // nil for a node being met
+	m       *message
+}
+
+// Start joins the cluster: the node answers other nodes on the port of its
+// bus address, pings them, and tells r when it must change role. It doesn't
+// block, and does nothing without a bus address.
+func (c *Cluster) Start(r Replication) error {
+	if c.cfg.BusAddr == "" {
+		return nil
+	}
+	_, port, err := net.SplitHostPort(c.cfg.BusAddr)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", ":"+port)
+	if err != nil {
+		return err
+	}
+	log.Printf("Cluster bus listening on %s", listener.Addr())
+	c.repl = r
+	go c.busServer.Serve(listener, c.handle)
+	go c.run()
+	go c.notify()
+	return nil
+}
+
+// Close leaves the cluster, as if the node had gone away
+func (c *Cluster) Close() {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		close(c.stop)
+	}
+	c.mu.Unlock()
+	c.bus.Close()
+	c.busServer.Close()
+}
+
+// Meet introduces the node whose bus is at busAddr to this node, and so to
+// the whole cluster. It is met once it answers, which it must do within
+// NodeTimeout.
+func (c *Cluster) Meet(busAddr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.handshakes[busAddr]; !ok {
+		c.handshakes[busAddr] = &handshake{started: time.Now()}
+	}
+}
+
+// run pings other nodes and looks for failures until Close is called
+func (c *Cluster) run() {
+	ticker := time.NewTicker(c.cfg.NodeTimeout / 10)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.tick()
+		}
+	}
+}
+
+// tick does what is due: meeting nodes, pinging the others every quarter of
+// NodeTimeout, flagging those that haven't answered for NodeTimeout, and
+// standing for election if our master has failed
+func (c *Cluster) tick() {
+	offset := c.repl.Offset()
+	now := time.Now()
+	timeout := c.cfg.NodeTimeout
+
+	c.mu.Lock()
+	c.offset = offset
+	var out []outgoing
+	for busAddr, h := range c.handshakes {
+		switch {
+		case now.Sub(h.started) > timeout:
+			log.Printf("Cluster node at %s didn't answer MEET", busAddr)
+			delete(c.handshakes, busAddr)
+		case !h.sending:
+			h.sending = true
+			out = append(out, outgoing{busAddr: busAddr, m: c.message(msgMeet)})
+		}
+	}
+	for _, n := range c.nodes {
+		if n == c.myself || n.busAddr == "" {
+			continue
+		}
+		if !n.pinging && now.Sub(n.lastPing) >= timeout/4 {
+			n.pinging = true
+			n.lastPing = now
+			if n.pingSent.IsZero() {
+				n.pingSent = now
+			}
+			out = append(out, outgoing{busAddr: n.busAddr, to: n, m: c.message(msgPing)})
+		}
+		if !n.pingSent.IsZero() && now.Sub(n.pingSent) > timeout && !n.pfail && !n.fail {
+			log.Printf("Cluster node %s is not answering", n.addr)
+			n.pfail = true
+			out = append(out, c.markFailing(n, now)...)
+		}
+	}
+	out = append(out, c.failover(now)...)
+	c.mu.Unlock()
+	c.send(out)
+}
+
+// send sends messages, each on its own, and takes in their answers
+func (c *Cluster) send(out []outgoing) {
+	for _, o := range out {
+		go func() {
+			reply, err := c.bus.Call(o.busAddr, o.m)
+			c.mu.Lock()
+			if o.to != nil && o.m.Type == msgPing {
+				o.to.pinging = false
+			}
+			if h := c.handshakes[o.busAddr]; h != nil {
+				h.sending = false
+				if err == nil {
+					delete(c.handshakes, o.busAddr)
+				}
+			}
+			var more []outgoing
+			if err == nil {
+				more = c.process(reply, time.Now())
+			}
+			c.mu.Unlock()
+			c.send(more)
+		}()
+	}
+}
+
+// broadcast returns m addressed to every other node on the bus. Callers
+// must hold mu.
+func (c *Cluster) broadcast(m *message) []outgoing {
+	var out []outgoing
+	for _, n := range c.nodes {
+		if n != c.myself && n.busAddr != "" {
+			out = append(out, outgoing{busAddr: n.busAddr, to: n, m: m})
+		}
+	}
+	return out
+}
+
+// handle answers a message from another node
+func (c *Cluster) handle(m *message) *message {
+	c.mu.Lock()
+	now := time.Now()
+	out := c.process(m, now)
+	var reply *message
+	if m.Type == msgAuthRequest {
+		reply = c.message(msgAuthAck)
+		reply.Epoch = m.Epoch
+		reply.Granted = c.vote(m, now)
+	} else {
+		reply = c.message(msgPong)
+	}
+	c.mu.Unlock()
+	c.send(out)
+	return reply
+}
+
+// message returns a message of type t describing this node. A replica
+// describes its master's slots. Callers must hold mu.
+func (c *Cluster) message(t messageType) *message {
+	me := c.myself
+	m := &message{
+		Type:         t,
+		Sender:       me.id,
+		Addr:         me.addr,
+		BusAddr:      me.busAddr,
+		ReplAddr:     me.replAddr,
+		Master:       me.master,
+		CurrentEpoch: c.currentEpoch,
+		Offset:       c.offset,
+	}
+	master := me
+	if me.master != "" {
+		master = c.nodes[me.master]
+	}
+	if master != nil {
+		m.ConfigEpoch = master.configEpoch
+		m.Slots = c.slotRanges(master)
+	}
+	for _, n := range c.nodes {
+		if n != me && n.busAddr != "" {
+			m.Gossip = append(m.Gossip, gossip{
+				ID: n.id, Addr: n.addr, BusAddr: n.busAddr, ReplAddr: n.replAddr,
+				PFail: n.pfail, Fail: n.fail,
+			})
+		}
+	}
+	return m
+}
+
+// process takes in what a message says about its sender and the cluster,
+// and returns the messages to send in turn. Only MEET, and PONG answering
+// one, introduce their sender. Callers must hold mu.
+func (c *Cluster) process(m *message, now time.Time) []outgoing {
+	timeout := c.cfg.NodeTimeout
+	c.currentEpoch = max(c.currentEpoch, m.CurrentEpoch)
+	sender := c.nodes[m.Sender]
+	if sender == nil {
+		if m.Type != msgMeet && m.Type != msgPong {
+			return nil
+		}
+		sender = c.addNode(m.Sender, m.Addr)
+		log.Printf("Met cluster node %s", m.Addr)
+	}
+	if sender == c.myself {
+		return nil
+	}
+	sender.busAddr, sender.replAddr = m.BusAddr, m.ReplAddr
+	sender.master = m.Master
+	sender.offset = m.Offset
+	if m.Master == "" && m.ConfigEpoch > sender.configEpoch {
+		sender.configEpoch = m.ConfigEpoch
+	}
+	if m.Type == msgPong {
+		sender.pingSent = time.Time{}
+		sender.pongReceived = now
+		sender.pfail = false
+		// A failed master is back for good if it lost its slots, or if no
+		// replica took them over
+		if sender.fail && (m.Master != "" || len(m.Slots) == 0 || now.Sub(sender.failTime) > 2*timeout) {
+			log.Printf("Cluster node %s is reachable again", sender.addr)
+			sender.fail = false
+			clear(sender.failReports)
+		}
+	}
+	if m.Master == "" {
+		c.claimSlots(sender, m)
+	}
+
+	var out []outgoing
+	for _, g := range m.Gossip {
+		n := c.nodes[g.ID]
+		if n == nil {
+			if !g.PFail && !g.Fail && g.BusAddr != "" {
+				n = c.addNode(g.ID, g.Addr)
+				n.busAddr, n.replAddr = g.BusAddr, g.ReplAddr
+			}
+			continue
+		}
+		if n == c.myself || sender.master != "" {
+			continue
+		}
+		if g.PFail || g.Fail {
+			n.failReports[sender.id] = now
+			out = append(out, c.markFailing(n, now)...)
+		} else {
+			delete(n.failReports, sender.id)
+		}
+	}
+	if m.Type == msgFail {
+		if n := c.nodes[m.Failed]; n != nil && n != c.myself && !n.fail {
+			log.Printf("Cluster node %s failed, as %s says", n.addr, sender.addr)
+			n.fail, n.failTime, n.pfail = true, now, false
+		}
+	}
+	if m.Type == msgAuthAck && m.Granted && sender.master == "" {
+		c.countVote(sender, m.Epoch)
+	}
+	return out
+}
+
+// claimSlots gives a master the slots it claims, unless their owner has at
+// least its config epoch or we are importing them. A master, or a replica,
+// that loses its last slot to the sender that way has been replaced by it,
+// and follows it. Callers must hold mu.
+func (c *Cluster) claimSlots(sender *node, m *message) {
+	me := c.myself
+	master := me
+	if me.master != "" {
+		master = c.nodes[me.master]
+	}
+	lost := false
+	for _, r := range m.Slots {
+		for slot := r.Start; slot <= r.End; slot++ {
+			owner := c.slots[slot]
+			if owner == sender || c.importing[slot] != nil || owner != nil && owner.configEpoch >= m.ConfigEpoch {
+				continue
+			}
+			c.slots[slot] = sender
+			delete(c.migrating, slot)
+			if owner != nil && owner == master {
+				lost = true
+			}
+		}
+	}
+	if lost && !c.serves(master) && me.master != sender.id {
+		log.Printf("Cluster node %s took over our slots", sender.addr)
+		c.follow(sender)
+	}
+	if sender.master == "" && me.master == "" && sender.configEpoch == me.configEpoch && c.serves(me) {
+		c.epochCollision(sender)
+	}
+}
+
+// epochCollision gives this master a new config epoch if another master has
+// the same one and a greater ID, so that every master ends up with its own.
+// Callers must hold mu.
+func (c *Cluster) epochCollision(other *node) {
+	if c.myself.configEpoch != other.configEpoch || c.myself.id > other.id {
+		return
+	}
+	c.currentEpoch++
+	c.myself.configEpoch = c.currentEpoch
+}
+
+// markFailing fails n, a node that doesn't answer our pings, once most of
+// the masters serving slots say so too, and returns the FAIL to tell every
+// node. Callers must hold mu.
+func (c *Cluster) markFailing(n *node, now time.Time) []outgoing {
+	if !n.pfail || n.fail {
+		return nil
+	}
+	reports := 0
+	for id, at := range n.failReports {
+		if now.Sub(at) > 2*c.cfg.NodeTimeout {
+			delete(n.failReports, id)
+			continue
+		}
+		reports++
+	}
+	if c.myself.master == "" && c.serves(c.myself) {
+		reports++
+	}
+	if reports < c.quorum() {
+		return nil
+	}
+	log.Printf("Cluster node %s failed", n.addr)
+	n.fail, n.failTime, n.pfail = true, now, false
+	m := c.message(msgFail)
+	m.Failed = n.id
+	return c.broadcast(m)
+}
+
+// quorum is a majority of the masters serving slots. Callers must hold mu.
+func (c *Cluster) quorum() int {
+	masters := make(map[*node]bool)
+	for _, n := range c.slots {
+		if n != nil {
+			masters[n] = true
+		}
+	}
+	return len(masters)/2 + 1
+}
+
+// follow makes this node a replica of master, and has the replication
+// follow it. Callers must hold mu.
+func (c *Cluster) follow(master *node) {
+	c.myself.master = master.id
+	c.election = election{}
+	addr := master.replAddr
+	c.change(func(r Replication) { r.Follow(addr) })
+}
+
+// change queues a role change for the replication. Callers must hold mu.
+func (c *Cluster) change(fn func(Replication)) {
+	c.changes = append(c.changes, fn)
+	select {
+	case c.changed <- struct{}{}:
+	default:
+	}
+}
+
+// notify makes the queued role changes, outside mu since the replication
+// may be calling into the cluster meanwhile
+func (c *Cluster) notify() {
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-c.changed:
+		}
+		c.mu.Lock()
+		changes := c.changes
+		c.changes = nil
+		c.mu.Unlock()
+		for _, fn := range changes {
+			fn(c.repl)
+		}
+	}
+}
@@ -0,0 +1,225 @@
+package cluster
+
+import (
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testNodeTimeout = 200 * time.Millisecond
+
+// fakeReplication records the role changes a node is told to make
+type fakeReplication struct {
+	mu        sync.Mutex
+	promoted  bool
+	following string
+}
+
+func (r *fakeReplication) Promote() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.promoted, r.following = true, ""
+}
+
+func (r *fakeReplication) Follow(addr string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.following = addr
+}
+
+func (r *fakeReplication) Offset() int64 { return 0 }
+
+func (r *fakeReplication) state() (promoted bool, following string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.promoted, r.following
+}
+
+// startNodes starts n nodes on localhost, their buses on ports from
+// basePort, each alone in its cluster
+func startNodes(t *testing.T, n, basePort int) ([]*Cluster, []*fakeReplication) {
+	t.Helper()
+	var nodes []*Cluster
+	var repls []*fakeReplication
+	for i := range n {
+		c := New(Config{
+			Addr:        fmt.Sprintf("127.0.0.1:%d", 7000+i),
+			BusAddr:     fmt.Sprintf("127.0.0.1:%d", basePort+i),
+			ReplAddr:    fmt.Sprintf("127.0.0.1:%d", 8000+i),
+			NodeTimeout: testNodeTimeout,
+		})
+		r := &fakeReplication{}
+		if err := c.Start(r); err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(c.Close)
+		nodes = append(nodes, c)
+		repls = append(repls, r)
+	}
+	return nodes, repls
+}
+
+// meetAll introduces every node to the first one, and waits for each to
+// know all the others
+func meetAll(t *testing.T, nodes []*Cluster) {
+	t.Helper()
+	for _, c := range nodes[1:] {
+		nodes[0].Meet(c.cfg.BusAddr)
+	}
+	waitFor(t, "every node to know every other", func() bool {
+		for _, c := range nodes {
+			if len(c.Nodes()) != len(nodes) {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func nodeInfo(c *Cluster, id string) Node {
+	for _, n := range c.Nodes() {
+		if n.ID == id {
+			return n
+		}
+	}
+	return Node{}
+}
+
+func TestGossip(t *testing.T) {
+	nodes, _ := startNodes(t, 3, 18300)
+	if err := nodes[0].AddSlots(0, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+	if err := nodes[1].AddSlots(100); err != nil {
+		t.Fatal(err)
+	}
+	meetAll(t, nodes)
+
+	// Slots spread, and each master ends up with its own config epoch
+	waitFor(t, "slots to spread", func() bool {
+		for _, c := range nodes {
+			if id, _, _ := c.Owner(1); id != nodes[0].MyID() {
+				return false
+			}
+			if id, _, _ := c.Owner(100); id != nodes[1].MyID() {
+				return false
+			}
+		}
+		return true
+	})
+	waitFor(t, "config epochs to differ", func() bool {
+		a, b := nodeInfo(nodes[2], nodes[0].MyID()), nodeInfo(nodes[2], nodes[1].MyID())
+		return a.ConfigEpoch != b.ConfigEpoch
+	})
+	for _, n := range nodes[2].Nodes() {
+		if n.BusAddr == "" || n.ReplAddr == "" || n.PFail || n.Fail {
+			t.Errorf("node 2 sees %+v", n)
+		}
+	}
+
+	// A claim with a greater epoch wins
+	nodes[2].mu.Lock()
+	nodes[2].currentEpoch += 10
+	nodes[2].myself.configEpoch = nodes[2].currentEpoch
+	nodes[2].slots[100] = nodes[2].myself
+	nodes[2].mu.Unlock()
+	waitFor(t, "the slot to move", func() bool {
+		id, _, _ := nodes[1].Owner(100)
+		return id == nodes[2].MyID()
+	})
+}
+
+func TestFailureDetection(t *testing.T) {
+	nodes, _ := startNodes(t, 3, 18310)
+	for i, c := range nodes {
+		if err := c.AddSlots(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meetAll(t, nodes)
+
+	nodes[2].Close()
+	failed := nodes[2].MyID()
+	waitFor(t, "the node to fail", func() bool {
+		return nodeInfo(nodes[0], failed).Fail && nodeInfo(nodes[1], failed).Fail
+	})
+
+	// Nodes still answering aren't flagged
+	if n := nodeInfo(nodes[0], nodes[1].MyID()); n.PFail || n.Fail {
+		t.Errorf("healthy node flagged: %+v", n)
+	}
+}
+
+func TestFailover(t *testing.T) {
+	nodes, repls := startNodes(t, 5, 18320)
+	for i, c := range nodes[:3] {
+		if err := c.AddSlots(i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	meetAll(t, nodes)
+
+	master := nodes[2]
+	for i, c := range nodes[3:] {
+		if err := c.Replicate(master.MyID()); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(t, "the replica to follow", func() bool {
+			_, following := repls[3+i].state()
+			return following == master.cfg.ReplAddr
+		})
+	}
+	for _, err := range []error{
+		nodes[3].Replicate(nodes[3].MyID()),
+		nodes[0].Replicate(nodes[4].MyID()),
+		nodes[0].Replicate(nodes[1].MyID()), // serves a slot
+		nodes[3].AddSlots(10),
+	} {
+		if err == nil {
+			t.Error("expected an error")
+		}
+	}
+	waitFor(t, "replicas to be known", func() bool {
+		return nodeInfo(nodes[0], nodes[3].MyID()).MasterID == master.MyID() &&
+			nodeInfo(nodes[0], nodes[4].MyID()).MasterID == master.MyID()
+	})
+
+	master.Close()
+	var winner int
+	waitFor(t, "a replica to take over", func() bool {
+		for _, i := range []int{3, 4} {
+			if promoted, _ := repls[i].state(); promoted {
+				winner = i
+				return true
+			}
+		}
+		return false
+	})
+	loser := 7 - winner
+	waitFor(t, "the cluster to agree", func() bool {
+		for _, c := range nodes[:2] {
+			if id, _, _ := c.Owner(2); id != nodes[winner].MyID() {
+				return false
+			}
+		}
+		n := nodeInfo(nodes[0], nodes[winner].MyID())
+		_, following := repls[loser].state()
+		return n.MasterID == "" && slices.Equal(n.Slots, []SlotRange{{2, 2}}) && following == nodes[winner].cfg.ReplAddr
+	})
+	if promoted, _ := repls[loser].state(); promoted {
+		t.Error("both replicas were promoted")
+	}
+}
@@ -0,0 +1,87 @@
+package cluster
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// SlotCount is the number of hash slots keys are spread over
+const SlotCount = 16384
+
+// crc16Table is the table of CRC-16/XMODEM, the CRC16 Redis Cluster uses
+var crc16Table = func() (table [256]uint16) {
+	for i := range table {
+		crc := uint16(i) << 8
+		for range 8 {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+		table[i] = crc
+	}
+	return table
+}()
+
+// crc16 is CRC-16/XMODEM: polynomial 0x1021, initial value 0
+func crc16(data string) uint16 {
+	var crc uint16
+	for i := 0; i < len(data); i++ {
+		crc = crc<<8 ^ crc16Table[byte(crc>>8)^data[i]]
+	}
+	return crc
+}
+
+// KeySlot returns the slot key hashes to. If the key has a non-empty
+// {hashtag}, the first such section, only the tag is hashed, so keys with
+// the same tag always share a slot.
+func KeySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key)) % SlotCount
+}
+
+// SlotRange is the slots from Start to End, both included
+type SlotRange struct {
+	Start, End int
+}
+
+func (r SlotRange) String() string {
+	if r.Start == r.End {
+		return strconv.Itoa(r.Start)
+	}
+	return fmt.Sprintf("%d-%d", r.Start, r.End)
+}
+
+// ParseSlot parses a slot number
+func ParseSlot(s string) (int, error) {
+	slot, err := strconv.Atoi(s)
+	if err != nil || slot < 0 || slot >= SlotCount {
+		return 0, fmt.Errorf("invalid or out of range slot %q", s)
+	}
+	return slot, nil
+}
+
+// ParseSlotRange parses "slot" or "start-end"
+func ParseSlotRange(s string) (SlotRange, error) {
+	first, last, isRange := strings.Cut(s, "-")
+	start, err := ParseSlot(first)
+	if err != nil {
+		return SlotRange{}, err
+	}
+	end := start
+	if isRange {
+		if end, err = ParseSlot(last); err != nil {
+			return SlotRange{}, err
+		}
+		if end < start {
+			return SlotRange{}, fmt.Errorf("invalid slot range %q", s)
+		}
+	}
+	return SlotRange{Start: start, End: end}, nil
+}
@@ -0,0 +1,185 @@
+// Package gobrpc carries requests between servers over TCP, gob-encoded,
+// each answered by a response. Raft nodes and the cluster bus use it.
+package gobrpc
+
+import (
+	"encoding/gob"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+// ErrClosed is returned by calls made once the client is closed
+var ErrClosed = errors.New("gobrpc: closed")
+
+// Client sends requests to servers named by their host:port. It keeps one
+// connection per server and sends one request at a time on it.
+type Client[Req, Resp any] struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*clientConn
+	closed bool
+}
+
+// clientConn is the connection to one server, dialled on first use and
+// again after an error
+type clientConn struct {
+	mu   sync.Mutex
+	conn net.Conn
+	enc  *gob.Encoder
+	dec  *gob.Decoder
+}
+
+// NewClient creates a client whose calls time out after timeout, dial
+// included
+func NewClient[Req, Resp any](timeout time.Duration) *Client[Req, Resp] {
+	return &Client[Req, Resp]{timeout: timeout, conns: make(map[string]*clientConn)}
+}
+
+// Call sends req to the server at addr and returns its response
+func (c *Client[Req, Resp]) Call(addr string, req *Req) (*Resp, error) {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil, ErrClosed
+	}
+	cc, ok := c.conns[addr]
+	if !ok {
+		cc = &clientConn{}
+		c.conns[addr] = cc
+	}
+	c.mu.Unlock()
+
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+	if cc.conn == nil {
+		conn, err := net.DialTimeout("tcp", addr, c.timeout)
+		if err != nil {
+			return nil, err
+		}
+		cc.conn, cc.enc, cc.dec = conn, gob.NewEncoder(conn), gob.NewDecoder(conn)
+	}
+	cc.conn.SetDeadline(time.Now().Add(c.timeout))
+	var resp Resp
+	err := cc.enc.Encode(req)
+	if err == nil {
+		err = cc.dec.Decode(&resp)
+	}
+	if err != nil {
+		// The stream may be out of step now, start over on a new one
+		cc.conn.Close()
+		cc.conn = nil
+		return nil, err
+	}
+	return &resp, nil
+}
+
+// Close closes the connections to servers. Calls fail with ErrClosed from
+// then on.
+func (c *Client[Req, Resp]) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.closed = true
+	for _, cc := range c.conns {
+		cc.mu.Lock()
+		if cc.conn != nil {
+			cc.conn.Close()
+			cc.conn = nil
+		}
+		cc.mu.Unlock()
+	}
+}
+
+// Server answers the requests of the clients it accepts
+type Server[Req, Resp any] struct {
+	name string // of the service, in log messages
+
+	mu       sync.Mutex
+	listener net.Listener
+	conns    map[net.Conn]bool // being served
+	closed   bool
+}
+
+// NewServer creates a server for the service called name in log messages
+func NewServer[Req, Resp any](name string) *Server[Req, Resp] {
+	return &Server[Req, Resp]{name: name, conns: make(map[net.Conn]bool)}
+}
+
+// Serve answers requests from the clients listener accepts with handle,
+// until Close is called. A client whose request handle answers with nil is
+// disconnected.
+func (s *Server[Req, Resp]) Serve(listener net.Listener, handle func(*Req) *Resp) error {
+	defer listener.Close()
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Error accepting %s connection: %v", s.name, err)
+			continue
+		}
+		go s.serveConn(conn, handle)
+	}
+}
+
+func (s *Server[Req, Resp]) serveConn(conn net.Conn, handle func(*Req) *Resp) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, conn)
+		s.mu.Unlock()
+		conn.Close()
+	}()
+
+	enc, dec := gob.NewEncoder(conn), gob.NewDecoder(conn)
+	for {
+		var req Req
+		if err := dec.Decode(&req); err != nil {
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] %s read error: %v", conn.RemoteAddr(), s.name, err)
+			}
+			return
+		}
+		resp := handle(&req)
+		if resp == nil {
+			return
+		}
+		if err := enc.Encode(resp); err != nil {
+			return
+		}
+	}
+}
+
+// Close stops listening and disconnects the clients being served
+func (s *Server[Req, Resp]) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package gobrpc
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+type request struct{ Text string }
+
+type response struct{ Text string }
+
+func startServer(t *testing.T, addr string) *Server[request, response] {
+	t.Helper()
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := NewServer[request, response]("test")
+	t.Cleanup(func() { s.Close() })
+	go s.Serve(listener, func(req *request) *response {
+		if req.Text == "" {
+			return nil
+		}
+		return &response{Text: strings.ToUpper(req.Text)}
+	})
+	return s
+}
+
+func TestCall(t *testing.T) {
+	const addr = "127.0.0.1:18600"
+	s := startServer(t, addr)
+	c := NewClient[request, response](time.Second)
+	defer c.Close()
+
+	for _, text := range []string{"a", "b"} {
+		resp, err := c.Call(addr, &request{Text: text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Text != strings.ToUpper(text) {
+			t.Errorf("got %q", resp.Text)
+		}
+	}
+
+	// A request the handler refuses drops the connection, and the next
+	// call dials again
+	if _, err := c.Call(addr, &request{}); err == nil {
+		t.Error("refused request succeeded")
+	}
+	if resp, err := c.Call(addr, &request{Text: "c"}); err != nil || resp.Text != "C" {
+		t.Errorf("call after a dropped connection: %+v, %v", resp, err)
+	}
+
+	s.Close()
+	if _, err := c.Call(addr, &request{Text: "d"}); err == nil {
+		t.Error("call to a closed server succeeded")
+	}
+	c.Close()
+	if _, err := c.Call(addr, &request{Text: "e"}); !errors.Is(err, ErrClosed) {
+		t.Errorf("call on a closed client: got %v, want ErrClosed", err)
+	}
+}
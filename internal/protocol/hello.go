@@ -0,0 +1,79 @@
+package protocol
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// RedisVersion is the Redis release whose command behaviour we follow.
+// Clients use it from the HELLO reply for feature detection.
+const RedisVersion = "7.0.0"
+
+// HelloArgs are the arguments of
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+type HelloArgs struct {
+	Protocol int // 0 if not given
+	SetName  bool
+	Name     string // given with SETNAME
+}
+
+// ParseHello parses a HELLO command, args[0] being HELLO itself. Its errors
+// are the error replies to send, code included. AUTH is accepted and
+// ignored: no users are configured, so every client is the default user.
+func ParseHello(args []string) (HelloArgs, error) {
+	var hello HelloArgs
+	if len(args) > 1 {
+		v, err := strconv.Atoi(args[1])
+		if err != nil {
+			return hello, errors.New("ERR Protocol version is not an integer or out of range")
+		}
+		if v != RESP2 && v != RESP3 {
+			return hello, errors.New("NOPROTO unsupported protocol version")
+		}
+		hello.Protocol = v
+	}
+	for i := 2; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "AUTH":
+			if i+2 >= len(args) {
+				return hello, errors.New("ERR Syntax error in HELLO option 'AUTH'")
+			}
+			i += 2
+		case "SETNAME":
+			if i+1 >= len(args) {
+				return hello, errors.New("ERR Syntax error in HELLO option 'SETNAME'")
+			}
+			hello.SetName, hello.Name = true, args[i+1]
+			i++
+		default:
+			return hello, errors.New("ERR Syntax error in HELLO option '" + args[i] + "'")
+		}
+	}
+	return hello, nil
+}
+
+// WriteHello switches to proto, or stays on the current protocol if it is
+// 0, and replies to HELLO with a map describing the server: the client's
+// connection id, the server's mode (standalone, cluster or proxy) and its
+// role (master or replica).
+func (w *Writer) WriteHello(proto int, id int64, mode, role string) error {
+	if proto != 0 {
+		w.SetProtocol(proto)
+	}
+	w.WriteMapHeader(7)
+	w.WriteBulkString("server")
+	w.WriteBulkString("redis")
+	w.WriteBulkString("version")
+	w.WriteBulkString(RedisVersion)
+	w.WriteBulkString("proto")
+	w.WriteInteger(int64(w.proto))
+	w.WriteBulkString("id")
+	w.WriteInteger(id)
+	w.WriteBulkString("mode")
+	w.WriteBulkString(mode)
+	w.WriteBulkString("role")
+	w.WriteBulkString(role)
+	w.WriteBulkString("modules")
+	return w.WriteArrayHeader(0)
+}
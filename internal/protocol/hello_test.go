@@ -0,0 +1,58 @@
+package protocol
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestParseHello(t *testing.T) {
+	hello, err := ParseHello([]string{"HELLO", "3", "AUTH", "default", "pw", "setname", "app"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hello != (HelloArgs{Protocol: RESP3, SetName: true, Name: "app"}) {
+		t.Errorf("got %+v", hello)
+	}
+	if hello, err := ParseHello([]string{"HELLO"}); err != nil || hello != (HelloArgs{}) {
+		t.Errorf("HELLO without arguments: got %+v, %v", hello, err)
+	}
+
+	for _, tt := range []struct {
+		args []string
+		want string
+	}{
+		{[]string{"HELLO", "x"}, "ERR Protocol version"},
+		{[]string{"HELLO", "4"}, "NOPROTO"},
+		{[]string{"HELLO", "3", "AUTH", "default"}, "ERR Syntax error in HELLO option 'AUTH'"},
+		{[]string{"HELLO", "3", "SETNAME"}, "ERR Syntax error in HELLO option 'SETNAME'"},
+		{[]string{"HELLO", "3", "BOGUS"}, "ERR Syntax error in HELLO option 'BOGUS'"},
+	} {
+		if _, err := ParseHello(tt.args); err == nil || !strings.HasPrefix(err.Error(), tt.want) {
+			t.Errorf("%q: got %v, want %q", tt.args, err, tt.want)
+		}
+	}
+}
+
+func TestWriteHello(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteHello(RESP3, 7, "proxy", "master")
+	w.Flush()
+	if w.Protocol() != RESP3 {
+		t.Errorf("protocol not switched: %d", w.Protocol())
+	}
+	v, err := NewReader(&buf).ReadValue()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Type != Map || len(v.Array) != 14 || v.Array[3].Str != RedisVersion || v.Array[9].Str != "proxy" {
+		t.Errorf("got %+v", v)
+	}
+
+	// 0 keeps the protocol in use
+	w.WriteHello(0, 7, "proxy", "master")
+	if w.Protocol() != RESP3 {
+		t.Errorf("protocol changed: %d", w.Protocol())
+	}
+}
@@ -0,0 +1,358 @@
+package protocol
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxInlineSize  = 64 * 1024         // longest inline command we accept
+	maxBulkLength  = 512 * 1024 * 1024 // same limit as Redis' proto-max-bulk-len
+	maxArrayLength = 1024 * 1024
+)
+
+// ProtocolError reports malformed input. The stream cannot be resynchronised
+// after one, so the connection should be closed.
+type ProtocolError struct {
+	Msg string
+}
+
+func (e *ProtocolError) Error() string {
+	return "Protocol error: " + e.Msg
+}
+
+func protocolError(format string, args ...any) error {
+	return &ProtocolError{Msg: fmt.Sprintf(format, args...)}
+}
+
+// Reader decodes RESP values from a stream.
+type Reader struct {
+	rd *bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{rd: bufio.NewReader(r)}
+}
+
+// Buffered returns the number of bytes already read from the stream but not
+// yet consumed. Servers use it to batch replies to pipelined commands.
+func (r *Reader) Buffered() int {
+	return r.rd.Buffered()
+}
+
+// ReadCommand reads one client command. Clients normally send an array of
+// bulk strings; any other line is treated as an inline command so `nc` and
+// telnet users can still type commands by hand (see SplitArgs). Empty inline
+// lines are skipped, and so are empty and null multibulks.
+func (r *Reader) ReadCommand() ([]string, error) {
+	for {
+		b, err := r.rd.Peek(1)
+		if err != nil {
+			return nil, err
+		}
+		var args []string
+		if Type(b[0]) == Array {
+			args, err = r.readMultiBulk()
+		} else {
+			var line string
+			if line, err = r.readLine(); err != nil {
+				return nil, err
+			}
+			args, err = SplitArgs(line)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if len(args) > 0 {
+			return args, nil
+		}
+	}
+}
+
+// SplitArgs splits an inline command line into arguments the way redis-cli
+// does. Arguments are separated by whitespace; "double quoted" arguments may
+// contain spaces and the escapes \n \r \t \b \a \\ \" and \xHH, and
+// 'single quoted' arguments are taken literally except for \'.
+func SplitArgs(line string) ([]string, error) {
+	var args []string
+	i := 0
+	for {
+		for i < len(line) && isSpace(line[i]) {
+			i++
+		}
+		if i == len(line) {
+			return args, nil
+		}
+
+		var arg strings.Builder
+		inDouble, inSingle := false, false
+		done := false
+		for !done {
+			if i == len(line) {
+				if inDouble || inSingle {
+					return nil, protocolError("unbalanced quotes in request")
+				}
+				break
+			}
+			c := line[i]
+			switch {
+			case inDouble:
+				if c == '\\' && i+3 < len(line) && line[i+1] == 'x' && isHex(line[i+2]) && isHex(line[i+3]) {
+					arg.WriteByte(unhex(line[i+2])<<4 | unhex(line[i+3]))
+					i += 3
+				} else if c == '\\' && i+1 < len(line) {
+					i++
+					switch line[i] {
+					case 'n':
+						arg.WriteByte('\n')
+					case 'r':
+						arg.WriteByte('\r')
+					case 't':
+						arg.WriteByte('\t')
+					case 'b':
+						arg.WriteByte('\b')
+					case 'a':
+						arg.WriteByte('\a')
+					default:
+						arg.WriteByte(line[i])
+					}
+				} else if c == '"' {
+					// A closing quote must be followed by a space or the end
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg.WriteByte(c)
+				}
+			case inSingle:
+				if c == '\\' && i+1 < len(line) && line[i+1] == '\'' {
+					arg.WriteByte('\'')
+					i++
+				} else if c == '\'' {
+					if i+1 < len(line) && !isSpace(line[i+1]) {
+						return nil, protocolError("unbalanced quotes in request")
+					}
+					done = true
+				} else {
+					arg.WriteByte(c)
+				}
+			default:
+				switch {
+				case isSpace(c):
+					done = true
+				case c == '"':
+					inDouble = true
+				case c == '\'':
+					inSingle = true
+				default:
+					arg.WriteByte(c)
+				}
+			}
+			i++
+		}
+		args = append(args, arg.String())
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r' || c == '\v' || c == '\f'
+}
+
+func isHex(c byte) bool {
+	return ('0' <= c && c <= '9') || ('a' <= c && c <= 'f') || ('A' <= c && c <= 'F')
+}
+
+func unhex(c byte) byte {
+	switch {
+	case '0' <= c && c <= '9':
+		return c - '0'
+	case 'a' <= c && c <= 'f':
+		return c - 'a' + 10
+	default:
+		return c - 'A' + 10
+	}
+}
+
+// readMultiBulk reads a command sent as an array of bulk strings.
+func (r *Reader) readMultiBulk() ([]string, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	n, err := parseLength(line[1:], maxArrayLength)
+	if err != nil {
+		return nil, protocolError("invalid multibulk length")
+	}
+	args := make([]string, 0, max(n, 0))
+	for i := 0; i < n; i++ {
+		line, err := r.readLine()
+		if err != nil {
+			return nil, err
+		}
+		if len(line) == 0 || Type(line[0]) != BulkString {
+			return nil, protocolError("expected '$', got '%s'", firstByte(line))
+		}
+		s, null, err := r.readBulk(line)
+		if err != nil {
+			return nil, err
+		}
+		if null {
+			return nil, protocolError("invalid bulk length")
+		}
+		args = append(args, s)
+	}
+	return args, nil
+}
+
+// ReadValue reads a single RESP2 or RESP3 value of any type. Clients use it
+// to decode replies. An attribute is not returned on its own: its pairs are
+// attached to the value that follows it.
+func (r *Reader) ReadValue() (Value, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return Value{}, err
+	}
+	if len(line) == 0 {
+		return Value{}, protocolError("empty line")
+	}
+	t := Type(line[0])
+	body := line[1:]
+	switch t {
+	case SimpleString, Error, BigNumber:
+		return Value{Type: t, Str: body}, nil
+	case Integer:
+		n, err := strconv.ParseInt(body, 10, 64)
+		if err != nil {
+			return Value{}, protocolError("invalid integer '%s'", body)
+		}
+		return Value{Type: t, Int: n}, nil
+	case BulkString, BlobError:
+		s, null, err := r.readBulk(line)
+		if err != nil {
+			return Value{}, err
+		}
+		return Value{Type: t, Str: s, Null: null}, nil
+	case VerbatimString:
+		s, null, err := r.readBulk(line)
+		if err != nil {
+			return Value{}, err
+		}
+		if null || len(s) < 4 || s[3] != ':' {
+			return Value{}, protocolError("invalid verbatim string")
+		}
+		return Value{Type: t, Format: s[:3], Str: s[4:]}, nil
+	case Null:
+		return Value{Type: t, Null: true}, nil
+	case Double:
+		f, err := strconv.ParseFloat(body, 64)
+		if err != nil {
+			return Value{}, protocolError("invalid double '%s'", body)
+		}
+		return Value{Type: t, Double: f}, nil
+	case Boolean:
+		if body != "t" && body != "f" {
+			return Value{}, protocolError("invalid boolean '%s'", body)
+		}
+		return Value{Type: t, Bool: body == "t"}, nil
+	case Array, Set, Push, Map, Attribute:
+		n, err := parseLength(body, maxArrayLength)
+		if err != nil {
+			return Value{}, protocolError("invalid aggregate length")
+		}
+		if n < 0 {
+			if t != Array {
+				return Value{}, protocolError("invalid aggregate length")
+			}
+			return Value{Type: t, Null: true}, nil
+		}
+		if t == Map || t == Attribute {
+			n *= 2
+		}
+		elems := make([]Value, n)
+		for i := range elems {
+			if elems[i], err = r.ReadValue(); err != nil {
+				return Value{}, err
+			}
+		}
+		if t == Attribute {
+			v, err := r.ReadValue()
+			if err != nil {
+				return Value{}, err
+			}
+			v.Attrs = elems
+			return v, nil
+		}
+		return Value{Type: t, Array: elems}, nil
+	default:
+		return Value{}, protocolError("unknown type '%s'", firstByte(line))
+	}
+}
+
+// readBulk reads the payload announced by a "$<len>" style header line.
+func (r *Reader) readBulk(header string) (string, bool, error) {
+	n, err := parseLength(header[1:], maxBulkLength)
+	if err != nil {
+		return "", false, protocolError("invalid bulk length")
+	}
+	if n < 0 {
+		return "", true, nil
+	}
+	buf := make([]byte, n+2)
+	if _, err := io.ReadFull(r.rd, buf); err != nil {
+		return "", false, err
+	}
+	if buf[n] != '\r' || buf[n+1] != '\n' {
+		return "", false, protocolError("bulk string not terminated by CRLF")
+	}
+	return string(buf[:n]), false, nil
+}
+
+// readLine reads up to the next '\n' and strips the line terminator. A bare
+// '\n' is accepted so inline commands typed in a terminal work.
+func (r *Reader) readLine() (string, error) {
+	var line []byte
+	for {
+		chunk, err := r.rd.ReadSlice('\n')
+		line = append(line, chunk...)
+		if len(line) > maxInlineSize {
+			return "", protocolError("too big inline request")
+		}
+		if err == nil {
+			break
+		}
+		if err != bufio.ErrBufferFull {
+			if err == io.EOF && len(line) > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return "", err
+		}
+	}
+	line = line[:len(line)-1]
+	if len(line) > 0 && line[len(line)-1] == '\r' {
+		line = line[:len(line)-1]
+	}
+	return string(line), nil
+}
+
+// parseLength parses an array or bulk length; -1 means null.
+func parseLength(s string, limit int) (int, error) {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		return 0, err
+	}
+	if n < -1 || n > limit {
+		return 0, fmt.Errorf("length %d out of range", n)
+	}
+	return n, nil
+}
+
+func firstByte(s string) string {
+	if s == "" {
+		return ""
+	}
+	return s[:1]
+}
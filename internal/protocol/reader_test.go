@@ -0,0 +1,239 @@
+package protocol
+
+import (
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestReadCommand(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []string
+	}{
+		{"multibulk", "*2\r\n$3\r\nGET\r\n$3\r\nkey\r\n", []string{"GET", "key"}},
+		{"empty bulk", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$0\r\n\r\n", []string{"SET", "k", ""}},
+		{"bulk with CRLF inside", "*2\r\n$4\r\nECHO\r\n$4\r\na\r\nb\r\n", []string{"ECHO", "a\r\nb"}},
+		{"inline", "SET key value\r\n", []string{"SET", "key", "value"}},
+		{"inline with bare LF", "PING\n", []string{"PING"}},
+		{"inline collapses whitespace", "  GET   key  \r\n", []string{"GET", "key"}},
+		{"inline quoted", "SET k \"a  b\"\r\n", []string{"SET", "k", "a  b"}},
+		{"skips empty lines", "\r\n\nPING\r\n", []string{"PING"}},
+		{"skips empty multibulks", "*0\r\n*-1\r\nPING\r\n", []string{"PING"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := NewReader(strings.NewReader(tt.input))
+			got, err := r.ReadCommand()
+			if err != nil {
+				t.Fatalf("ReadCommand failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadCommandPipelined(t *testing.T) {
+	r := NewReader(strings.NewReader("*1\r\n$4\r\nPING\r\nGET k\r\n*1\r\n$4\r\nSIZE\r\n"))
+	want := [][]string{{"PING"}, {"GET", "k"}, {"SIZE"}}
+	for i, expected := range want {
+		got, err := r.ReadCommand()
+		if err != nil {
+			t.Fatalf("command %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, expected) {
+			t.Errorf("command %d: got %q, want %q", i, got, expected)
+		}
+	}
+	if _, err := r.ReadCommand(); err != io.EOF {
+		t.Errorf("expected io.EOF at end of stream, got %v", err)
+	}
+}
+
+func TestReadCommandErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		input    string
+		protoErr bool
+	}{
+		{"bad array length", "*x\r\n", true},
+		{"negative bulk in command", "*1\r\n$-1\r\n", true},
+		{"not a bulk string", "*1\r\n+PING\r\n", true},
+		{"bulk missing CRLF", "*1\r\n$4\r\nPINGxx", true},
+		{"bulk too long", "*1\r\n$999999999999\r\n", true},
+		{"truncated bulk", "*1\r\n$4\r\nPI", false},
+		{"truncated line", "*1\r\n$4", false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewReader(strings.NewReader(tt.input)).ReadCommand()
+			if err == nil {
+				t.Fatalf("expected error for %q", tt.input)
+			}
+			var protoErr *ProtocolError
+			if errors.As(err, &protoErr) != tt.protoErr {
+				t.Errorf("protocol error = %v, got %v", tt.protoErr, err)
+			}
+		})
+	}
+}
+
+func TestReadCommandInlineTooBig(t *testing.T) {
+	input := strings.Repeat("a", maxInlineSize+10) + "\r\n"
+	_, err := NewReader(strings.NewReader(input)).ReadCommand()
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Errorf("expected protocol error, got %v", err)
+	}
+}
+
+func TestReadValue(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Value
+	}{
+		{"simple string", "+OK\r\n", Value{Type: SimpleString, Str: "OK"}},
+		{"error", "-ERR boom\r\n", Value{Type: Error, Str: "ERR boom"}},
+		{"integer", ":-42\r\n", Value{Type: Integer, Int: -42}},
+		{"bulk", "$5\r\nhello\r\n", Value{Type: BulkString, Str: "hello"}},
+		{"null bulk", "$-1\r\n", Value{Type: BulkString, Null: true}},
+		{"null array", "*-1\r\n", Value{Type: Array, Null: true}},
+		{"empty array", "*0\r\n", Value{Type: Array, Array: []Value{}}},
+		{
+			"nested array",
+			"*2\r\n:1\r\n*1\r\n$1\r\nx\r\n",
+			Value{Type: Array, Array: []Value{
+				{Type: Integer, Int: 1},
+				{Type: Array, Array: []Value{{Type: BulkString, Str: "x"}}},
+			}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewReader(strings.NewReader(tt.input)).ReadValue()
+			if err != nil {
+				t.Fatalf("ReadValue failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadValueUnknownType(t *testing.T) {
+	_, err := NewReader(strings.NewReader("?what\r\n")).ReadValue()
+	var protoErr *ProtocolError
+	if !errors.As(err, &protoErr) {
+		t.Errorf("expected protocol error, got %v", err)
+	}
+}
+
+func TestReadValueRESP3(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  Value
+	}{
+		{"null", "_\r\n", Value{Type: Null, Null: true}},
+		{"double", ",3.25\r\n", Value{Type: Double, Double: 3.25}},
+		{"true", "#t\r\n", Value{Type: Boolean, Bool: true}},
+		{"false", "#f\r\n", Value{Type: Boolean, Bool: false}},
+		{"big number", "(12345678901234567890\r\n", Value{Type: BigNumber, Str: "12345678901234567890"}},
+		{"blob error", "!8\r\nERR a\r\nb\r\n", Value{Type: BlobError, Str: "ERR a\r\nb"}},
+		{"verbatim", "=9\r\ntxt:hello\r\n", Value{Type: VerbatimString, Format: "txt", Str: "hello"}},
+		{
+			"map",
+			"%1\r\n+key\r\n:1\r\n",
+			Value{Type: Map, Array: []Value{{Type: SimpleString, Str: "key"}, {Type: Integer, Int: 1}}},
+		},
+		{"set", "~1\r\n+a\r\n", Value{Type: Set, Array: []Value{{Type: SimpleString, Str: "a"}}}},
+		{"push", ">1\r\n+msg\r\n", Value{Type: Push, Array: []Value{{Type: SimpleString, Str: "msg"}}}},
+		{
+			"attribute attaches to next value",
+			"|1\r\n+ttl\r\n:10\r\n$1\r\nv\r\n",
+			Value{Type: BulkString, Str: "v", Attrs: []Value{{Type: SimpleString, Str: "ttl"}, {Type: Integer, Int: 10}}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := NewReader(strings.NewReader(tt.input)).ReadValue()
+			if err != nil {
+				t.Fatalf("ReadValue failed: %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestReadValueRESP3Errors(t *testing.T) {
+	inputs := []string{
+		",abc\r\n",      // bad double
+		"#x\r\n",        // bad boolean
+		"=3\r\ntxt\r\n", // verbatim without format separator
+		"%-1\r\n",       // only arrays may be null
+	}
+	for _, input := range inputs {
+		_, err := NewReader(strings.NewReader(input)).ReadValue()
+		var protoErr *ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("%q: expected protocol error, got %v", input, err)
+		}
+	}
+}
+
+func TestSplitArgs(t *testing.T) {
+	tests := []struct {
+		line string
+		want []string
+	}{
+		{"", nil},
+		{"   ", nil},
+		{"GET key", []string{"GET", "key"}},
+		{`SET k "hello world"`, []string{"SET", "k", "hello world"}},
+		{`SET k ""`, []string{"SET", "k", ""}},
+		{`SET k "a\nb\r\t\"q\"\\"`, []string{"SET", "k", "a\nb\r\t\"q\"\\"}},
+		{`SET k "\x00\xff\x4A"`, []string{"SET", "k", "\x00\xffJ"}},
+		{`SET k 'it\'s "raw" \n'`, []string{"SET", "k", `it's "raw" \n`}},
+		{`SET  k	v`, []string{"SET", "k", "v"}},
+	}
+
+	for _, tt := range tests {
+		got, err := SplitArgs(tt.line)
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", tt.line, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.line, got, tt.want)
+		}
+	}
+}
+
+func TestSplitArgsUnbalancedQuotes(t *testing.T) {
+	lines := []string{
+		`SET k "open`,
+		`SET k 'open`,
+		`SET k "closed"trailing`,
+		`SET k 'closed'trailing`,
+	}
+	for _, line := range lines {
+		_, err := SplitArgs(line)
+		var protoErr *ProtocolError
+		if !errors.As(err, &protoErr) {
+			t.Errorf("%q: expected protocol error, got %v", line, err)
+		}
+	}
+}
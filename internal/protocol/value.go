@@ -0,0 +1,51 @@
+package protocol
+
+// Type is the RESP type byte that prefixes every value on the wire.
+type Type byte
+
+const (
+	SimpleString Type = '+'
+	Error        Type = '-'
+	Integer      Type = ':'
+	BulkString   Type = '$'
+	Array        Type = '*'
+
+	// RESP3 types, only sent to connections that negotiated them with HELLO 3
+	Null           Type = '_'
+	Double         Type = ','
+	Boolean        Type = '#'
+	BlobError      Type = '!'
+	VerbatimString Type = '='
+	BigNumber      Type = '('
+	Map            Type = '%'
+	Set            Type = '~'
+	Attribute      Type = '|'
+	Push           Type = '>'
+)
+
+// Protocol versions that can be negotiated with HELLO
+const (
+	RESP2 = 2
+	RESP3 = 3
+)
+
+// Value is a decoded RESP value. Only the fields relevant to Type are set.
+type Value struct {
+	Type   Type
+	Str    string  // SimpleString, Error, BulkString, BlobError, VerbatimString, BigNumber
+	Int    int64   // Integer
+	Double float64 // Double
+	Bool   bool    // Boolean
+	Format string  // VerbatimString format, e.g. "txt"
+	// Array, Set and Push hold their elements here; Map holds alternating
+	// keys and values so the server's ordering is preserved.
+	Array []Value
+	Null  bool // null bulk string, null array or RESP3 null
+	// Attrs holds the key/value pairs of an attribute that preceded the value.
+	Attrs []Value
+}
+
+// IsError reports whether the value is an error reply.
+func (v Value) IsError() bool {
+	return v.Type == Error || v.Type == BlobError
+}
@@ -0,0 +1,263 @@
+package protocol
+
+import (
+	"bufio"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Writer encodes RESP values onto a buffered stream. Nothing reaches the
+// underlying writer until Flush is called.
+//
+// The writer starts in RESP2. After SetProtocol(RESP3) the RESP3-only types
+// are sent natively; in RESP2 each of them is downgraded to the closest RESP2
+// type, so command handlers can always write the richest type available.
+type Writer struct {
+	wr    *bufio.Writer
+	proto int
+}
+
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{wr: bufio.NewWriter(w), proto: RESP2}
+}
+
+// SetProtocol switches the encoding used for RESP3-only types.
+func (w *Writer) SetProtocol(version int) {
+	w.proto = version
+}
+
+// Protocol returns the protocol version currently in use.
+func (w *Writer) Protocol() int {
+	return w.proto
+}
+
+// WriteSimpleString writes a status reply such as +OK. CR and LF are not
+// allowed in simple strings and are replaced with spaces.
+func (w *Writer) WriteSimpleString(s string) error {
+	return w.writeLine(SimpleString, sanitize(s))
+}
+
+// WriteError writes an error reply. By convention msg starts with an upper
+// case error code, e.g. "ERR unknown command".
+func (w *Writer) WriteError(msg string) error {
+	return w.writeLine(Error, sanitize(msg))
+}
+
+func (w *Writer) WriteInteger(n int64) error {
+	return w.writeLine(Integer, strconv.FormatInt(n, 10))
+}
+
+func (w *Writer) WriteBulkString(s string) error {
+	w.writeLine(BulkString, strconv.Itoa(len(s)))
+	w.wr.WriteString(s)
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// WriteNull writes the "key does not exist" reply: a null bulk string in
+// RESP2 and the null type in RESP3.
+func (w *Writer) WriteNull() error {
+	if w.proto >= RESP3 {
+		return w.writeLine(Null, "")
+	}
+	return w.writeLine(BulkString, "-1")
+}
+
+// WriteArrayHeader starts an array of n elements; the caller writes the
+// elements next.
+func (w *Writer) WriteArrayHeader(n int) error {
+	return w.writeLine(Array, strconv.Itoa(n))
+}
+
+// WriteMapHeader starts a map of n key/value pairs; the caller writes 2*n
+// elements next. RESP2 receives a flat array of keys and values.
+func (w *Writer) WriteMapHeader(n int) error {
+	if w.proto >= RESP3 {
+		return w.writeLine(Map, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(2 * n)
+}
+
+// WriteSetHeader starts a set of n elements. RESP2 receives an array.
+func (w *Writer) WriteSetHeader(n int) error {
+	if w.proto >= RESP3 {
+		return w.writeLine(Set, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(n)
+}
+
+// WritePushHeader starts an out-of-band push message of n elements. RESP2
+// receives an array.
+func (w *Writer) WritePushHeader(n int) error {
+	if w.proto >= RESP3 {
+		return w.writeLine(Push, strconv.Itoa(n))
+	}
+	return w.WriteArrayHeader(n)
+}
+
+// WriteDouble writes a floating point number. RESP2 receives it as a bulk
+// string.
+func (w *Writer) WriteDouble(f float64) error {
+	var s string
+	switch {
+	case math.IsInf(f, 1):
+		s = "inf"
+	case math.IsInf(f, -1):
+		s = "-inf"
+	case math.IsNaN(f):
+		s = "nan"
+	default:
+		s = strconv.FormatFloat(f, 'g', -1, 64)
+	}
+	if w.proto >= RESP3 {
+		return w.writeLine(Double, s)
+	}
+	return w.WriteBulkString(s)
+}
+
+// WriteBoolean writes a boolean. RESP2 receives the integers 1 and 0.
+func (w *Writer) WriteBoolean(b bool) error {
+	if w.proto >= RESP3 {
+		if b {
+			return w.writeLine(Boolean, "t")
+		}
+		return w.writeLine(Boolean, "f")
+	}
+	if b {
+		return w.WriteInteger(1)
+	}
+	return w.WriteInteger(0)
+}
+
+// WriteVerbatimString writes text tagged with a three letter format such as
+// "txt" or "mkd". RESP2 receives a plain bulk string.
+func (w *Writer) WriteVerbatimString(format, s string) error {
+	if w.proto >= RESP3 {
+		w.writeLine(VerbatimString, strconv.Itoa(len(s)+4))
+		w.wr.WriteString(format)
+		w.wr.WriteByte(':')
+		w.wr.WriteString(s)
+		_, err := w.wr.WriteString("\r\n")
+		return err
+	}
+	return w.WriteBulkString(s)
+}
+
+// WriteAttribute writes auxiliary key/value pairs that describe the reply
+// written right after it. RESP2 has no equivalent, so nothing is written.
+func (w *Writer) WriteAttribute(pairs []Value) error {
+	if w.proto < RESP3 {
+		return nil
+	}
+	w.writeLine(Attribute, strconv.Itoa(len(pairs)/2))
+	for _, v := range pairs {
+		w.WriteValue(v)
+	}
+	return w.err()
+}
+
+// WriteBulkStrings writes an array of bulk strings.
+func (w *Writer) WriteBulkStrings(items []string) error {
+	w.WriteArrayHeader(len(items))
+	for _, s := range items {
+		w.WriteBulkString(s)
+	}
+	return w.err()
+}
+
+// WriteCommand writes a command the way clients send it: an array of bulk
+// strings.
+func (w *Writer) WriteCommand(args ...string) error {
+	return w.WriteBulkStrings(args)
+}
+
+// WriteValue writes a decoded value back out, e.g. when proxying replies.
+func (w *Writer) WriteValue(v Value) error {
+	if len(v.Attrs) > 0 {
+		w.WriteAttribute(v.Attrs)
+	}
+	switch v.Type {
+	case SimpleString:
+		return w.WriteSimpleString(v.Str)
+	case Error:
+		return w.WriteError(v.Str)
+	case Integer:
+		return w.WriteInteger(v.Int)
+	case BulkString:
+		if v.Null {
+			return w.WriteNull()
+		}
+		return w.WriteBulkString(v.Str)
+	case Array, Set, Push, Map:
+		if v.Null {
+			if w.proto >= RESP3 {
+				return w.writeLine(Null, "")
+			}
+			return w.writeLine(Array, "-1")
+		}
+		switch v.Type {
+		case Set:
+			w.WriteSetHeader(len(v.Array))
+		case Push:
+			w.WritePushHeader(len(v.Array))
+		case Map:
+			w.WriteMapHeader(len(v.Array) / 2)
+		default:
+			w.WriteArrayHeader(len(v.Array))
+		}
+		for _, elem := range v.Array {
+			w.WriteValue(elem)
+		}
+		return w.err()
+	case Null:
+		return w.WriteNull()
+	case Double:
+		return w.WriteDouble(v.Double)
+	case Boolean:
+		return w.WriteBoolean(v.Bool)
+	case VerbatimString:
+		return w.WriteVerbatimString(v.Format, v.Str)
+	case BigNumber:
+		if w.proto >= RESP3 {
+			return w.writeLine(BigNumber, v.Str)
+		}
+		return w.WriteBulkString(v.Str)
+	case BlobError:
+		if w.proto >= RESP3 {
+			w.writeLine(BlobError, strconv.Itoa(len(v.Str)))
+			w.wr.WriteString(v.Str)
+			_, err := w.wr.WriteString("\r\n")
+			return err
+		}
+		return w.WriteError(v.Str)
+	default:
+		return w.WriteError("ERR unsupported reply type")
+	}
+}
+
+// Flush writes any buffered data to the underlying writer.
+func (w *Writer) Flush() error {
+	return w.wr.Flush()
+}
+
+func (w *Writer) writeLine(t Type, s string) error {
+	w.wr.WriteByte(byte(t))
+	w.wr.WriteString(s)
+	_, err := w.wr.WriteString("\r\n")
+	return err
+}
+
+// err returns the sticky error of the underlying bufio.Writer, if any.
+func (w *Writer) err() error {
+	_, err := w.wr.Write(nil)
+	return err
+}
+
+func sanitize(s string) string {
+	if strings.ContainsAny(s, "\r\n") {
+		return strings.NewReplacer("\r", " ", "\n", " ").Replace(s)
+	}
+	return s
+}
@@ -0,0 +1,187 @@
+package protocol
+
+import (
+	"bytes"
+	"math"
+	"reflect"
+	"testing"
+)
+
+func TestWriterEncoding(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		want  string
+	}{
+		{"simple string", func(w *Writer) { w.WriteSimpleString("OK") }, "+OK\r\n"},
+		{"simple string strips CRLF", func(w *Writer) { w.WriteSimpleString("a\r\nb") }, "+a  b\r\n"},
+		{"error", func(w *Writer) { w.WriteError("ERR bad") }, "-ERR bad\r\n"},
+		{"integer", func(w *Writer) { w.WriteInteger(-7) }, ":-7\r\n"},
+		{"bulk", func(w *Writer) { w.WriteBulkString("a\r\nb") }, "$4\r\na\r\nb\r\n"},
+		{"empty bulk", func(w *Writer) { w.WriteBulkString("") }, "$0\r\n\r\n"},
+		{"null", func(w *Writer) { w.WriteNull() }, "$-1\r\n"},
+		{"bulk array", func(w *Writer) { w.WriteBulkStrings([]string{"a", "bc"}) }, "*2\r\n$1\r\na\r\n$2\r\nbc\r\n"},
+		{"empty array", func(w *Writer) { w.WriteBulkStrings(nil) }, "*0\r\n"},
+		{"command", func(w *Writer) { w.WriteCommand("GET", "k") }, "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			tt.write(w)
+			if err := w.Flush(); err != nil {
+				t.Fatalf("Flush failed: %v", err)
+			}
+			if buf.String() != tt.want {
+				t.Errorf("got %q, want %q", buf.String(), tt.want)
+			}
+		})
+	}
+}
+
+func TestWriterNothingBeforeFlush(t *testing.T) {
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.WriteSimpleString("OK")
+	if buf.Len() != 0 {
+		t.Errorf("expected no output before Flush, got %q", buf.String())
+	}
+}
+
+func TestWriteValueRoundTrip(t *testing.T) {
+	values := []Value{
+		{Type: SimpleString, Str: "PONG"},
+		{Type: Error, Str: "ERR nope"},
+		{Type: Integer, Int: 12345},
+		{Type: BulkString, Str: "binary\x00data"},
+		{Type: BulkString, Null: true},
+		{Type: Array, Null: true},
+		{Type: Array, Array: []Value{
+			{Type: BulkString, Str: "x"},
+			{Type: Array, Array: []Value{{Type: Integer, Int: 1}}},
+		}},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	for _, v := range values {
+		w.WriteValue(v)
+	}
+	w.Flush()
+
+	r := NewReader(&buf)
+	for i, want := range values {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("value %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
+
+func TestWriterRESP3Types(t *testing.T) {
+	tests := []struct {
+		name  string
+		write func(w *Writer)
+		resp2 string
+		resp3 string
+	}{
+		{"null", func(w *Writer) { w.WriteNull() }, "$-1\r\n", "_\r\n"},
+		{
+			"map",
+			func(w *Writer) {
+				w.WriteMapHeader(1)
+				w.WriteBulkString("k")
+				w.WriteInteger(1)
+			},
+			"*2\r\n$1\r\nk\r\n:1\r\n",
+			"%1\r\n$1\r\nk\r\n:1\r\n",
+		},
+		{
+			"set",
+			func(w *Writer) {
+				w.WriteSetHeader(1)
+				w.WriteBulkString("a")
+			},
+			"*1\r\n$1\r\na\r\n",
+			"~1\r\n$1\r\na\r\n",
+		},
+		{
+			"push",
+			func(w *Writer) {
+				w.WritePushHeader(1)
+				w.WriteBulkString("a")
+			},
+			"*1\r\n$1\r\na\r\n",
+			">1\r\n$1\r\na\r\n",
+		},
+		{"double", func(w *Writer) { w.WriteDouble(1.5) }, "$3\r\n1.5\r\n", ",1.5\r\n"},
+		{"infinity", func(w *Writer) { w.WriteDouble(math.Inf(-1)) }, "$4\r\n-inf\r\n", ",-inf\r\n"},
+		{"boolean", func(w *Writer) { w.WriteBoolean(true) }, ":1\r\n", "#t\r\n"},
+		{"verbatim", func(w *Writer) { w.WriteVerbatimString("txt", "hi") }, "$2\r\nhi\r\n", "=6\r\ntxt:hi\r\n"},
+		{
+			"attribute",
+			func(w *Writer) {
+				w.WriteAttribute([]Value{{Type: SimpleString, Str: "a"}, {Type: Integer, Int: 1}})
+				w.WriteInteger(2)
+			},
+			":2\r\n",
+			"|1\r\n+a\r\n:1\r\n:2\r\n",
+		},
+	}
+
+	for _, tt := range tests {
+		for _, proto := range []int{RESP2, RESP3} {
+			var buf bytes.Buffer
+			w := NewWriter(&buf)
+			w.SetProtocol(proto)
+			tt.write(w)
+			w.Flush()
+
+			want := tt.resp2
+			if proto == RESP3 {
+				want = tt.resp3
+			}
+			if buf.String() != want {
+				t.Errorf("%s (RESP%d): got %q, want %q", tt.name, proto, buf.String(), want)
+			}
+		}
+	}
+}
+
+func TestWriteValueRoundTripRESP3(t *testing.T) {
+	values := []Value{
+		{Type: Null, Null: true},
+		{Type: Double, Double: -2.5},
+		{Type: Boolean, Bool: true},
+		{Type: VerbatimString, Format: "txt", Str: "info"},
+		{Type: BigNumber, Str: "99999999999999999999"},
+		{Type: BlobError, Str: "ERR blob"},
+		{Type: Map, Array: []Value{{Type: BulkString, Str: "k"}, {Type: Integer, Int: 1}}},
+		{Type: Set, Array: []Value{{Type: BulkString, Str: "m"}}},
+		{Type: Push, Array: []Value{{Type: BulkString, Str: "p"}}},
+		{Type: Integer, Int: 5, Attrs: []Value{{Type: BulkString, Str: "a"}, {Type: Boolean, Bool: false}}},
+	}
+
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	w.SetProtocol(RESP3)
+	for _, v := range values {
+		w.WriteValue(v)
+	}
+	w.Flush()
+
+	r := NewReader(&buf)
+	for i, want := range values {
+		got, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("value %d: %v", i, err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("value %d: got %+v, want %+v", i, got, want)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync/atomic"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+)
+
+// nextClientID numbers client connections, as reported by HELLO
+var nextClientID atomic.Int64
+
+// client is a connection from a client to the proxy
+type client struct {
+	id     int64
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer
+}
+
+func (p *Proxy) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	c := &client{
+		id:     nextClientID.Add(1),
+		conn:   conn,
+		reader: protocol.NewReader(conn),
+		writer: protocol.NewWriter(conn),
+	}
+	for {
+		args, err := c.reader.ReadCommand()
+		if err != nil {
+			var protoErr *protocol.ProtocolError
+			if errors.As(err, &protoErr) {
+				// The stream can't be resynchronised, so reply and hang up
+				c.writer.WriteError("ERR " + protoErr.Error())
+				c.writer.Flush()
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] Read error: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		p.execute(c, args)
+		// Only flush once every pipelined command has been answered
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs one client command and writes its reply
+func (p *Proxy) execute(c *client, args []string) {
+	switch command := strings.ToUpper(args[0]); command {
+	case "PING":
+		switch len(args) {
+		case 1:
+			c.writer.WriteSimpleString("PONG")
+		case 2:
+			c.writer.WriteBulkString(args[1])
+		default:
+			wrongArgs(c, "ping")
+		}
+	case "HELLO":
+		helloCommand(c, args)
+	case "SET", "GET":
+		if len(args) < 2 {
+			wrongArgs(c, strings.ToLower(command))
+			return
+		}
+		p.forward(c, args)
+	case "DEL":
+		p.delCommand(c, args)
+	case "MGET":
+		p.mgetCommand(c, args)
+	case "KEYS":
+		p.keysCommand(c)
+	case "SIZE":
+		p.sizeCommand(c)
+	case "FLUSH":
+		p.flushCommand(c)
+	default:
+		c.writer.WriteError("ERR unknown command '" + args[0] + "'")
+	}
+}
+
+func wrongArgs(c *client, command string) {
+	c.writer.WriteError("ERR wrong number of arguments for '" + command + "' command")
+}
+
+// writeBackendError replies with a failure to reach a backend, which is
+// not the backend's own error reply
+func writeBackendError(c *client, err error) {
+	c.writer.WriteError("ERR " + err.Error())
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// negotiates the protocol with the proxy itself. Backends are always spoken
+// to with RESP2, and their replies converted.
+func helloCommand(c *client, args []string) {
+	hello, err := protocol.ParseHello(args)
+	if err != nil {
+		c.writer.WriteError(err.Error())
+		return
+	}
+	c.writer.WriteHello(hello.Protocol, c.id, "proxy", "master")
+}
+
+// forward sends a command on one key, its first argument, to the key's
+// backend and relays the reply
+func (p *Proxy) forward(c *client, args []string) {
+	groups, err := p.route(args[1:2])
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	for b := range groups {
+		replies, err := p.call(b, args)
+		if err != nil {
+			writeBackendError(c, err)
+			return
+		}
+		c.writer.WriteValue(replies[0])
+	}
+}
+
+// DEL key [key ...]
+// deletes each backend's keys there and replies with the total deleted
+func (p *Proxy) delCommand(c *client, args []string) {
+	if len(args) < 2 {
+		wrongArgs(c, "del")
+		return
+	}
+	keys := args[1:]
+	groups, err := p.route(keys)
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	commands := make(map[*backend][][]string, len(groups))
+	for b, indexes := range groups {
+		del := []string{"DEL"}
+		for _, i := range indexes {
+			del = append(del, keys[i])
+		}
+		commands[b] = [][]string{del}
+	}
+	replies, err := p.fanOut(commands)
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	var deleted int64
+	for _, r := range replies {
+		if r[0].IsError() {
+			c.writer.WriteValue(r[0])
+			return
+		}
+		deleted += r[0].Int
+	}
+	c.writer.WriteInteger(deleted)
+}
+
+// MGET key [key ...]
+// gets each key from its backend, which has no MGET of its own, and
+// replies with the values in order, null for missing keys. A backend's
+// error reply is passed on, rather than the key looking missing.
+func (p *Proxy) mgetCommand(c *client, args []string) {
+	if len(args) < 2 {
+		wrongArgs(c, "mget")
+		return
+	}
+	keys := args[1:]
+	groups, err := p.route(keys)
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	commands := make(map[*backend][][]string, len(groups))
+	for b, indexes := range groups {
+		for _, i := range indexes {
+			commands[b] = append(commands[b], []string{"GET", keys[i]})
+		}
+	}
+	replies, err := p.fanOut(commands)
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	values := make([]protocol.Value, len(keys))
+	for b, indexes := range groups {
+		for j, i := range indexes {
+			if replies[b][j].IsError() {
+				c.writer.WriteValue(replies[b][j])
+				return
+			}
+			values[i] = replies[b][j]
+		}
+	}
+	c.writer.WriteArrayHeader(len(values))
+	for _, v := range values {
+		c.writer.WriteValue(v)
+	}
+}
+
+// KEYS replies with the keys of every backend
+func (p *Proxy) keysCommand(c *client) {
+	replies, err := p.everyBackend("KEYS")
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	var keys []protocol.Value
+	for _, r := range replies {
+		if r.IsError() {
+			c.writer.WriteValue(r)
+			return
+		}
+		keys = append(keys, r.Array...)
+	}
+	c.writer.WriteSetHeader(len(keys))
+	for _, key := range keys {
+		c.writer.WriteValue(key)
+	}
+}
+
+// SIZE replies with the number of keys of every backend together
+func (p *Proxy) sizeCommand(c *client) {
+	replies, err := p.everyBackend("SIZE")
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	var size int64
+	for _, r := range replies {
+		if r.IsError() {
+			c.writer.WriteValue(r)
+			return
+		}
+		size += r.Int
+	}
+	c.writer.WriteInteger(size)
+}
+
+// FLUSH empties every backend
+func (p *Proxy) flushCommand(c *client) {
+	replies, err := p.everyBackend("FLUSH")
+	if err != nil {
+		writeBackendError(c, err)
+		return
+	}
+	for _, r := range replies {
+		if r.IsError() {
+			c.writer.WriteValue(r)
+			return
+		}
+	}
+	c.writer.WriteSimpleString("OK")
+}
+
+// everyBackend sends a command to every backend and returns their replies
+// in backend address order
+func (p *Proxy) everyBackend(args ...string) ([]protocol.Value, error) {
+	backends := p.all()
+	if len(backends) == 0 {
+		return nil, errors.New("no backends to route to")
+	}
+	commands := make(map[*backend][][]string, len(backends))
+	for _, b := range backends {
+		commands[b] = [][]string{args}
+	}
+	replies, err := p.fanOut(commands)
+	if err != nil {
+		return nil, err
+	}
+	values := make([]protocol.Value, len(backends))
+	for i, b := range backends {
+		values[i] = replies[b][0]
+	}
+	return values, nil
+}
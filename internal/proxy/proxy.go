@@ -0,0 +1,283 @@
+// Package proxy lets clients that know nothing about sharding use a set of
+// standalone servers as one. It speaks the servers' client protocol, sends
+// each key's commands to the server the consistent-hash ring gives the key
+// to, and answers commands spanning several keys, or all of them, by
+// sending each server its part and merging the replies.
+//
+// The set of servers can be changed while clients are connected. Keys are
+// not moved when it is: a key whose server changes is lost to clients until
+// it is written again, as with other sharding proxies.
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/sharding"
+)
+
+const (
+	// DefaultTimeout bounds a round trip to a backend, dial included
+	DefaultTimeout = time.Second
+	// maxIdleConns is how many unused connections are kept per backend
+	maxIdleConns = 16
+)
+
+// Config describes the servers a proxy routes to
+type Config struct {
+	Backends     []string // client addresses of the servers
+	VirtualNodes int      // points per server on the ring, sharding.DefaultVirtualNodes if 0
+	Timeout      time.Duration
+}
+
+type Proxy struct {
+	vnodes  int
+	timeout time.Duration
+
+	// The ring and the backends on it are swapped together by SetBackends
+	mu       sync.RWMutex
+	ring     *sharding.Ring
+	backends map[string]*backend // by address
+
+	listener net.Listener
+	closed   bool
+}
+
+// backend is a server the proxy routes to, with the connections it keeps
+// open to it
+type backend struct {
+	addr string
+
+	mu     sync.Mutex
+	idle   []*backendConn
+	closed bool // no longer on the ring, so connections aren't kept
+}
+
+type backendConn struct {
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer
+}
+
+// New creates a proxy for the servers in cfg. Zero fields take the defaults.
+func New(cfg Config) (*Proxy, error) {
+	if cfg.Timeout <= 0 {
+		cfg.Timeout = DefaultTimeout
+	}
+	p := &Proxy{vnodes: cfg.VirtualNodes, timeout: cfg.Timeout}
+	if err := p.SetBackends(cfg.Backends); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// SetBackends replaces the servers the proxy routes to. Commands already
+// sent to a server finish there, and clients stay connected.
+func (p *Proxy) SetBackends(addrs []string) error {
+	ring := sharding.NewRing(p.vnodes, nil)
+	for _, addr := range addrs {
+		if _, err := ring.Add(addr); err != nil {
+			return fmt.Errorf("proxy: backend %q: %w", addr, err)
+		}
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	backends := make(map[string]*backend, len(addrs))
+	for _, addr := range addrs {
+		if b, ok := p.backends[addr]; ok {
+			backends[addr] = b
+		} else {
+			backends[addr] = &backend{addr: addr}
+		}
+	}
+	for addr, b := range p.backends {
+		if _, ok := backends[addr]; !ok {
+			b.close()
+		}
+	}
+	p.ring, p.backends = ring, backends
+	log.Printf("Proxying to %d backends: %v", len(addrs), ring.Nodes())
+	return nil
+}
+
+// Backends returns the addresses of the servers the proxy routes to, sorted
+func (p *Proxy) Backends() []string {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	return p.ring.Nodes()
+}
+
+// Start serves clients on addr until Close is called
+func (p *Proxy) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return net.ErrClosed
+	}
+	p.listener = listener
+	p.mu.Unlock()
+	log.Printf("Proxy listening on %s", addr)
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		go p.handleConnection(conn)
+	}
+}
+
+// Close stops accepting clients and closes idle backend connections.
+// Connected clients are not disconnected.
+func (p *Proxy) Close() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for _, b := range p.backends {
+		b.close()
+	}
+	if p.listener != nil {
+		return p.listener.Close()
+	}
+	return nil
+}
+
+// route groups the indexes of keys by the backend each key belongs to
+func (p *Proxy) route(keys []string) (map[*backend][]int, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	groups := make(map[*backend][]int)
+	for i, key := range keys {
+		addr, ok := p.ring.Get(key)
+		if !ok {
+			return nil, errors.New("no backends to route to")
+		}
+		b := p.backends[addr]
+		groups[b] = append(groups[b], i)
+	}
+	return groups, nil
+}
+
+// all returns every backend, in address order
+func (p *Proxy) all() []*backend {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	backends := make([]*backend, 0, len(p.backends))
+	for _, b := range p.backends {
+		backends = append(backends, b)
+	}
+	slices.SortFunc(backends, func(a, b *backend) int { return strings.Compare(a.addr, b.addr) })
+	return backends
+}
+
+// call sends commands to b, pipelined, and returns their replies in order
+func (p *Proxy) call(b *backend, commands ...[]string) ([]protocol.Value, error) {
+	c, err := b.get(p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.conn.SetDeadline(time.Now().Add(p.timeout))
+	for _, args := range commands {
+		c.writer.WriteCommand(args...)
+	}
+	if err := c.writer.Flush(); err != nil {
+		c.conn.Close()
+		return nil, err
+	}
+	replies := make([]protocol.Value, len(commands))
+	for i := range replies {
+		if replies[i], err = c.reader.ReadValue(); err != nil {
+			// The stream is out of step, so the connection can't be reused
+			c.conn.Close()
+			return nil, err
+		}
+	}
+	b.put(c)
+	return replies, nil
+}
+
+// fanOut sends each backend its commands, all at once, and returns the
+// replies of each
+func (p *Proxy) fanOut(commands map[*backend][][]string) (map[*backend][]protocol.Value, error) {
+	type result struct {
+		b       *backend
+		replies []protocol.Value
+		err     error
+	}
+	results := make(chan result, len(commands))
+	for b, cmds := range commands {
+		go func() {
+			replies, err := p.call(b, cmds...)
+			results <- result{b, replies, err}
+		}()
+	}
+	replies := make(map[*backend][]protocol.Value, len(commands))
+	var err error
+	for range commands {
+		r := <-results
+		if r.err != nil {
+			err = fmt.Errorf("backend %s: %w", r.b.addr, r.err)
+			continue
+		}
+		replies[r.b] = r.replies
+	}
+	return replies, err
+}
+
+// get returns an idle connection to the backend, or a new one
+func (b *backend) get(timeout time.Duration) (*backendConn, error) {
+	b.mu.Lock()
+	if n := len(b.idle); n > 0 {
+		c := b.idle[n-1]
+		b.idle = b.idle[:n-1]
+		b.mu.Unlock()
+		return c, nil
+	}
+	b.mu.Unlock()
+	conn, err := net.DialTimeout("tcp", b.addr, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return &backendConn{conn: conn, reader: protocol.NewReader(conn), writer: protocol.NewWriter(conn)}, nil
+}
+
+// put keeps a connection for reuse, unless there are enough already or
+// the backend was removed
+func (b *backend) put(c *backendConn) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed || len(b.idle) >= maxIdleConns {
+		c.conn.Close()
+		return
+	}
+	b.idle = append(b.idle, c)
+}
+
+// close closes the idle connections, and those in use once they are done
+func (b *backend) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	for _, c := range b.idle {
+		c.conn.Close()
+	}
+	b.idle = nil
+}
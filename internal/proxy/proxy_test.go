@@ -0,0 +1,234 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+	"github.com/kartikey-singh/redis/internal/cluster"
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/server"
+)
+
+// startBackends starts standalone servers on ports from basePort, returning
+// their caches and addresses
+func startBackends(t *testing.T, n, basePort int) ([]*cache.Cache, []string) {
+	t.Helper()
+	var caches []*cache.Cache
+	var addrs []string
+	for i := range n {
+		c := cache.New(1000)
+		t.Cleanup(c.Close)
+		addr := fmt.Sprintf("127.0.0.1:%d", basePort+i)
+		srv := server.New(addr, c, "standalone", "", 0)
+		t.Cleanup(func() { srv.Close() })
+		go srv.Start()
+		caches = append(caches, c)
+		addrs = append(addrs, addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	return caches, addrs
+}
+
+func startProxy(t *testing.T, port int, backends []string) (*Proxy, *conn) {
+	t.Helper()
+	p, err := New(Config{Backends: backends})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Close() })
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	go p.Start(addr)
+	time.Sleep(50 * time.Millisecond)
+	return p, dial(t, addr)
+}
+
+// conn is a client connection to the proxy
+type conn struct {
+	t *testing.T
+	r *protocol.Reader
+	w *protocol.Writer
+}
+
+func dial(t *testing.T, addr string) *conn {
+	t.Helper()
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return &conn{t: t, r: protocol.NewReader(c), w: protocol.NewWriter(c)}
+}
+
+func (c *conn) do(args ...string) protocol.Value {
+	c.t.Helper()
+	c.w.WriteCommand(args...)
+	c.w.Flush()
+	reply, err := c.r.ReadValue()
+	if err != nil {
+		c.t.Fatalf("%v: %v", args, err)
+	}
+	return reply
+}
+
+func strs(v protocol.Value) []string {
+	var s []string
+	for _, elem := range v.Array {
+		if elem.Null {
+			s = append(s, "(nil)")
+		} else {
+			s = append(s, elem.Str)
+		}
+	}
+	return s
+}
+
+func TestProxy(t *testing.T) {
+	caches, backends := startBackends(t, 3, 18500)
+	_, c := startProxy(t, 18510, backends)
+
+	var keys []string
+	for i := range 60 {
+		key := "key" + strconv.Itoa(i)
+		keys = append(keys, key)
+		if got := c.do("SET", key, "v"+strconv.Itoa(i)); got.Str != "OK" {
+			t.Fatalf("SET %s: got %+v", key, got)
+		}
+	}
+	// Keys are spread over every backend, each on one
+	total := 0
+	for i, ch := range caches {
+		if ch.Size() == 0 {
+			t.Errorf("backend %d got no keys", i)
+		}
+		total += ch.Size()
+	}
+	if total != len(keys) {
+		t.Errorf("backends hold %d keys, want %d", total, len(keys))
+	}
+	if got := c.do("GET", "key7"); got.Str != "v7" {
+		t.Errorf("GET: got %+v", got)
+	}
+	if got := c.do("SET", "ttl", "v", "EX", "100"); got.Str != "OK" {
+		t.Errorf("SET EX: got %+v", got)
+	}
+
+	if got := strs(c.do("MGET", "key1", "missing", "key2", "key30")); !slices.Equal(got, []string{"v1", "(nil)", "v2", "v30"}) {
+		t.Errorf("MGET: got %v", got)
+	}
+	if got := c.do("SIZE"); got.Int != int64(len(keys)+1) {
+		t.Errorf("SIZE: got %+v", got)
+	}
+	if got := c.do("KEYS"); len(got.Array) != len(keys)+1 {
+		t.Errorf("KEYS: got %d keys, want %d", len(got.Array), len(keys)+1)
+	}
+	if got := c.do("DEL", "key1", "key2", "key3", "key4", "missing"); got.Int != 4 {
+		t.Errorf("DEL: got %+v", got)
+	}
+	if got := c.do("GET", "key1"); !got.Null {
+		t.Errorf("GET of a deleted key: got %+v", got)
+	}
+
+	for _, args := range [][]string{{"GET"}, {"DEL"}, {"MGET"}, {"NOSUCH"}} {
+		if got := c.do(args...); !got.IsError() {
+			t.Errorf("%v: got %+v, want an error", args, got)
+		}
+	}
+	// Empty commands are skipped
+	c.w.WriteCommand()
+	if got := c.do("PING"); got.Str != "PONG" {
+		t.Errorf("PING after an empty command: got %+v", got)
+	}
+	if got := c.do("HELLO", "3"); got.Type != protocol.Map {
+		t.Errorf("HELLO 3: got %+v", got)
+	}
+	if got := c.do("KEYS"); got.Type != protocol.Set {
+		t.Errorf("KEYS after HELLO 3: got type %c", got.Type)
+	}
+
+	if got := c.do("FLUSH"); got.Str != "OK" {
+		t.Errorf("FLUSH: got %+v", got)
+	}
+	for i, ch := range caches {
+		if ch.Size() != 0 {
+			t.Errorf("backend %d not flushed", i)
+		}
+	}
+}
+
+func TestProxySetBackends(t *testing.T) {
+	caches, backends := startBackends(t, 3, 18520)
+	p, c := startProxy(t, 18530, backends[:2])
+
+	for i := range 20 {
+		c.do("SET", "key"+strconv.Itoa(i), "v")
+	}
+	if caches[2].Size() != 0 {
+		t.Fatal("a backend not yet added got keys")
+	}
+
+	// The client stays connected while the backends change
+	if err := p.SetBackends(backends[1:]); err != nil {
+		t.Fatal(err)
+	}
+	if got := p.Backends(); !slices.Equal(got, backends[1:]) {
+		t.Errorf("Backends: got %v", got)
+	}
+	c.do("FLUSH")
+	if caches[0].Size() == 0 || caches[1].Size() != 0 {
+		t.Errorf("FLUSH reached a removed backend, or missed a current one")
+	}
+	for i := range 20 {
+		c.do("SET", "key"+strconv.Itoa(i), "v")
+	}
+	if caches[2].Size() == 0 {
+		t.Error("the added backend got no keys")
+	}
+	if got := c.do("SIZE"); got.Int != 20 {
+		t.Errorf("SIZE: got %+v", got)
+	}
+
+	if err := p.SetBackends([]string{backends[0], backends[0]}); err == nil {
+		t.Error("SetBackends with a duplicate succeeded")
+	}
+	if err := p.SetBackends(nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := c.do("GET", "key1"); !got.IsError() {
+		t.Errorf("GET without backends: got %+v", got)
+	}
+
+	// A backend that is down is reported, and the others still answer
+	p.SetBackends([]string{backends[2], "127.0.0.1:1"})
+	if got := c.do("SIZE"); !got.IsError() {
+		t.Errorf("SIZE with a backend down: got %+v", got)
+	}
+	if got := c.do("PING"); got.Str != "PONG" {
+		t.Errorf("PING: got %+v", got)
+	}
+
+	// A backend's error reply is passed on, not taken for a missing key
+	ch := cache.New(1000)
+	t.Cleanup(ch.Close)
+	// Take a free port for it from a listener we close again
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	listener.Close()
+	srv := server.New(addr, ch, "standalone", "", 0)
+	srv.SetCluster(cluster.New(cluster.Config{Addr: addr})) // serving no slots
+	t.Cleanup(func() { srv.Close() })
+	go srv.Start()
+	time.Sleep(100 * time.Millisecond)
+	p.SetBackends([]string{addr})
+	if got := c.do("MGET", "k1", "k2"); !got.IsError() || !strings.HasPrefix(got.Str, "CLUSTERDOWN") {
+		t.Errorf("MGET with a backend refusing the keys: got %+v", got)
+	}
+}
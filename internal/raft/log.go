@@ -0,0 +1,95 @@
+package raft
+
+import (
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+// Op is the write a Command performs on the cache
+type Op uint8
+
+const (
+	OpSet Op = iota + 1
+	OpDelete
+	OpFlush
+)
+
+// Command is a write to the cache, carried by a log entry. Expiry times are
+// absolute, so every node expires the key at the same moment however late it
+// applies the entry.
+type Command struct {
+	Op        Op
+	Key       string
+	Value     string
+	ExpiresAt time.Time // for OpSet, zero if the key does not expire
+}
+
+// apply performs the command on c and reports whether a deleted key existed
+func (cmd Command) apply(c *cache.Cache) bool {
+	switch cmd.Op {
+	case OpSet:
+		c.SetWithDeadline(cmd.Key, cmd.Value, cmd.ExpiresAt)
+	case OpDelete:
+		return c.Delete(cmd.Key)
+	case OpFlush:
+		c.Flush()
+	}
+	return false
+}
+
+// EntryType tells commands from the entries Raft adds for itself
+type EntryType uint8
+
+const (
+	// EntryNoop is appended by each new leader, so entries left by earlier
+	// terms are committed as soon as it is
+	EntryNoop EntryType = iota + 1
+	EntryCommand
+)
+
+// Entry is one slot of the replicated log
+type Entry struct {
+	Index   uint64
+	Term    uint64
+	Type    EntryType
+	Command Command
+}
+
+// The log is kept in Node.log, whose first element is not a real entry but
+// stands for everything before the log: its Index and Term are those of the
+// entry just before log[1]. Until the log is compacted that is index 0,
+// term 0. These helpers must be called with Node.mu held.
+
+func (n *Node) lastIndex() uint64 {
+	return n.log[len(n.log)-1].Index
+}
+
+func (n *Node) lastTerm() uint64 {
+	return n.log[len(n.log)-1].Term
+}
+
+// entry returns the entry at index, which must be in the log
+func (n *Node) entry(index uint64) Entry {
+	return n.log[index-n.log[0].Index]
+}
+
+// termAt returns the term of the entry at index, which must not be past the
+// end of the log
+func (n *Node) termAt(index uint64) uint64 {
+	return n.entry(index).Term
+}
+
+// entriesFrom returns up to max entries starting at index
+func (n *Node) entriesFrom(index uint64, max int) []Entry {
+	start := index - n.log[0].Index
+	end := min(uint64(len(n.log)), start+uint64(max))
+	entries := make([]Entry, end-start)
+	copy(entries, n.log[start:end])
+	return entries
+}
+
+// truncateFrom drops the entry at index and every entry after it
+func (n *Node) truncateFrom(index uint64) {
+	n.log = n.log[:index-n.log[0].Index]
+}
@@ -0,0 +1,471 @@
+// Package raft keeps a cache.Cache replicated across a group of nodes with
+// the Raft consensus algorithm (https://raft.github.io/raft.pdf).
+//
+// Writes are proposed to the leader as log entries. Each entry is applied
+// to every node's cache in log order, and only once a majority of the group
+// has stored it, so a write that returns nil survives the loss of any
+// minority of nodes and is seen by every later write. Followers refuse
+// writes with a NotLeaderError naming the leader, and a leader that loses
+// touch with a majority steps down rather than hold writes it can't commit.
+// Reads are served from the local cache, so a follower may return data a
+// little behind the leader.
+//
+// Every node must apply the same writes to the same keys, so the cache must
+// not evict keys on its own: create it without a size limit.
+//
+// Once a node has applied SnapshotThreshold entries since its last
+// snapshot, it snapshots the cache and drops the log up to there. A
+// follower that needs entries the leader has dropped is sent the leader's
+// snapshot instead.
+//
+// Like the rest of the server, a node keeps everything in memory: a node
+// that restarts must rejoin the group as an empty node.
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	mrand "math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+const (
+	DefaultElectionTimeout   = time.Second
+	DefaultHeartbeatInterval = 100 * time.Millisecond
+	// maxAppendEntries bounds the entries sent in one AppendEntries
+	maxAppendEntries = 512
+)
+
+// Role is a node's part in the current term
+type Role string
+
+const (
+	Follower  Role = "follower"
+	Candidate Role = "candidate"
+	Leader    Role = "leader"
+)
+
+var (
+	// ErrLeadershipLost is returned by a write whose leader stepped down
+	// before it committed. The write may still be applied by the new leader.
+	ErrLeadershipLost = errors.New("raft: leadership lost while committing, the write may or may not be applied")
+	ErrClosed         = errors.New("raft: node closed")
+)
+
+// NotLeaderError refuses a write on a node that is not the leader
+type NotLeaderError struct {
+	Leader string // client address of the leader, "" if none is known
+}
+
+func (e *NotLeaderError) Error() string {
+	if e.Leader == "" {
+		return "raft: no leader elected yet"
+	}
+	return "raft: not the leader, the leader is " + e.Leader
+}
+
+// Config describes a node and the group it belongs to
+type Config struct {
+	ID         string   // this node's name on the transport
+	Peers      []string // IDs of the other nodes of the group
+	ClientAddr string   // where clients reach this node, sent to followers for redirects
+	Transport  Transport
+
+	// A follower that hears from no leader for ElectionTimeout, randomized
+	// up to twice that, stands for election. The leader sends heartbeats
+	// every HeartbeatInterval, which must be well below ElectionTimeout.
+	ElectionTimeout   time.Duration
+	HeartbeatInterval time.Duration
+	// SnapshotThreshold is how many entries are applied between snapshots
+	SnapshotThreshold uint64
+	// SnapshotChunkSize is about how many bytes of keys and values are
+	// sent to a follower per InstallSnapshot RPC
+	SnapshotChunkSize int
+}
+
+type Node struct {
+	cfg   Config
+	cache *cache.Cache
+
+	mu          sync.Mutex
+	role        Role
+	currentTerm uint64
+	votedFor    string // in currentTerm, "" if nobody
+	log         []Entry
+	snapshot    *Snapshot // latest, taken or installed; covers log[0]
+	installing  *Snapshot // installed from the leader, to be restored
+	receiving   *Snapshot // chunks received from the leader so far
+	commitIndex uint64
+	lastApplied uint64
+	leaderID    string // in currentTerm, "" if not known
+	leaderAddr  string
+	// electionDeadline is when a follower or candidate starts an election
+	electionDeadline time.Time
+
+	// Leader state, reset at each election won
+	nextIndex  map[string]uint64 // next entry to send to each peer
+	matchIndex map[string]uint64 // last entry known stored on each peer
+	triggers   map[string]chan struct{}
+	stepDown   chan struct{}        // closed when this node stops leading
+	pending    map[uint64]*proposal // writes waiting to commit, by index
+	// lastContact is when each peer last answered, see checkQuorum
+	lastContact map[string]time.Time
+
+	applyCond *sync.Cond // signalled when commitIndex advances, and on Close
+	closed    bool
+	done      chan struct{} // closed by Close
+}
+
+// proposal is a write waiting for its entry to be applied
+type proposal struct {
+	term uint64
+	done chan proposalResult
+}
+
+type proposalResult struct {
+	deleted bool // for OpDelete, whether the key existed
+	err     error
+}
+
+// NewNode starts a node of a Raft group that applies committed writes to c.
+// Zero durations take the defaults. The node starts as a follower with an
+// empty log, and is reachable once registered with its transport.
+func NewNode(c *cache.Cache, cfg Config) (*Node, error) {
+	if cfg.ID == "" || cfg.Transport == nil {
+		return nil, errors.New("raft: node ID and transport are required")
+	}
+	for _, peer := range cfg.Peers {
+		if peer == cfg.ID {
+			return nil, fmt.Errorf("raft: node %s is listed as its own peer", peer)
+		}
+	}
+	if cfg.ElectionTimeout <= 0 {
+		cfg.ElectionTimeout = DefaultElectionTimeout
+	}
+	if cfg.HeartbeatInterval <= 0 {
+		cfg.HeartbeatInterval = DefaultHeartbeatInterval
+	}
+	if cfg.SnapshotThreshold == 0 {
+		cfg.SnapshotThreshold = DefaultSnapshotThreshold
+	}
+	if cfg.SnapshotChunkSize <= 0 {
+		cfg.SnapshotChunkSize = DefaultSnapshotChunkSize
+	}
+	n := &Node{
+		cfg:     cfg,
+		cache:   c,
+		role:    Follower,
+		log:     []Entry{{}},
+		pending: make(map[uint64]*proposal),
+		done:    make(chan struct{}),
+	}
+	n.applyCond = sync.NewCond(&n.mu)
+	n.resetElectionTimer()
+	go n.run()
+	go n.applyLoop()
+	return n, nil
+}
+
+// Close stops the node. Writes still waiting fail with ErrClosed.
+func (n *Node) Close() error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return nil
+	}
+	n.closed = true
+	close(n.done)
+	if n.role == Leader {
+		close(n.stepDown)
+	}
+	n.failPending(ErrClosed)
+	n.applyCond.Broadcast()
+	return nil
+}
+
+// Cache functions
+// Set proposes cache.SetWithTTL and returns once it is applied
+func (n *Node) Set(key, value string, ttl time.Duration) error {
+	cmd := Command{Op: OpSet, Key: key, Value: value}
+	if ttl > 0 {
+		cmd.ExpiresAt = time.Now().Add(ttl)
+	}
+	_, err := n.propose(cmd)
+	return err
+}
+
+// Delete proposes cache.Delete and reports, once it is applied, whether the
+// key existed
+func (n *Node) Delete(key string) (bool, error) {
+	return n.propose(Command{Op: OpDelete, Key: key})
+}
+
+// Flush proposes cache.Flush and returns once it is applied
+func (n *Node) Flush() error {
+	_, err := n.propose(Command{Op: OpFlush})
+	return err
+}
+
+// Get reads from the local cache
+func (n *Node) Get(key string) (string, bool) {
+	return n.cache.Get(key)
+}
+
+// propose appends cmd to the leader's log and waits for it to be applied
+func (n *Node) propose(cmd Command) (bool, error) {
+	n.mu.Lock()
+	if n.closed {
+		n.mu.Unlock()
+		return false, ErrClosed
+	}
+	if n.role != Leader {
+		err := &NotLeaderError{Leader: n.leaderAddr}
+		n.mu.Unlock()
+		return false, err
+	}
+	index := n.lastIndex() + 1
+	n.log = append(n.log, Entry{Index: index, Term: n.currentTerm, Type: EntryCommand, Command: cmd})
+	p := &proposal{term: n.currentTerm, done: make(chan proposalResult, 1)}
+	n.pending[index] = p
+	n.advanceCommit()
+	n.triggerReplication()
+	n.mu.Unlock()
+
+	r := <-p.done
+	return r.deleted, r.err
+}
+
+// failPending fails every write waiting to commit. Callers must hold mu.
+func (n *Node) failPending(err error) {
+	for index, p := range n.pending {
+		p.done <- proposalResult{err: err}
+		delete(n.pending, index)
+	}
+}
+
+// Status is a point-in-time view of a node
+type Status struct {
+	ID          string
+	Role        Role
+	Term        uint64
+	Leader      string // ID of the leader, "" if not known
+	LeaderAddr  string // client address of the leader
+	CommitIndex uint64
+	LastApplied uint64
+	LastIndex   uint64
+	// SnapshotIndex is the last entry covered by the latest snapshot; the
+	// log holds the entries after it
+	SnapshotIndex uint64
+	Peers         int
+}
+
+func (n *Node) Status() Status {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return Status{
+		ID:          n.cfg.ID,
+		Role:        n.role,
+		Term:        n.currentTerm,
+		Leader:      n.leaderID,
+		LeaderAddr:  n.leaderAddr,
+		CommitIndex: n.commitIndex,
+		LastApplied: n.lastApplied,
+		LastIndex:   n.lastIndex(),
+		Peers:       len(n.cfg.Peers),
+
+		SnapshotIndex: n.log[0].Index,
+	}
+}
+
+// quorum is the number of nodes, this one included, that make a majority
+func (n *Node) quorum() int {
+	return (len(n.cfg.Peers)+1)/2 + 1
+}
+
+// resetElectionTimer puts the next election a randomized timeout away, so
+// followers rarely stand at once and split the vote. Callers must hold mu.
+func (n *Node) resetElectionTimer() {
+	timeout := n.cfg.ElectionTimeout + mrand.N(n.cfg.ElectionTimeout)
+	n.electionDeadline = time.Now().Add(timeout)
+}
+
+// run starts an election whenever a follower's or candidate's timer runs
+// out, and has a leader step down once it loses touch with a majority
+func (n *Node) run() {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-n.done:
+			return
+		case <-ticker.C:
+			n.mu.Lock()
+			if n.role != Leader && time.Now().After(n.electionDeadline) {
+				n.startElection()
+			} else if n.role == Leader {
+				n.checkQuorum()
+			}
+			n.mu.Unlock()
+		}
+	}
+}
+
+// startElection stands for leader in a new term. Callers must hold mu.
+func (n *Node) startElection() {
+	n.currentTerm++
+	n.role = Candidate
+	n.votedFor = n.cfg.ID
+	n.leaderID, n.leaderAddr = "", ""
+	n.resetElectionTimer()
+	term := n.currentTerm
+	log.Printf("Raft %s: starting election for term %d", n.cfg.ID, term)
+
+	req := &RequestVoteRequest{
+		Term:         term,
+		CandidateID:  n.cfg.ID,
+		LastLogIndex: n.lastIndex(),
+		LastLogTerm:  n.lastTerm(),
+	}
+	votes := 1
+	if votes >= n.quorum() {
+		n.becomeLeader()
+		return
+	}
+	for _, peer := range n.cfg.Peers {
+		go func() {
+			resp, err := n.cfg.Transport.RequestVote(peer, req)
+			if err != nil {
+				return
+			}
+			n.mu.Lock()
+			defer n.mu.Unlock()
+			if resp.Term > n.currentTerm {
+				n.becomeFollower(resp.Term)
+				return
+			}
+			if n.role != Candidate || n.currentTerm != term || !resp.VoteGranted {
+				return
+			}
+			votes++
+			if votes == n.quorum() {
+				n.becomeLeader()
+			}
+		}()
+	}
+}
+
+// checkQuorum steps down a leader that has not heard from a majority for
+// ElectionTimeout. Cut off from them it can commit nothing, and without
+// stepping down it would hold its writes until the partition heals.
+// Callers must hold mu.
+func (n *Node) checkQuorum() {
+	contacted := 1
+	for _, at := range n.lastContact {
+		if time.Since(at) < n.cfg.ElectionTimeout {
+			contacted++
+		}
+	}
+	if contacted < n.quorum() {
+		log.Printf("Raft %s: lost touch with a majority in term %d", n.cfg.ID, n.currentTerm)
+		n.becomeFollower(n.currentTerm)
+		n.leaderID, n.leaderAddr = "", ""
+	}
+}
+
+// becomeFollower steps down to follower, in a newer term if term is ahead
+// of ours. Callers must hold mu.
+func (n *Node) becomeFollower(term uint64) {
+	if term > n.currentTerm {
+		n.currentTerm = term
+		n.votedFor = ""
+		n.leaderID, n.leaderAddr = "", ""
+	}
+	if n.role == Leader {
+		log.Printf("Raft %s: stepping down in term %d", n.cfg.ID, n.currentTerm)
+		close(n.stepDown)
+		n.failPending(ErrLeadershipLost)
+		n.resetElectionTimer()
+	}
+	n.role = Follower
+}
+
+// becomeLeader takes over the group after winning an election: it appends
+// a no-op entry for the new term and starts replicating to every peer.
+// Callers must hold mu.
+func (n *Node) becomeLeader() {
+	n.role = Leader
+	n.leaderID, n.leaderAddr = n.cfg.ID, n.cfg.ClientAddr
+	log.Printf("Raft %s: elected leader for term %d", n.cfg.ID, n.currentTerm)
+
+	n.log = append(n.log, Entry{Index: n.lastIndex() + 1, Term: n.currentTerm, Type: EntryNoop})
+	n.nextIndex = make(map[string]uint64)
+	n.matchIndex = make(map[string]uint64)
+	n.triggers = make(map[string]chan struct{})
+	n.stepDown = make(chan struct{})
+	n.lastContact = make(map[string]time.Time)
+	for _, peer := range n.cfg.Peers {
+		n.nextIndex[peer] = n.lastIndex()
+		n.matchIndex[peer] = 0
+		n.lastContact[peer] = time.Now() // they voted for us, or may have
+		n.triggers[peer] = make(chan struct{}, 1)
+		go n.replicate(peer, n.currentTerm, n.stepDown, n.triggers[peer])
+	}
+	n.advanceCommit()
+}
+
+// applyLoop applies committed entries to the cache in log order, hands
+// their results to the writes waiting for them, and takes snapshots. It
+// also restores snapshots installed from the leader, so it is the only
+// writer of the cache.
+func (n *Node) applyLoop() {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for {
+		for !n.closed && n.installing == nil && n.lastApplied >= n.commitIndex {
+			n.applyCond.Wait()
+		}
+		if n.closed {
+			return
+		}
+		if snap := n.installing; snap != nil {
+			n.installing = nil
+			n.mu.Unlock()
+			restore(n.cache, snap)
+			n.mu.Lock()
+			n.lastApplied = max(n.lastApplied, snap.Index)
+			continue
+		}
+		entries := n.entriesFrom(n.lastApplied+1, int(n.commitIndex-n.lastApplied))
+		n.mu.Unlock()
+
+		deleted := make([]bool, len(entries))
+		for i, e := range entries {
+			if e.Type == EntryCommand {
+				deleted[i] = e.Command.apply(n.cache)
+			}
+		}
+
+		n.mu.Lock()
+		for i, e := range entries {
+			n.lastApplied = e.Index
+			p, ok := n.pending[e.Index]
+			if !ok {
+				continue
+			}
+			delete(n.pending, e.Index)
+			if p.term == e.Term {
+				p.done <- proposalResult{deleted: deleted[i]}
+			} else {
+				// Another leader's entry replaced ours
+				p.done <- proposalResult{err: ErrLeadershipLost}
+			}
+		}
+		if n.lastApplied-n.log[0].Index >= n.cfg.SnapshotThreshold {
+			n.takeSnapshot(n.lastApplied)
+		}
+	}
+}
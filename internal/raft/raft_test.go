@@ -0,0 +1,364 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+// cluster is a Raft group connected by an InmemNetwork
+type cluster struct {
+	t       *testing.T
+	network *InmemNetwork
+	nodes   []*Node
+	caches  []*cache.Cache
+}
+
+// newCluster starts a group of size nodes, with configure, if given,
+// applied to each node's config
+func newCluster(t *testing.T, size int, configure ...func(*Config)) *cluster {
+	t.Helper()
+	c := &cluster{t: t, network: NewInmemNetwork()}
+	ids := make([]string, size)
+	for i := range ids {
+		ids[i] = fmt.Sprintf("n%d", i)
+	}
+	for i, id := range ids {
+		var peers []string
+		for j, peer := range ids {
+			if j != i {
+				peers = append(peers, peer)
+			}
+		}
+		ch := cache.New(0)
+		t.Cleanup(ch.Close)
+		cfg := Config{
+			ID:                id,
+			Peers:             peers,
+			ClientAddr:        "client-" + id,
+			Transport:         c.network.Transport(id),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+		}
+		for _, fn := range configure {
+			fn(&cfg)
+		}
+		node, err := NewNode(ch, cfg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		c.network.Register(id, node)
+		c.nodes = append(c.nodes, node)
+		c.caches = append(c.caches, ch)
+	}
+	return c
+}
+
+// leader waits for exactly one of the given nodes, or all nodes if none are
+// given, to lead in the newest term among them
+func (c *cluster) leader(among ...*Node) *Node {
+	c.t.Helper()
+	if len(among) == 0 {
+		among = c.nodes
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for time.Now().Before(deadline) {
+		var leaders []*Node
+		var newest uint64
+		for _, n := range among {
+			st := n.Status()
+			newest = max(newest, st.Term)
+			if st.Role == Leader {
+				leaders = append(leaders, n)
+			}
+		}
+		if len(leaders) == 1 && leaders[0].Status().Term == newest {
+			return leaders[0]
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	c.t.Fatal("no single leader was elected")
+	return nil
+}
+
+// waitFor waits until every given cache, or all caches, has key set to
+// value, or has no key if value is ""
+func (c *cluster) waitFor(key, value string, caches ...*cache.Cache) {
+	c.t.Helper()
+	if len(caches) == 0 {
+		caches = c.caches
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for _, ch := range caches {
+		for {
+			got, _ := ch.Get(key)
+			if got == value {
+				break
+			}
+			if time.Now().After(deadline) {
+				c.t.Fatalf("%s = %q, want %q", key, got, value)
+			}
+			time.Sleep(5 * time.Millisecond)
+		}
+	}
+}
+
+func TestElectsOneLeader(t *testing.T) {
+	for _, size := range []int{3, 5} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			c := newCluster(t, size)
+			leader := c.leader()
+			term := leader.Status().Term
+
+			// Heartbeats keep the leader in place
+			time.Sleep(300 * time.Millisecond)
+			if st := leader.Status(); st.Role != Leader || st.Term != term {
+				t.Fatalf("leader lost its place without a failure: %+v", st)
+			}
+			for _, n := range c.nodes {
+				if st := n.Status(); st.Leader != leader.cfg.ID || st.LeaderAddr != leader.cfg.ClientAddr {
+					t.Errorf("%s follows %q at %q, want %s", st.ID, st.Leader, st.LeaderAddr, leader.cfg.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestReplicatesCommittedWrites(t *testing.T) {
+	for _, size := range []int{3, 5} {
+		t.Run(fmt.Sprintf("%d nodes", size), func(t *testing.T) {
+			c := newCluster(t, size)
+			leader := c.leader()
+
+			for i := range 100 {
+				if err := leader.Set(fmt.Sprintf("k%d", i), "v", 0); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// A write has been applied on the leader once it returns
+			if v, _ := leader.Get("k99"); v != "v" {
+				t.Fatalf("leader has k99 = %q after Set returned", v)
+			}
+			c.waitFor("k99", "v")
+
+			if deleted, err := leader.Delete("k0"); err != nil || !deleted {
+				t.Fatalf("Delete(k0) = %v, %v", deleted, err)
+			}
+			if deleted, err := leader.Delete("k0"); err != nil || deleted {
+				t.Fatalf("second Delete(k0) = %v, %v", deleted, err)
+			}
+			c.waitFor("k0", "")
+
+			if err := leader.Set("ttl", "v", time.Hour); err != nil {
+				t.Fatal(err)
+			}
+			c.waitFor("ttl", "v")
+			_, ttl, _ := leader.cache.GetWithTTL("ttl")
+			for _, ch := range c.caches {
+				if _, got, _ := ch.GetWithTTL("ttl"); got > ttl+time.Second || got < ttl-time.Second {
+					t.Errorf("TTL %v on a follower, %v on the leader", got, ttl)
+				}
+			}
+
+			if err := leader.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			c.waitFor("k99", "")
+
+			for _, n := range c.nodes {
+				waitForApplied(t, n, leader.Status().CommitIndex)
+			}
+		})
+	}
+}
+
+func waitForApplied(t *testing.T, n *Node, index uint64) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for n.Status().LastApplied < index {
+		if time.Now().After(deadline) {
+			t.Fatalf("%s applied up to %d, want %d", n.cfg.ID, n.Status().LastApplied, index)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestFollowerRefusesWrites(t *testing.T) {
+	c := newCluster(t, 3)
+	leader := c.leader()
+	// Wait for the followers to hear from the leader
+	leader.Set("k", "v", 0)
+	c.waitFor("k", "v")
+	for _, n := range c.nodes {
+		if n == leader {
+			continue
+		}
+		err := n.Set("k", "other", 0)
+		var notLeader *NotLeaderError
+		if !errors.As(err, &notLeader) || notLeader.Leader != leader.cfg.ClientAddr {
+			t.Errorf("Set on follower %s: got %v, want a redirect to %s", n.cfg.ID, err, leader.cfg.ClientAddr)
+		}
+	}
+	c.waitFor("k", "v")
+}
+
+func TestLeaderFailover(t *testing.T) {
+	c := newCluster(t, 5)
+	old := c.leader()
+	if err := old.Set("before", "1", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	c.network.Disconnect(old.cfg.ID)
+	var rest []*Node
+	for _, n := range c.nodes {
+		if n != old {
+			rest = append(rest, n)
+		}
+	}
+	leader := c.leader(rest...)
+	if leader.Status().Term <= old.Status().Term {
+		t.Fatalf("new leader's term %d is not past the old one's %d", leader.Status().Term, old.Status().Term)
+	}
+	if v, _ := leader.Get("before"); v != "1" {
+		t.Fatalf("committed write lost in the failover, before = %q", v)
+	}
+	if err := leader.Set("after", "2", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// The old leader steps down when it hears the newer term, and catches up
+	c.network.Reconnect(old.cfg.ID)
+	c.waitFor("after", "2")
+	if st := old.Status(); st.Role != Follower || st.Leader != leader.cfg.ID {
+		t.Errorf("old leader should follow %s, got %+v", leader.cfg.ID, st)
+	}
+}
+
+func TestIsolatedLeaderCannotCommit(t *testing.T) {
+	c := newCluster(t, 5)
+	old := c.leader()
+	c.network.Disconnect(old.cfg.ID)
+
+	// Cut off from the majority, it steps down within an election timeout
+	// or so and fails the write waiting on it
+	result := make(chan error, 1)
+	go func() { result <- old.Set("lost", "v", 0) }()
+	select {
+	case err := <-result:
+		if !errors.Is(err, ErrLeadershipLost) {
+			t.Fatalf("write on an isolated leader: got %v, want ErrLeadershipLost", err)
+		}
+	case <-time.After(3 * time.Second):
+		t.Fatal("write on an isolated leader never returned")
+	}
+	if st := old.Status(); st.Role == Leader || st.LeaderAddr != "" {
+		t.Errorf("isolated leader did not step down: %+v", st)
+	}
+
+	var rest []*Node
+	for _, n := range c.nodes {
+		if n != old {
+			rest = append(rest, n)
+		}
+	}
+	leader := c.leader(rest...)
+	if err := leader.Set("kept", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+
+	// Back in the group, the old leader drops its uncommitted entry for
+	// the new leader's
+	c.network.Reconnect(old.cfg.ID)
+	c.waitFor("kept", "v")
+	for _, ch := range c.caches {
+		if _, ok := ch.Get("lost"); ok {
+			t.Error("an uncommitted write was applied")
+		}
+	}
+}
+
+func TestVotesOncePerTerm(t *testing.T) {
+	node, err := NewNode(cache.New(0), Config{
+		ID:              "n0",
+		Peers:           []string{"n1", "n2"},
+		Transport:       NewInmemNetwork().Transport("n0"),
+		ElectionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	if resp := node.HandleRequestVote(&RequestVoteRequest{Term: 1, CandidateID: "n1"}); !resp.VoteGranted {
+		t.Fatal("first candidate of term 1 should get the vote")
+	}
+	if resp := node.HandleRequestVote(&RequestVoteRequest{Term: 1, CandidateID: "n2"}); resp.VoteGranted {
+		t.Fatal("a second candidate in term 1 should not get the vote")
+	}
+	if resp := node.HandleRequestVote(&RequestVoteRequest{Term: 0, CandidateID: "n2"}); resp.VoteGranted || resp.Term != 1 {
+		t.Fatalf("a stale term should be refused with ours, got %+v", resp)
+	}
+
+	// A candidate whose log is behind ours is refused even in a new term
+	node.HandleAppendEntries(&AppendEntriesRequest{
+		Term: 2, LeaderID: "n1",
+		Entries: []Entry{{Index: 1, Term: 2, Type: EntryNoop}},
+	})
+	if resp := node.HandleRequestVote(&RequestVoteRequest{Term: 3, CandidateID: "n2", LastLogIndex: 1, LastLogTerm: 1}); resp.VoteGranted {
+		t.Fatal("a candidate with an older log should not get the vote")
+	}
+	if resp := node.HandleRequestVote(&RequestVoteRequest{Term: 3, CandidateID: "n2", LastLogIndex: 1, LastLogTerm: 2}); !resp.VoteGranted {
+		t.Fatal("a candidate with an up-to-date log should get the vote")
+	}
+}
+
+func TestAppendEntriesConsistencyCheck(t *testing.T) {
+	node, err := NewNode(cache.New(0), Config{
+		ID:              "n0",
+		Peers:           []string{"n1"},
+		Transport:       NewInmemNetwork().Transport("n0"),
+		ElectionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	set := func(index, term uint64, key string) Entry {
+		return Entry{Index: index, Term: term, Type: EntryCommand, Command: Command{Op: OpSet, Key: key, Value: "v"}}
+	}
+	resp := node.HandleAppendEntries(&AppendEntriesRequest{
+		Term: 1, LeaderID: "n1",
+		Entries: []Entry{set(1, 1, "a"), set(2, 1, "b"), set(3, 1, "c")},
+	})
+	if !resp.Success || node.Status().LastIndex != 3 {
+		t.Fatalf("append to an empty log: %+v", resp)
+	}
+
+	// A gap is refused, with a hint of where our log ends
+	resp = node.HandleAppendEntries(&AppendEntriesRequest{Term: 1, LeaderID: "n1", PrevLogIndex: 5, PrevLogTerm: 1})
+	if resp.Success || resp.LastLogIndex != 3 {
+		t.Fatalf("append past the end of the log: %+v", resp)
+	}
+
+	// A new leader overwrites the uncommitted tail it conflicts with
+	resp = node.HandleAppendEntries(&AppendEntriesRequest{
+		Term: 2, LeaderID: "n1", PrevLogIndex: 1, PrevLogTerm: 1,
+		Entries: []Entry{set(2, 2, "x")}, LeaderCommit: 2,
+	})
+	if !resp.Success || resp.LastLogIndex != 2 {
+		t.Fatalf("append over a conflicting tail: %+v", resp)
+	}
+	waitForApplied(t, node, 2)
+	if _, ok := node.Get("b"); ok {
+		t.Error("a replaced entry was applied")
+	}
+	if _, ok := node.Get("x"); !ok {
+		t.Error("the leader's entry was not applied")
+	}
+}
@@ -0,0 +1,191 @@
+package raft
+
+import "time"
+
+// replicate keeps peer up to date for as long as this node leads in term:
+// it sends new entries as soon as they are proposed, and a heartbeat every
+// HeartbeatInterval otherwise. Only one AppendEntries is in flight per peer.
+func (n *Node) replicate(peer string, term uint64, stop <-chan struct{}, trigger <-chan struct{}) {
+	ticker := time.NewTicker(n.cfg.HeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		// Keep sending while the peer is behind and answering
+		for n.sendAppend(peer, term) {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+		}
+		select {
+		case <-stop:
+			return
+		case <-trigger:
+		case <-ticker.C:
+		}
+	}
+}
+
+// triggerReplication wakes every peer's replicator. Callers must hold mu.
+func (n *Node) triggerReplication() {
+	for _, trigger := range n.triggers {
+		select {
+		case trigger <- struct{}{}:
+		default: // already woken
+		}
+	}
+}
+
+// sendAppend sends peer the entries it is missing, or a heartbeat, and
+// reports whether there is more to send right away
+func (n *Node) sendAppend(peer string, term uint64) bool {
+	n.mu.Lock()
+	if n.role != Leader || n.currentTerm != term {
+		n.mu.Unlock()
+		return false
+	}
+	next := n.nextIndex[peer]
+	if next <= n.log[0].Index {
+		// The peer needs entries we compacted into our snapshot
+		snap := n.snapshot
+		n.mu.Unlock()
+		return n.sendSnapshot(peer, term, snap)
+	}
+	req := &AppendEntriesRequest{
+		Term:         term,
+		LeaderID:     n.cfg.ID,
+		LeaderAddr:   n.cfg.ClientAddr,
+		PrevLogIndex: next - 1,
+		PrevLogTerm:  n.termAt(next - 1),
+		Entries:      n.entriesFrom(next, maxAppendEntries),
+		LeaderCommit: n.commitIndex,
+	}
+	n.mu.Unlock()
+
+	resp, err := n.cfg.Transport.AppendEntries(peer, req)
+	if err != nil {
+		return false // try again at the next heartbeat
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.currentTerm {
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.currentTerm != term {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	if !resp.Success {
+		// Back up to where the logs may agree and try again
+		n.nextIndex[peer] = max(1, min(next-1, resp.LastLogIndex+1))
+		return true
+	}
+	match := req.PrevLogIndex + uint64(len(req.Entries))
+	n.matchIndex[peer] = max(n.matchIndex[peer], match)
+	n.nextIndex[peer] = match + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// advanceCommit commits the newest entry of the current term that a
+// majority has stored, and with it every entry before it. Entries of
+// earlier terms are never committed by counting replicas, only through a
+// later entry of the current term. Callers must hold mu.
+func (n *Node) advanceCommit() {
+	for index := n.lastIndex(); index > n.commitIndex; index-- {
+		if n.termAt(index) != n.currentTerm {
+			return
+		}
+		stored := 1
+		for _, peer := range n.cfg.Peers {
+			if n.matchIndex[peer] >= index {
+				stored++
+			}
+		}
+		if stored >= n.quorum() {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+			n.triggerReplication() // tell followers the new commit index
+			return
+		}
+	}
+}
+
+// HandleRequestVote grants a vote to a candidate whose log is at least as
+// up to date as ours, if we have not voted for someone else in its term
+func (n *Node) HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if req.Term > n.currentTerm {
+		n.becomeFollower(req.Term)
+	}
+	resp := &RequestVoteResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm || n.closed {
+		return resp
+	}
+	upToDate := req.LastLogTerm > n.lastTerm() ||
+		(req.LastLogTerm == n.lastTerm() && req.LastLogIndex >= n.lastIndex())
+	if (n.votedFor == "" || n.votedFor == req.CandidateID) && upToDate {
+		n.votedFor = req.CandidateID
+		n.resetElectionTimer()
+		resp.VoteGranted = true
+	}
+	return resp
+}
+
+// HandleAppendEntries stores a leader's entries after checking that our log
+// matches the leader's up to them, dropping any of ours they conflict with
+func (n *Node) HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &AppendEntriesResponse{Term: n.currentTerm, LastLogIndex: n.lastIndex()}
+	if req.Term < n.currentTerm || n.closed {
+		return resp
+	}
+	// A candidate that hears from the leader of its term steps down too
+	if req.Term > n.currentTerm || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	resp.Term = n.currentTerm
+	n.leaderID, n.leaderAddr = req.LeaderID, req.LeaderAddr
+	n.resetElectionTimer()
+
+	prevIndex, prevTerm, entries := req.PrevLogIndex, req.PrevLogTerm, req.Entries
+	if snapIndex := n.log[0].Index; prevIndex < snapIndex {
+		// The start of the request is in our snapshot, so committed and
+		// matching: skip to the entries after it
+		skip := min(snapIndex-prevIndex, uint64(len(entries)))
+		prevIndex, entries = prevIndex+skip, entries[skip:]
+		if prevIndex < snapIndex {
+			prevIndex = snapIndex
+		}
+		prevTerm = n.termAt(prevIndex)
+	}
+	if prevIndex > n.lastIndex() {
+		return resp
+	}
+	if n.termAt(prevIndex) != prevTerm {
+		resp.LastLogIndex = prevIndex - 1
+		return resp
+	}
+	for i, e := range entries {
+		if e.Index <= n.lastIndex() {
+			if n.termAt(e.Index) == e.Term {
+				continue // already stored, maybe a repeated request
+			}
+			n.truncateFrom(e.Index)
+		}
+		n.log = append(n.log, entries[i:]...)
+		break
+	}
+	// Only entries known to match the leader's can be committed
+	if commit := min(req.LeaderCommit, prevIndex+uint64(len(entries))); commit > n.commitIndex {
+		n.commitIndex = commit
+		n.applyCond.Broadcast()
+	}
+	resp.Success = true
+	resp.LastLogIndex = n.lastIndex()
+	return resp
+}
@@ -0,0 +1,185 @@
+package raft
+
+import (
+	"log"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+// DefaultSnapshotThreshold is how many entries a node applies between two
+// snapshots by default
+const DefaultSnapshotThreshold = 8192
+
+// DefaultSnapshotChunkSize is how many bytes of keys and values a leader
+// sends per InstallSnapshot RPC by default
+const DefaultSnapshotChunkSize = 1 << 20
+
+// Snapshot is the cache's state once every entry up to Index is applied.
+// Expiry times are kept as they are, absolute, so a node restoring the
+// snapshot later still expires keys when the leader does.
+type Snapshot struct {
+	Index uint64
+	Term  uint64 // term of the entry at Index
+	Data  []cache.SnapshotEntry
+}
+
+// takeSnapshot snapshots the cache at index, the last applied entry, and
+// drops the log up to it. It runs on the apply loop, so nothing changes
+// the cache meanwhile. Callers must hold mu, which is released while the
+// cache is read.
+func (n *Node) takeSnapshot(index uint64) {
+	n.mu.Unlock()
+	data := n.cache.Snapshot()
+	n.mu.Lock()
+	if index <= n.log[0].Index {
+		return // a snapshot from the leader replaced the log meanwhile
+	}
+	n.snapshot = &Snapshot{Index: index, Term: n.termAt(index), Data: data}
+	n.compactTo(index)
+	log.Printf("Raft %s: snapshot at index %d, %d keys", n.cfg.ID, index, len(data))
+}
+
+// compactTo drops every entry up to index, which must be in the log
+func (n *Node) compactTo(index uint64) {
+	start := index - n.log[0].Index
+	entries := make([]Entry, len(n.log)-int(start))
+	copy(entries, n.log[start:])
+	entries[0] = Entry{Index: index, Term: entries[0].Term}
+	n.log = entries
+}
+
+// restore replaces the cache with a snapshot's data
+func restore(c *cache.Cache, snap *Snapshot) {
+	c.Flush()
+	for _, e := range snap.Data {
+		c.SetWithDeadline(e.Key, e.Value, e.ExpiresAt)
+	}
+}
+
+// sendSnapshot brings peer up to date with our latest snapshot, when the
+// entries it needs are gone from our log, and reports whether there is
+// more to send right away
+func (n *Node) sendSnapshot(peer string, term uint64, snap *Snapshot) bool {
+	for offset := 0; ; {
+		end := snapshotChunkEnd(snap.Data, offset, n.cfg.SnapshotChunkSize)
+		req := &InstallSnapshotRequest{
+			Term:              term,
+			LeaderID:          n.cfg.ID,
+			LeaderAddr:        n.cfg.ClientAddr,
+			LastIncludedIndex: snap.Index,
+			LastIncludedTerm:  snap.Term,
+			Offset:            offset,
+			Data:              snap.Data[offset:end],
+			Done:              end == len(snap.Data),
+		}
+		if !n.sendSnapshotChunk(peer, term, req) {
+			return false
+		}
+		if req.Done {
+			break
+		}
+		offset = end
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.role != Leader || n.currentTerm != term {
+		return false
+	}
+	log.Printf("Raft %s: sent %s a snapshot at index %d", n.cfg.ID, peer, snap.Index)
+	n.matchIndex[peer] = max(n.matchIndex[peer], snap.Index)
+	n.nextIndex[peer] = snap.Index + 1
+	n.advanceCommit()
+	return n.nextIndex[peer] <= n.lastIndex()
+}
+
+// sendSnapshotChunk sends one chunk of a snapshot and reports whether peer
+// took it, while we still lead in term
+func (n *Node) sendSnapshotChunk(peer string, term uint64, req *InstallSnapshotRequest) bool {
+	resp, err := n.cfg.Transport.InstallSnapshot(peer, req)
+	if err != nil {
+		return false
+	}
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if resp.Term > n.currentTerm {
+		n.becomeFollower(resp.Term)
+		return false
+	}
+	if n.role != Leader || n.currentTerm != term {
+		return false
+	}
+	n.lastContact[peer] = time.Now()
+	return resp.Success
+}
+
+// snapshotChunkEnd returns where the chunk of data starting at offset ends,
+// once it holds size bytes of keys and values, or a single entry if that
+// is larger
+func snapshotChunkEnd(data []cache.SnapshotEntry, offset, size int) int {
+	end, bytes := offset, 0
+	for end < len(data) {
+		bytes += len(data[end].Key) + len(data[end].Value)
+		if end > offset && bytes > size {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+// HandleInstallSnapshot collects the leader's snapshot chunk by chunk, then
+// replaces our log and cache with it, unless our log already holds the
+// entries it covers
+func (n *Node) HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	resp := &InstallSnapshotResponse{Term: n.currentTerm}
+	if req.Term < n.currentTerm || n.closed {
+		return resp
+	}
+	if req.Term > n.currentTerm || n.role != Follower {
+		n.becomeFollower(req.Term)
+	}
+	resp.Term = n.currentTerm
+	n.leaderID, n.leaderAddr = req.LeaderID, req.LeaderAddr
+	n.resetElectionTimer()
+
+	index := req.LastIncludedIndex
+	if req.Offset == 0 {
+		n.receiving = &Snapshot{Index: index, Term: req.LastIncludedTerm}
+	}
+	snap := n.receiving
+	if snap == nil || snap.Index != index || snap.Term != req.LastIncludedTerm || req.Offset != len(snap.Data) {
+		return resp // a chunk was lost, the leader starts over
+	}
+	snap.Data = append(snap.Data, req.Data...)
+	resp.Success = true
+	if !req.Done {
+		return resp
+	}
+	n.receiving = nil
+
+	if index <= n.log[0].Index {
+		return resp // we have a snapshot at least as recent
+	}
+	if index <= n.lastIndex() && n.termAt(index) == req.LastIncludedTerm {
+		// Our log agrees up to the snapshot: it is committed, and the
+		// entries after it are kept
+		if index > n.commitIndex {
+			n.commitIndex = index
+			n.applyCond.Broadcast()
+		}
+		return resp
+	}
+
+	n.log = []Entry{{Index: index, Term: snap.Term}}
+	n.snapshot = snap
+	n.installing = snap
+	n.commitIndex = max(n.commitIndex, index)
+	n.applyCond.Broadcast()
+	log.Printf("Raft %s: installing a snapshot at index %d from %s", n.cfg.ID, index, req.LeaderID)
+	return resp
+}
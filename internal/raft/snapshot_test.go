@@ -0,0 +1,236 @@
+package raft
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+func snapshotEvery(threshold uint64) func(*Config) {
+	return func(cfg *Config) { cfg.SnapshotThreshold = threshold }
+}
+
+func TestSnapshotCompactsLog(t *testing.T) {
+	c := newCluster(t, 3, snapshotEvery(50))
+	leader := c.leader()
+	for i := range 200 {
+		if err := leader.Set(fmt.Sprintf("k%d", i), "v", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.waitFor("k199", "v")
+	for _, n := range c.nodes {
+		waitForApplied(t, n, leader.Status().CommitIndex)
+		st := n.Status()
+		if st.SnapshotIndex == 0 || st.LastIndex-st.SnapshotIndex >= 50+maxAppendEntries {
+			t.Errorf("%s did not compact its log: %+v", st.ID, st)
+		}
+	}
+	for i := range 200 {
+		c.waitFor(fmt.Sprintf("k%d", i), "v")
+	}
+}
+
+func TestLaggingFollowerInstallsSnapshot(t *testing.T) {
+	c := newCluster(t, 3, snapshotEvery(20))
+	// The follower is cut off from the start, so it has none of the log
+	lagging := c.nodes[2]
+	c.network.Disconnect(lagging.cfg.ID)
+	leader := c.leader(c.nodes[:2]...)
+
+	for i := range 100 {
+		if err := leader.Set(fmt.Sprintf("k%d", i), "v", 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	leader.Delete("k0")
+	if err := leader.Set("ttl", "v", time.Hour); err != nil {
+		t.Fatal(err)
+	}
+	if err := leader.Set("after", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	if st := leader.Status(); st.SnapshotIndex < 20 {
+		t.Fatalf("leader should have compacted its log, %+v", st)
+	}
+
+	c.network.Reconnect(lagging.cfg.ID)
+	lc := c.caches[2]
+	c.waitFor("after", "v", lc)
+	c.waitFor("k99", "v", lc)
+	c.waitFor("k0", "", lc)
+	_, ttl, _ := lc.GetWithTTL("ttl")
+	if ttl < 59*time.Minute || ttl > time.Hour {
+		t.Errorf("TTL after a snapshot install: %v", ttl)
+	}
+	if st := lagging.Status(); st.SnapshotIndex == 0 {
+		t.Errorf("lagging follower should have installed a snapshot, %+v", st)
+	}
+
+	// And it keeps up with the log from there
+	if err := leader.Set("later", "v", 0); err != nil {
+		t.Fatal(err)
+	}
+	c.waitFor("later", "v", lc)
+}
+
+func TestInstallSnapshot(t *testing.T) {
+	c := cache.New(0)
+	node, err := NewNode(c, Config{
+		ID:              "n0",
+		Peers:           []string{"n1"},
+		Transport:       NewInmemNetwork().Transport("n0"),
+		ElectionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	set := func(index uint64, key string) Entry {
+		return Entry{Index: index, Term: 1, Type: EntryCommand, Command: Command{Op: OpSet, Key: key, Value: "log"}}
+	}
+	node.HandleAppendEntries(&AppendEntriesRequest{
+		Term: 1, LeaderID: "n1",
+		Entries: []Entry{set(1, "a"), set(2, "b"), set(3, "c")},
+	})
+
+	// A snapshot our log agrees with commits it, and keeps the entries after it
+	node.HandleInstallSnapshot(&InstallSnapshotRequest{
+		Term: 1, LeaderID: "n1", LastIncludedIndex: 2, LastIncludedTerm: 1, Done: true,
+		Data: []cache.SnapshotEntry{{Key: "a", Value: "log"}, {Key: "b", Value: "log"}},
+	})
+	waitForApplied(t, node, 2)
+	if st := node.Status(); st.LastIndex != 3 || st.CommitIndex != 2 {
+		t.Fatalf("matching snapshot: %+v", st)
+	}
+
+	// A snapshot from a newer term replaces the log and the cache
+	node.HandleInstallSnapshot(&InstallSnapshotRequest{
+		Term: 2, LeaderID: "n1", LastIncludedIndex: 5, LastIncludedTerm: 2, Done: true,
+		Data: []cache.SnapshotEntry{{Key: "x", Value: "snap", ExpiresAt: time.Now().Add(time.Hour)}},
+	})
+	waitForApplied(t, node, 5)
+	if st := node.Status(); st.SnapshotIndex != 5 || st.LastIndex != 5 {
+		t.Fatalf("conflicting snapshot: %+v", st)
+	}
+	if _, ok := node.Get("a"); ok {
+		t.Error("keys from before the snapshot were kept")
+	}
+	if v, ttl, _ := c.GetWithTTL("x"); v != "snap" || ttl < 59*time.Minute {
+		t.Errorf("x = %q with TTL %v after the snapshot", v, ttl)
+	}
+
+	// Entries the snapshot covers are skipped, the rest are appended
+	resp := node.HandleAppendEntries(&AppendEntriesRequest{
+		Term: 2, LeaderID: "n1", PrevLogIndex: 3, PrevLogTerm: 1,
+		Entries: []Entry{
+			{Index: 4, Term: 2, Type: EntryNoop},
+			{Index: 5, Term: 2, Type: EntryNoop},
+			{Index: 6, Term: 2, Type: EntryCommand, Command: Command{Op: OpSet, Key: "y", Value: "log"}},
+		},
+		LeaderCommit: 6,
+	})
+	if !resp.Success || resp.LastLogIndex != 6 {
+		t.Fatalf("append over the snapshot: %+v", resp)
+	}
+	waitForApplied(t, node, 6)
+	if v, _ := node.Get("y"); v != "log" {
+		t.Errorf("y = %q after the append", v)
+	}
+}
+
+func TestInstallSnapshotInChunks(t *testing.T) {
+	c := cache.New(0)
+	node, err := NewNode(c, Config{
+		ID:              "n0",
+		Peers:           []string{"n1"},
+		Transport:       NewInmemNetwork().Transport("n0"),
+		ElectionTimeout: time.Hour,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer node.Close()
+
+	chunk := func(offset int, key string, done bool) *InstallSnapshotResponse {
+		return node.HandleInstallSnapshot(&InstallSnapshotRequest{
+			Term: 1, LeaderID: "n1", LastIncludedIndex: 3, LastIncludedTerm: 1,
+			Offset: offset, Data: []cache.SnapshotEntry{{Key: key, Value: "snap"}}, Done: done,
+		})
+	}
+	if resp := chunk(0, "a", false); !resp.Success {
+		t.Fatalf("first chunk: %+v", resp)
+	}
+	if st := node.Status(); st.SnapshotIndex != 0 {
+		t.Fatalf("snapshot installed before its last chunk: %+v", st)
+	}
+	if resp := chunk(2, "c", true); resp.Success {
+		t.Error("a chunk after a gap was taken")
+	}
+	if resp := chunk(1, "b", true); !resp.Success {
+		t.Fatalf("last chunk: %+v", resp)
+	}
+	waitForApplied(t, node, 3)
+	for _, key := range []string{"a", "b"} {
+		if v, _ := node.Get(key); v != "snap" {
+			t.Errorf("%s = %q after the snapshot", key, v)
+		}
+	}
+	if _, ok := node.Get("c"); ok {
+		t.Error("the chunk after a gap was installed")
+	}
+}
+
+// slowTransport takes perByte to send each byte of a snapshot's keys and
+// values, and fails an InstallSnapshot that would take longer than timeout
+type slowTransport struct {
+	Transport
+	perByte, timeout time.Duration
+}
+
+func (t *slowTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	size := 0
+	for _, e := range req.Data {
+		size += len(e.Key) + len(e.Value)
+	}
+	delay := time.Duration(size) * t.perByte
+	if delay > t.timeout {
+		time.Sleep(t.timeout)
+		return nil, errors.New("timed out")
+	}
+	time.Sleep(delay)
+	return t.Transport.InstallSnapshot(peer, req)
+}
+
+func TestSnapshotLongerThanRPCTimeout(t *testing.T) {
+	c := newCluster(t, 3, snapshotEvery(20), func(cfg *Config) {
+		cfg.Transport = &slowTransport{Transport: cfg.Transport, perByte: 100 * time.Microsecond, timeout: 50 * time.Millisecond}
+		cfg.SnapshotChunkSize = 100
+	})
+	lagging := c.nodes[2]
+	c.network.Disconnect(lagging.cfg.ID)
+	leader := c.leader(c.nodes[:2]...)
+
+	// The snapshot takes over 200ms to send, a chunk about 10ms
+	value := strings.Repeat("v", 20)
+	for i := range 100 {
+		if err := leader.Set(fmt.Sprintf("k%02d", i), value, 0); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if st := leader.Status(); st.SnapshotIndex < 20 {
+		t.Fatalf("leader should have compacted its log, %+v", st)
+	}
+
+	c.network.Reconnect(lagging.cfg.ID)
+	c.waitFor("k99", value, c.caches[2])
+	c.waitFor("k00", value, c.caches[2])
+	if st := lagging.Status(); st.SnapshotIndex == 0 {
+		t.Errorf("lagging follower should have installed a snapshot, %+v", st)
+	}
+}
@@ -0,0 +1,117 @@
+package raft
+
+import (
+	"errors"
+	"log"
+	"net"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/gobrpc"
+)
+
+// DefaultRPCTimeout bounds a TCPTransport RPC, dial included
+const DefaultRPCTimeout = time.Second
+
+// TCPTransport carries RPCs over TCP, gob-encoded, with peers named by
+// their host:port. It keeps one connection per peer and sends one RPC at a
+// time on it.
+type TCPTransport struct {
+	client *gobrpc.Client[rpcRequest, rpcResponse]
+	server *gobrpc.Server[rpcRequest, rpcResponse]
+}
+
+// rpcRequest and rpcResponse wrap every RPC; exactly one field is set
+type rpcRequest struct {
+	RequestVote     *RequestVoteRequest
+	AppendEntries   *AppendEntriesRequest
+	InstallSnapshot *InstallSnapshotRequest
+}
+
+type rpcResponse struct {
+	RequestVote     *RequestVoteResponse
+	AppendEntries   *AppendEntriesResponse
+	InstallSnapshot *InstallSnapshotResponse
+}
+
+// NewTCPTransport creates a transport whose RPCs time out after timeout,
+// or DefaultRPCTimeout if it is zero
+func NewTCPTransport(timeout time.Duration) *TCPTransport {
+	if timeout <= 0 {
+		timeout = DefaultRPCTimeout
+	}
+	return &TCPTransport{
+		client: gobrpc.NewClient[rpcRequest, rpcResponse](timeout),
+		server: gobrpc.NewServer[rpcRequest, rpcResponse]("Raft"),
+	}
+}
+
+func (t *TCPTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	resp, err := t.call(peer, &rpcRequest{RequestVote: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.RequestVote == nil {
+		return nil, errors.New("raft: peer answered RequestVote with another RPC")
+	}
+	return resp.RequestVote, nil
+}
+
+func (t *TCPTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	resp, err := t.call(peer, &rpcRequest{AppendEntries: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.AppendEntries == nil {
+		return nil, errors.New("raft: peer answered AppendEntries with another RPC")
+	}
+	return resp.AppendEntries, nil
+}
+
+func (t *TCPTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	resp, err := t.call(peer, &rpcRequest{InstallSnapshot: req})
+	if err != nil {
+		return nil, err
+	}
+	if resp.InstallSnapshot == nil {
+		return nil, errors.New("raft: peer answered InstallSnapshot with another RPC")
+	}
+	return resp.InstallSnapshot, nil
+}
+
+func (t *TCPTransport) call(peer string, req *rpcRequest) (*rpcResponse, error) {
+	resp, err := t.client.Call(peer, req)
+	if errors.Is(err, gobrpc.ErrClosed) {
+		err = ErrClosed
+	}
+	return resp, err
+}
+
+// Listen answers RPCs from peers on addr with h until Close is called
+func (t *TCPTransport) Listen(addr string, h Handler) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	log.Printf("Raft transport listening on %s", addr)
+	return t.server.Serve(listener, func(req *rpcRequest) *rpcResponse {
+		var resp rpcResponse
+		switch {
+		case req.RequestVote != nil:
+			resp.RequestVote = h.HandleRequestVote(req.RequestVote)
+		case req.AppendEntries != nil:
+			resp.AppendEntries = h.HandleAppendEntries(req.AppendEntries)
+		case req.InstallSnapshot != nil:
+			resp.InstallSnapshot = h.HandleInstallSnapshot(req.InstallSnapshot)
+		default:
+			log.Printf("Empty Raft request")
+			return nil
+		}
+		return &resp
+	})
+}
+
+// Close stops listening and closes the connections to and from peers
+func (t *TCPTransport) Close() error {
+	t.client.Close()
+	return t.server.Close()
+}
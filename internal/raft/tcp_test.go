@@ -0,0 +1,57 @@
+package raft
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+func TestTCPTransport(t *testing.T) {
+	addrs := []string{"127.0.0.1:18200", "127.0.0.1:18201", "127.0.0.1:18202"}
+	c := &cluster{t: t}
+	start := func(i int) {
+		var peers []string
+		for j, peer := range addrs {
+			if j != i {
+				peers = append(peers, peer)
+			}
+		}
+		transport := NewTCPTransport(100 * time.Millisecond)
+		t.Cleanup(func() { transport.Close() })
+		ch := cache.New(0)
+		t.Cleanup(ch.Close)
+		node, err := NewNode(ch, Config{
+			ID:                addrs[i],
+			Peers:             peers,
+			ClientAddr:        fmt.Sprintf("client-%d", i),
+			Transport:         transport,
+			ElectionTimeout:   100 * time.Millisecond,
+			HeartbeatInterval: 20 * time.Millisecond,
+			SnapshotThreshold: 10,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { node.Close() })
+		go transport.Listen(addrs[i], node)
+		c.nodes = append(c.nodes, node)
+		c.caches = append(c.caches, ch)
+	}
+
+	// Two nodes are a majority of three
+	start(0)
+	start(1)
+	leader := c.leader()
+	for i := range 30 {
+		if err := leader.Set(fmt.Sprintf("k%d", i), "v", time.Minute); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The third node joins late, and catches up from a snapshot
+	start(2)
+	c.waitFor("k29", "v")
+	c.waitFor("k0", "v")
+}
@@ -0,0 +1,171 @@
+package raft
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+// RequestVoteRequest is sent by candidates to gather votes
+type RequestVoteRequest struct {
+	Term         uint64
+	CandidateID  string
+	LastLogIndex uint64
+	LastLogTerm  uint64
+}
+
+type RequestVoteResponse struct {
+	Term        uint64
+	VoteGranted bool
+}
+
+// AppendEntriesRequest is sent by the leader to replicate entries, and
+// with no entries as a heartbeat
+type AppendEntriesRequest struct {
+	Term         uint64
+	LeaderID     string
+	LeaderAddr   string // client address of the leader, for redirects
+	PrevLogIndex uint64
+	PrevLogTerm  uint64
+	Entries      []Entry
+	LeaderCommit uint64
+}
+
+type AppendEntriesResponse struct {
+	Term    uint64
+	Success bool
+	// On failure, the last index the follower may share with the leader,
+	// so the leader can skip back to it instead of one entry at a time
+	LastLogIndex uint64
+}
+
+// InstallSnapshotRequest is sent by the leader to a follower that needs
+// entries the leader has compacted away. The snapshot is sent in chunks, in
+// order, so that each RPC stays small however large the snapshot.
+type InstallSnapshotRequest struct {
+	Term              uint64
+	LeaderID          string
+	LeaderAddr        string
+	LastIncludedIndex uint64
+	LastIncludedTerm  uint64
+	Offset            int // of the chunk's first entry in the snapshot
+	Data              []cache.SnapshotEntry
+	Done              bool // the chunk is the last one
+}
+
+type InstallSnapshotResponse struct {
+	Term uint64
+	// Success is false if the chunk doesn't follow the ones received
+	// before, and the leader must start over from offset 0
+	Success bool
+}
+
+// Transport carries RPCs from a node to its peers, named by their IDs
+type Transport interface {
+	RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error)
+	AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error)
+	InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error)
+}
+
+// Handler answers the RPCs a transport receives. *Node is a Handler.
+type Handler interface {
+	HandleRequestVote(req *RequestVoteRequest) *RequestVoteResponse
+	HandleAppendEntries(req *AppendEntriesRequest) *AppendEntriesResponse
+	HandleInstallSnapshot(req *InstallSnapshotRequest) *InstallSnapshotResponse
+}
+
+// ErrUnreachable is returned by an InmemNetwork transport for a peer that
+// is not registered or is disconnected
+var ErrUnreachable = errors.New("raft: peer unreachable")
+
+// InmemNetwork connects nodes in the same process, for tests. RPCs are
+// plain function calls on the receiving node. Nodes can be disconnected to
+// simulate crashes and partitions.
+type InmemNetwork struct {
+	mu           sync.RWMutex
+	nodes        map[string]Handler
+	disconnected map[string]bool
+}
+
+func NewInmemNetwork() *InmemNetwork {
+	return &InmemNetwork{
+		nodes:        make(map[string]Handler),
+		disconnected: make(map[string]bool),
+	}
+}
+
+// Register makes h reachable as id
+func (nw *InmemNetwork) Register(id string, h Handler) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.nodes[id] = h
+}
+
+// Transport returns the transport the node id sends its RPCs through
+func (nw *InmemNetwork) Transport(id string) Transport {
+	return &inmemTransport{network: nw, from: id}
+}
+
+// Disconnect cuts id off from every other node, both ways
+func (nw *InmemNetwork) Disconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	nw.disconnected[id] = true
+}
+
+// Reconnect undoes Disconnect
+func (nw *InmemNetwork) Reconnect(id string) {
+	nw.mu.Lock()
+	defer nw.mu.Unlock()
+	delete(nw.disconnected, id)
+}
+
+// peer returns the handler for an RPC from one node to another, or nil if
+// the two can't reach each other
+func (nw *InmemNetwork) peer(from, to string) Handler {
+	nw.mu.RLock()
+	defer nw.mu.RUnlock()
+	if nw.disconnected[from] || nw.disconnected[to] {
+		return nil
+	}
+	return nw.nodes[to]
+}
+
+type inmemTransport struct {
+	network *InmemNetwork
+	from    string
+}
+
+func (t *inmemTransport) RequestVote(peer string, req *RequestVoteRequest) (*RequestVoteResponse, error) {
+	h := t.network.peer(t.from, peer)
+	if h == nil {
+		return nil, ErrUnreachable
+	}
+	return h.HandleRequestVote(req), nil
+}
+
+func (t *inmemTransport) AppendEntries(peer string, req *AppendEntriesRequest) (*AppendEntriesResponse, error) {
+	h := t.network.peer(t.from, peer)
+	if h == nil {
+		return nil, ErrUnreachable
+	}
+	resp := h.HandleAppendEntries(req)
+	// A node cut off while the call was in flight loses the reply
+	if t.network.peer(t.from, peer) == nil {
+		return nil, ErrUnreachable
+	}
+	return resp, nil
+}
+
+func (t *inmemTransport) InstallSnapshot(peer string, req *InstallSnapshotRequest) (*InstallSnapshotResponse, error) {
+	h := t.network.peer(t.from, peer)
+	if h == nil {
+		return nil, ErrUnreachable
+	}
+	resp := h.HandleInstallSnapshot(req)
+	if t.network.peer(t.from, peer) == nil {
+		return nil, ErrUnreachable
+	}
+	return resp, nil
+}
@@ -0,0 +1,58 @@
+package replication
+
+// DefaultBacklogSize is how many recent writes the master keeps for partial
+// resynchronisation
+const DefaultBacklogSize = 10000
+
+// backlog is a fixed-size ring of the most recent writes. A reconnecting
+// replica whose offset still falls inside the ring only needs the writes
+// after it instead of a full copy of the keyspace.
+//
+// Offsets of consecutive writes are consecutive, so the position of any
+// offset in the ring can be computed from the oldest one.
+type backlog struct {
+	ops   []*Operation
+	start int // index of the oldest write
+	count int
+}
+
+func newBacklog(size int) *backlog {
+	if size <= 0 {
+		panic("replication: backlog size must be positive")
+	}
+	return &backlog{ops: make([]*Operation, size)}
+}
+
+// add appends a write, overwriting the oldest one once the ring is full
+func (b *backlog) add(op *Operation) {
+	if b.count < len(b.ops) {
+		b.ops[(b.start+b.count)%len(b.ops)] = op
+		b.count++
+		return
+	}
+	b.ops[b.start] = op
+	b.start = (b.start + 1) % len(b.ops)
+}
+
+// since returns the writes after offset, in order. ok is false when the
+// backlog cannot serve that offset: it is older than the oldest write kept,
+// or newer than the latest one. current is the master's latest offset and is
+// only needed to tell "up to date" apart from "unknown" when the ring is empty.
+func (b *backlog) since(offset, current int64) (ops []*Operation, ok bool) {
+	if offset == current {
+		return nil, true
+	}
+	if b.count == 0 || offset > current {
+		return nil, false
+	}
+	oldest := b.ops[b.start].Offset
+	if offset < oldest-1 {
+		return nil, false
+	}
+	skip := int(offset - (oldest - 1))
+	ops = make([]*Operation, 0, b.count-skip)
+	for i := skip; i < b.count; i++ {
+		ops = append(ops, b.ops[(b.start+i)%len(b.ops)])
+	}
+	return ops, true
+}
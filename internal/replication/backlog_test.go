@@ -0,0 +1,83 @@
+package replication
+
+import "testing"
+
+func fillBacklog(b *backlog, from, to int64) {
+	for off := from; off <= to; off++ {
+		b.add(&Operation{Type: OpSet, Offset: off})
+	}
+}
+
+func offsetsOf(ops []*Operation) []int64 {
+	offsets := make([]int64, len(ops))
+	for i, op := range ops {
+		offsets[i] = op.Offset
+	}
+	return offsets
+}
+
+func TestBacklogSince(t *testing.T) {
+	b := newBacklog(5)
+	fillBacklog(b, 1, 3)
+
+	tests := []struct {
+		name   string
+		offset int64
+		want   []int64
+		ok     bool
+	}{
+		{"from the start", 0, []int64{1, 2, 3}, true},
+		{"from the middle", 1, []int64{2, 3}, true},
+		{"up to date", 3, nil, true},
+		{"ahead of master", 4, nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ops, ok := b.since(tt.offset, 3)
+			if ok != tt.ok {
+				t.Fatalf("ok: got %v, want %v", ok, tt.ok)
+			}
+			got := offsetsOf(ops)
+			if len(got) != len(tt.want) {
+				t.Fatalf("got offsets %v, want %v", got, tt.want)
+			}
+			for i := range got {
+				if got[i] != tt.want[i] {
+					t.Errorf("got offsets %v, want %v", got, tt.want)
+					break
+				}
+			}
+		})
+	}
+}
+
+func TestBacklogWrapsAround(t *testing.T) {
+	b := newBacklog(3)
+	fillBacklog(b, 1, 7) // only 5, 6, 7 are kept
+
+	if _, ok := b.since(3, 7); ok {
+		t.Error("offset 3 has left the backlog, expected a miss")
+	}
+	ops, ok := b.since(4, 7)
+	if !ok {
+		t.Fatal("offset 4 is just before the oldest write, expected a hit")
+	}
+	if got := offsetsOf(ops); len(got) != 3 || got[0] != 5 || got[2] != 7 {
+		t.Errorf("expected offsets [5 6 7], got %v", got)
+	}
+	ops, ok = b.since(6, 7)
+	if !ok || len(ops) != 1 || ops[0].Offset != 7 {
+		t.Errorf("expected only offset 7, got %v (ok=%v)", offsetsOf(ops), ok)
+	}
+}
+
+func TestBacklogEmpty(t *testing.T) {
+	b := newBacklog(3)
+	if _, ok := b.since(0, 0); !ok {
+		t.Error("an up to date replica should be served by an empty backlog")
+	}
+	// A master that restarted its history has writes we never recorded
+	if _, ok := b.since(0, 10); ok {
+		t.Error("an empty backlog cannot serve missing writes")
+	}
+}
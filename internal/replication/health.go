@@ -44,4 +44,10 @@ func(h *HealthMonitor) RecordFailure() {
 	h.mu.Lock()
 	defer h.mu.Unlock()
 	h.missedHeartbeats++
-}
\ No newline at end of file
+}
+
+func(h *HealthMonitor) MissedHeartbeats() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.missedHeartbeats
+}
@@ -170,13 +170,13 @@ func TestHealthMonitor_ConcurrentAccess(t *testing.T) {
 //    WHY HARD: Would need to mock time or wait real seconds
 //    ALTERNATIVE: Integration test (TestMasterSlaveReplication)
 //
-// 2. ListenForPongs() - Blocks on bufio.Scanner
+// 2. listenForReplies() - Blocks reading frames from the connection
 //    WHY HARD: Needs real TCP connection or mock net.Conn
-//    ALTERNATIVE: Integration test
+//    ALTERNATIVE: Integration test (TestReplicationOffsetsAndAcks)
 //
-// 3. broadcast() - Spawns goroutines per slave
+// 3. propagate()/writeLoop() - One queue and writer goroutine per slave
 //    WHY HARD: Need to verify async behavior
-//    ALTERNATIVE: Integration test (TestMultipleSlaves)
+//    ALTERNATIVE: Integration test (TestMultipleSlaves, TestReplicationPreservesOrder)
 //
 // 4. Actual PING/PONG over network
 //    WHY HARD: Timing, network, multiple goroutines
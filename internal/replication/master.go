@@ -2,109 +2,581 @@ package replication
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"io"
 	"log"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kartikey-singh/redis/internal/cache"
 )
 
+// ErrNoReplicas is returned by writes while min-replicas-to-write is not
+// met. Its text is the Redis error reply, code included.
+var ErrNoReplicas = errors.New("NOREPLICAS Not enough good replicas to write.")
+
+const (
+	// handshakeTimeout bounds how long either side waits for the version handshake
+	handshakeTimeout = 5 * time.Second
+	// pingInterval is how often the master PINGs each slave
+	pingInterval = 5 * time.Second
+	// maxMissedPings is how many PINGs in a row either side of a link may
+	// miss before it gives the other up
+	maxMissedPings = 3
+)
+
 type Master struct {
-	cache  *cache.Cache
-	slaves []*SlaveConnection
-	mu     sync.RWMutex
+	cache    *cache.Cache
+	slaves   []*SlaveConnection
+	listener net.Listener
+	closed   bool
+	limits   OutputBufferLimits // applied to each slave as it registers
+	mu       sync.RWMutex       // guards slaves, listener, closed and limits
+	done     chan struct{}      // closed by Close
+
+	// The stream is built from the cache's change hook, which runs under
+	// the cache lock, so offsets follow the order changes hit the cache.
+	// That includes keys the cache expires or evicts by itself.
+	streamMu sync.Mutex
+	offset   atomic.Int64 // offset of the last write, only advanced under streamMu
+	backlog  *backlog     // recent writes for partial resync, guarded by streamMu
+
+	// writeMu makes the min-replicas check and the write it guards atomic.
+	// Writes are refused unless minReplicas healthy replicas have ACKed
+	// within maxLag; 0 disables the check. Both are guarded by writeMu.
+	writeMu     sync.Mutex
+	minReplicas int
+	maxLag      time.Duration
+
+	// replID names this master's history; offsets are only comparable
+	// between nodes that share it. A promoted replica also accepts PSYNCs
+	// for its old master's history, replID2, up to the offset it was
+	// promoted at. Only a relay changes them, under streamMu.
+	replID        string
+	replID2       string
+	replID2Offset int64
+
+	// A relay serves a replica's own replicas, see relay.go. It forwards
+	// the upstream stream under applyMu, which fullSync also takes so a
+	// snapshot never splits applying a write from forwarding it.
+	relay   bool
+	applyMu sync.Mutex
+
+	syncFull       atomic.Int64
+	syncPartialOK  atomic.Int64
+	syncPartialErr atomic.Int64
+	// replicas disconnected for going over their output buffer limits
+	outputBufferDisconnects atomic.Int64
+
+	// ackNotify is closed and replaced whenever a replica acknowledges,
+	// waking WaitForReplicas callers
+	ackMu     sync.Mutex
+	ackNotify chan struct{}
+}
+
+// SyncStats counts how replicas were brought up to date
+type SyncStats struct {
+	Full       int64 // full resyncs served
+	PartialOK  int64 // PSYNCs served from the backlog
+	PartialErr int64 // PSYNCs that had to fall back to a full resync
 }
 
 type SlaveConnection struct {
 	conn          net.Conn
+	reader        *bufio.Reader
 	writer        *bufio.Writer
-	mu            sync.RWMutex
+	version       uint16 // negotiated stream protocol version
+	listeningPort int    // client port the slave announced, 0 if none
 	health        *HealthMonitor
 	pongReceived  chan int64
-	stopHeartbeat chan struct{}
+	stopHeartbeat chan struct{} // closed when the slave is removed
 	closeOnce     sync.Once
+
+	// Ordered send queue, drained by a single writeLoop goroutine so
+	// operations reach the slave in offset order. queued counts the bytes
+	// in the queue and in the batch being written; it is bounded by limits.
+	queueMu    sync.Mutex
+	queue      []*Operation
+	queueReady chan struct{}
+	queued     int64
+	overSoft   time.Time // when queued went above limits.Soft, zero if below
+	limits     OutputBufferLimits
+	overLimit  bool // the slave broke its limits and is being dropped
+
+	ackOffset atomic.Int64 // last offset the slave acknowledged
+	lastAck   atomic.Int64 // unix milliseconds of the last ACK
 }
 
+// ReplicaStatus is a point-in-time view of one connected replica
+type ReplicaStatus struct {
+	Addr      string
+	AckOffset int64
+	Lag       int64 // operations the replica has not acknowledged yet
+	LastAck   time.Time
+	Healthy   bool
+	// MissedHeartbeats counts PINGs in a row the replica did not answer
+	MissedHeartbeats int
+	// OutputBuffer is the bytes of stream queued for the replica
+	OutputBuffer int64
+	// ListeningPort is the client port the replica announced, 0 if none
+	ListeningPort int
+}
+
+// NewMaster makes c the source of a replication stream. The master is the
+// only authority on expiry: keys the cache expires or evicts are sent to
+// replicas as DELETEs.
 func NewMaster(c *cache.Cache) *Master {
+	m := newMaster(c, newReplicationID())
+	c.SetReplicaMode(false)
+	c.SetHook(m.onCacheEvent)
+	return m
+}
+
+// NewMasterFrom creates a master for a replica being promoted. It starts a
+// new history at the replica's offset, so replicas of the old master that
+// have not gone past that offset can continue with a partial resync.
+func NewMasterFrom(c *cache.Cache, replID string, offset int64) *Master {
+	m := NewMaster(c)
+	m.offset.Store(offset)
+	m.replID2 = replID
+	m.replID2Offset = offset
+	return m
+}
+
+func newMaster(c *cache.Cache, replID string) *Master {
 	return &Master{
-		cache:  c,
-		slaves: make([]*SlaveConnection, 0),
+		cache:     c,
+		slaves:    make([]*SlaveConnection, 0),
+		backlog:   newBacklog(DefaultBacklogSize),
+		replID:    replID,
+		limits:    DefaultOutputBufferLimits,
+		done:      make(chan struct{}),
+		ackNotify: make(chan struct{}),
 	}
 }
 
+// newReplicationID returns a random 40 character hex ID, like Redis' run IDs
+func newReplicationID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic("replication: cannot generate replication ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
 // Cache functions
 // Set wraps cache.SetWithTTL and broadcasts to slaves
 func (m *Master) Set(key, value string, ttl time.Duration) error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.checkMinReplicas(); err != nil {
+		return err
+	}
 	m.cache.SetWithTTL(key, value, ttl)
-	m.broadcast(&Operation{
-		Type:      OpSet,
-		Key:       key,
-		Value:     value,
-		TTL:       ttl,
-		Timestamp: time.Now().Unix(),
-	})
 	return nil
 }
 
-// Delete wraps cache.Delete and broadcasts to slaves
-func (m *Master) Delete(key string) error {
-	m.cache.Delete(key)
-	m.broadcast(&Operation{
-		Type:      OpDelete,
-		Key:       key,
-		Timestamp: time.Now().Unix(),
-	})
-	return nil
+// Delete wraps cache.Delete and broadcasts to slaves.
+// It reports whether the key existed on the master; only then is anything
+// sent.
+func (m *Master) Delete(key string) (bool, error) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.checkMinReplicas(); err != nil {
+		return false, err
+	}
+	return m.cache.Delete(key), nil
 }
 
 // Flush wraps cache.Flush and broadcasts to slaves
 func (m *Master) Flush() error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	if err := m.checkMinReplicas(); err != nil {
+		return err
+	}
 	m.cache.Flush()
-	m.broadcast(&Operation{
-		Type:      OpFlush,
-		Timestamp: time.Now().Unix(),
-	})
 	return nil
 }
 
+// SetMinReplicas makes the master refuse writes with ErrNoReplicas unless at
+// least n replicas are healthy and have acknowledged within maxLag, like
+// Redis' min-replicas-to-write and min-replicas-max-lag. n = 0 turns the
+// check off.
+func (m *Master) SetMinReplicas(n int, maxLag time.Duration) {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	m.minReplicas = n
+	m.maxLag = maxLag
+}
+
+// GoodReplicas counts the replicas that pass the min-replicas check: healthy
+// and acknowledged within maxLag. With the check off it counts healthy ones.
+func (m *Master) GoodReplicas() int {
+	m.writeMu.Lock()
+	maxLag := m.maxLag
+	m.writeMu.Unlock()
+	return m.goodReplicas(maxLag)
+}
+
+func (m *Master) goodReplicas(maxLag time.Duration) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	good := 0
+	for _, s := range m.slaves {
+		if !s.health.IsHealthy() {
+			continue
+		}
+		if maxLag > 0 && time.Since(time.UnixMilli(s.lastAck.Load())) > maxLag {
+			continue
+		}
+		good++
+	}
+	return good
+}
+
+// CanWrite returns ErrNoReplicas if writes would be refused right now, for
+// callers that must know before doing something they can't take back
+func (m *Master) CanWrite() error {
+	m.writeMu.Lock()
+	defer m.writeMu.Unlock()
+	return m.checkMinReplicas()
+}
+
+// checkMinReplicas is called by every write. Callers must hold writeMu.
+func (m *Master) checkMinReplicas() error {
+	if m.minReplicas > 0 && m.goodReplicas(m.maxLag) < m.minReplicas {
+		return ErrNoReplicas
+	}
+	return nil
+}
+
+// SetOutputBufferLimits changes the output buffer limits of connected and
+// future replicas. A replica already past the new limits is dropped on its
+// next write.
+func (m *Master) SetOutputBufferLimits(limits OutputBufferLimits) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.limits = limits
+	for _, s := range m.slaves {
+		s.queueMu.Lock()
+		s.limits = limits
+		s.queueMu.Unlock()
+	}
+}
+
+// OutputBufferDisconnects counts the replicas dropped for going over their
+// output buffer limits
+func (m *Master) OutputBufferDisconnects() int64 {
+	return m.outputBufferDisconnects.Load()
+}
+
 // Get reads from cache (no replication needed for reads)
 func (m *Master) Get(key string) (string, bool) {
 	return m.cache.Get(key)
 }
 
-// broadcast sends operation to all connected slaves
-func (m *Master) broadcast(op *Operation) {
+// Offset returns the replication offset of the last write
+func (m *Master) Offset() int64 {
+	return m.offset.Load()
+}
+
+// ReplID returns the replication ID of this master's history
+func (m *Master) ReplID() string {
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	return m.replID
+}
+
+// SecondaryReplID returns the history a promoted master still accepts
+// PSYNCs for and the last offset it is valid up to, or "" and -1
+func (m *Master) SecondaryReplID() (string, int64) {
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	if m.replID2 == "" {
+		return "", -1
+	}
+	return m.replID2, m.replID2Offset
+}
+
+// SyncStats reports how many full and partial resyncs have been served
+func (m *Master) SyncStats() SyncStats {
+	return SyncStats{
+		Full:       m.syncFull.Load(),
+		PartialOK:  m.syncPartialOK.Load(),
+		PartialErr: m.syncPartialErr.Load(),
+	}
+}
+
+// Replicas reports the connected replicas and how far behind each one is
+func (m *Master) Replicas() []ReplicaStatus {
 	m.mu.RLock()
 	slaves := make([]*SlaveConnection, len(m.slaves))
 	copy(slaves, m.slaves)
 	m.mu.RUnlock()
 
-	for _, slave := range slaves {
-		go func(s *SlaveConnection) {
-			if err := s.Send(op); err != nil {
-				//m.removeSlave(s)
-				log.Printf("Failed to send operation to slave: %s", s.conn.RemoteAddr())
+	offset := m.Offset()
+	statuses := make([]ReplicaStatus, 0, len(slaves))
+	for _, s := range slaves {
+		ack := s.ackOffset.Load()
+		status := ReplicaStatus{
+			Addr:      s.conn.RemoteAddr().String(),
+			AckOffset: ack,
+			Lag:       max(offset-ack, 0),
+			Healthy:   s.health.IsHealthy(),
+
+			MissedHeartbeats: s.health.MissedHeartbeats(),
+			ListeningPort:    s.listeningPort,
+		}
+		s.queueMu.Lock()
+		status.OutputBuffer = s.queued
+		s.queueMu.Unlock()
+		if ms := s.lastAck.Load(); ms > 0 {
+			status.LastAck = time.UnixMilli(ms)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// WaitForReplicas blocks until at least n replicas have acknowledged offset
+// or the timeout expires, and returns how many have. A zero timeout waits
+// forever, like Redis' WAIT.
+func (m *Master) WaitForReplicas(offset int64, n int, timeout time.Duration) int {
+	if count := m.ackedReplicas(offset); count >= n {
+		return count
+	}
+	m.requestAcks()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		// Take the channel before counting so an ACK in between still
+		// wakes us up
+		m.ackMu.Lock()
+		notify := m.ackNotify
+		m.ackMu.Unlock()
+		if count := m.ackedReplicas(offset); count >= n {
+			return count
+		}
+		select {
+		case <-notify:
+		case <-expired:
+			return m.ackedReplicas(offset)
+		case <-m.done:
+			return m.ackedReplicas(offset)
+		}
+	}
+}
+
+// ackedReplicas counts the replicas that have acknowledged offset
+func (m *Master) ackedReplicas(offset int64) int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	count := 0
+	for _, s := range m.slaves {
+		if s.ackOffset.Load() >= offset {
+			count++
+		}
+	}
+	return count
+}
+
+// requestAcks asks every replica to acknowledge now rather than at its next
+// ACK tick
+func (m *Master) requestAcks() {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, s := range m.slaves {
+		m.send(s, &Operation{Type: OpGetAck, Timestamp: time.Now().UnixMilli()})
+	}
+}
+
+// notifyAcks wakes everyone blocked in WaitForReplicas
+func (m *Master) notifyAcks() {
+	m.ackMu.Lock()
+	close(m.ackNotify)
+	m.ackNotify = make(chan struct{})
+	m.ackMu.Unlock()
+}
+
+// onCacheEvent turns a change to the cache into a write on the stream. It
+// runs under the cache lock.
+func (m *Master) onCacheEvent(ev cache.Event) {
+	op := &Operation{Timestamp: time.Now().UnixMilli()}
+	switch ev.Type {
+	case cache.EventSet:
+		op.Type, op.Key, op.Value, op.ExpireAt = OpSet, ev.Key, ev.Value, expireAtMillis(ev.ExpiresAt)
+	case cache.EventDelete, cache.EventExpire, cache.EventEvict:
+		op.Type, op.Key = OpDelete, ev.Key
+	case cache.EventFlush:
+		op.Type = OpFlush
+	default:
+		return
+	}
+	m.propagate(op)
+}
+
+// expireAtMillis converts a cache deadline to the stream's unix milliseconds
+func expireAtMillis(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// propagate assigns the next offset to a write, records it in the backlog
+// and queues it for every slave. Callers must hold the cache lock, which
+// orders writes, see onCacheEvent.
+func (m *Master) propagate(op *Operation) {
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	op.Offset = m.offset.Add(1)
+	m.broadcast(op)
+}
+
+// broadcast records a write that has its offset in the backlog and queues it
+// for every slave. Callers must hold streamMu.
+func (m *Master) broadcast(op *Operation) {
+	m.backlog.add(op)
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	for _, slave := range m.slaves {
+		m.send(slave, op)
+	}
+}
+
+// send is Send, counting the slaves it drops for their output buffer
+func (m *Master) send(s *SlaveConnection, op *Operation) error {
+	err := s.Send(op)
+	if errors.Is(err, ErrOutputBufferLimit) {
+		m.outputBufferDisconnects.Add(1)
+	}
+	return err
+}
+
+// Send queues an operation for this slave. Operations are written in the
+// order they were queued; write errors are handled by the slave's writeLoop.
+// Send never blocks: a slave whose queue grows past its output buffer limits
+// is disconnected instead, and ErrOutputBufferLimit returned.
+func (s *SlaveConnection) Send(op *Operation) error {
+	select {
+	case <-s.stopHeartbeat:
+		return net.ErrClosed
+	default:
+	}
+	s.queueMu.Lock()
+	if s.overLimit {
+		s.queueMu.Unlock()
+		return net.ErrClosed
+	}
+	s.queue = append(s.queue, op)
+	s.queued += frameLen(op)
+	now := time.Now()
+	if s.limits.Soft > 0 && s.queued > s.limits.Soft && s.overSoft.IsZero() {
+		s.overSoft = now
+	}
+	if reason := s.limits.exceeded(s.queued, s.overSoft, now); reason != "" {
+		// Callers may hold the master's locks, so only close the
+		// connection here; the slave's goroutines see it fail and remove it
+		s.overLimit = true
+		s.queue = nil
+		s.queueMu.Unlock()
+		log.Printf("Disconnecting slave %s: output buffer at %s", s.conn.RemoteAddr(), reason)
+		s.conn.Close()
+		return ErrOutputBufferLimit
+	}
+	s.queueMu.Unlock()
+
+	select {
+	case s.queueReady <- struct{}{}:
+	default: // writeLoop already has a wake-up pending
+	}
+	return nil
+}
+
+// writeLoop drains the slave's send queue onto the connection, flushing once
+// per batch
+func (m *Master) writeLoop(s *SlaveConnection) {
+	for {
+		select {
+		case <-s.stopHeartbeat:
+			return
+		case <-s.queueReady:
+		}
+
+		s.queueMu.Lock()
+		batch := s.queue
+		s.queue = nil
+		s.queueMu.Unlock()
+
+		var written int64
+		for _, op := range batch {
+			if err := WriteOperation(s.writer, op); err != nil {
+				log.Printf("Failed to send operation to slave %s: %v", s.conn.RemoteAddr(), err)
+				m.removeSlave(s)
+				return
 			}
-		}(slave)
+			written += frameLen(op)
+		}
+		if err := s.writer.Flush(); err != nil {
+			log.Printf("Failed to send operation to slave %s: %v", s.conn.RemoteAddr(), err)
+			m.removeSlave(s)
+			return
+		}
+
+		s.queueMu.Lock()
+		s.queued -= written
+		if s.queued <= s.limits.Soft {
+			s.overSoft = time.Time{}
+		}
+		s.queueMu.Unlock()
 	}
 }
 
-// Goroutine 1: Listen for PONGs
-func (s *SlaveConnection) ListenForPongs() {
-	scanner := bufio.NewScanner(s.conn)
-	for scanner.Scan() {
-		op, err := ParseOperation(scanner.Text())
-		if err == nil && op.Type == OpPong {
+// listenForReplies reads PONGs and ACKs sent back by the slave
+func (m *Master) listenForReplies(s *SlaveConnection) {
+	defer close(s.pongReceived)
+	for {
+		op, err := ReadOperation(s.reader)
+		if err != nil {
+			if err != io.EOF {
+				log.Printf("Replication stream error from slave %s: %v", s.conn.RemoteAddr(), err)
+			}
+			m.removeSlave(s)
+			return
+		}
+		switch op.Type {
+		case OpPong:
 			select {
 			case s.pongReceived <- op.Timestamp:
 				// Successfully sent
 			default:
 				// Receiver not ready, drop this late pong
 			}
+		case OpAck:
+			// ACKs can arrive out of order relative to each other only if the
+			// slave misbehaves; never move the acknowledged offset backwards
+			for {
+				cur := s.ackOffset.Load()
+				if op.Offset <= cur || s.ackOffset.CompareAndSwap(cur, op.Offset) {
+					break
+				}
+			}
+			s.lastAck.Store(time.Now().UnixMilli())
+			m.notifyAcks()
 		}
 	}
-	close(s.pongReceived)
 }
 
 // Heartbeat functions
@@ -117,9 +589,9 @@ func (m *Master) StartHeartbeatForSlave(s *SlaveConnection, pingInterval time.Du
 		case <-s.stopHeartbeat:
 			return
 		case <-ticker.C:
-			timestamp := time.Now().Unix()
+			timestamp := time.Now().UnixMilli()
 			op := &Operation{Type: OpPing, Timestamp: timestamp}
-			if err := s.Send(op); err != nil {
+			if err := m.send(s, op); err != nil {
 				log.Printf("Heartbeat failed for slave: %s", s.conn.RemoteAddr())
 				s.health.RecordFailure()
 				if !s.health.IsHealthy() {
@@ -156,16 +628,28 @@ func (m *Master) StartHeartbeatForSlave(s *SlaveConnection, pingInterval time.Du
 	}
 }
 
-// ListenForSlaves accepts slave connections on the given port
+// ListenForSlaves accepts slave connections on the given port until Close
+// is called
 func (m *Master) ListenForSlaves(port string) error {
 	listener, err := net.Listen("tcp", port)
 	if err != nil {
 		return err
 	}
+	m.mu.Lock()
+	if m.closed {
+		m.mu.Unlock()
+		listener.Close()
+		return net.ErrClosed
+	}
+	m.listener = listener
+	m.mu.Unlock()
 	defer listener.Close()
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Printf("Accept error: %v", err)
 			continue
 		}
@@ -174,50 +658,185 @@ func (m *Master) ListenForSlaves(port string) error {
 	}
 }
 
+// Close stops accepting slaves and disconnects the connected ones
+func (m *Master) Close() error {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.done)
+	}
+	listener := m.listener
+	slaves := make([]*SlaveConnection, len(m.slaves))
+	copy(slaves, m.slaves)
+	m.mu.Unlock()
+
+	if !m.relay {
+		m.cache.SetHook(nil)
+	}
+	for _, slave := range slaves {
+		m.removeSlave(slave)
+	}
+	if listener != nil {
+		return listener.Close()
+	}
+	return nil
+}
+
 // addSlave adds a new slave connection
 func (m *Master) addSlave(conn net.Conn) {
 	slave := &SlaveConnection{
 		conn:          conn,
+		reader:        bufio.NewReader(conn),
 		writer:        bufio.NewWriter(conn),
-		health:        NewHealthMonitor(5*time.Second, 3),
+		health:        NewHealthMonitor(pingInterval, maxMissedPings),
 		pongReceived:  make(chan int64),
 		stopHeartbeat: make(chan struct{}),
+		queueReady:    make(chan struct{}, 1),
 	}
 
-	// Send all existing data first
-	m.mu.RLock()
-	keys := m.cache.Keys()
-	m.mu.RUnlock()
+	// Agree on a stream version before sending anything else
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	version, err := masterHandshake(bufio.NewReadWriter(slave.reader, slave.writer))
+	if err != nil {
+		log.Printf("Handshake with slave %s failed: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	slave.version = version
 
-	for _, key := range keys {
-		value, ttl, found := m.cache.GetWithTTL(key)
-		if found {
-			op := &Operation{
-				Type: OpSet, Key: key, Value: value, TTL: ttl,
-				Timestamp: time.Now().Unix(),
-			}
-			if err := slave.Send(op); err != nil {
-				log.Printf("Failed to send initial state: %v", err)
-				conn.Close()
-				return
-			}
+	// The replica tells us which history and offset it has seen
+	psync, err := ReadOperation(slave.reader)
+	if err != nil || psync.Type != OpPsync {
+		log.Printf("Expected PSYNC from slave %s: %v", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	if port, err := strconv.Atoi(psync.Value); err == nil && port > 0 && port <= 65535 {
+		slave.listeningPort = port
+	}
+
+	if m.partialSync(slave, psync) {
+		log.Printf("Partial resync with slave %s from offset %d", conn.RemoteAddr(), psync.Offset)
+		m.startSlave(slave)
+		return
+	}
+
+	if err := m.fullSync(slave); err != nil {
+		log.Printf("Full resync with slave %s failed: %v", conn.RemoteAddr(), err)
+		m.removeSlave(slave)
+		return
+	}
+	m.syncFull.Add(1)
+	m.startSlave(slave)
+}
+
+// fullSync sends the replica a point-in-time copy of the keyspace. The
+// offset is read and the replica registered under the snapshot's lock, so
+// the snapshot matches the offset exactly; writes made while the snapshot is
+// on the wire wait in the replica's send queue and follow it once writeLoop
+// starts.
+func (m *Master) fullSync(slave *SlaveConnection) error {
+	var replID string
+	var offset int64
+	var err error
+	m.applyMu.Lock()
+	snapshot := m.cache.SnapshotWith(func() {
+		m.streamMu.Lock()
+		replID, offset = m.replID, m.Offset()
+		m.streamMu.Unlock()
+		if replID == "" {
+			err = errNoHistory
+			return
+		}
+		err = m.registerSlave(slave)
+	})
+	m.applyMu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// writeLoop is not running yet, so nothing else writes to the connection
+	resync := &Operation{Type: OpFullResync, Key: replID, Value: strconv.Itoa(len(snapshot)), Offset: offset}
+	if err := WriteOperation(slave.writer, resync); err != nil {
+		return err
+	}
+	now := time.Now().UnixMilli()
+	for _, entry := range snapshot {
+		op := &Operation{
+			Type: OpSet, Key: entry.Key, Value: entry.Value, ExpireAt: expireAtMillis(entry.ExpiresAt),
+			Timestamp: now, Offset: offset,
+		}
+		if err := WriteOperation(slave.writer, op); err != nil {
+			return err
 		}
 	}
+	return slave.writer.Flush()
+}
+
+// partialSync serves a PSYNC from the backlog when the replica shares our
+// history and its offset is still covered. The replica is registered under
+// streamMu so no write can fall between the backlog tail and the live stream.
+func (m *Master) partialSync(slave *SlaveConnection, psync *Operation) bool {
+	if psync.Key == "" {
+		return false // a fresh replica, nothing to continue from
+	}
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
 
-	// Now add to slave list for ongoing replication
+	// Past replID2Offset our history and the old master's may differ
+	sameHistory := psync.Key == m.replID ||
+		(psync.Key == m.replID2 && psync.Offset <= m.replID2Offset)
+	if !sameHistory {
+		m.syncPartialErr.Add(1)
+		return false
+	}
+	missing, ok := m.backlog.since(psync.Offset, m.Offset())
+	if !ok {
+		m.syncPartialErr.Add(1)
+		return false
+	}
+
+	if err := m.registerSlave(slave); err != nil {
+		return false
+	}
+	slave.ackOffset.Store(psync.Offset)
+	m.send(slave, &Operation{Type: OpContinue, Key: m.replID, Offset: psync.Offset})
+	for _, op := range missing {
+		if m.send(slave, op) != nil {
+			break // dropped; its goroutines will remove it
+		}
+	}
+	m.syncPartialOK.Add(1)
+	return true
+}
+
+// registerSlave adds a slave to the set that receives writes, unless the
+// master has been closed
+func (m *Master) registerSlave(slave *SlaveConnection) error {
 	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		return net.ErrClosed
+	}
+	slave.queueMu.Lock()
+	slave.limits = m.limits
+	slave.queueMu.Unlock()
 	m.slaves = append(m.slaves, slave)
-	m.mu.Unlock()
+	return nil
+}
 
-	// Add health monitoring
-	go m.StartHeartbeatForSlave(slave, 5*time.Second, 3)
-	go slave.ListenForPongs()
+// startSlave starts the goroutines that serve a registered slave
+func (m *Master) startSlave(slave *SlaveConnection) {
+	go m.writeLoop(slave)
+	go m.StartHeartbeatForSlave(slave, pingInterval, maxMissedPings)
+	go m.listenForReplies(slave)
 }
 
 // removeSlave removes a disconnected slave
 func (m *Master) removeSlave(slave *SlaveConnection) {
-	log.Printf("Slave is unhealthy, removing: %s", slave.conn.RemoteAddr())
 	slave.closeOnce.Do(func() {
+		log.Printf("Removing slave: %s", slave.conn.RemoteAddr())
 		m.mu.Lock()
 		defer m.mu.Unlock()
 
@@ -232,19 +851,3 @@ func (m *Master) removeSlave(slave *SlaveConnection) {
 		close(slave.stopHeartbeat)
 	})
 }
-
-// Send sends an operation to this slave
-func (s *SlaveConnection) Send(op *Operation) error {
-	s.mu.Lock()
-	defer s.mu.Unlock()
-
-	_, err := s.writer.WriteString(op.String())
-	if err != nil {
-		return err
-	}
-	err = s.writer.Flush()
-	if err != nil {
-		return err
-	}
-	return nil
-}
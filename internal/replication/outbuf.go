@@ -0,0 +1,84 @@
+package replication
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ErrOutputBufferLimit is returned by Send when queueing an operation pushed
+// the replica past its output buffer limits. The replica is disconnected.
+var ErrOutputBufferLimit = errors.New("replica output buffer limit reached")
+
+// OutputBufferLimits bound how much unsent stream a replica may have queued
+// on the master, like Redis' client-output-buffer-limit replica. A replica
+// is disconnected as soon as its buffer passes Hard bytes, or once it has
+// stayed above Soft bytes for SoftDuration. Zero turns a limit off.
+type OutputBufferLimits struct {
+	Hard         int64
+	Soft         int64
+	SoftDuration time.Duration
+}
+
+// DefaultOutputBufferLimits are Redis' defaults for replicas
+var DefaultOutputBufferLimits = OutputBufferLimits{
+	Hard:         256 << 20,
+	Soft:         64 << 20,
+	SoftDuration: 60 * time.Second,
+}
+
+// exceeded reports which limit, if any, a buffer of size bytes breaks. over
+// is when the buffer went above Soft, zero if it hasn't.
+func (l OutputBufferLimits) exceeded(size int64, over, now time.Time) string {
+	if l.Hard > 0 && size > l.Hard {
+		return fmt.Sprintf("%d bytes over the hard limit of %d", size, l.Hard)
+	}
+	if l.Soft > 0 && !over.IsZero() && now.Sub(over) >= l.SoftDuration {
+		return fmt.Sprintf("%d bytes, over the soft limit of %d for %s", size, l.Soft, now.Sub(over).Truncate(time.Millisecond))
+	}
+	return ""
+}
+
+// ParseOutputBufferLimits parses limits in redis.conf's form,
+// "<hard> <soft> <soft seconds>", where sizes are bytes or take a kb, mb or
+// gb suffix, e.g. "256mb 64mb 60".
+func ParseOutputBufferLimits(s string) (OutputBufferLimits, error) {
+	fields := strings.Fields(s)
+	if len(fields) != 3 {
+		return OutputBufferLimits{}, fmt.Errorf("output buffer limits %q: want <hard> <soft> <soft seconds>", s)
+	}
+	hard, err := parseMemory(fields[0])
+	if err != nil {
+		return OutputBufferLimits{}, err
+	}
+	soft, err := parseMemory(fields[1])
+	if err != nil {
+		return OutputBufferLimits{}, err
+	}
+	seconds, err := strconv.ParseInt(fields[2], 10, 64)
+	if err != nil || seconds < 0 {
+		return OutputBufferLimits{}, fmt.Errorf("invalid soft limit seconds %q", fields[2])
+	}
+	return OutputBufferLimits{Hard: hard, Soft: soft, SoftDuration: time.Duration(seconds) * time.Second}, nil
+}
+
+// parseMemory parses a byte count with an optional kb, mb or gb suffix
+func parseMemory(s string) (int64, error) {
+	n, unit := strings.ToLower(s), int64(1)
+	for _, suffix := range []struct {
+		name string
+		size int64
+	}{{"kb", 1 << 10}, {"mb", 1 << 20}, {"gb", 1 << 30}} {
+		if strings.HasSuffix(n, suffix.name) {
+			n, unit = strings.TrimSuffix(n, suffix.name), suffix.size
+			break
+		}
+	}
+	v, err := strconv.ParseInt(n, 10, 64)
+	if err != nil || v < 0 {
+		return 0, fmt.Errorf("invalid memory size %q", s)
+	}
+	return v * unit, nil
+}
@@ -0,0 +1,87 @@
+package replication
+
+import (
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseOutputBufferLimits(t *testing.T) {
+	tests := []struct {
+		in   string
+		want OutputBufferLimits
+		ok   bool
+	}{
+		{"256mb 64mb 60", DefaultOutputBufferLimits, true},
+		{"1GB 512kb 0", OutputBufferLimits{Hard: 1 << 30, Soft: 512 << 10}, true},
+		{"0 0 0", OutputBufferLimits{}, true},
+		{"1000 100 5", OutputBufferLimits{Hard: 1000, Soft: 100, SoftDuration: 5 * time.Second}, true},
+		{"256mb 64mb", OutputBufferLimits{}, false},
+		{"lots 64mb 60", OutputBufferLimits{}, false},
+		{"256mb -1 60", OutputBufferLimits{}, false},
+		{"256mb 64mb soon", OutputBufferLimits{}, false},
+	}
+	for _, tt := range tests {
+		got, err := ParseOutputBufferLimits(tt.in)
+		if (err == nil) != tt.ok {
+			t.Errorf("%q: got error %v, want ok=%v", tt.in, err, tt.ok)
+			continue
+		}
+		if tt.ok && got != tt.want {
+			t.Errorf("%q: got %+v, want %+v", tt.in, got, tt.want)
+		}
+	}
+}
+
+// stalledSlave returns a slave connection that nothing ever writes out, so
+// everything sent to it stays queued
+func stalledSlave(t *testing.T, limits OutputBufferLimits) *SlaveConnection {
+	conn, peer := net.Pipe()
+	t.Cleanup(func() { conn.Close(); peer.Close() })
+	return &SlaveConnection{
+		conn:          conn,
+		stopHeartbeat: make(chan struct{}),
+		queueReady:    make(chan struct{}, 1),
+		limits:        limits,
+	}
+}
+
+func TestSendHardLimit(t *testing.T) {
+	s := stalledSlave(t, OutputBufferLimits{Hard: 1000})
+	op := &Operation{Type: OpSet, Key: "k", Value: strings.Repeat("v", 400)}
+
+	for i := 0; i < 2; i++ {
+		if err := s.Send(op); err != nil {
+			t.Fatalf("send %d under the hard limit: %v", i, err)
+		}
+	}
+	if err := s.Send(op); !errors.Is(err, ErrOutputBufferLimit) {
+		t.Fatalf("expected ErrOutputBufferLimit past the hard limit, got %v", err)
+	}
+	if err := s.Send(op); !errors.Is(err, net.ErrClosed) {
+		t.Errorf("a dropped slave should refuse further sends, got %v", err)
+	}
+	if _, err := s.conn.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Errorf("the connection should be closed, write returned %v", err)
+	}
+}
+
+func TestSendSoftLimit(t *testing.T) {
+	s := stalledSlave(t, OutputBufferLimits{Soft: 100, SoftDuration: 50 * time.Millisecond})
+	op := &Operation{Type: OpSet, Key: "k", Value: strings.Repeat("v", 200)}
+
+	// Going over the soft limit is allowed for a while
+	if err := s.Send(op); err != nil {
+		t.Fatalf("first send over the soft limit: %v", err)
+	}
+	if err := s.Send(op); err != nil {
+		t.Fatalf("second send over the soft limit: %v", err)
+	}
+	time.Sleep(60 * time.Millisecond)
+	if err := s.Send(op); !errors.Is(err, ErrOutputBufferLimit) {
+		t.Errorf("expected ErrOutputBufferLimit after the soft limit period, got %v", err)
+	}
+}
@@ -1,111 +1,278 @@
 package replication
 
 import (
+	"bufio"
+	"encoding/binary"
+	"errors"
 	"fmt"
-	"strconv"
-	"strings"
-	"time"
+	"hash/crc32"
+	"io"
 )
 
-type OpType string
+// Replication stream wire format
+//
+// After connecting, the replica and master exchange a handshake to agree on
+// a protocol version:
+//
+//	replica -> master: "RRPL" | min version (uint16) | max version (uint16)
+//	master -> replica: "RRPL" | chosen version (uint16), 0 if none is shared
+//
+// Every operation is then sent as one length-prefixed frame. All integers
+// are big-endian:
+//
+//	offset  size  field
+//	0       1     opcode
+//	1       4     key length
+//	5       4     value length
+//	9       8     expiry time in unix milliseconds, 0 if the key does not expire
+//	17      8     timestamp in unix milliseconds
+//	25      8     replication offset
+//	33      4     CRC-32C of bytes 0..32
+//	37      4     CRC-32C of the key and the value
+//	41      ...   key bytes, then value bytes
+//
+// Data operations (SET, DELETE, FLUSH) carry the master's replication offset,
+// which grows by one per operation. ACK frames flow from replica to master
+// and carry the offset of the last operation the replica applied. The master
+// can send GETACK to ask for an ACK right away.
+//
+// Expiry is absolute (PEXPIREAT semantics), so a replica stores exactly the
+// master's deadline however long the frame took to arrive.
+//
+// Right after the handshake the replica sends PSYNC with the replication ID
+// (in the key field) and offset it last saw, and, if it announces one, the
+// port it serves clients on as a decimal string in the value, like Redis'
+// REPLCONF listening-port. The master answers either
+// CONTINUE, followed by the writes the replica missed, or FULLRESYNC with its
+// replication ID, the offset the snapshot that follows corresponds to and the
+// number of SET frames in the snapshot (as a decimal string in the value).
+//
+// Readers reject frames with an unknown opcode, an oversized payload or a bad
+// checksum, so a corrupted stream is dropped instead of applied. The header
+// has a checksum of its own so that a corrupted length is caught before
+// memory is allocated for the payload.
 
 const (
-	OpSet    OpType = "SET"
-	OpDelete OpType = "DELETE"
-	OpFlush  OpType = "FLUSH"
-	OpPing   OpType = "PING"
-	OpPong   OpType = "PONG"
+	// ProtocolVersion is the newest stream version this build speaks
+	ProtocolVersion uint16 = 7
+	// MinProtocolVersion is the oldest stream version this build accepts.
+	// Version 1 frames had no offset field, version 2 had no PSYNC, version
+	// 3 had no GETACK, versions up to 4 sent a relative TTL, version 5 did
+	// not say how long the snapshot after FULLRESYNC is and version 6 had a
+	// single checksum, over the whole frame.
+	MinProtocolVersion uint16 = 7
+
+	handshakeMagic     = "RRPL"
+	frameHeaderLen     = 41
+	checksumPos        = 33 // of the header
+	payloadChecksumPos = 37
+	maxKeyLen          = 512 * 1024 * 1024
+	maxValueLen        = 512 * 1024 * 1024
+)
+
+var (
+	ErrChecksum        = errors.New("replication: frame checksum mismatch")
+	ErrFrameTooLarge   = errors.New("replication: frame exceeds size limit")
+	ErrNoCommonVersion = errors.New("replication: no common protocol version")
+	ErrBadHandshake    = errors.New("replication: invalid handshake")
+)
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+type OpType uint8
+
+const (
+	OpSet OpType = iota + 1
+	OpDelete
+	OpFlush
+	OpPing
+	OpPong
+	OpAck
+	OpPsync
+	OpFullResync
+	OpContinue
+	OpGetAck
 )
 
+func (t OpType) String() string {
+	switch t {
+	case OpSet:
+		return "SET"
+	case OpDelete:
+		return "DELETE"
+	case OpFlush:
+		return "FLUSH"
+	case OpPing:
+		return "PING"
+	case OpPong:
+		return "PONG"
+	case OpAck:
+		return "REPLCONF ACK"
+	case OpPsync:
+		return "PSYNC"
+	case OpFullResync:
+		return "FULLRESYNC"
+	case OpContinue:
+		return "CONTINUE"
+	case OpGetAck:
+		return "REPLCONF GETACK"
+	default:
+		return fmt.Sprintf("OpType(%d)", uint8(t))
+	}
+}
+
+func (t OpType) valid() bool {
+	return t >= OpSet && t <= OpGetAck
+}
+
+// isData reports whether the operation changes the keyspace and therefore
+// consumes a replication offset
+func (t OpType) isData() bool {
+	return t == OpSet || t == OpDelete || t == OpFlush
+}
+
 type Operation struct {
 	Type      OpType
 	Key       string
 	Value     string
-	TTL       time.Duration
-	Timestamp int64
+	ExpireAt  int64 // unix milliseconds, 0 if the key does not expire
+	Timestamp int64 // unix milliseconds on the master
+	Offset    int64 // replication offset, see the wire format above
 }
 
-// Serialize operation to wire format
-// Format varies by operation type
-func (op *Operation) String() string {
-	switch op.Type {
-	case OpSet:
-		ttlMillis := op.TTL.Milliseconds()
-		return fmt.Sprintf("%s %s %s %d %d\n", op.Type, op.Key, op.Value, ttlMillis, op.Timestamp)
-	case OpDelete:
-		return fmt.Sprintf("%s %s %d\n", op.Type, op.Key, op.Timestamp)
-	case OpFlush:
-		return fmt.Sprintf("%s %d\n", op.Type, op.Timestamp)
-	case OpPing, OpPong:
-		return fmt.Sprintf("%s %d\n", op.Type, op.Timestamp)
-	default:
-		return fmt.Sprintf("%s\n", op.Type)
+// MarshalBinary encodes the operation as a single frame
+func (op *Operation) MarshalBinary() ([]byte, error) {
+	if len(op.Key) > maxKeyLen || len(op.Value) > maxValueLen {
+		return nil, ErrFrameTooLarge
 	}
+	buf := make([]byte, frameHeaderLen+len(op.Key)+len(op.Value))
+	buf[0] = byte(op.Type)
+	binary.BigEndian.PutUint32(buf[1:5], uint32(len(op.Key)))
+	binary.BigEndian.PutUint32(buf[5:9], uint32(len(op.Value)))
+	binary.BigEndian.PutUint64(buf[9:17], uint64(op.ExpireAt))
+	binary.BigEndian.PutUint64(buf[17:25], uint64(op.Timestamp))
+	binary.BigEndian.PutUint64(buf[25:33], uint64(op.Offset))
+	copy(buf[frameHeaderLen:], op.Key)
+	copy(buf[frameHeaderLen+len(op.Key):], op.Value)
+	binary.BigEndian.PutUint32(buf[checksumPos:payloadChecksumPos], crc32.Checksum(buf[:checksumPos], crcTable))
+	binary.BigEndian.PutUint32(buf[payloadChecksumPos:frameHeaderLen], crc32.Checksum(buf[frameHeaderLen:], crcTable))
+	return buf, nil
 }
 
-// Parse operation from wire format
-func ParseOperation(line string) (*Operation, error) {
-	parts := strings.Fields(line)
-	if len(parts) < 2 {
-		return nil, fmt.Errorf("invalid operation format")
+// WriteOperation writes one frame to w
+func WriteOperation(w io.Writer, op *Operation) error {
+	frame, err := op.MarshalBinary()
+	if err != nil {
+		return err
 	}
+	_, err = w.Write(frame)
+	return err
+}
 
-	op := &Operation{
-		Type: OpType(parts[0]),
+// ReadOperation reads and verifies the next frame from r. Any error means the
+// stream can no longer be trusted and the connection should be dropped.
+func ReadOperation(r io.Reader) (*Operation, error) {
+	header := make([]byte, frameHeaderLen)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header[checksumPos:payloadChecksumPos]) != crc32.Checksum(header[:checksumPos], crcTable) {
+		return nil, ErrChecksum
+	}
+	op := &Operation{Type: OpType(header[0])}
+	if !op.Type.valid() {
+		return nil, fmt.Errorf("replication: unknown opcode %d", header[0])
+	}
+	keyLen := binary.BigEndian.Uint32(header[1:5])
+	valueLen := binary.BigEndian.Uint32(header[5:9])
+	if keyLen > maxKeyLen || valueLen > maxValueLen {
+		return nil, ErrFrameTooLarge
 	}
 
-	// Parse based on type
-	switch op.Type {
-	case OpSet:
-		if len(parts) < 5 {
-			return nil, fmt.Errorf("SET requires 5 parts")
+	payload := make([]byte, int(keyLen)+int(valueLen))
+	if _, err := io.ReadFull(r, payload); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
 		}
-		op.Key = parts[1]
-		op.Value = parts[2]
+		return nil, err
+	}
+	if binary.BigEndian.Uint32(header[payloadChecksumPos:frameHeaderLen]) != crc32.Checksum(payload, crcTable) {
+		return nil, ErrChecksum
+	}
 
-		ttlMillis, err := strconv.ParseInt(parts[3], 10, 64)
-		if err != nil {
-			return nil, err
-		}
-		op.TTL = time.Duration(ttlMillis) * time.Millisecond
+	op.ExpireAt = int64(binary.BigEndian.Uint64(header[9:17]))
+	op.Timestamp = int64(binary.BigEndian.Uint64(header[17:25]))
+	op.Offset = int64(binary.BigEndian.Uint64(header[25:33]))
+	op.Key = string(payload[:keyLen])
+	op.Value = string(payload[keyLen:])
+	return op, nil
+}
 
-		op.Timestamp, err = strconv.ParseInt(parts[4], 10, 64)
-		if err != nil {
-			return nil, err
-		}
+// frameLen is the size of op's frame on the wire
+func frameLen(op *Operation) int64 {
+	return int64(frameHeaderLen + len(op.Key) + len(op.Value))
+}
 
-	case OpDelete:
-		if len(parts) < 3 {
-			return nil, fmt.Errorf("DELETE requires 3 parts")
-		}
-		op.Key = parts[1]
+// replicaHandshake is run by the replica right after connecting. It offers
+// the range of versions it supports and returns the one the master picked.
+func replicaHandshake(rw *bufio.ReadWriter) (uint16, error) {
+	hello := make([]byte, 8)
+	copy(hello, handshakeMagic)
+	binary.BigEndian.PutUint16(hello[4:6], MinProtocolVersion)
+	binary.BigEndian.PutUint16(hello[6:8], ProtocolVersion)
+	if _, err := rw.Write(hello); err != nil {
+		return 0, err
+	}
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
 
-		var err error
-		op.Timestamp, err = strconv.ParseInt(parts[2], 10, 64)
-		if err != nil {
-			return nil, err
-		}
+	reply := make([]byte, 6)
+	if _, err := io.ReadFull(rw, reply); err != nil {
+		return 0, err
+	}
+	if string(reply[:4]) != handshakeMagic {
+		return 0, ErrBadHandshake
+	}
+	version := binary.BigEndian.Uint16(reply[4:6])
+	if version == 0 {
+		return 0, ErrNoCommonVersion
+	}
+	if version < MinProtocolVersion || version > ProtocolVersion {
+		return 0, fmt.Errorf("replication: master chose unsupported version %d", version)
+	}
+	return version, nil
+}
 
-	case OpFlush:
-		if len(parts) < 2 {
-			return nil, fmt.Errorf("FLUSH requires 2 parts")
-		}
-		var err error
-		op.Timestamp, err = strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return nil, err
-		}
+// masterHandshake is run by the master for each new replica connection. It
+// picks the newest version both sides support, or replies 0 and fails.
+func masterHandshake(rw *bufio.ReadWriter) (uint16, error) {
+	hello := make([]byte, 8)
+	if _, err := io.ReadFull(rw, hello); err != nil {
+		return 0, err
+	}
+	if string(hello[:4]) != handshakeMagic {
+		return 0, ErrBadHandshake
+	}
+	replicaMin := binary.BigEndian.Uint16(hello[4:6])
+	replicaMax := binary.BigEndian.Uint16(hello[6:8])
 
-	case OpPing, OpPong:
-		if len(parts) < 2 {
-			return nil, fmt.Errorf("%s requires 2 parts", op.Type)
-		}
-		var err error
-		op.Timestamp, err = strconv.ParseInt(parts[1], 10, 64)
-		if err != nil {
-			return nil, err
-		}
+	version := min(replicaMax, ProtocolVersion)
+	if version < max(replicaMin, MinProtocolVersion) {
+		version = 0
 	}
 
-	return op, nil
+	reply := make([]byte, 6)
+	copy(reply, handshakeMagic)
+	binary.BigEndian.PutUint16(reply[4:6], version)
+	if _, err := rw.Write(reply); err != nil {
+		return 0, err
+	}
+	if err := rw.Flush(); err != nil {
+		return 0, err
+	}
+	if version == 0 {
+		return 0, ErrNoCommonVersion
+	}
+	return version, nil
 }
@@ -1,8 +1,14 @@
 package replication
 
 import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"net"
 	"testing"
-	"time"
 )
 
 func TestOperationSerializeDeserialize(t *testing.T) {
@@ -16,8 +22,9 @@ func TestOperationSerializeDeserialize(t *testing.T) {
 				Type:      OpSet,
 				Key:       "mykey",
 				Value:     "myvalue",
-				TTL:       60 * time.Second,
+				ExpireAt:  1234567950000,
 				Timestamp: 1234567890,
+				Offset:    17,
 			},
 		},
 		{
@@ -26,7 +33,24 @@ func TestOperationSerializeDeserialize(t *testing.T) {
 				Type:      OpSet,
 				Key:       "key2",
 				Value:     "value2",
-				TTL:       0,
+				Timestamp: 1234567890,
+			},
+		},
+		{
+			name: "SET binary key and value",
+			op: &Operation{
+				Type:      OpSet,
+				Key:       "key with spaces\x00",
+				Value:     "  two  spaces\r\nnewline\x00nul\xff",
+				Timestamp: 1234567890,
+			},
+		},
+		{
+			name: "SET empty value",
+			op: &Operation{
+				Type:      OpSet,
+				Key:       "empty",
+				Value:     "",
 				Timestamp: 1234567890,
 			},
 		},
@@ -52,17 +76,28 @@ func TestOperationSerializeDeserialize(t *testing.T) {
 				Timestamp: 1234567890,
 			},
 		},
+		{
+			name: "ACK",
+			op: &Operation{
+				Type:      OpAck,
+				Timestamp: 1234567890,
+				Offset:    1 << 40,
+			},
+		},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
 			// Serialize
-			serialized := tt.op.String()
+			frame, err := tt.op.MarshalBinary()
+			if err != nil {
+				t.Fatalf("MarshalBinary failed: %v", err)
+			}
 
 			// Deserialize
-			parsed, err := ParseOperation(serialized)
+			parsed, err := ReadOperation(bytes.NewReader(frame))
 			if err != nil {
-				t.Fatalf("ParseOperation failed: %v", err)
+				t.Fatalf("ReadOperation failed: %v", err)
 			}
 
 			// Compare
@@ -75,35 +110,180 @@ func TestOperationSerializeDeserialize(t *testing.T) {
 			if parsed.Value != tt.op.Value {
 				t.Errorf("Value mismatch: got %v, want %v", parsed.Value, tt.op.Value)
 			}
-			if parsed.TTL != tt.op.TTL {
-				t.Errorf("TTL mismatch: got %v, want %v", parsed.TTL, tt.op.TTL)
+			if parsed.ExpireAt != tt.op.ExpireAt {
+				t.Errorf("ExpireAt mismatch: got %v, want %v", parsed.ExpireAt, tt.op.ExpireAt)
 			}
 			if parsed.Timestamp != tt.op.Timestamp {
 				t.Errorf("Timestamp mismatch: got %v, want %v", parsed.Timestamp, tt.op.Timestamp)
 			}
+			if parsed.Offset != tt.op.Offset {
+				t.Errorf("Offset mismatch: got %v, want %v", parsed.Offset, tt.op.Offset)
+			}
 		})
 	}
 }
 
-func TestParseOperationErrors(t *testing.T) {
+func TestReadOperationStream(t *testing.T) {
+	ops := []*Operation{
+		{Type: OpSet, Key: "a", Value: "1", Timestamp: 1},
+		{Type: OpDelete, Key: "a", Timestamp: 2},
+		{Type: OpFlush, Timestamp: 3},
+	}
+	var buf bytes.Buffer
+	for _, op := range ops {
+		if err := WriteOperation(&buf, op); err != nil {
+			t.Fatalf("WriteOperation failed: %v", err)
+		}
+	}
+	for i, want := range ops {
+		got, err := ReadOperation(&buf)
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		if got.Type != want.Type || got.Key != want.Key || got.Timestamp != want.Timestamp {
+			t.Errorf("frame %d: got %+v, want %+v", i, got, want)
+		}
+	}
+	if _, err := ReadOperation(&buf); err != io.EOF {
+		t.Errorf("expected io.EOF after last frame, got %v", err)
+	}
+}
+
+func TestReadOperationErrors(t *testing.T) {
+	valid, err := (&Operation{Type: OpSet, Key: "key", Value: "value", ExpireAt: 1042, Timestamp: 42}).MarshalBinary()
+	if err != nil {
+		t.Fatalf("MarshalBinary failed: %v", err)
+	}
+	corrupt := func(f func(frame []byte)) []byte {
+		frame := append([]byte(nil), valid...)
+		f(frame)
+		return frame
+	}
+	// resealed corrupts a frame's header and fixes up its checksum
+	resealed := func(f func(frame []byte)) []byte {
+		return corrupt(func(frame []byte) {
+			f(frame)
+			binary.BigEndian.PutUint32(frame[checksumPos:payloadChecksumPos], crc32.Checksum(frame[:checksumPos], crcTable))
+		})
+	}
+
 	tests := []struct {
 		name  string
-		input string
+		input []byte
+		want  error
 	}{
-		{"empty string", ""},
-		{"too few parts", "SET key"},
-		{"SET missing parts", "SET key value 60"}, // Missing timestamp
-		{"DELETE missing timestamp", "DELETE key"},
-		{"invalid TTL", "SET key value abc 123"},
-		{"invalid timestamp", "SET key value 60 abc"},
+		{"flipped value byte", corrupt(func(f []byte) { f[len(f)-1] ^= 0xff }), ErrChecksum},
+		{"flipped TTL byte", corrupt(func(f []byte) { f[12] ^= 0x01 }), ErrChecksum},
+		{"flipped offset byte", corrupt(func(f []byte) { f[30] ^= 0x01 }), ErrChecksum},
+		{"flipped checksum", corrupt(func(f []byte) { f[checksumPos] ^= 0x01 }), ErrChecksum},
+		{"flipped key length", corrupt(func(f []byte) { f[1] ^= 0x40 }), ErrChecksum},
+		{"flipped payload checksum", corrupt(func(f []byte) { f[payloadChecksumPos] ^= 0x01 }), ErrChecksum},
+		{"oversized key length", resealed(func(f []byte) { binary.BigEndian.PutUint32(f[1:5], maxKeyLen+1) }), ErrFrameTooLarge},
+		{"truncated header", valid[:10], io.ErrUnexpectedEOF},
+		{"truncated payload", valid[:len(valid)-2], io.ErrUnexpectedEOF},
 	}
 
 	for _, tt := range tests {
 		t.Run(tt.name, func(t *testing.T) {
-			_, err := ParseOperation(tt.input)
-			if err == nil {
-				t.Errorf("Expected error for input %q, got nil", tt.input)
+			_, err := ReadOperation(bytes.NewReader(tt.input))
+			if !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
 			}
 		})
 	}
+
+	t.Run("unknown opcode", func(t *testing.T) {
+		_, err := ReadOperation(bytes.NewReader(resealed(func(f []byte) { f[0] = 0xee })))
+		if err == nil || errors.Is(err, ErrChecksum) {
+			t.Error("expected error for unknown opcode")
+		}
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	replicaConn, masterConn := net.Pipe()
+	defer replicaConn.Close()
+	defer masterConn.Close()
+
+	result := make(chan uint16, 1)
+	go func() {
+		rw := bufio.NewReadWriter(bufio.NewReader(masterConn), bufio.NewWriter(masterConn))
+		version, err := masterHandshake(rw)
+		if err != nil {
+			t.Errorf("masterHandshake failed: %v", err)
+		}
+		result <- version
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(replicaConn), bufio.NewWriter(replicaConn))
+	version, err := replicaHandshake(rw)
+	if err != nil {
+		t.Fatalf("replicaHandshake failed: %v", err)
+	}
+	if version != ProtocolVersion || <-result != ProtocolVersion {
+		t.Errorf("expected both sides to agree on v%d", ProtocolVersion)
+	}
+}
+
+func TestHandshakeRefusesRelativeTTLReplica(t *testing.T) {
+	replicaConn, masterConn := net.Pipe()
+	defer replicaConn.Close()
+	defer masterConn.Close()
+
+	go func() {
+		// A version 4 replica would read expiry times as TTLs
+		replicaConn.Write([]byte(handshakeMagic + "\x00\x03\x00\x04"))
+		io.ReadFull(replicaConn, make([]byte, 6))
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(masterConn), bufio.NewWriter(masterConn))
+	if _, err := masterHandshake(rw); !errors.Is(err, ErrNoCommonVersion) {
+		t.Errorf("expected ErrNoCommonVersion, got %v", err)
+	}
+}
+
+func TestHandshakeRefusesWholeFrameChecksumReplica(t *testing.T) {
+	replicaConn, masterConn := net.Pipe()
+	defer replicaConn.Close()
+	defer masterConn.Close()
+
+	go func() {
+		// A version 6 replica would misread the header checksum
+		replicaConn.Write([]byte(handshakeMagic + "\x00\x06\x00\x06"))
+		io.ReadFull(replicaConn, make([]byte, 6))
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(masterConn), bufio.NewWriter(masterConn))
+	if _, err := masterHandshake(rw); !errors.Is(err, ErrNoCommonVersion) {
+		t.Errorf("expected ErrNoCommonVersion, got %v", err)
+	}
+}
+
+func TestHandshakeNoCommonVersion(t *testing.T) {
+	replicaConn, masterConn := net.Pipe()
+	defer replicaConn.Close()
+	defer masterConn.Close()
+
+	go func() {
+		// A replica from the future that only speaks versions we don't
+		hello := []byte(handshakeMagic + "\x00\x63\x00\x64")
+		replicaConn.Write(hello)
+		reply := make([]byte, 6)
+		io.ReadFull(replicaConn, reply)
+		if binary.BigEndian.Uint16(reply[4:6]) != 0 {
+			t.Errorf("expected master to refuse with version 0, got %v", reply)
+		}
+	}()
+
+	rw := bufio.NewReadWriter(bufio.NewReader(masterConn), bufio.NewWriter(masterConn))
+	if _, err := masterHandshake(rw); !errors.Is(err, ErrNoCommonVersion) {
+		t.Errorf("expected ErrNoCommonVersion, got %v", err)
+	}
+}
+
+func TestHandshakeBadMagic(t *testing.T) {
+	rw := bufio.NewReadWriter(bufio.NewReader(bytes.NewReader([]byte("SET k v\n"))), bufio.NewWriter(io.Discard))
+	if _, err := masterHandshake(rw); !errors.Is(err, ErrBadHandshake) {
+		t.Errorf("expected ErrBadHandshake, got %v", err)
+	}
 }
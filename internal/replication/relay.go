@@ -0,0 +1,95 @@
+package replication
+
+import (
+	"errors"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+)
+
+// errNoHistory refuses sub-replicas while their relay has not synced yet
+var errNoHistory = errors.New("replication: not synced with a master yet")
+
+// A relay is the Master a replica uses to serve replicas of its own. It does
+// not create writes: it forwards the stream it receives from upstream with
+// the upstream offsets, so sub-replicas share the top master's replication
+// ID and offsets and can PSYNC from any node of the chain.
+//
+// A relay never hooks the cache. Instead the replica applies each upstream
+// write and forwards it under applyMu; lock order is applyMu, then the
+// cache lock, then streamMu.
+
+// newRelay creates a relay that continues history replID from offset. An
+// empty replID means the replica has not synced, and sub-replicas are refused
+// until it has.
+func newRelay(c *cache.Cache, replID string, offset int64) *Master {
+	m := newMaster(c, replID)
+	m.relay = true
+	m.offset.Store(offset)
+	return m
+}
+
+// forward applies an upstream operation through apply and passes writes on
+// to sub-replicas unchanged. PINGs and GETACKs are only for this link; the
+// relay runs its own heartbeats.
+func (m *Master) forward(op *Operation, apply func()) {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	apply()
+	if !op.Type.isData() {
+		return
+	}
+	m.streamMu.Lock()
+	defer m.streamMu.Unlock()
+	m.offset.Store(op.Offset)
+	m.broadcast(op)
+}
+
+// resync replaces the relay's history after a full resync from upstream.
+// load replaces the keyspace; no sub-replica can snapshot it half loaded.
+// Sub-replicas are disconnected, since their data no longer matches, and
+// will full resync from the new history. If load fails the relay forgets
+// its history and refuses sub-replicas until the next successful resync.
+func (m *Master) resync(replID string, offset int64, load func() error) error {
+	m.applyMu.Lock()
+	defer m.applyMu.Unlock()
+	err := load()
+	m.streamMu.Lock()
+	if err != nil {
+		replID = ""
+	}
+	m.replID, m.replID2, m.replID2Offset = replID, "", 0
+	m.offset.Store(offset)
+	m.backlog = newBacklog(len(m.backlog.ops))
+	m.streamMu.Unlock()
+	m.dropSlaves()
+	return err
+}
+
+// continueAs records that upstream continued our history under replID, as
+// after its promotion. Like a promoted master, the relay keeps accepting
+// PSYNCs for the old ID up to the current offset. Sub-replicas are
+// disconnected so they pick up the new ID with a partial resync.
+func (m *Master) continueAs(replID string) {
+	m.streamMu.Lock()
+	if replID == m.replID {
+		m.streamMu.Unlock()
+		return
+	}
+	if m.replID != "" {
+		m.replID2, m.replID2Offset = m.replID, m.Offset()
+	}
+	m.replID = replID
+	m.streamMu.Unlock()
+	m.dropSlaves()
+}
+
+// dropSlaves disconnects every slave
+func (m *Master) dropSlaves() {
+	m.mu.RLock()
+	slaves := make([]*SlaveConnection, len(m.slaves))
+	copy(slaves, m.slaves)
+	m.mu.RUnlock()
+	for _, slave := range slaves {
+		m.removeSlave(slave)
+	}
+}
@@ -1,6 +1,11 @@
 package replication
 
 import (
+	"bufio"
+	"fmt"
+	"net"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -57,7 +62,7 @@ func TestMasterSlaveReplication(t *testing.T) {
 	}
 
 	// Test 2: DELETE operation replicates
-	err = master.Delete("key1")
+	_, err = master.Delete("key1")
 	if err != nil {
 		t.Fatalf("Master Delete failed: %v", err)
 	}
@@ -139,3 +144,877 @@ func TestMultipleSlaves(t *testing.T) {
 		}
 	}
 }
+
+func TestReplicationBinarySafe(t *testing.T) {
+	masterCache := cache.New(100)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+
+	masterPort := ":19002"
+	go master.ListenForSlaves(masterPort)
+	time.Sleep(100 * time.Millisecond)
+
+	slaveCache := cache.New(100)
+	defer slaveCache.Close()
+	slave := NewSlave(slaveCache, "localhost"+masterPort)
+	if err := slave.ConnectToMaster(); err != nil {
+		t.Fatalf("Failed to connect to master: %v", err)
+	}
+	defer slave.Close()
+	go slave.StartReplication()
+	time.Sleep(100 * time.Millisecond)
+
+	pairs := map[string]string{
+		"plain":              "value",
+		"key with spaces":    "value  with   runs of  spaces",
+		"newline\nkey":       "line1\r\nline2\n",
+		"nul\x00key":         "nul\x00value\x00",
+		"binary\xff\xfe":     "\x00\x01\x02\xff",
+		"SET fake 1 0 0\r\n": "looks like an operation",
+		"empty":              "",
+	}
+	for key, value := range pairs {
+		if err := master.Set(key, value, 0); err != nil {
+			t.Fatalf("Master Set failed: %v", err)
+		}
+	}
+
+	time.Sleep(200 * time.Millisecond)
+
+	for key, want := range pairs {
+		got, found := slave.Get(key)
+		if !found {
+			t.Errorf("key %q missing on slave", key)
+			continue
+		}
+		if got != want {
+			t.Errorf("key %q: slave has %q, want %q", key, got, want)
+		}
+	}
+	if slaveCache.Size() != len(pairs) {
+		t.Errorf("slave has %d keys, want %d", slaveCache.Size(), len(pairs))
+	}
+}
+
+// startPair starts a master on port and one connected, replicating slave
+// whose ACK interval is short enough for tests
+func startPair(t *testing.T, port string) (*Master, *Slave) {
+	t.Helper()
+	masterCache := cache.New(10000)
+	t.Cleanup(masterCache.Close)
+	master := NewMaster(masterCache)
+	go master.ListenForSlaves(port)
+	time.Sleep(100 * time.Millisecond)
+
+	slaveCache := cache.New(10000)
+	t.Cleanup(slaveCache.Close)
+	slave := NewSlave(slaveCache, "localhost"+port)
+	slave.ackInterval = 20 * time.Millisecond
+	if err := slave.ConnectToMaster(); err != nil {
+		t.Fatalf("Failed to connect to master: %v", err)
+	}
+	t.Cleanup(func() { slave.Close() })
+	go slave.StartReplication()
+	time.Sleep(100 * time.Millisecond)
+	return master, slave
+}
+
+// waitFor polls cond until it holds or the timeout expires
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReplicationOffsetsAndAcks(t *testing.T) {
+	master, slave := startPair(t, ":19003")
+
+	for i := 0; i < 10; i++ {
+		master.Set(fmt.Sprintf("key%d", i), "v", 0)
+	}
+	master.Delete("key0")
+	master.Flush()
+
+	if got := master.Offset(); got != 12 {
+		t.Fatalf("master offset: expected 12, got %d", got)
+	}
+
+	waitFor(t, 2*time.Second, "slave to apply all writes", func() bool {
+		return slave.Offset() == 12
+	})
+	waitFor(t, 2*time.Second, "master to receive ACK", func() bool {
+		replicas := master.Replicas()
+		return len(replicas) == 1 && replicas[0].AckOffset == 12
+	})
+
+	replica := master.Replicas()[0]
+	if replica.Lag != 0 {
+		t.Errorf("expected lag 0 after ACK, got %d", replica.Lag)
+	}
+	if replica.LastAck.IsZero() || time.Since(replica.LastAck) > time.Second {
+		t.Errorf("expected a recent ACK time, got %v", replica.LastAck)
+	}
+}
+
+func TestReplicationPreservesOrder(t *testing.T) {
+	master, slave := startPair(t, ":19004")
+
+	// Interleave writes to the same keys; any reordering on the way to the
+	// slave would leave a different final state
+	const n = 2000
+	for i := 0; i < n; i++ {
+		master.Set("counter", fmt.Sprintf("%d", i), 0)
+		if i%3 == 0 {
+			master.Delete("flappy")
+		} else {
+			master.Set("flappy", fmt.Sprintf("%d", i), 0)
+		}
+	}
+
+	waitFor(t, 5*time.Second, "slave to catch up", func() bool {
+		return slave.Offset() == master.Offset()
+	})
+
+	if val, _ := slave.Get("counter"); val != fmt.Sprintf("%d", n-1) {
+		t.Errorf("counter: expected %d, got %q", n-1, val)
+	}
+	wantFlappy, wantFound := master.Get("flappy")
+	gotFlappy, gotFound := slave.Get("flappy")
+	if gotFound != wantFound || gotFlappy != wantFlappy {
+		t.Errorf("flappy: master has (%q, %v), slave has (%q, %v)", wantFlappy, wantFound, gotFlappy, gotFound)
+	}
+}
+
+// reconnect drops the slave's link and brings it back, as after a network blip
+func reconnect(t *testing.T, master *Master, slave *Slave, whileDown func()) {
+	t.Helper()
+	slave.Close()
+	waitFor(t, 2*time.Second, "master to drop the slave", func() bool {
+		return len(master.Replicas()) == 0
+	})
+	whileDown()
+	if err := slave.ConnectToMaster(); err != nil {
+		t.Fatalf("Reconnect failed: %v", err)
+	}
+	go slave.StartReplication()
+}
+
+func TestPartialResync(t *testing.T) {
+	master, slave := startPair(t, ":19005")
+
+	for i := 0; i < 5; i++ {
+		master.Set(fmt.Sprintf("key%d", i), "before", 0)
+	}
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return slave.Offset() == 5 })
+	if slave.ReplID() != master.ReplID() {
+		t.Fatalf("slave replid %q, master replid %q", slave.ReplID(), master.ReplID())
+	}
+
+	// A key only the slave has survives a partial resync but not a full one
+	slave.cache.Set("local-marker", "x")
+
+	reconnect(t, master, slave, func() {
+		for i := 5; i < 8; i++ {
+			master.Set(fmt.Sprintf("key%d", i), "while-down", 0)
+		}
+	})
+
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return slave.Offset() == 8 })
+	stats := master.SyncStats()
+	if stats.Full != 1 || stats.PartialOK != 1 || stats.PartialErr != 0 {
+		t.Errorf("expected 1 full and 1 partial sync, got %+v", stats)
+	}
+	for i := 0; i < 8; i++ {
+		if _, found := slave.Get(fmt.Sprintf("key%d", i)); !found {
+			t.Errorf("key%d missing on slave", i)
+		}
+	}
+	if _, found := slave.Get("local-marker"); !found {
+		t.Error("partial resync should not have flushed the slave")
+	}
+}
+
+func TestPartialResyncFallsBackToFullSync(t *testing.T) {
+	master, slave := startPair(t, ":19006")
+	master.streamMu.Lock()
+	master.backlog = newBacklog(2)
+	master.streamMu.Unlock()
+
+	for i := 0; i < 5; i++ {
+		master.Set(fmt.Sprintf("key%d", i), "v", 0)
+	}
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return slave.Offset() == 5 })
+	slave.cache.Set("local-marker", "x")
+
+	// Five writes while down, but the backlog only holds two
+	reconnect(t, master, slave, func() {
+		for i := 5; i < 10; i++ {
+			master.Set(fmt.Sprintf("key%d", i), "v", 0)
+		}
+	})
+
+	waitFor(t, 2*time.Second, "slave to resync", func() bool { return slave.cache.Size() == 10 })
+	stats := master.SyncStats()
+	if stats.Full != 2 || stats.PartialOK != 0 || stats.PartialErr != 1 {
+		t.Errorf("expected 2 full syncs and 1 failed partial, got %+v", stats)
+	}
+	if _, found := slave.Get("local-marker"); found {
+		t.Error("full resync should have replaced the slave's data")
+	}
+	if slave.Offset() != 10 {
+		t.Errorf("expected slave offset 10 after full resync, got %d", slave.Offset())
+	}
+}
+
+func TestFullSyncDuringWrites(t *testing.T) {
+	masterCache := cache.New(0)
+	t.Cleanup(masterCache.Close)
+	master := NewMaster(masterCache)
+	go master.ListenForSlaves(":19007")
+	time.Sleep(100 * time.Millisecond)
+
+	for i := 0; i < 1000; i++ {
+		master.Set(fmt.Sprintf("key%d", i), "initial", 0)
+	}
+
+	// Keep writing and deleting keys while replicas attach, so writes land
+	// before, during and after each snapshot
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for n := 0; ; n++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				// Every key is written once, so a write lost during the
+				// snapshot is never repaired by a later one
+				master.Set(fmt.Sprintf("w%d-%d", w, n), "v", 0)
+				if n%5 == 0 {
+					master.Delete(fmt.Sprintf("key%d", (n/5*4+w)%1000))
+				}
+			}
+		}(w)
+	}
+
+	// ConnectToMaster returns once the snapshot is loaded, so attach the
+	// replicas side by side, each a little later than the previous one
+	slaves := make([]*Slave, 3)
+	var connected sync.WaitGroup
+	for i := range slaves {
+		slaveCache := cache.New(0)
+		t.Cleanup(slaveCache.Close)
+		slaves[i] = NewSlave(slaveCache, "localhost:19007")
+		t.Cleanup(func() { slaves[i].Close() })
+		connected.Add(1)
+		go func(slave *Slave) {
+			defer connected.Done()
+			if err := slave.ConnectToMaster(); err != nil {
+				t.Errorf("Failed to connect slave: %v", err)
+				return
+			}
+			go slave.StartReplication()
+		}(slaves[i])
+		time.Sleep(20 * time.Millisecond)
+	}
+	connected.Wait()
+	time.Sleep(50 * time.Millisecond)
+	close(stop)
+	wg.Wait()
+
+	want := make(map[string]string)
+	for _, e := range masterCache.Snapshot() {
+		want[e.Key] = e.Value
+	}
+	for i, slave := range slaves {
+		waitFor(t, 5*time.Second, "slave to catch up", func() bool { return slave.Offset() == master.Offset() })
+		got := slave.cache.Snapshot()
+		if len(got) != len(want) {
+			t.Errorf("slave %d: has %d keys, master has %d", i, len(got), len(want))
+		}
+		for _, e := range got {
+			if want[e.Key] != e.Value {
+				t.Errorf("slave %d: %s = %q, master has %q", i, e.Key, e.Value, want[e.Key])
+				break
+			}
+		}
+	}
+	if stats := master.SyncStats(); stats.Full != 3 {
+		t.Errorf("expected 3 full syncs, got %+v", stats)
+	}
+}
+
+// newFastSlave returns a slave that acks, times out and retries quickly
+func newFastSlave(t *testing.T, addr string) *Slave {
+	t.Helper()
+	slaveCache := cache.New(1000)
+	t.Cleanup(slaveCache.Close)
+	slave := NewSlave(slaveCache, addr)
+	slave.ackInterval = 20 * time.Millisecond
+	slave.minBackoff = 10 * time.Millisecond
+	slave.maxBackoff = 50 * time.Millisecond
+	t.Cleanup(slave.Stop)
+	return slave
+}
+
+func TestSlaveReconnectsAfterMasterRestart(t *testing.T) {
+	firstCache := cache.New(100)
+	defer firstCache.Close()
+	first := NewMaster(firstCache)
+	go first.ListenForSlaves(":19008")
+	time.Sleep(100 * time.Millisecond)
+
+	slave := newFastSlave(t, "localhost:19008")
+	go slave.Run()
+	waitFor(t, 2*time.Second, "link to come up", func() bool { return slave.LinkState() == LinkConnected })
+
+	first.Set("old", "1", 0)
+	waitFor(t, 2*time.Second, "first write", func() bool { _, ok := slave.Get("old"); return ok })
+
+	first.Close()
+	waitFor(t, 2*time.Second, "link to drop", func() bool { return slave.LinkState() != LinkConnected })
+	if st := slave.Status(); st.LinkDownSince.IsZero() || st.LastIO.IsZero() {
+		t.Errorf("expected link down time and last I/O to be recorded, got %+v", st)
+	}
+
+	// A restarted master has a new history, so the slave must full resync
+	secondCache := cache.New(100)
+	defer secondCache.Close()
+	second := NewMaster(secondCache)
+	defer second.Close()
+	second.Set("new", "2", 0)
+	go second.ListenForSlaves(":19008")
+
+	waitFor(t, 5*time.Second, "slave to resync", func() bool { _, ok := slave.Get("new"); return ok })
+	if slave.LinkState() != LinkConnected {
+		t.Errorf("expected link state connected, got %s", slave.LinkState())
+	}
+	if slave.ReplID() != second.ReplID() {
+		t.Error("slave should follow the new master's history")
+	}
+	if st := slave.Status(); !st.LinkDownSince.IsZero() {
+		t.Errorf("link down time should be cleared once reconnected, got %v", st.LinkDownSince)
+	}
+	if _, ok := slave.Get("old"); ok {
+		t.Error("data from the old master should be gone after full resync")
+	}
+}
+
+func TestSlaveDetectsSilentMaster(t *testing.T) {
+	// A master that completes the handshake and then never sends anything,
+	// not even PINGs, like one behind a dead network link
+	listener, err := net.Listen("tcp", "localhost:19009")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	var accepted atomic.Int32
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			accepted.Add(1)
+			t.Cleanup(func() { conn.Close() })
+			rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+			if _, err := masterHandshake(rw); err != nil {
+				continue
+			}
+			ReadOperation(rw)
+			WriteOperation(rw, &Operation{Type: OpFullResync, Key: "silent", Value: "0"})
+			rw.Flush()
+		}
+	}()
+
+	slave := newFastSlave(t, "localhost:19009")
+	slave.pingInterval = 30 * time.Millisecond
+	go slave.Run()
+
+	waitFor(t, 2*time.Second, "slave to miss a PING", func() bool { return slave.Status().MissedPings > 0 })
+	waitFor(t, 2*time.Second, "slave to give up and reconnect", func() bool { return accepted.Load() >= 2 })
+}
+
+func TestSlaveStaysUpWhileMasterPings(t *testing.T) {
+	masterCache := cache.New(100)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+	defer master.Close()
+	go master.ListenForSlaves(":19019")
+	time.Sleep(100 * time.Millisecond)
+
+	slave := newFastSlave(t, "localhost:19019")
+	slave.pingInterval = 30 * time.Millisecond
+	go slave.Run()
+	waitFor(t, 2*time.Second, "link to come up", func() bool { return slave.LinkState() == LinkConnected })
+
+	// The master only PINGs every few seconds, but a steady stream of
+	// writes is just as good a sign of life
+	for i := 0; i < 20; i++ {
+		master.Set(fmt.Sprintf("k%d", i), "v", 0)
+		time.Sleep(10 * time.Millisecond)
+	}
+	if st := slave.Status(); st.State != LinkConnected || st.MissedPings != 0 {
+		t.Errorf("link should stay up while writes arrive, got %+v", st)
+	}
+	if stats := master.SyncStats(); stats.Full != 1 {
+		t.Errorf("expected a single full sync, got %+v", stats)
+	}
+}
+
+func TestStopInterruptsSnapshotLoad(t *testing.T) {
+	// A master that announces a large snapshot, sends one key of it and
+	// then stalls
+	listener, err := net.Listen("tcp", "localhost:19026")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		t.Cleanup(func() { conn.Close() })
+		rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+		if _, err := masterHandshake(rw); err != nil {
+			return
+		}
+		ReadOperation(rw)
+		WriteOperation(rw, &Operation{Type: OpFullResync, Key: "stalled", Value: "1000"})
+		WriteOperation(rw, &Operation{Type: OpSet, Key: "k", Value: "v"})
+		rw.Flush()
+	}()
+
+	slave := newFastSlave(t, "localhost:19026")
+	go slave.Run()
+	waitFor(t, 2*time.Second, "snapshot load to start", func() bool {
+		_, ok := slave.Get("k")
+		return ok
+	})
+
+	start := time.Now()
+	slave.Stop()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Stop waited %v for the snapshot load", elapsed)
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	s := NewSlave(nil, "")
+	s.minBackoff = 100 * time.Millisecond
+	s.maxBackoff = time.Second
+
+	for attempt, ceiling := range []time.Duration{100, 200, 400, 800, 1000, 1000} {
+		ceiling *= time.Millisecond
+		for i := 0; i < 20; i++ {
+			d := s.retryDelay(attempt)
+			if d < ceiling/2 || d > ceiling {
+				t.Fatalf("attempt %d: delay %v outside [%v, %v]", attempt, d, ceiling/2, ceiling)
+			}
+		}
+	}
+	if d := s.retryDelay(1000); d > s.maxBackoff {
+		t.Errorf("delay %v exceeds the maximum", d)
+	}
+}
+
+func TestPromotedReplicaServesPartialResync(t *testing.T) {
+	oldMaster, promoted := startPair(t, ":19010")
+	sibling := newFastSlave(t, "localhost:19010")
+	if err := sibling.ConnectToMaster(); err != nil {
+		t.Fatal(err)
+	}
+	go sibling.StartReplication()
+
+	for i := 0; i < 5; i++ {
+		oldMaster.Set(fmt.Sprintf("key%d", i), "v", 0)
+	}
+	waitFor(t, 2*time.Second, "replicas to catch up", func() bool {
+		return promoted.Offset() == 5 && sibling.Offset() == 5
+	})
+	promoted.Stop()
+	sibling.Stop()
+
+	// The old master keeps writing after the failover, so it has gone past
+	// the point where the histories split
+	oldMaster.Set("lost", "v", 0)
+	oldMaster.Close()
+
+	newMaster := NewMasterFrom(promoted.cache, promoted.ReplID(), promoted.Offset())
+	defer newMaster.Close()
+	go newMaster.ListenForSlaves(":19011")
+	time.Sleep(100 * time.Millisecond)
+	newMaster.Set("after", "v", 0)
+
+	moved := NewSlaveFrom(sibling.cache, "localhost:19011", sibling.ReplID(), sibling.Offset())
+	t.Cleanup(moved.Stop)
+	if err := moved.ConnectToMaster(); err != nil {
+		t.Fatal(err)
+	}
+	go moved.StartReplication()
+	waitFor(t, 2*time.Second, "moved replica to catch up", func() bool { return moved.Offset() == 6 })
+	if moved.ReplID() != newMaster.ReplID() {
+		t.Error("moved replica should adopt the new master's replication ID")
+	}
+
+	demotedCache := cache.New(100)
+	defer demotedCache.Close()
+	demotedCache.Set("lost", "v")
+	demoted := NewSlaveFrom(demotedCache, "localhost:19011", oldMaster.ReplID(), oldMaster.Offset())
+	t.Cleanup(demoted.Stop)
+	if err := demoted.ConnectToMaster(); err != nil {
+		t.Fatal(err)
+	}
+	go demoted.StartReplication()
+	waitFor(t, 2*time.Second, "demoted master to resync", func() bool { _, ok := demoted.Get("after"); return ok })
+	if _, ok := demoted.Get("lost"); ok {
+		t.Error("a write past the split must not survive on the demoted master")
+	}
+
+	if stats := newMaster.SyncStats(); stats.PartialOK != 1 || stats.PartialErr != 1 || stats.Full != 1 {
+		t.Errorf("expected one partial and one full resync, got %+v", stats)
+	}
+}
+
+func TestWaitForReplicas(t *testing.T) {
+	masterCache := cache.New(100)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+	defer master.Close()
+	go master.ListenForSlaves(":19012")
+	time.Sleep(100 * time.Millisecond)
+
+	// Periodic ACKs are far off, so only GETACK can make WAIT return quickly
+	slave := newFastSlave(t, "localhost:19012")
+	slave.ackInterval = time.Hour
+	if err := slave.ConnectToMaster(); err != nil {
+		t.Fatal(err)
+	}
+	go slave.StartReplication()
+	waitFor(t, 2*time.Second, "slave to register", func() bool { return len(master.Replicas()) == 1 })
+
+	master.Set("k", "v", 0)
+	start := time.Now()
+	if n := master.WaitForReplicas(master.Offset(), 1, 2*time.Second); n != 1 {
+		t.Fatalf("expected 1 replica to acknowledge, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("WAIT took %v, GETACK should have answered sooner", elapsed)
+	}
+
+	// Asking for more replicas than exist runs into the timeout
+	start = time.Now()
+	if n := master.WaitForReplicas(master.Offset(), 2, 100*time.Millisecond); n != 1 {
+		t.Errorf("expected 1 replica to acknowledge, got %d", n)
+	}
+	if elapsed := time.Since(start); elapsed < 100*time.Millisecond {
+		t.Errorf("WAIT returned after %v, before its timeout", elapsed)
+	}
+
+	// Nothing to wait for
+	if n := master.WaitForReplicas(master.Offset(), 0, 0); n != 1 {
+		t.Errorf("expected an immediate count of 1, got %d", n)
+	}
+}
+
+func TestMinReplicasToWrite(t *testing.T) {
+	masterCache := cache.New(100)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+	defer master.Close()
+	master.SetMinReplicas(1, time.Second)
+	go master.ListenForSlaves(":19013")
+	time.Sleep(100 * time.Millisecond)
+
+	// No replicas at all
+	if err := master.Set("k", "v", 0); err != ErrNoReplicas {
+		t.Fatalf("expected ErrNoReplicas, got %v", err)
+	}
+	if _, err := master.Delete("k"); err != ErrNoReplicas {
+		t.Errorf("Delete: expected ErrNoReplicas, got %v", err)
+	}
+	if err := master.Flush(); err != ErrNoReplicas {
+		t.Errorf("Flush: expected ErrNoReplicas, got %v", err)
+	}
+	if _, ok := master.Get("k"); ok || master.Offset() != 0 {
+		t.Error("a refused write must not reach the cache or the stream")
+	}
+
+	slave := newFastSlave(t, "localhost:19013")
+	go slave.Run()
+	waitFor(t, 2*time.Second, "replica to count as good", func() bool { return master.GoodReplicas() == 1 })
+	if err := master.Set("k", "v", 0); err != nil {
+		t.Fatalf("expected write to succeed with a good replica, got %v", err)
+	}
+
+	// Once the replica goes away writes are refused again
+	slave.Stop()
+	waitFor(t, 2*time.Second, "replica to be dropped", func() bool { return master.GoodReplicas() == 0 })
+	if err := master.Set("k2", "v", 0); err != ErrNoReplicas {
+		t.Errorf("expected ErrNoReplicas after losing the replica, got %v", err)
+	}
+
+	master.SetMinReplicas(0, 0)
+	if err := master.Set("k2", "v", 0); err != nil {
+		t.Errorf("expected write to succeed with the check off, got %v", err)
+	}
+}
+
+func TestMinReplicasIgnoresStaleAcks(t *testing.T) {
+	masterCache := cache.New(100)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+	defer master.Close()
+	master.SetMinReplicas(1, 200*time.Millisecond)
+	go master.ListenForSlaves(":19014")
+	time.Sleep(100 * time.Millisecond)
+
+	// Connected and healthy, but it never acknowledges on its own
+	slave := newFastSlave(t, "localhost:19014")
+	slave.ackInterval = time.Hour
+	go slave.Run()
+	waitFor(t, 2*time.Second, "replica to attach", func() bool { return len(master.Replicas()) == 1 })
+
+	if err := master.Set("k", "v", 0); err != ErrNoReplicas {
+		t.Errorf("expected ErrNoReplicas for a replica that never ACKed, got %v", err)
+	}
+}
+
+func TestExpiryReplicatedAsDelete(t *testing.T) {
+	master, slave := startPair(t, ":19015")
+
+	master.Set("short", "v", 50*time.Millisecond)
+	master.Set("long", "v", 0)
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return slave.Offset() == 2 })
+
+	time.Sleep(100 * time.Millisecond)
+	// The slave hides the expired key but leaves removing it to the master
+	if _, found := slave.Get("short"); found {
+		t.Error("slave should hide a logically expired key")
+	}
+	if slave.cache.Size() != 2 {
+		t.Errorf("slave should not reap keys itself, size is %d", slave.cache.Size())
+	}
+
+	// A read on the master expires the key and replicates a DELETE
+	if _, found := master.Get("short"); found {
+		t.Fatal("master should have expired the key")
+	}
+	waitFor(t, 2*time.Second, "expiry to replicate", func() bool { return slave.Offset() == 3 })
+	if slave.cache.Size() != 1 {
+		t.Errorf("slave should have applied the DELETE, size is %d", slave.cache.Size())
+	}
+}
+
+func TestEvictionReplicatedAsDelete(t *testing.T) {
+	masterCache := cache.New(2)
+	defer masterCache.Close()
+	master := NewMaster(masterCache)
+	defer master.Close()
+	go master.ListenForSlaves(":19016")
+	time.Sleep(100 * time.Millisecond)
+
+	slave := newFastSlave(t, "localhost:19016")
+	go slave.Run()
+	waitFor(t, 2*time.Second, "link to come up", func() bool { return slave.LinkState() == LinkConnected })
+
+	master.Set("a", "1", 0)
+	master.Set("b", "2", 0)
+	master.Set("c", "3", 0) // evicts a
+
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return slave.Offset() == master.Offset() })
+	if master.Offset() != 4 {
+		t.Errorf("expected 3 SETs and 1 DELETE, master offset is %d", master.Offset())
+	}
+	if _, found := slave.Get("a"); found {
+		t.Error("evicted key should be deleted on the slave")
+	}
+	if slave.cache.Size() != 2 {
+		t.Errorf("slave should mirror the master's 2 keys, has %d", slave.cache.Size())
+	}
+}
+
+func TestReplicaKeepsMasterExpiry(t *testing.T) {
+	master, streamed := startPair(t, ":19017")
+
+	master.Set("k", "v", time.Minute)
+	waitFor(t, 2*time.Second, "slave to catch up", func() bool { return streamed.Offset() == 1 })
+
+	// A second replica gets the key through a full sync instead
+	synced := newFastSlave(t, "localhost:19017")
+	if err := synced.ConnectToMaster(); err != nil {
+		t.Fatal(err)
+	}
+	go synced.StartReplication()
+	waitFor(t, 2*time.Second, "full sync", func() bool { _, ok := synced.Get("k"); return ok })
+
+	expiry := func(c *cache.Cache) int64 {
+		entries := c.Snapshot()
+		if len(entries) != 1 {
+			t.Fatalf("expected 1 key, got %+v", entries)
+		}
+		return entries[0].ExpiresAt.UnixMilli()
+	}
+	want := expiry(master.cache)
+	if got := expiry(streamed.cache); got != want {
+		t.Errorf("streamed replica expires at %d, master at %d", got, want)
+	}
+	if got := expiry(synced.cache); got != want {
+		t.Errorf("full-synced replica expires at %d, master at %d", got, want)
+	}
+}
+
+func TestStalledReplicaIsDisconnected(t *testing.T) {
+	master, slave := startPair(t, ":19018")
+	defer master.Close()
+	master.SetOutputBufferLimits(OutputBufferLimits{Hard: 2 << 20})
+
+	// A replica that completes PSYNC and then never reads the stream
+	conn, err := net.Dial("tcp", "localhost:19018")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	rw := bufio.NewReadWriter(bufio.NewReader(conn), bufio.NewWriter(conn))
+	if _, err := replicaHandshake(rw); err != nil {
+		t.Fatal(err)
+	}
+	if err := WriteOperation(rw.Writer, &Operation{Type: OpPsync, Offset: 0}); err != nil {
+		t.Fatal(err)
+	}
+	rw.Flush()
+	waitFor(t, 2*time.Second, "stalled replica to register", func() bool { return len(master.Replicas()) == 2 })
+
+	// Writes never block on it, it is dropped once socket buffers fill up
+	// and its queue passes the hard limit
+	value := string(make([]byte, 64<<10))
+	for i := 0; master.OutputBufferDisconnects() == 0; i++ {
+		if i == 2000 {
+			t.Fatal("stalled replica was never disconnected")
+		}
+		master.Set(fmt.Sprintf("key%d", i), value, 0)
+		// Don't outrun the replica that does read
+		waitFor(t, 2*time.Second, "healthy replica to keep up", func() bool { return slave.Offset() >= master.Offset()-8 })
+	}
+	waitFor(t, 2*time.Second, "stalled replica to be removed", func() bool { return len(master.Replicas()) == 1 })
+
+	// The replica that keeps up is unaffected
+	waitFor(t, 5*time.Second, "healthy replica to catch up", func() bool { return slave.Offset() == master.Offset() })
+	if n := master.OutputBufferDisconnects(); n != 1 {
+		t.Errorf("expected 1 output buffer disconnect, got %d", n)
+	}
+}
+
+// startChain starts a master on masterPort, a replica of it that serves its
+// own replicas on relayPort, and one replica of that replica
+func startChain(t *testing.T, masterPort, relayPort string) (*Master, *Slave, *Slave) {
+	t.Helper()
+	masterCache := cache.New(1000)
+	t.Cleanup(masterCache.Close)
+	master := NewMaster(masterCache)
+	t.Cleanup(func() { master.Close() })
+	go master.ListenForSlaves(masterPort)
+	time.Sleep(100 * time.Millisecond)
+
+	middle := newFastSlave(t, "localhost"+masterPort)
+	go middle.Run()
+	go middle.ListenForReplicas(relayPort)
+	waitFor(t, 2*time.Second, "middle replica to sync", func() bool { return middle.LinkState() == LinkConnected })
+
+	leaf := newFastSlave(t, "localhost"+relayPort)
+	go leaf.Run()
+	waitFor(t, 2*time.Second, "leaf replica to sync", func() bool { return leaf.LinkState() == LinkConnected })
+	return master, middle, leaf
+}
+
+func TestChainedReplication(t *testing.T) {
+	master, middle, leaf := startChain(t, ":19020", ":19021")
+
+	master.Set("a", "1", 0)
+	master.Set("b", "2", time.Minute)
+	master.Delete("a")
+	waitFor(t, 2*time.Second, "leaf to catch up", func() bool { return leaf.Offset() == master.Offset() })
+
+	if _, ok := leaf.Get("a"); ok {
+		t.Error("leaf should have applied the DELETE")
+	}
+	if v, ok := leaf.Get("b"); !ok || v != "2" {
+		t.Errorf("leaf: b = %q, %v", v, ok)
+	}
+	if got, want := leaf.cache.Snapshot()[0].ExpiresAt.UnixMilli(), master.cache.Snapshot()[0].ExpiresAt.UnixMilli(); got != want {
+		t.Errorf("leaf expires b at %d, master at %d", got, want)
+	}
+	// The whole chain shares the master's history
+	if leaf.ReplID() != master.ReplID() || middle.ReplID() != master.ReplID() {
+		t.Errorf("replication IDs differ: master %s, middle %s, leaf %s", master.ReplID(), middle.ReplID(), leaf.ReplID())
+	}
+	// and the master only serves the middle replica
+	if n := len(master.Replicas()); n != 1 {
+		t.Errorf("master should have 1 replica, has %d", n)
+	}
+	waitFor(t, 2*time.Second, "leaf to ACK the middle replica", func() bool {
+		replicas := middle.Replicas()
+		return len(replicas) == 1 && replicas[0].AckOffset == master.Offset()
+	})
+}
+
+func TestChainedPartialResync(t *testing.T) {
+	master, middle, leaf := startChain(t, ":19022", ":19023")
+
+	master.Set("a", "1", 0)
+	waitFor(t, 2*time.Second, "leaf to catch up", func() bool { return leaf.Offset() == master.Offset() })
+
+	// The leaf drops its link and misses writes; the middle replica's
+	// backlog has them
+	leaf.Close()
+	master.Set("b", "2", 0)
+	master.Set("c", "3", 0)
+	waitFor(t, 2*time.Second, "leaf to catch up again", func() bool { return leaf.Offset() == master.Offset() })
+	if _, ok := leaf.Get("c"); !ok {
+		t.Error("leaf is missing a write made while it was away")
+	}
+	if stats := middle.relay.SyncStats(); stats.PartialOK != 1 || stats.Full != 1 {
+		t.Errorf("expected the leaf to resync partially, got %+v", stats)
+	}
+
+	// The middle replica losing its own link doesn't disturb the leaf
+	middle.Close()
+	master.Set("d", "4", 0)
+	waitFor(t, 2*time.Second, "leaf to get the next write", func() bool { _, ok := leaf.Get("d"); return ok })
+	if stats := middle.relay.SyncStats(); stats.Full != 1 {
+		t.Errorf("the leaf should not have needed another full sync, got %+v", stats)
+	}
+}
+
+func TestChainedReplicaFollowsUpstreamResync(t *testing.T) {
+	master, middle, leaf := startChain(t, ":19024", ":19025")
+	master.Set("old", "1", 0)
+	waitFor(t, 2*time.Second, "leaf to catch up", func() bool { return leaf.Offset() == master.Offset() })
+
+	// A restarted master has a new history, so the whole chain full resyncs
+	master.Close()
+	secondCache := cache.New(100)
+	defer secondCache.Close()
+	second := NewMaster(secondCache)
+	defer second.Close()
+	second.Set("new", "2", 0)
+	go second.ListenForSlaves(":19024")
+
+	waitFor(t, 5*time.Second, "leaf to resync", func() bool { _, ok := leaf.Get("new"); return ok })
+	if _, ok := leaf.Get("old"); ok {
+		t.Error("data from the old master should be gone from the leaf")
+	}
+	if leaf.ReplID() != second.ReplID() || middle.ReplID() != second.ReplID() {
+		t.Error("the chain should follow the new master's history")
+	}
+}
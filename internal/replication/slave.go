@@ -2,75 +2,461 @@ package replication
 
 import (
 	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"log"
+	"math/rand/v2"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/kartikey-singh/redis/internal/cache"
 )
 
+const (
+	// defaultAckInterval is how often a slave reports its offset to the master
+	defaultAckInterval = 1 * time.Second
+
+	minReconnectDelay = 100 * time.Millisecond
+	maxReconnectDelay = 5 * time.Second
+)
+
+// ErrStopped is returned by ConnectToMaster once the slave has been stopped
+var ErrStopped = errors.New("replication: slave stopped")
+
+// LinkState describes the slave's connection to its master, using the names
+// Redis reports in ROLE and INFO
+type LinkState string
+
+const (
+	LinkConnecting LinkState = "connecting" // dialing or waiting to retry
+	LinkSync       LinkState = "sync"       // handshake and PSYNC in progress
+	LinkConnected  LinkState = "connected"  // streaming writes from the master
+)
+
 type Slave struct {
-	cache      *cache.Cache
-	masterAddr string
-	conn       net.Conn
-	mu         sync.RWMutex
-	buffer     *bufio.Writer
+	cache       *cache.Cache
+	masterAddr  string
+	conn        net.Conn
+	setup       net.Conn // being set up by ConnectToMaster, closed by Stop
+	mu          sync.RWMutex
+	reader      *bufio.Reader
+	buffer      *bufio.Writer
+	version     uint16       // negotiated stream protocol version
+	offset      atomic.Int64 // offset of the last applied write
+	replID      string       // master history our offset belongs to, "" before the first sync
+	state       LinkState
+	ackInterval time.Duration
+
+	lastIO        atomic.Int64 // unix milliseconds of the last frame from the master
+	linkDownSince time.Time    // when a connected link was lost, guarded by mu
+
+	// The master PINGs every pingInterval. health counts the intervals in
+	// a row in which nothing arrived from it, and gives the link up after
+	// maxMissedPings. It is replaced on every connection, guarded by mu.
+	health       *HealthMonitor
+	heard        atomic.Bool // a frame arrived since the last health check
+	pingInterval time.Duration
+
+	// relay forwards the stream to replicas of this replica, if any
+	relay *Master
+	// listeningPort is announced to the master in PSYNC, guarded by mu
+	listeningPort int
+
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	stop       chan struct{} // closed by Stop
+	stopOnce   sync.Once
+	running    atomic.Bool
+	done       chan struct{} // closed when Run returns
 }
 
+// NewSlave puts c in replica mode: from now on only the master decides when
+// keys expire, and the slave applies its DELETEs.
 func NewSlave(c *cache.Cache, masterAddr string) *Slave {
+	if c != nil {
+		c.SetReplicaMode(true)
+	}
 	return &Slave{
-		cache:      c,
-		masterAddr: masterAddr,
+		cache:        c,
+		masterAddr:   masterAddr,
+		state:        LinkConnecting,
+		ackInterval:  defaultAckInterval,
+		health:       NewHealthMonitor(pingInterval, maxMissedPings),
+		pingInterval: pingInterval,
+		minBackoff:   minReconnectDelay,
+		maxBackoff:   maxReconnectDelay,
+		relay:        newRelay(c, "", 0),
+		stop:         make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// NewSlaveFrom creates a slave that resumes from a known replication ID and
+// offset, e.g. a demoted master or a replica moved to another master, so it
+// can try a partial resync instead of copying the whole keyspace
+func NewSlaveFrom(c *cache.Cache, masterAddr string, replID string, offset int64) *Slave {
+	s := NewSlave(c, masterAddr)
+	s.replID = replID
+	s.offset.Store(offset)
+	s.relay = newRelay(c, replID, offset)
+	return s
+}
+
+// Run keeps the slave attached to its master until Stop is called. Whenever
+// the link is lost, by EOF, a stream error or missed PINGs, it reconnects
+// with exponential backoff and jitter and resumes with PSYNC.
+func (s *Slave) Run() {
+	s.running.Store(true)
+	defer close(s.done)
+	for attempt := 0; ; attempt++ {
+		if err := s.ConnectToMaster(); err != nil {
+			if errors.Is(err, ErrStopped) {
+				return
+			}
+			log.Printf("Error connecting to master: %v", err)
+		} else {
+			attempt = 0
+			if err := s.StartReplication(); err != nil {
+				log.Printf("Lost connection to master: %v", err)
+			} else {
+				log.Printf("Master closed the connection")
+			}
+		}
+		s.setState(LinkConnecting)
+
+		delay := s.retryDelay(attempt)
+		log.Printf("Reconnecting to master %s in %v", s.masterAddr, delay)
+		select {
+		case <-s.stop:
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+// retryDelay doubles with every failed attempt up to maxBackoff, then picks
+// a random point in the upper half so replicas of a restarted master don't
+// all reconnect at once
+func (s *Slave) retryDelay(attempt int) time.Duration {
+	delay := s.maxBackoff
+	if attempt < 32 {
+		delay = min(s.minBackoff<<attempt, s.maxBackoff)
+	}
+	return delay/2 + rand.N(delay/2+1)
+}
+
+// Stop ends Run and closes the connection to the master, and disconnects
+// replicas of this one. Once it returns, the slave no longer writes to the
+// cache.
+func (s *Slave) Stop() {
+	s.stopOnce.Do(func() { close(s.stop) })
+	s.relay.Close()
+	s.Close()
+	if s.running.Load() {
+		<-s.done
 	}
 }
 
 // ConnectToMaster establishes connection to master
 func (s *Slave) ConnectToMaster() error {
-	conn, err := net.Dial("tcp", s.masterAddr)
+	if s.stopped() {
+		return ErrStopped
+	}
+	s.setState(LinkConnecting)
+	conn, err := s.dial()
 	if err != nil {
+		if s.stopped() {
+			return ErrStopped
+		}
 		return err
 	}
+	// Stop closes the connection from here on, cutting the handshake and
+	// snapshot load short
+	s.mu.Lock()
+	if s.stopped() {
+		s.mu.Unlock()
+		conn.Close()
+		return ErrStopped
+	}
+	s.setup = conn
+	s.mu.Unlock()
+	fail := func(err error) error {
+		s.mu.Lock()
+		s.setup = nil
+		s.mu.Unlock()
+		conn.Close()
+		if s.stopped() {
+			return ErrStopped
+		}
+		return err
+	}
+
+	s.setState(LinkSync)
+	reader := bufio.NewReader(conn)
+	buffer := bufio.NewWriter(conn)
+
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	version, err := replicaHandshake(bufio.NewReadWriter(reader, buffer))
+	if err != nil {
+		return fail(fmt.Errorf("handshake with master %s: %w", s.masterAddr, err))
+	}
+	if err := s.psync(conn, reader, buffer); err != nil {
+		return fail(fmt.Errorf("psync with master %s: %w", s.masterAddr, err))
+	}
+	conn.SetDeadline(time.Time{})
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.setup = nil
+	if s.stopped() {
+		conn.Close()
+		return ErrStopped
+	}
 	s.conn = conn
-	s.buffer = bufio.NewWriter(conn)
-	log.Printf("Connected to master: %s", s.masterAddr)
+	s.reader = reader
+	s.buffer = buffer
+	s.version = version
+	s.state = LinkConnected
+	s.linkDownSince = time.Time{}
+	s.health = NewHealthMonitor(s.pingInterval, maxMissedPings)
+	s.lastIO.Store(time.Now().UnixMilli())
+	log.Printf("Connected to master: %s (protocol v%d)", s.masterAddr, version)
+	return nil
+}
+
+// dial connects to the master, giving up early if Stop is called
+func (s *Slave) dial() (net.Conn, error) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-s.stop:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+	dialer := net.Dialer{Timeout: handshakeTimeout}
+	return dialer.DialContext(ctx, "tcp", s.masterAddr)
+}
+
+func (s *Slave) stopped() bool {
+	select {
+	case <-s.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// psync asks the master to continue from our replication ID and offset. On
+// FULLRESYNC the local data is replaced by the snapshot of the master's
+// keyspace that follows.
+func (s *Slave) psync(conn net.Conn, reader *bufio.Reader, buffer *bufio.Writer) error {
+	s.mu.Lock()
+	replID, port := s.replID, s.listeningPort
+	s.mu.Unlock()
+
+	req := &Operation{Type: OpPsync, Key: replID, Offset: s.Offset(), Timestamp: time.Now().UnixMilli()}
+	if port > 0 {
+		req.Value = strconv.Itoa(port)
+	}
+	if err := WriteOperation(buffer, req); err != nil {
+		return err
+	}
+	if err := buffer.Flush(); err != nil {
+		return err
+	}
+
+	reply, err := ReadOperation(reader)
+	if err != nil {
+		return err
+	}
+	switch reply.Type {
+	case OpContinue:
+		// The master may have been promoted and named a new history
+		log.Printf("Partial resync from offset %d", s.Offset())
+		s.mu.Lock()
+		s.replID = reply.Key
+		s.mu.Unlock()
+		s.relay.continueAs(reply.Key)
+	case OpFullResync:
+		log.Printf("Full resync: replid=%s offset=%d", reply.Key, reply.Offset)
+		return s.relay.resync(reply.Key, reply.Offset, func() error {
+			return s.loadSnapshot(conn, reader, reply)
+		})
+	default:
+		return fmt.Errorf("unexpected reply to PSYNC: %s", reply.Type)
+	}
 	return nil
 }
 
+// loadSnapshot replaces the keyspace with the snapshot announced by a
+// FULLRESYNC reply. Until it is complete our history is unknown, so a failed
+// load leaves the slave to full resync again.
+func (s *Slave) loadSnapshot(conn net.Conn, reader *bufio.Reader, resync *Operation) error {
+	s.mu.Lock()
+	s.replID = ""
+	s.mu.Unlock()
+	s.cache.Flush()
+
+	count, err := strconv.Atoi(resync.Value)
+	if err != nil || count < 0 {
+		return fmt.Errorf("invalid snapshot size %q", resync.Value)
+	}
+	for i := 0; i < count; i++ {
+		if s.stopped() {
+			return ErrStopped
+		}
+		conn.SetDeadline(time.Now().Add(handshakeTimeout))
+		op, err := ReadOperation(reader)
+		if err != nil {
+			return err
+		}
+		if op.Type != OpSet {
+			return fmt.Errorf("unexpected %s in snapshot", op.Type)
+		}
+		s.apply(op)
+	}
+
+	s.mu.Lock()
+	s.replID = resync.Key
+	s.mu.Unlock()
+	s.offset.Store(resync.Offset)
+	return nil
+}
+
+// SetListeningPort sets the client port announced to the master from the
+// next PSYNC on, so it can tell others, e.g. sentinels, where to reach us
+func (s *Slave) SetListeningPort(port int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.listeningPort = port
+}
+
+// ListenForReplicas serves replicas of this replica on addr until Stop is
+// called. They receive the stream exactly as it arrives from the master.
+func (s *Slave) ListenForReplicas(addr string) error {
+	return s.relay.ListenForSlaves(addr)
+}
+
+// Replicas reports the replicas of this replica
+func (s *Slave) Replicas() []ReplicaStatus {
+	return s.relay.Replicas()
+}
+
+// LinkState reports the state of the connection to the master
+func (s *Slave) LinkState() LinkState {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state
+}
+
+func (s *Slave) setState(state LinkState) {
+	s.mu.Lock()
+	if s.state == LinkConnected && state != LinkConnected {
+		s.linkDownSince = time.Now()
+	}
+	s.state = state
+	s.mu.Unlock()
+}
+
+// MasterLinkStatus is a point-in-time view of a slave's link to its master
+type MasterLinkStatus struct {
+	MasterAddr    string
+	State         LinkState
+	ReplID        string
+	Offset        int64
+	LastIO        time.Time // last frame from the master, zero if none yet
+	LinkDownSince time.Time // zero while connected or before the first connection
+	// MissedPings counts ping intervals in a row the master stayed silent
+	MissedPings int
+}
+
+// Status reports the state of the link to the master
+func (s *Slave) Status() MasterLinkStatus {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	status := MasterLinkStatus{
+		MasterAddr:    s.masterAddr,
+		State:         s.state,
+		ReplID:        s.replID,
+		Offset:        s.Offset(),
+		LinkDownSince: s.linkDownSince,
+		MissedPings:   s.health.MissedHeartbeats(),
+	}
+	if ms := s.lastIO.Load(); ms > 0 {
+		status.LastIO = time.UnixMilli(ms)
+	}
+	return status
+}
+
+// MasterAddr returns the address of the master's replication port
+func (s *Slave) MasterAddr() string {
+	return s.masterAddr
+}
+
+// ReplID returns the replication ID of the master history we follow
+func (s *Slave) ReplID() string {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.replID
+}
+
 // StartReplication receives and applies operations from master
+// While it runs, the slave periodically acknowledges its offset and checks
+// that the master is still PINGing
 func (s *Slave) StartReplication() error {
-	scanner := bufio.NewScanner(s.conn)
-	for scanner.Scan() {
-		line := scanner.Text()
-		op, err := ParseOperation(line)
+	s.mu.RLock()
+	conn, reader, health := s.conn, s.reader, s.health
+	s.mu.RUnlock()
+
+	stop := make(chan struct{})
+	defer close(stop)
+	go s.sendAcks(stop)
+	s.heard.Store(true)
+	go s.monitorMaster(stop, conn, health)
+
+	for {
+		op, err := ReadOperation(reader)
 		if err != nil {
-			log.Printf("Error parsing operation: %v", err)
-			continue
+			if !health.IsHealthy() {
+				return fmt.Errorf("master %s missed %d PINGs", s.masterAddr, health.MissedHeartbeats())
+			}
+			if err == io.EOF {
+				s.Close()
+				return nil
+			}
+			// A bad frame means the stream is out of sync or corrupted;
+			// applying anything after it would be guesswork
+			log.Printf("Replication stream error: %v", err)
+			s.Close()
+			return err
 		}
-		s.apply(op) // Apply synchronously to maintain order
+		s.lastIO.Store(time.Now().UnixMilli())
+		s.heard.Store(true)
+		// Apply synchronously to maintain order
+		s.relay.forward(op, func() { s.apply(op) })
 	}
-	return scanner.Err()
 }
 
 // apply executes an operation on the local cache
 func (s *Slave) apply(op *Operation) {
+	if op.Type.isData() {
+		defer s.offset.Store(op.Offset)
+	}
 	switch op.Type {
 	case OpSet:
-		if op.TTL > 0 {
-			// Calculate remaining TTL to account for replication lag
-			elapsed := time.Since(time.Unix(op.Timestamp, 0))
-			remaining := op.TTL - elapsed
-
-			log.Printf("SET %s: original TTL=%v, elapsed=%v, remaining=%v", op.Key, op.TTL, elapsed, remaining)
-
-			if remaining <= 0 {
-				// Already expired during replication, skip
-				log.Printf("Skipping expired key: %s", op.Key)
-				return
-			}
-
-			s.cache.SetWithTTL(op.Key, op.Value, remaining)
-			log.Printf("Applied SET with TTL: %s (remaining=%v)", op.Key, remaining)
+		if op.ExpireAt > 0 {
+			// Keep the master's deadline as is. If it has already passed the
+			// cache hides the key until the master's DELETE arrives.
+			expiresAt := time.UnixMilli(op.ExpireAt)
+			s.cache.SetWithDeadline(op.Key, op.Value, expiresAt)
+			log.Printf("Applied SET with expiry: %s (expires at %v)", op.Key, expiresAt)
 		} else {
 			// No TTL, set without expiration
 			s.cache.Set(op.Key, op.Value)
@@ -86,11 +472,65 @@ func (s *Slave) apply(op *Operation) {
 		log.Printf("Received PING from master")
 		op1 := &Operation{Type: OpPong, Timestamp: op.Timestamp}
 		s.send(op1)
+	case OpGetAck:
+		// Everything before the GETACK has been applied, so the offset
+		// covers the writes the master is waiting for
+		s.send(&Operation{Type: OpAck, Offset: s.Offset(), Timestamp: time.Now().UnixMilli()})
 	default:
 		log.Printf("Unknown operation: %s", op.Type)
 	}
 }
 
+// monitorMaster checks every ping interval that something arrived from the
+// master. Writes count as well as PINGs, since they queue up ahead of them.
+// A half-open connection never reports an error, so after maxMissedPings
+// silent intervals the link is closed, which makes Run reconnect.
+func (s *Slave) monitorMaster(stop chan struct{}, conn net.Conn, health *HealthMonitor) {
+	ticker := time.NewTicker(s.pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			if s.heard.Swap(false) {
+				health.RecordSuccess()
+				continue
+			}
+			health.RecordFailure()
+			log.Printf("No PING from master %s in %v (%d missed)", s.masterAddr, s.pingInterval, health.MissedHeartbeats())
+			if !health.IsHealthy() {
+				log.Printf("Master %s is unresponsive, marking link down", s.masterAddr)
+				conn.Close()
+				return
+			}
+		}
+	}
+}
+
+// sendAcks sends REPLCONF ACK with the applied offset every ackInterval
+func (s *Slave) sendAcks(stop chan struct{}) {
+	ticker := time.NewTicker(s.ackInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+			ack := &Operation{Type: OpAck, Offset: s.Offset(), Timestamp: time.Now().UnixMilli()}
+			if err := s.send(ack); err != nil {
+				log.Printf("Failed to send ACK to master: %v", err)
+				return
+			}
+		}
+	}
+}
+
+// Offset returns the offset of the last write applied from the master
+func (s *Slave) Offset() int64 {
+	return s.offset.Load()
+}
+
 // Get reads from local cache (slaves can serve reads!)
 func (s *Slave) Get(key string) (string, bool) {
 	return s.cache.Get(key)
@@ -101,17 +541,21 @@ func (s *Slave) Close() error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	if s.setup != nil {
+		s.setup.Close()
+	}
 	if s.conn != nil {
 		return s.conn.Close()
 	}
 	return nil
 }
 
-
-func (s* Slave) send(op *Operation) error {
+func (s *Slave) send(op *Operation) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
-	_, err := s.buffer.WriteString(op.String())
+	// Don't hold mu forever on a link whose send buffer never drains
+	s.conn.SetWriteDeadline(time.Now().Add(s.pingInterval * maxMissedPings))
+	err := WriteOperation(s.buffer, op)
 	if err != nil {
 		return err
 	}
@@ -120,4 +564,4 @@ func (s* Slave) send(op *Operation) error {
 		return err
 	}
 	return nil
-}
\ No newline at end of file
+}
@@ -0,0 +1,112 @@
+package sentinel
+
+import (
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+)
+
+// SENTINEL subcommand [args ...]
+//
+//	get-master-addr-by-name <name>   current master's [ip, port], for clients
+//	replicas <name>                  known replicas, as field/value lists
+//	myid                             this sentinel's run ID
+//	is-master-down-by-addr <ip> <port> <epoch> <runid|*>
+//	                                 [down, leader, leader epoch], for peers
+//	hello <name> <ip> <port> <epoch> another sentinel's current master
+func (s *Sentinel) sentinelCommand(w *protocol.Writer, args []string) {
+	if len(args) < 2 {
+		w.WriteError("ERR wrong number of arguments for 'sentinel' command")
+		return
+	}
+	sub := strings.ToLower(args[1])
+	want := map[string]int{
+		"get-master-addr-by-name": 3,
+		"replicas":                3,
+		"slaves":                  3,
+		"myid":                    2,
+		"is-master-down-by-addr":  6,
+		"hello":                   6,
+	}
+	n, ok := want[sub]
+	if !ok {
+		w.WriteError("ERR Unknown sentinel subcommand '" + args[1] + "'")
+		return
+	}
+	if len(args) != n {
+		w.WriteError("ERR wrong number of arguments for 'sentinel|" + sub + "' command")
+		return
+	}
+
+	switch sub {
+	case "get-master-addr-by-name":
+		if args[2] != s.cfg.Name {
+			w.WriteNull()
+			return
+		}
+		host, port, _ := net.SplitHostPort(s.MasterAddr())
+		w.WriteBulkStrings([]string{host, port})
+
+	case "replicas", "slaves":
+		if args[2] != s.cfg.Name {
+			w.WriteError("ERR No such master with that name")
+			return
+		}
+		s.writeReplicas(w)
+
+	case "myid":
+		w.WriteBulkString(s.runID)
+
+	case "is-master-down-by-addr":
+		epoch, err := strconv.ParseInt(args[4], 10, 64)
+		if err != nil {
+			w.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		reply := s.isMasterDown(net.JoinHostPort(args[2], args[3]), epoch, args[5])
+		down := int64(0)
+		if reply.down {
+			down = 1
+		}
+		w.WriteArrayHeader(3)
+		w.WriteInteger(down)
+		w.WriteBulkString(reply.leader)
+		w.WriteInteger(reply.leaderEpoch)
+
+	case "hello":
+		epoch, err := strconv.ParseInt(args[5], 10, 64)
+		if err != nil {
+			w.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		if args[2] == s.cfg.Name {
+			s.hello(net.JoinHostPort(args[3], args[4]), epoch)
+		}
+		w.WriteSimpleString("OK")
+	}
+}
+
+// writeReplicas replies with one flat field/value list per known replica,
+// the way Redis' SENTINEL REPLICAS does
+func (s *Sentinel) writeReplicas(w *protocol.Writer) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	w.WriteArrayHeader(len(s.replicas))
+	for _, r := range s.replicas {
+		host, port, _ := net.SplitHostPort(r.addr)
+		flags := "slave"
+		if r.down(s.cfg.DownAfter) {
+			flags = "s_down,slave"
+		}
+		w.WriteBulkStrings([]string{
+			"name", r.addr,
+			"ip", host,
+			"port", port,
+			"flags", flags,
+			"master-link", r.masterLink,
+			"slave-repl-offset", strconv.FormatInt(r.offset, 10),
+		})
+	}
+}
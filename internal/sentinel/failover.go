@@ -0,0 +1,209 @@
+package sentinel
+
+import (
+	"cmp"
+	"log"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// checkObjectivelyDown asks the other sentinels whether they also see the
+// master down, if we do, and reports whether at least Quorum of us do
+func (s *Sentinel) checkObjectivelyDown() bool {
+	s.mu.Lock()
+	addr := s.master.addr
+	down := s.master.down(s.cfg.DownAfter)
+	epoch := s.currentEpoch
+	if !down {
+		if s.odown {
+			log.Printf("-odown master %s %s", s.cfg.Name, addr)
+			s.odown = false
+		}
+		s.mu.Unlock()
+		return false
+	}
+	s.mu.Unlock()
+
+	agree := 1
+	for _, reply := range s.askPeers(addr, epoch, "*") {
+		if reply.down {
+			agree++
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if addr != s.master.addr {
+		return false // a peer announced a new master meanwhile
+	}
+	odown := agree >= s.cfg.Quorum
+	if odown && !s.odown {
+		log.Printf("+odown master %s %s #quorum %d/%d", s.cfg.Name, addr, agree, s.cfg.Quorum)
+		if now := time.Now(); s.nextFailover.Before(now) {
+			s.nextFailover = now.Add(s.failoverDelay())
+		}
+	}
+	s.odown = odown
+	return odown
+}
+
+// peerReply is a reply to SENTINEL is-master-down-by-addr
+type peerReply struct {
+	down        bool
+	leader      string
+	leaderEpoch int64
+}
+
+// askPeers sends SENTINEL is-master-down-by-addr for the master at addr to
+// every other sentinel. runID is "*" to only ask whether they see it down,
+// or our run ID to also ask for their vote in epoch.
+func (s *Sentinel) askPeers(addr string, epoch int64, runID string) []peerReply {
+	host, port, _ := net.SplitHostPort(addr)
+	var replies []peerReply
+	for _, v := range s.callPeers("SENTINEL", "is-master-down-by-addr", host, port, strconv.FormatInt(epoch, 10), runID) {
+		if len(v.Array) != 3 {
+			continue
+		}
+		replies = append(replies, peerReply{
+			down:        v.Array[0].Int == 1,
+			leader:      v.Array[1].Str,
+			leaderEpoch: v.Array[2].Int,
+		})
+	}
+	return replies
+}
+
+// isMasterDown answers a peer's SENTINEL is-master-down-by-addr: whether we
+// see the master at addr down and, if runID is not "*", our vote for epoch
+func (s *Sentinel) isMasterDown(addr string, epoch int64, runID string) peerReply {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	reply := peerReply{
+		down:   addr == s.master.addr && s.master.down(s.cfg.DownAfter),
+		leader: "*",
+	}
+	if runID == "*" {
+		return reply
+	}
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	// One vote per epoch, to whoever asks first
+	if epoch > s.leaderEpoch {
+		s.leader, s.leaderEpoch = runID, epoch
+		log.Printf("+vote-for-leader %s %d", runID, epoch)
+		if runID != s.runID {
+			// Give the leader time to finish before trying ourselves
+			s.nextFailover = time.Now().Add(2 * s.cfg.FailoverTimeout)
+		}
+	}
+	reply.leader, reply.leaderEpoch = s.leader, s.leaderEpoch
+	return reply
+}
+
+// tryFailover starts an election in a new epoch, once it is our turn, and
+// fails over if we win it
+func (s *Sentinel) tryFailover() {
+	s.mu.Lock()
+	if time.Now().Before(s.nextFailover) {
+		s.mu.Unlock()
+		return
+	}
+	s.currentEpoch++
+	epoch := s.currentEpoch
+	s.leader, s.leaderEpoch = s.runID, epoch
+	s.nextFailover = time.Now().Add(2 * s.cfg.FailoverTimeout)
+	addr := s.master.addr
+	s.mu.Unlock()
+
+	log.Printf("+try-failover master %s %s (epoch %d)", s.cfg.Name, addr, epoch)
+	votes := 1
+	for _, reply := range s.askPeers(addr, epoch, s.runID) {
+		if reply.leader == s.runID && reply.leaderEpoch == epoch {
+			votes++
+		}
+	}
+	needed := max(s.cfg.Quorum, (len(s.cfg.Peers)+1)/2+1)
+	if votes < needed {
+		log.Printf("-failover-abort-not-elected master %s %s (%d/%d votes)", s.cfg.Name, addr, votes, needed)
+		return
+	}
+	log.Printf("+elected-leader master %s %s (epoch %d, %d votes)", s.cfg.Name, addr, epoch, votes)
+	s.failover(epoch)
+}
+
+// failover promotes the best replica and points the others at it
+func (s *Sentinel) failover(epoch int64) {
+	s.mu.Lock()
+	oldAddr := s.master.addr
+	var candidates []instance
+	var others []string
+	for _, r := range s.replicas {
+		if r.role == "slave" && !r.down(s.cfg.DownAfter) {
+			candidates = append(candidates, *r)
+		}
+	}
+	s.mu.Unlock()
+	if len(candidates) == 0 {
+		log.Printf("-failover-abort-no-good-slave master %s %s", s.cfg.Name, oldAddr)
+		return
+	}
+
+	// The replica that has seen the most of the old master's writes wins
+	slices.SortFunc(candidates, func(a, b instance) int {
+		if c := cmp.Compare(b.offset, a.offset); c != 0 {
+			return c
+		}
+		return strings.Compare(a.addr, b.addr)
+	})
+	promoted := candidates[0].addr
+	for _, c := range candidates[1:] {
+		others = append(others, c.addr)
+	}
+
+	log.Printf("+selected-slave slave %s @ %s %s", promoted, s.cfg.Name, oldAddr)
+	if reply, err := s.call(promoted, "REPLICAOF", "NO", "ONE"); err != nil || reply.IsError() {
+		log.Printf("-failover-abort-slave-error %s: %v %s", promoted, err, reply.Str)
+		return
+	}
+
+	// Wait for the promoted replica to report itself master, and learn
+	// where its replicas should connect
+	var replAddr string
+	deadline := time.Now().Add(s.cfg.FailoverTimeout)
+	for {
+		result := s.probe(promoted)
+		if result.info["role"] == "master" {
+			inst := newInstance(promoted)
+			inst.update(result)
+			replAddr = inst.replicationAddr()
+			break
+		}
+		if time.Now().After(deadline) {
+			log.Printf("-failover-abort-timeout master %s %s", s.cfg.Name, oldAddr)
+			return
+		}
+		time.Sleep(s.cfg.Interval)
+	}
+	log.Printf("+promoted-slave slave %s @ %s %s", promoted, s.cfg.Name, oldAddr)
+
+	s.mu.Lock()
+	s.switchMaster(promoted, epoch)
+	s.mu.Unlock()
+	s.sayHello()
+
+	if replAddr == "" {
+		return // the others are reconfigured once INFO shows the port
+	}
+	host, port, _ := net.SplitHostPort(replAddr)
+	for _, addr := range others {
+		if reply, err := s.call(addr, "REPLICAOF", host, port); err != nil || reply.IsError() {
+			log.Printf("Failed to reconfigure %s: %v %s", addr, err, reply.Str)
+			continue
+		}
+		log.Printf("+slave-reconf-sent slave %s @ %s %s", addr, s.cfg.Name, promoted)
+	}
+}
@@ -0,0 +1,253 @@
+package sentinel
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+)
+
+// instance is what a sentinel knows about one master or replica, from its
+// last replies to PING and INFO
+type instance struct {
+	addr      string    // client address, ip:port
+	lastOK    time.Time // last valid reply to PING
+	role      string    // "master" or "slave", "" until INFO has answered
+	roleSince time.Time // when role was first reported
+	replPort  int       // port the instance serves replicas on
+	offset    int64     // replication offset
+	// For replicas, the replication address of the master they follow
+	masterLink string
+	replicas   []string // for masters, client addresses of their replicas
+}
+
+func newInstance(addr string) *instance {
+	// Count from now, so an instance is not down before it was ever probed
+	return &instance{addr: addr, lastOK: time.Now()}
+}
+
+// down reports whether the instance has been silent for longer than
+// downAfter, i.e. it is subjectively down
+func (i *instance) down(downAfter time.Duration) bool {
+	return time.Since(i.lastOK) > downAfter
+}
+
+// replicationAddr is where replicas of the instance connect, "" if unknown
+func (i *instance) replicationAddr() string {
+	if i.replPort == 0 {
+		return ""
+	}
+	host, _, _ := net.SplitHostPort(i.addr)
+	return net.JoinHostPort(host, strconv.Itoa(i.replPort))
+}
+
+// probeResult is an instance's reply to PING and INFO
+type probeResult struct {
+	ok   bool // PING was answered
+	info map[string]string
+}
+
+// probe PINGs addr and reads its INFO over one connection
+func (s *Sentinel) probe(addr string) probeResult {
+	timeout := min(s.cfg.DownAfter, maxCallTimeout)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return probeResult{}
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := protocol.NewWriter(conn)
+	w.WriteCommand("PING")
+	w.WriteCommand("INFO")
+	if err := w.Flush(); err != nil {
+		return probeResult{}
+	}
+	r := protocol.NewReader(conn)
+	pong, err := r.ReadValue()
+	if err != nil || pong.Str != "PONG" {
+		return probeResult{}
+	}
+	result := probeResult{ok: true}
+	if info, err := r.ReadValue(); err == nil && !info.IsError() {
+		result.info = parseInfo(info.Str)
+	}
+	return result
+}
+
+// parseInfo splits an INFO reply into its field:value pairs
+func parseInfo(text string) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(text, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+// update records a probe of the instance
+func (i *instance) update(result probeResult) {
+	if !result.ok {
+		return
+	}
+	i.lastOK = time.Now()
+	info := result.info
+	if info == nil {
+		return
+	}
+	if role := info["role"]; role != i.role {
+		i.role = role
+		i.roleSince = time.Now()
+	}
+	i.replPort, _ = strconv.Atoi(info["replication_port"])
+	switch i.role {
+	case "master":
+		i.offset, _ = strconv.ParseInt(info["master_repl_offset"], 10, 64)
+		i.masterLink = ""
+		i.replicas = i.replicas[:0]
+		for n := 0; ; n++ {
+			line, ok := info[fmt.Sprintf("slave%d", n)]
+			if !ok {
+				break
+			}
+			if addr := replicaAddr(line); addr != "" {
+				i.replicas = append(i.replicas, addr)
+			}
+		}
+	case "slave":
+		i.offset, _ = strconv.ParseInt(info["slave_repl_offset"], 10, 64)
+		i.masterLink = net.JoinHostPort(info["master_host"], info["master_port"])
+		i.replicas = nil
+	}
+}
+
+// replicaAddr returns the client address in an INFO "slaveN" line,
+// ip=...,port=...,...
+func replicaAddr(line string) string {
+	var ip, port string
+	for _, field := range strings.Split(line, ",") {
+		key, value, _ := strings.Cut(field, "=")
+		switch key {
+		case "ip":
+			ip = value
+		case "port":
+			port = value
+		}
+	}
+	if ip == "" || port == "" {
+		return ""
+	}
+	return net.JoinHostPort(ip, port)
+}
+
+// probeAll probes the master and every known replica at once, and adds the
+// replicas the master reports
+func (s *Sentinel) probeAll() {
+	s.mu.Lock()
+	instances := []*instance{s.master}
+	for _, r := range s.replicas {
+		instances = append(instances, r)
+	}
+	s.mu.Unlock()
+
+	results := make([]probeResult, len(instances))
+	var wg sync.WaitGroup
+	for n, inst := range instances {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[n] = s.probe(inst.addr)
+		}()
+	}
+	wg.Wait()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for n, inst := range instances {
+		wasDown := inst.down(s.cfg.DownAfter)
+		inst.update(results[n])
+		if isDown := inst.down(s.cfg.DownAfter); isDown != wasDown {
+			kind := "slave"
+			if inst == s.master {
+				kind = "master"
+			}
+			event := "+sdown"
+			if !isDown {
+				event = "-sdown"
+			}
+			log.Printf("%s %s %s @ %s", event, kind, inst.addr, s.cfg.Name)
+		}
+	}
+	if s.master.role != "master" {
+		return
+	}
+	for _, addr := range s.master.replicas {
+		if _, known := s.replicas[addr]; !known && addr != s.master.addr {
+			s.replicas[addr] = newInstance(addr)
+			log.Printf("+slave slave %s @ %s %s", addr, s.cfg.Name, s.master.addr)
+		}
+	}
+}
+
+// reconfigureInstances points instances that disagree with our view at the
+// current master: replicas that follow another master, and old masters that
+// came back still believing they are masters. It only acts while the
+// current master is up and has been announced long enough for every
+// sentinel to know about it.
+func (s *Sentinel) reconfigureInstances() {
+	s.mu.Lock()
+	master := s.master
+	target := master.replicationAddr()
+	if master.down(s.cfg.DownAfter) || master.role != "master" || target == "" {
+		s.mu.Unlock()
+		return
+	}
+	var wrong []string
+	for _, r := range s.replicas {
+		if r.down(s.cfg.DownAfter) {
+			continue
+		}
+		switch r.role {
+		case "master":
+			if time.Since(r.roleSince) > s.cfg.DownAfter {
+				wrong = append(wrong, r.addr)
+			}
+		case "slave":
+			if !sameAddr(r.masterLink, target) {
+				wrong = append(wrong, r.addr)
+			}
+		}
+	}
+	s.mu.Unlock()
+
+	host, port, _ := net.SplitHostPort(target)
+	for _, addr := range wrong {
+		log.Printf("+convert-to-slave slave %s @ %s %s", addr, s.cfg.Name, master.addr)
+		if reply, err := s.call(addr, "REPLICAOF", host, port); err != nil || reply.IsError() {
+			log.Printf("Failed to reconfigure %s: %v %s", addr, err, reply.Str)
+		}
+	}
+}
+
+// sameAddr compares two host:port addresses, resolving host names, so a
+// replica told to follow "localhost" is not reconfigured to "127.0.0.1"
+func sameAddr(a, b string) bool {
+	if a == b {
+		return true
+	}
+	ra, err := net.ResolveTCPAddr("tcp", a)
+	if err != nil {
+		return false
+	}
+	rb, err := net.ResolveTCPAddr("tcp", b)
+	if err != nil {
+		return false
+	}
+	return ra.String() == rb.String()
+}
@@ -0,0 +1,336 @@
+// Package sentinel watches a master and its replicas and, once a quorum of
+// sentinels agrees the master is down, promotes a replica in its place, like
+// Redis Sentinel.
+//
+// Sentinels talk to servers and to each other over the client port:
+//
+//   - every Interval each instance gets a PING and an INFO; replicas are
+//     discovered from the master's INFO
+//   - a master that has not answered a PING for DownAfter is subjectively
+//     down (SDOWN); once Quorum sentinels see it down it is objectively down
+//     (ODOWN), asked with SENTINEL is-master-down-by-addr
+//   - the sentinels then elect a leader for a new epoch; each votes once
+//     per epoch, and the leader needs a majority and at least Quorum votes
+//   - the leader promotes the most up-to-date replica with REPLICAOF NO ONE
+//     and points the other replicas at it
+//   - sentinels announce the master they know of, with the epoch it was
+//     configured in, to each other every Interval (SENTINEL hello); a newer
+//     epoch wins, so all of them converge on the promoted master
+package sentinel
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	mrand "math/rand/v2"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+)
+
+const (
+	DefaultDownAfter       = 30 * time.Second
+	DefaultFailoverTimeout = 3 * time.Minute
+	DefaultInterval        = time.Second
+)
+
+// Config describes the master a sentinel watches and the sentinels it works
+// with
+type Config struct {
+	Name       string   // name clients ask for the master by
+	MasterAddr string   // client address of the master to start with
+	Quorum     int      // sentinels that must see the master down
+	Peers      []string // client addresses of the other sentinels
+
+	DownAfter       time.Duration // silence after which an instance is down
+	FailoverTimeout time.Duration // bound on a failover, and wait between retries
+	Interval        time.Duration // how often instances and peers are contacted
+}
+
+type Sentinel struct {
+	cfg   Config
+	runID string
+
+	mu       sync.Mutex
+	master   *instance
+	replicas map[string]*instance // by client address
+	// configEpoch is the epoch the current master was chosen in.
+	// currentEpoch is the newest epoch seen; each election starts a new one.
+	configEpoch  int64
+	currentEpoch int64
+	// The sentinel this one voted for, and the epoch of that vote
+	leader      string
+	leaderEpoch int64
+	odown       bool
+	// nextFailover is the earliest time this sentinel may start an election
+	nextFailover time.Time
+
+	listener net.Listener
+	closed   bool
+	done     chan struct{} // closed by Close
+}
+
+// New creates a sentinel for the master in cfg. Zero durations take the
+// defaults. The master's address is resolved to an IP, which is how replicas
+// are reported too.
+func New(cfg Config) (*Sentinel, error) {
+	if cfg.Name == "" || cfg.MasterAddr == "" {
+		return nil, errors.New("sentinel: master name and address are required")
+	}
+	if cfg.Quorum < 1 || cfg.Quorum > len(cfg.Peers)+1 {
+		return nil, fmt.Errorf("sentinel: quorum %d cannot be reached with %d sentinels", cfg.Quorum, len(cfg.Peers)+1)
+	}
+	if cfg.DownAfter <= 0 {
+		cfg.DownAfter = DefaultDownAfter
+	}
+	if cfg.FailoverTimeout <= 0 {
+		cfg.FailoverTimeout = DefaultFailoverTimeout
+	}
+	if cfg.Interval <= 0 {
+		cfg.Interval = DefaultInterval
+	}
+	addr, err := net.ResolveTCPAddr("tcp", cfg.MasterAddr)
+	if err != nil {
+		return nil, fmt.Errorf("sentinel: master address: %w", err)
+	}
+	return &Sentinel{
+		cfg:      cfg,
+		runID:    newRunID(),
+		master:   newInstance(addr.String()),
+		replicas: make(map[string]*instance),
+		done:     make(chan struct{}),
+	}, nil
+}
+
+// newRunID returns a random 40 character hex ID, like Redis' run IDs
+func newRunID() string {
+	b := make([]byte, 20)
+	if _, err := rand.Read(b); err != nil {
+		panic("sentinel: cannot generate run ID: " + err.Error())
+	}
+	return hex.EncodeToString(b)
+}
+
+// Start serves clients and peers on addr and monitors the master until Close
+// is called
+func (s *Sentinel) Start(addr string) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	defer listener.Close()
+
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+	log.Printf("Sentinel %s listening on %s, monitoring %s at %s (quorum %d)",
+		s.runID[:8], addr, s.cfg.Name, s.cfg.MasterAddr, s.cfg.Quorum)
+
+	go s.monitor()
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			log.Printf("Error accepting connection: %v", err)
+			continue
+		}
+		go s.handleConnection(conn)
+	}
+}
+
+// Close stops monitoring and serving
+func (s *Sentinel) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if !s.closed {
+		s.closed = true
+		close(s.done)
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
+
+// MasterAddr returns the client address of the current master
+func (s *Sentinel) MasterAddr() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.master.addr
+}
+
+func (s *Sentinel) monitor() {
+	ticker := time.NewTicker(s.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-s.done:
+			return
+		case <-ticker.C:
+			s.tick()
+		}
+	}
+}
+
+// tick runs one round of monitoring
+func (s *Sentinel) tick() {
+	s.probeAll()
+	s.sayHello()
+	if s.checkObjectivelyDown() {
+		s.tryFailover()
+		return
+	}
+	s.reconfigureInstances()
+}
+
+// sayHello tells the other sentinels which master we know of
+func (s *Sentinel) sayHello() {
+	s.mu.Lock()
+	host, port, _ := net.SplitHostPort(s.master.addr)
+	epoch := fmt.Sprint(s.configEpoch)
+	s.mu.Unlock()
+	s.callPeers("SENTINEL", "hello", s.cfg.Name, host, port, epoch)
+}
+
+// hello handles another sentinel's announcement of the master it knows of.
+// A newer configuration epoch replaces ours.
+func (s *Sentinel) hello(addr string, epoch int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if epoch > s.currentEpoch {
+		s.currentEpoch = epoch
+	}
+	if epoch <= s.configEpoch {
+		return
+	}
+	if addr != s.master.addr {
+		s.switchMaster(addr, epoch)
+	}
+	s.configEpoch = epoch
+}
+
+// switchMaster makes addr the master, chosen in epoch. The old master is
+// kept as a replica, so it is reconfigured if it comes back. Callers must
+// hold mu.
+func (s *Sentinel) switchMaster(addr string, epoch int64) {
+	old := s.master
+	promoted, ok := s.replicas[addr]
+	if !ok {
+		promoted = newInstance(addr)
+	}
+	delete(s.replicas, addr)
+	// Give the new master a full DownAfter before it can be declared down
+	promoted.lastOK = time.Now()
+	s.master = promoted
+	s.replicas[old.addr] = old
+	s.configEpoch = epoch
+	s.odown = false
+	log.Printf("+switch-master %s %s %s (epoch %d)", s.cfg.Name, old.addr, addr, epoch)
+}
+
+// callPeers sends a command to every other sentinel at once and returns the
+// replies of those that answered
+func (s *Sentinel) callPeers(args ...string) []protocol.Value {
+	replies := make(chan protocol.Value, len(s.cfg.Peers))
+	var wg sync.WaitGroup
+	for _, peer := range s.cfg.Peers {
+		wg.Add(1)
+		go func(peer string) {
+			defer wg.Done()
+			if reply, err := s.call(peer, args...); err == nil && !reply.IsError() {
+				replies <- reply
+			}
+		}(peer)
+	}
+	wg.Wait()
+	close(replies)
+
+	var answered []protocol.Value
+	for reply := range replies {
+		answered = append(answered, reply)
+	}
+	return answered
+}
+
+// call sends one command to addr and returns the reply
+func (s *Sentinel) call(addr string, args ...string) (protocol.Value, error) {
+	timeout := min(s.cfg.DownAfter, maxCallTimeout)
+	conn, err := net.DialTimeout("tcp", addr, timeout)
+	if err != nil {
+		return protocol.Value{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	w := protocol.NewWriter(conn)
+	w.WriteCommand(args...)
+	if err := w.Flush(); err != nil {
+		return protocol.Value{}, err
+	}
+	return protocol.NewReader(conn).ReadValue()
+}
+
+// maxCallTimeout bounds every request, so one unresponsive instance can't
+// stall a round of monitoring for long
+const maxCallTimeout = time.Second
+
+// failoverDelay spreads the sentinels' elections out, so they rarely all
+// ask for votes in the same epoch and split them
+func (s *Sentinel) failoverDelay() time.Duration {
+	return mrand.N(10 * s.cfg.Interval)
+}
+
+func (s *Sentinel) handleConnection(conn net.Conn) {
+	defer conn.Close()
+	reader := protocol.NewReader(conn)
+	writer := protocol.NewWriter(conn)
+	for {
+		args, err := reader.ReadCommand()
+		if err != nil {
+			var protoErr *protocol.ProtocolError
+			if errors.As(err, &protoErr) {
+				// The stream can't be resynchronised, so reply and hang up
+				writer.WriteError("ERR " + protoErr.Error())
+				writer.Flush()
+			}
+			if err != io.EOF && !errors.Is(err, net.ErrClosed) {
+				log.Printf("[%s] Read error: %v", conn.RemoteAddr(), err)
+			}
+			return
+		}
+		s.execute(writer, args)
+		if reader.Buffered() == 0 {
+			if err := writer.Flush(); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// execute runs one client or peer command
+func (s *Sentinel) execute(w *protocol.Writer, args []string) {
+	switch strings.ToUpper(args[0]) {
+	case "PING":
+		w.WriteSimpleString("PONG")
+	case "ROLE":
+		w.WriteArrayHeader(2)
+		w.WriteBulkString("sentinel")
+		w.WriteBulkStrings([]string{s.cfg.Name})
+	case "SENTINEL":
+		s.sentinelCommand(w, args)
+	default:
+		w.WriteError("ERR unknown command '" + args[0] + "'")
+	}
+}
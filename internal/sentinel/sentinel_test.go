@@ -0,0 +1,255 @@
+package sentinel
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cache"
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/server"
+)
+
+// node is a server started for a test, with its client and replication
+// addresses
+type node struct {
+	srv        *server.Server
+	addr, repl string
+}
+
+func startNode(t *testing.T, port int, role, masterRepl string) node {
+	t.Helper()
+	c := cache.New(1000)
+	t.Cleanup(c.Close)
+	n := node{addr: fmt.Sprintf("127.0.0.1:%d", port), repl: fmt.Sprintf("127.0.0.1:%d", port+1)}
+	n.srv = server.New(n.addr, c, role, masterRepl, port+1)
+	t.Cleanup(func() { n.srv.Close() })
+	go n.srv.Start()
+	return n
+}
+
+func startSentinels(t *testing.T, ports []int, cfg Config) []*Sentinel {
+	t.Helper()
+	sentinels := make([]*Sentinel, len(ports))
+	for i, port := range ports {
+		c := cfg
+		c.Peers = nil
+		for j, peer := range ports {
+			if j != i {
+				c.Peers = append(c.Peers, fmt.Sprintf("127.0.0.1:%d", peer))
+			}
+		}
+		s, err := New(c)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		go s.Start(fmt.Sprintf("127.0.0.1:%d", port))
+		sentinels[i] = s
+	}
+	return sentinels
+}
+
+func do(t *testing.T, addr string, args ...string) protocol.Value {
+	t.Helper()
+	conn, err := net.DialTimeout("tcp", addr, time.Second)
+	if err != nil {
+		t.Fatalf("dial %s: %v", addr, err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	w := protocol.NewWriter(conn)
+	w.WriteCommand(args...)
+	w.Flush()
+	reply, err := protocol.NewReader(conn).ReadValue()
+	if err != nil {
+		t.Fatalf("%v on %s: %v", args, addr, err)
+	}
+	return reply
+}
+
+func waitFor(t *testing.T, timeout time.Duration, what string, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for %s", what)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+var testConfig = Config{
+	Name:            "mymaster",
+	Quorum:          2,
+	DownAfter:       300 * time.Millisecond,
+	FailoverTimeout: 2 * time.Second,
+	Interval:        50 * time.Millisecond,
+}
+
+func TestFailover(t *testing.T) {
+	master := startNode(t, 18100, "master", "")
+	time.Sleep(100 * time.Millisecond)
+	replicas := []node{
+		startNode(t, 18102, "slave", master.repl),
+		startNode(t, 18104, "slave", master.repl),
+	}
+	cfg := testConfig
+	cfg.MasterAddr = master.addr
+	sentinels := startSentinels(t, []int{18110, 18111, 18112}, cfg)
+
+	do(t, master.addr, "SET", "k", "v")
+	for _, s := range sentinels {
+		waitFor(t, 3*time.Second, "sentinels to discover the replicas", func() bool {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			return len(s.replicas) == 2
+		})
+		if s.MasterAddr() != master.addr {
+			t.Fatalf("sentinel should monitor %s, has %s", master.addr, s.MasterAddr())
+		}
+	}
+
+	master.srv.Close()
+
+	var promoted string
+	waitFor(t, 10*time.Second, "every sentinel to agree on a new master", func() bool {
+		promoted = sentinels[0].MasterAddr()
+		for _, s := range sentinels {
+			if addr := s.MasterAddr(); addr == master.addr || addr != promoted {
+				return false
+			}
+		}
+		return true
+	})
+	reply := do(t, "127.0.0.1:18111", "SENTINEL", "get-master-addr-by-name", "mymaster")
+	host, port, _ := net.SplitHostPort(promoted)
+	if len(reply.Array) != 2 || reply.Array[0].Str != host || reply.Array[1].Str != port {
+		t.Errorf("get-master-addr-by-name: got %+v, want %s", reply, promoted)
+	}
+
+	// The promoted replica takes writes, and the other one follows it
+	var other string
+	for _, r := range replicas {
+		if r.addr != promoted {
+			other = r.addr
+		}
+	}
+	if role := do(t, promoted, "ROLE"); role.Array[0].Str != "master" {
+		t.Fatalf("promoted replica reports %+v", role)
+	}
+	if got := do(t, promoted, "GET", "k"); got.Str != "v" {
+		t.Errorf("promoted replica lost the master's data, GET k = %+v", got)
+	}
+	do(t, promoted, "SET", "after", "failover")
+	waitFor(t, 5*time.Second, "the other replica to follow the new master", func() bool {
+		return do(t, other, "GET", "after").Str == "failover"
+	})
+}
+
+func TestNoFailoverWithoutQuorum(t *testing.T) {
+	master := startNode(t, 18120, "master", "")
+	time.Sleep(100 * time.Millisecond)
+	startNode(t, 18122, "slave", master.repl)
+
+	// Two sentinels are configured, but only one runs
+	cfg := testConfig
+	cfg.MasterAddr = master.addr
+	cfg.Peers = []string{"127.0.0.1:18131"}
+	s, err := New(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+	go s.Start("127.0.0.1:18130")
+	waitFor(t, 3*time.Second, "the replica to be discovered", func() bool {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return len(s.replicas) == 1
+	})
+
+	master.srv.Close()
+	time.Sleep(10 * testConfig.DownAfter)
+	if addr := s.MasterAddr(); addr != master.addr {
+		t.Errorf("a lone sentinel below quorum failed over to %s", addr)
+	}
+}
+
+func TestVotesOncePerEpoch(t *testing.T) {
+	s, err := New(Config{Name: "m", MasterAddr: "127.0.0.1:1", Quorum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r := s.isMasterDown("127.0.0.1:1", 1, "a"); r.leader != "a" || r.leaderEpoch != 1 {
+		t.Errorf("first request in epoch 1 should get the vote, got %+v", r)
+	}
+	if r := s.isMasterDown("127.0.0.1:1", 1, "b"); r.leader != "a" {
+		t.Errorf("a second candidate in the same epoch should not get the vote, got %+v", r)
+	}
+	if r := s.isMasterDown("127.0.0.1:1", 2, "b"); r.leader != "b" || r.leaderEpoch != 2 {
+		t.Errorf("a newer epoch should get a new vote, got %+v", r)
+	}
+	if r := s.isMasterDown("127.0.0.1:1", 1, "*"); r.leader != "*" {
+		t.Errorf("asking without a run ID should not vote, got %+v", r)
+	}
+}
+
+func TestHelloAdoptsNewerConfig(t *testing.T) {
+	s, err := New(Config{Name: "m", MasterAddr: "127.0.0.1:1", Quorum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.hello("127.0.0.1:2", 3)
+	if s.MasterAddr() != "127.0.0.1:2" {
+		t.Fatalf("expected the newer master, got %s", s.MasterAddr())
+	}
+	s.hello("127.0.0.1:3", 2)
+	if s.MasterAddr() != "127.0.0.1:2" {
+		t.Errorf("an older epoch must not replace the master, got %s", s.MasterAddr())
+	}
+	if _, ok := s.replicas["127.0.0.1:1"]; !ok {
+		t.Error("the old master should be kept as a replica")
+	}
+}
+
+func TestNewRejectsBadConfig(t *testing.T) {
+	for _, cfg := range []Config{
+		{MasterAddr: "127.0.0.1:1", Quorum: 1},
+		{Name: "m", Quorum: 1},
+		{Name: "m", MasterAddr: "127.0.0.1:1", Quorum: 2},
+		{Name: "m", MasterAddr: "127.0.0.1:1", Quorum: 0},
+		{Name: "m", MasterAddr: "127.0.0.1:" + strconv.Itoa(1<<20), Quorum: 1},
+	} {
+		if _, err := New(cfg); err == nil {
+			t.Errorf("New(%+v): expected an error", cfg)
+		}
+	}
+}
+
+func TestProtocolErrorReply(t *testing.T) {
+	s, err := New(Config{Name: "m", MasterAddr: "127.0.0.1:1", Quorum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, conn := net.Pipe()
+	defer client.Close()
+	go s.handleConnection(conn)
+
+	client.SetDeadline(time.Now().Add(2 * time.Second))
+	client.Write([]byte("*1\r\n+PING\r\n"))
+	r := protocol.NewReader(client)
+	reply, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if !reply.IsError() || !strings.Contains(reply.Str, "Protocol error") {
+		t.Errorf("expected protocol error, got %+v", reply)
+	}
+	// The stream can't be resynchronised, so the sentinel hangs up
+	if _, err := r.ReadValue(); err == nil {
+		t.Error("expected connection to be closed after protocol error")
+	}
+}
@@ -0,0 +1,517 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/cluster"
+)
+
+// SetCluster puts the server in cluster mode: it only serves keys of the
+// slots c says it owns, and redirects clients elsewhere with MOVED, or ASK
+// for keys of a slot being moved. Start joins c's cluster bus, after which
+// the cluster makes the server a master or a replica as failovers happen.
+// Raft mode can't be combined with it.
+func (s *Server) SetCluster(c *cluster.Cluster) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cluster = c
+	s.cache.IndexBy(cluster.KeySlot)
+}
+
+// clusterRole changes the server's role for the cluster
+type clusterRole struct {
+	s *Server
+}
+
+// Promote makes the server, a replica whose master failed, a master
+func (r clusterRole) Promote() {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if !r.s.closed && r.s.role == "slave" {
+		r.s.promote()
+	}
+}
+
+// Follow makes the server a replica of the master replicating from addr
+func (r clusterRole) Follow(addr string) {
+	r.s.mu.Lock()
+	defer r.s.mu.Unlock()
+	if r.s.closed || r.s.role == "slave" && r.s.masterAddr == addr {
+		return
+	}
+	r.s.follow(addr)
+}
+
+func (r clusterRole) Offset() int64 {
+	r.s.mu.RLock()
+	defer r.s.mu.RUnlock()
+	switch r.s.role {
+	case "master":
+		return r.s.master.Offset()
+	case "slave":
+		return r.s.slave.Offset()
+	}
+	return 0
+}
+
+// commandKeys returns the keys a command reads or writes, or nil if it has
+// none or too few arguments, which the command itself reports
+func commandKeys(command string, args []string) []string {
+	switch command {
+	case "SET", "GET", "RESTORE", "RESTORE-ASKING":
+		if len(args) >= 2 {
+			return args[1:2]
+		}
+	case "DEL":
+		return args[1:]
+	}
+	return nil
+}
+
+// checkSlot makes sure this node serves every key of a command, which must
+// all be in one slot. If not it replies with an error, MOVED with the slot's
+// owner if there is one, and returns false.
+//
+// While a slot moves, its keys are served where they are: the old owner
+// sends clients asking for keys it no longer has to the new one with ASK,
+// and the new one serves them after ASKING. A command whose keys are split
+// between the two must be retried once they have all moved. Callers must
+// hold mu.
+func (s *Server) checkSlot(c *client, keys []string) bool {
+	if len(keys) == 0 {
+		return true
+	}
+	slot := cluster.KeySlot(keys[0])
+	for _, key := range keys[1:] {
+		if cluster.KeySlot(key) != slot {
+			c.writer.WriteError("CROSSSLOT Keys in request don't hash to the same slot")
+			return false
+		}
+	}
+	info := s.cluster.Slot(slot)
+	mine := info.OwnerID == s.cluster.MyID()
+	if mine && info.MigratingTo == "" {
+		return true
+	}
+	if !mine && (info.ImportingFrom == "" || !c.asking) {
+		if info.OwnerID == "" {
+			c.writer.WriteError("CLUSTERDOWN Hash slot not served")
+		} else {
+			c.writer.WriteError(fmt.Sprintf("MOVED %d %s", slot, info.OwnerAddr))
+		}
+		return false
+	}
+
+	missing := 0
+	for _, key := range keys {
+		if !s.cache.Exists(key) {
+			missing++
+		}
+	}
+	switch {
+	case mine && missing == len(keys):
+		c.writer.WriteError(fmt.Sprintf("ASK %d %s", slot, info.MigratingTo))
+		return false
+	case missing > 0 && len(keys) > 1:
+		c.writer.WriteError("TRYAGAIN Multiple keys request during rehashing of slot")
+		return false
+	}
+	return true
+}
+
+// CLUSTER KEYSLOT key | SLOTS | SHARDS | NODES | MYID | INFO |
+// MEET ip port [bus-port] | REPLICATE id | ADDSLOTS slot [slot ...] |
+// SETSLOT slot MIGRATING|IMPORTING|NODE id | SETSLOT slot STABLE |
+// COUNTKEYSINSLOT slot | GETKEYSINSLOT slot count
+func (s *Server) clusterCommand(c *client, args []string) {
+	if len(args) < 2 {
+		wrongArgs(c, "cluster")
+		return
+	}
+	sub := strings.ToUpper(args[1])
+	if sub == "KEYSLOT" {
+		// Works without cluster mode too, like in Redis
+		if len(args) != 3 {
+			wrongArgs(c, "cluster|keyslot")
+			return
+		}
+		c.writer.WriteInteger(int64(cluster.KeySlot(args[2])))
+		return
+	}
+	if s.cluster == nil {
+		c.writer.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	switch sub {
+	case "SLOTS":
+		s.clusterSlots(c)
+	case "SHARDS":
+		s.clusterShards(c)
+	case "NODES":
+		c.writer.WriteVerbatimString("txt", s.clusterNodes())
+	case "MYID":
+		c.writer.WriteBulkString(s.cluster.MyID())
+	case "INFO":
+		c.writer.WriteVerbatimString("txt", s.clusterInfo())
+	case "MEET":
+		s.clusterMeet(c, args)
+	case "REPLICATE":
+		if len(args) != 3 {
+			wrongArgs(c, "cluster|replicate")
+			return
+		}
+		if s.role != "slave" && s.cache.Size() > 0 {
+			c.writer.WriteError("ERR To set a master the node must be empty and without assigned slots.")
+			return
+		}
+		if err := s.cluster.Replicate(args[2]); err != nil {
+			c.writer.WriteError("ERR " + err.Error())
+			return
+		}
+		c.writer.WriteSimpleString("OK")
+	case "ADDSLOTS":
+		if len(args) < 3 {
+			wrongArgs(c, "cluster|addslots")
+			return
+		}
+		slots := make([]int, 0, len(args)-2)
+		for _, arg := range args[2:] {
+			slot, err := cluster.ParseSlot(arg)
+			if err != nil {
+				c.writer.WriteError("ERR Invalid or out of range slot")
+				return
+			}
+			slots = append(slots, slot)
+		}
+		if err := s.cluster.AddSlots(slots...); err != nil {
+			c.writer.WriteError("ERR " + err.Error())
+			return
+		}
+		c.writer.WriteSimpleString("OK")
+	case "SETSLOT":
+		s.clusterSetSlot(c, args)
+	case "COUNTKEYSINSLOT":
+		if len(args) != 3 {
+			wrongArgs(c, "cluster|countkeysinslot")
+			return
+		}
+		slot, err := cluster.ParseSlot(args[2])
+		if err != nil {
+			c.writer.WriteError("ERR Invalid or out of range slot")
+			return
+		}
+		c.writer.WriteInteger(int64(s.cache.GroupSize(slot)))
+	case "GETKEYSINSLOT":
+		if len(args) != 4 {
+			wrongArgs(c, "cluster|getkeysinslot")
+			return
+		}
+		slot, err := cluster.ParseSlot(args[2])
+		if err != nil {
+			c.writer.WriteError("ERR Invalid or out of range slot")
+			return
+		}
+		count, err := strconv.Atoi(args[3])
+		if err != nil || count < 0 {
+			c.writer.WriteError("ERR Invalid number of keys")
+			return
+		}
+		c.writer.WriteBulkStrings(s.cache.GroupKeys(slot, count))
+	default:
+		c.writer.WriteError("ERR unknown subcommand '" + args[1] + "'. Try CLUSTER HELP.")
+	}
+}
+
+// CLUSTER MEET ip port [bus-port]
+// introduces the node at ip:port, whose cluster bus is on bus-port or else
+// port+10000 like in Redis, to the cluster. It is met in the background.
+func (s *Server) clusterMeet(c *client, args []string) {
+	if len(args) != 4 && len(args) != 5 {
+		wrongArgs(c, "cluster|meet")
+		return
+	}
+	port, err := strconv.Atoi(args[3])
+	if err != nil || port <= 0 || port > 65535 {
+		c.writer.WriteError("ERR Invalid base port specified: " + args[3])
+		return
+	}
+	busPort := port + 10000
+	if len(args) == 5 {
+		busPort, err = strconv.Atoi(args[4])
+		if err != nil || busPort <= 0 || busPort > 65535 {
+			c.writer.WriteError("ERR Invalid bus port specified: " + args[4])
+			return
+		}
+	}
+	if net.ParseIP(args[2]) == nil && args[2] != "localhost" {
+		c.writer.WriteError("ERR Invalid node address specified: " + args[2] + ":" + args[3])
+		return
+	}
+	s.cluster.Meet(net.JoinHostPort(args[2], strconv.Itoa(busPort)))
+	c.writer.WriteSimpleString("OK")
+}
+
+// CLUSTER SETSLOT slot MIGRATING|IMPORTING|NODE id | STABLE
+// Once a slot has moved, NODE is sent to its old and new owners, and the
+// new owner's claim reaches the other nodes by gossip.
+func (s *Server) clusterSetSlot(c *client, args []string) {
+	if len(args) < 4 {
+		wrongArgs(c, "cluster|setslot")
+		return
+	}
+	slot, err := cluster.ParseSlot(args[2])
+	if err != nil {
+		c.writer.WriteError("ERR Invalid or out of range slot")
+		return
+	}
+	action := strings.ToUpper(args[3])
+	if action == "STABLE" {
+		if len(args) != 4 {
+			c.writer.WriteError("ERR syntax error")
+			return
+		}
+		s.cluster.SetStable(slot)
+		c.writer.WriteSimpleString("OK")
+		return
+	}
+	if len(args) != 5 {
+		c.writer.WriteError("ERR syntax error")
+		return
+	}
+	id := args[4]
+	switch action {
+	case "MIGRATING":
+		err = s.cluster.SetMigrating(slot, id)
+	case "IMPORTING":
+		err = s.cluster.SetImporting(slot, id)
+	case "NODE":
+		myID := s.cluster.MyID()
+		if info := s.cluster.Slot(slot); info.OwnerID == myID && id != myID && s.cache.GroupSize(slot) > 0 {
+			c.writer.WriteError(fmt.Sprintf("ERR Can't assign hashslot %d to a different node while I still hold keys for this hash slot.", slot))
+			return
+		}
+		err = s.cluster.SetOwner(slot, id)
+	default:
+		c.writer.WriteError("ERR Invalid CLUSTER SETSLOT action or number of arguments. Try CLUSTER HELP")
+		return
+	}
+	if err != nil {
+		c.writer.WriteError("ERR " + err.Error())
+		return
+	}
+	c.writer.WriteSimpleString("OK")
+}
+
+// clusterSlots replies with [start, end, master, replica ...] for every
+// range of slots served by one master, in slot order, each node as
+// [host, port, id]. Failed replicas are left out.
+func (s *Server) clusterSlots(c *client) {
+	type entry struct {
+		r     cluster.SlotRange
+		nodes []cluster.Node
+	}
+	var entries []entry
+	for _, shard := range clusterShards(s.cluster.Nodes()) {
+		for _, r := range shard[0].Slots {
+			nodes := []cluster.Node{shard[0]}
+			for _, n := range shard[1:] {
+				if !n.Fail {
+					nodes = append(nodes, n)
+				}
+			}
+			entries = append(entries, entry{r, nodes})
+		}
+	}
+	slices.SortFunc(entries, func(a, b entry) int { return a.r.Start - b.r.Start })
+
+	c.writer.WriteArrayHeader(len(entries))
+	for _, e := range entries {
+		c.writer.WriteArrayHeader(2 + len(e.nodes))
+		c.writer.WriteInteger(int64(e.r.Start))
+		c.writer.WriteInteger(int64(e.r.End))
+		for _, n := range e.nodes {
+			host, port := splitHostPort(n.Addr)
+			c.writer.WriteArrayHeader(3)
+			c.writer.WriteBulkString(host)
+			c.writer.WriteInteger(port)
+			c.writer.WriteBulkString(n.ID)
+		}
+	}
+}
+
+// clusterShards replies with a map per master and its replicas: the
+// master's slots as a flat list of start and end slots, and the details of
+// each node
+func (s *Server) clusterShards(c *client) {
+	shards := clusterShards(s.cluster.Nodes())
+	c.writer.WriteArrayHeader(len(shards))
+	for _, shard := range shards {
+		c.writer.WriteMapHeader(2)
+		c.writer.WriteBulkString("slots")
+		c.writer.WriteArrayHeader(2 * len(shard[0].Slots))
+		for _, r := range shard[0].Slots {
+			c.writer.WriteInteger(int64(r.Start))
+			c.writer.WriteInteger(int64(r.End))
+		}
+		c.writer.WriteBulkString("nodes")
+		c.writer.WriteArrayHeader(len(shard))
+		for _, n := range shard {
+			host, port := splitHostPort(n.Addr)
+			role, health := "master", "online"
+			if n.MasterID != "" {
+				role = "replica"
+			}
+			if n.Fail {
+				health = "fail"
+			}
+			c.writer.WriteMapHeader(7)
+			c.writer.WriteBulkString("id")
+			c.writer.WriteBulkString(n.ID)
+			c.writer.WriteBulkString("port")
+			c.writer.WriteInteger(port)
+			c.writer.WriteBulkString("ip")
+			c.writer.WriteBulkString(host)
+			c.writer.WriteBulkString("endpoint")
+			c.writer.WriteBulkString(host)
+			c.writer.WriteBulkString("role")
+			c.writer.WriteBulkString(role)
+			c.writer.WriteBulkString("replication-offset")
+			c.writer.WriteInteger(n.Offset)
+			c.writer.WriteBulkString("health")
+			c.writer.WriteBulkString(health)
+		}
+	}
+}
+
+// clusterShards groups nodes into shards, each a master followed by its
+// replicas. Replicas of a master we don't know are left out.
+func clusterShards(nodes []cluster.Node) [][]cluster.Node {
+	var shards [][]cluster.Node
+	byMaster := make(map[string]int)
+	for _, n := range nodes {
+		if n.MasterID == "" {
+			byMaster[n.ID] = len(shards)
+			shards = append(shards, []cluster.Node{n})
+		}
+	}
+	for _, n := range nodes {
+		if i, ok := byMaster[n.MasterID]; ok && n.MasterID != "" {
+			shards[i] = append(shards[i], n)
+		}
+	}
+	return shards
+}
+
+// clusterNodes renders the cluster the way CLUSTER NODES does, a line per
+// node: id, address with bus port, flags, master, ping sent, pong received,
+// config epoch, link state and slots, followed on this node's line by the
+// slots it is moving. Nodes only known from the config have bus port 0.
+func (s *Server) clusterNodes() string {
+	var b strings.Builder
+	for _, n := range s.cluster.Nodes() {
+		var flags []string
+		if n.Myself {
+			flags = append(flags, "myself")
+		}
+		if n.MasterID == "" {
+			flags = append(flags, "master")
+		} else {
+			flags = append(flags, "slave")
+		}
+		if n.PFail {
+			flags = append(flags, "fail?")
+		}
+		if n.Fail {
+			flags = append(flags, "fail")
+		}
+		master, link := "-", "connected"
+		if n.MasterID != "" {
+			master = n.MasterID
+		}
+		if n.PFail || n.Fail {
+			link = "disconnected"
+		}
+		_, busPort := splitHostPort(n.BusAddr)
+		fmt.Fprintf(&b, "%s %s@%d %s %s %d %d %d %s", n.ID, n.Addr, busPort, strings.Join(flags, ","),
+			master, unixMilli(n.PingSent), unixMilli(n.PongReceived), n.ConfigEpoch, link)
+		for _, r := range n.Slots {
+			fmt.Fprintf(&b, " %s", r)
+		}
+		writeMigrations(&b, n)
+		b.WriteString("\n")
+	}
+	return b.String()
+}
+
+// unixMilli is t in milliseconds since the epoch, or 0 if t is zero
+func unixMilli(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixMilli()
+}
+
+// clusterInfo renders CLUSTER INFO. The cluster is ok once every slot is
+// served by a master that hasn't failed.
+func (s *Server) clusterInfo() string {
+	nodes := s.cluster.Nodes()
+	assigned, failed, size := 0, 0, 0
+	var myEpoch uint64
+	for _, n := range nodes {
+		served := 0
+		for _, r := range n.Slots {
+			served += r.End - r.Start + 1
+		}
+		assigned += served
+		if n.Fail {
+			failed += served
+		}
+		if served > 0 {
+			size++
+		}
+		if n.Myself {
+			myEpoch = n.ConfigEpoch
+		}
+	}
+	state := "ok"
+	if assigned < cluster.SlotCount || failed > 0 {
+		state = "fail"
+	}
+	var b strings.Builder
+	fmt.Fprintf(&b, "cluster_state:%s\r\n", state)
+	fmt.Fprintf(&b, "cluster_slots_assigned:%d\r\n", assigned)
+	fmt.Fprintf(&b, "cluster_slots_ok:%d\r\n", assigned-failed)
+	fmt.Fprintf(&b, "cluster_slots_fail:%d\r\n", failed)
+	fmt.Fprintf(&b, "cluster_known_nodes:%d\r\n", len(nodes))
+	fmt.Fprintf(&b, "cluster_size:%d\r\n", size)
+	fmt.Fprintf(&b, "cluster_current_epoch:%d\r\n", s.cluster.CurrentEpoch())
+	fmt.Fprintf(&b, "cluster_my_epoch:%d\r\n", myEpoch)
+	return b.String()
+}
+
+// writeMigrations writes the slots a node is moving the way CLUSTER NODES
+// does: [slot->-id] for those migrating to the node with that ID and
+// [slot-<-id] for those importing from it
+func writeMigrations(b *strings.Builder, n cluster.Node) {
+	type migration struct {
+		slot      int
+		direction string
+		id        string
+	}
+	var migrations []migration
+	for slot, id := range n.Migrating {
+		migrations = append(migrations, migration{slot, "->-", id})
+	}
+	for slot, id := range n.Importing {
+		migrations = append(migrations, migration{slot, "-<-", id})
+	}
+	slices.SortFunc(migrations, func(a, b migration) int { return a.slot - b.slot })
+	for _, m := range migrations {
+		fmt.Fprintf(b, " [%d%s%s]", m.slot, m.direction, m.id)
+	}
+}
@@ -0,0 +1,508 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/raft"
+	"github.com/kartikey-singh/redis/internal/replication"
+)
+
+var nextClientID atomic.Int64
+
+// staleCommands can run on a replica with replica-serve-stale-data off even
+// while its master link is down
+var staleCommands = map[string]bool{
+	"PING":  true,
+	"HELLO": true,
+	"ROLE":  true,
+	"INFO":  true,
+}
+
+// client holds the per-connection state of a client of the server.
+// It is owned by the connection's goroutine, so it needs no locking.
+type client struct {
+	id     int64
+	name   string
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer // also tracks the negotiated RESP version
+
+	// lastWriteOffset is the master's replication offset right after this
+	// client's last write; WAIT blocks until replicas have reached it
+	lastWriteOffset int64
+	// asking lets the next command use a slot being imported, see ASKING
+	asking bool
+}
+
+func newClient(conn net.Conn) *client {
+	return &client{
+		id:     nextClientID.Add(1),
+		conn:   conn,
+		reader: protocol.NewReader(conn),
+		writer: protocol.NewWriter(conn),
+	}
+}
+
+// execute runs a single command and writes its reply to the client
+func (s *Server) execute(c *client, args []string) {
+	command := strings.ToUpper(args[0])
+	if command == "RESTORE-ASKING" {
+		c.asking = true // sent by MIGRATE, always allowed in an importing slot
+	}
+	if command != "ASKING" {
+		// ASKING only lets the one command after it through
+		defer func() { c.asking = false }()
+	}
+	switch command {
+	case "REPLICAOF", "SLAVEOF":
+		s.replicaofCommand(c, args)
+		return
+	case "WAIT":
+		// Handled outside the role lock, since it can block for long
+		s.waitCommand(c, args)
+		return
+	case "MIGRATE":
+		// Takes the role lock for writing, so no command sees keys
+		// halfway through their move
+		s.migrateCommand(c, args)
+		return
+	}
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if s.role == "slave" && !s.serveStaleData && !staleCommands[command] &&
+		s.slave.LinkState() != replication.LinkConnected {
+		c.writer.WriteError("MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'.")
+		return
+	}
+	if s.cluster != nil && !s.checkSlot(c, commandKeys(command, args)) {
+		return
+	}
+	switch command {
+	case "SET":
+		s.setCommand(c, args)
+	case "GET":
+		s.getCommand(c, args)
+	case "DEL":
+		s.delCommand(c, args)
+	case "PING":
+		pingCommand(c, args)
+	case "HELLO":
+		s.helloCommand(c, args)
+	case "ROLE":
+		s.roleCommand(c)
+	case "INFO":
+		s.infoCommand(c, args)
+	case "KEYS":
+		s.keysCommand(c)
+	case "FLUSH":
+		s.flushCommand(c)
+	case "SIZE":
+		c.writer.WriteInteger(int64(s.cache.Size()))
+	case "CLUSTER":
+		s.clusterCommand(c, args)
+	case "ASKING":
+		s.askingCommand(c)
+	case "RESTORE", "RESTORE-ASKING":
+		s.restoreCommand(c, args)
+	default:
+		c.writer.WriteError("ERR unknown command '" + args[0] + "'")
+	}
+}
+
+func wrongArgs(c *client, command string) {
+	c.writer.WriteError("ERR wrong number of arguments for '" + command + "' command")
+}
+
+// writeMasterError replies with an error returned by a replicated write.
+// NOREPLICAS already carries its own error code.
+func writeMasterError(c *client, err error) {
+	if errors.Is(err, replication.ErrNoReplicas) {
+		c.writer.WriteError(err.Error())
+		return
+	}
+	c.writer.WriteError("ERR " + err.Error())
+}
+
+// writeRaftError replies with an error returned by a write in raft mode.
+// A follower redirects the client to the leader with REDIRECT host:port.
+func writeRaftError(c *client, err error) {
+	var notLeader *raft.NotLeaderError
+	switch {
+	case errors.As(err, &notLeader) && notLeader.Leader != "":
+		c.writer.WriteError("REDIRECT " + notLeader.Leader)
+	case errors.As(err, &notLeader):
+		c.writer.WriteError("TRYAGAIN No Raft leader elected yet")
+	default:
+		c.writer.WriteError("ERR " + err.Error())
+	}
+}
+
+// SET key value [EX seconds]
+// The value is taken verbatim, so it may contain spaces or any other byte.
+func (s *Server) setCommand(c *client, args []string) {
+	if len(args) < 3 {
+		wrongArgs(c, "set")
+		return
+	}
+	key, value := args[1], args[2]
+	var ttl time.Duration
+
+	// Check for TTL
+	switch {
+	case len(args) == 3:
+	case len(args) == 5 && strings.ToUpper(args[3]) == "EX":
+		t, err := strconv.Atoi(args[4])
+		if err != nil || t <= 0 {
+			c.writer.WriteError("ERR invalid expire time in 'set' command")
+			return
+		}
+		ttl = time.Duration(t) * time.Second
+	default:
+		c.writer.WriteError("ERR syntax error")
+		return
+	}
+
+	if s.set(c, key, value, ttl) {
+		c.writer.WriteSimpleString("OK")
+	}
+}
+
+// set stores a key the way the server's role writes. It replies with the
+// error and returns false if the write is refused.
+func (s *Server) set(c *client, key, value string, ttl time.Duration) bool {
+	switch s.role {
+	case "master":
+		if err := s.master.Set(key, value, ttl); err != nil {
+			writeMasterError(c, err)
+			return false
+		}
+		c.lastWriteOffset = s.master.Offset()
+	case "slave":
+		c.writer.WriteError("READONLY You can't write against a read only replica.")
+		return false
+	case "raft":
+		if err := s.raft.Set(key, value, ttl); err != nil {
+			writeRaftError(c, err)
+			return false
+		}
+	case "standalone":
+		s.cache.SetWithTTL(key, value, ttl)
+	}
+	return true
+}
+
+// GET key
+func (s *Server) getCommand(c *client, args []string) {
+	if len(args) != 2 {
+		wrongArgs(c, "get")
+		return
+	}
+	var value string
+	var found bool
+	switch s.role {
+	case "master":
+		value, found = s.master.Get(args[1])
+	case "slave":
+		value, found = s.slave.Get(args[1])
+	case "raft":
+		value, found = s.raft.Get(args[1])
+	case "standalone":
+		value, found = s.cache.Get(args[1])
+	}
+	if !found {
+		c.writer.WriteNull()
+		return
+	}
+	c.writer.WriteBulkString(value)
+}
+
+// DEL key [key ...] replies with the number of keys that were removed
+func (s *Server) delCommand(c *client, args []string) {
+	if len(args) < 2 {
+		wrongArgs(c, "del")
+		return
+	}
+	if s.role == "slave" {
+		c.writer.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+	if !s.checkWritable(c) {
+		return
+	}
+	var deleted int64
+	for _, key := range args[1:] {
+		found, ok := s.delete(c, key)
+		if !ok {
+			return
+		}
+		if found {
+			deleted++
+		}
+	}
+	c.writer.WriteInteger(deleted)
+}
+
+// delete removes a key the way the server's role writes, and reports
+// whether it was there. It replies with the error and returns ok false if
+// the write is refused. Replicas must be refused by the caller.
+func (s *Server) delete(c *client, key string) (found, ok bool) {
+	var err error
+	switch s.role {
+	case "master":
+		found, err = s.master.Delete(key)
+		if err != nil {
+			writeMasterError(c, err)
+			return false, false
+		}
+		c.lastWriteOffset = s.master.Offset()
+	case "raft":
+		found, err = s.raft.Delete(key)
+		if err != nil {
+			writeRaftError(c, err)
+			return false, false
+		}
+	case "standalone":
+		found = s.cache.Delete(key)
+	}
+	return found, true
+}
+
+// checkWritable reports whether keys can be deleted here, replying with
+// the error a delete would fail with if not, so that commands removing
+// several keys, DEL and MIGRATE, find out before removing any. Callers must
+// hold mu.
+func (s *Server) checkWritable(c *client) bool {
+	switch s.role {
+	case "master":
+		if err := s.master.CanWrite(); err != nil {
+			writeMasterError(c, err)
+			return false
+		}
+	case "raft":
+		if st := s.raft.Status(); st.Role != raft.Leader {
+			writeRaftError(c, &raft.NotLeaderError{Leader: st.LeaderAddr})
+			return false
+		}
+	}
+	return true
+}
+
+// PING [message]
+func pingCommand(c *client, args []string) {
+	switch len(args) {
+	case 1:
+		c.writer.WriteSimpleString("PONG")
+	case 2:
+		c.writer.WriteBulkString(args[1])
+	default:
+		wrongArgs(c, "ping")
+	}
+}
+
+// HELLO [protover [AUTH username password] [SETNAME clientname]]
+// switches the connection to the requested RESP version and replies with a
+// map describing the server.
+func (s *Server) helloCommand(c *client, args []string) {
+	hello, err := protocol.ParseHello(args)
+	if err != nil {
+		c.writer.WriteError(err.Error())
+		return
+	}
+	if hello.SetName {
+		c.name = hello.Name
+	}
+
+	role := "master"
+	if s.role == "slave" || s.role == "raft" && s.raft.Status().Role != raft.Leader {
+		role = "replica"
+	}
+	mode := "standalone"
+	if s.cluster != nil {
+		mode = "cluster"
+	}
+	c.writer.WriteHello(hello.Protocol, c.id, mode, role)
+}
+
+// REPLICAOF host port | REPLICAOF NO ONE
+// host and port name the master's replication port. NO ONE promotes a
+// replica to master; any other target (re-)points the server at a master,
+// demoting it first if needed.
+func (s *Server) replicaofCommand(c *client, args []string) {
+	if len(args) != 3 {
+		wrongArgs(c, strings.ToLower(args[0]))
+		return
+	}
+	// Checked before taking the role lock, which a raft write waiting to
+	// commit holds for reading
+	if s.raft != nil {
+		c.writer.WriteError("ERR REPLICAOF not allowed in raft mode")
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if strings.EqualFold(args[1], "no") && strings.EqualFold(args[2], "one") {
+		if s.role == "slave" {
+			s.promote()
+		}
+		c.writer.WriteSimpleString("OK")
+		return
+	}
+
+	port, err := strconv.Atoi(args[2])
+	if err != nil || port <= 0 || port > 65535 {
+		c.writer.WriteError("ERR Invalid master port")
+		return
+	}
+	addr := net.JoinHostPort(args[1], args[2])
+	if s.role == "slave" && s.masterAddr == addr {
+		c.writer.WriteSimpleString("OK Already connected to specified master")
+		return
+	}
+	s.follow(addr)
+	c.writer.WriteSimpleString("OK")
+}
+
+// WAIT numreplicas timeout
+// blocks until numreplicas replicas have acknowledged this connection's last
+// write, or timeout milliseconds have passed (0 waits forever), and replies
+// with the number of replicas that did. A standalone server has no replicas
+// and replies 0 at once.
+func (s *Server) waitCommand(c *client, args []string) {
+	if len(args) != 3 {
+		wrongArgs(c, "wait")
+		return
+	}
+	numReplicas, err := strconv.Atoi(args[1])
+	if err != nil {
+		c.writer.WriteError("ERR value is not an integer or out of range")
+		return
+	}
+	timeout, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil {
+		c.writer.WriteError("ERR timeout is not an integer or out of range")
+		return
+	}
+	if timeout < 0 {
+		c.writer.WriteError("ERR timeout is negative")
+		return
+	}
+
+	s.mu.RLock()
+	role, master := s.role, s.master
+	s.mu.RUnlock()
+	switch role {
+	case "slave":
+		c.writer.WriteError("ERR WAIT cannot be used with replica instances.")
+	case "raft":
+		// Writes only return once a majority has them
+		c.writer.WriteError("ERR WAIT cannot be used in raft mode")
+	case "master":
+		acked := master.WaitForReplicas(c.lastWriteOffset, numReplicas, time.Duration(timeout)*time.Millisecond)
+		c.writer.WriteInteger(int64(acked))
+	default:
+		c.writer.WriteInteger(0)
+	}
+}
+
+// ROLE replies the way Redis does:
+// master:  ["master", offset, [[ip, port, acked offset], ...]]
+// replica: ["slave", master host, master port, link state, offset]
+// In raft mode: ["raft", leader|follower|candidate, term, leader address]
+func (s *Server) roleCommand(c *client) {
+	if s.role == "raft" {
+		st := s.raft.Status()
+		c.writer.WriteArrayHeader(4)
+		c.writer.WriteBulkString("raft")
+		c.writer.WriteBulkString(string(st.Role))
+		c.writer.WriteInteger(int64(st.Term))
+		c.writer.WriteBulkString(st.LeaderAddr)
+		return
+	}
+	if s.role == "slave" {
+		host, port := splitHostPort(s.slave.MasterAddr())
+		c.writer.WriteArrayHeader(5)
+		c.writer.WriteBulkString("slave")
+		c.writer.WriteBulkString(host)
+		c.writer.WriteInteger(port)
+		c.writer.WriteBulkString(string(s.slave.LinkState()))
+		c.writer.WriteInteger(s.slave.Offset())
+		return
+	}
+
+	var offset int64
+	var replicas []replication.ReplicaStatus
+	if s.role == "master" {
+		offset = s.master.Offset()
+		replicas = s.master.Replicas()
+	}
+	c.writer.WriteArrayHeader(3)
+	c.writer.WriteBulkString("master")
+	c.writer.WriteInteger(offset)
+	c.writer.WriteArrayHeader(len(replicas))
+	for _, r := range replicas {
+		host, port := replicaHostPort(r)
+		c.writer.WriteArrayHeader(3)
+		c.writer.WriteBulkString(host)
+		c.writer.WriteBulkString(strconv.FormatInt(port, 10))
+		c.writer.WriteBulkString(strconv.FormatInt(r.AckOffset, 10))
+	}
+}
+
+// splitHostPort splits addr for replies that report host and port apart
+func splitHostPort(addr string) (string, int64) {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr, 0
+	}
+	port, _ := strconv.ParseInt(portStr, 10, 64)
+	return host, port
+}
+
+// replicaHostPort is where a replica can be reached: the port it announced,
+// or the port of its replication connection if it did not announce one
+func replicaHostPort(r replication.ReplicaStatus) (string, int64) {
+	host, port := splitHostPort(r.Addr)
+	if r.ListeningPort > 0 {
+		port = int64(r.ListeningPort)
+	}
+	return host, port
+}
+
+// KEYS replies with a set in RESP3, since keys are unique and unordered
+func (s *Server) keysCommand(c *client) {
+	keys := s.cache.Keys()
+	c.writer.WriteSetHeader(len(keys))
+	for _, key := range keys {
+		c.writer.WriteBulkString(key)
+	}
+}
+
+func (s *Server) flushCommand(c *client) {
+	switch s.role {
+	case "master":
+		if err := s.master.Flush(); err != nil {
+			writeMasterError(c, err)
+			return
+		}
+		c.lastWriteOffset = s.master.Offset()
+	case "slave":
+		c.writer.WriteError("READONLY You can't write against a read only replica.")
+		return
+	case "raft":
+		if err := s.raft.Flush(); err != nil {
+			writeRaftError(c, err)
+			return
+		}
+	case "standalone":
+		s.cache.Flush()
+	}
+	c.writer.WriteSimpleString("OK")
+}
@@ -0,0 +1,187 @@
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/raft"
+	"github.com/kartikey-singh/redis/internal/replication"
+)
+
+// infoSections lists the sections INFO knows about, in the order they are
+// printed when no section is asked for
+var infoSections = []struct {
+	name  string
+	write func(s *Server, b *strings.Builder)
+}{
+	{"server", (*Server).infoServer},
+	{"replication", (*Server).infoReplication},
+	{"raft", (*Server).infoRaft},
+	{"cluster", (*Server).infoCluster},
+}
+
+// INFO [section ...]
+// replies with "field:value" lines grouped under "# Section" headers, as a
+// verbatim string in RESP3. Unknown sections are skipped, like Redis does.
+func (s *Server) infoCommand(c *client, args []string) {
+	wanted := map[string]bool{}
+	for _, arg := range args[1:] {
+		wanted[strings.ToLower(arg)] = true
+	}
+	all := len(wanted) == 0 || wanted["all"] || wanted["everything"] || wanted["default"]
+
+	var b strings.Builder
+	for _, section := range infoSections {
+		if !all && !wanted[section.name] {
+			continue
+		}
+		if b.Len() > 0 {
+			b.WriteString("\r\n")
+		}
+		fmt.Fprintf(&b, "# %s%s\r\n", strings.ToUpper(section.name[:1]), section.name[1:])
+		section.write(s, &b)
+	}
+	c.writer.WriteVerbatimString("txt", b.String())
+}
+
+func (s *Server) infoServer(b *strings.Builder) {
+	_, port := splitHostPort(s.addr)
+	fmt.Fprintf(b, "redis_version:%s\r\n", protocol.RedisVersion)
+	fmt.Fprintf(b, "process_id:%d\r\n", os.Getpid())
+	fmt.Fprintf(b, "tcp_port:%d\r\n", port)
+	fmt.Fprintf(b, "replication_port:%d\r\n", s.replicationPort)
+	fmt.Fprintf(b, "uptime_in_seconds:%d\r\n", int64(time.Since(s.startTime).Seconds()))
+}
+
+// infoReplication follows the field names of Redis' replication section.
+// Replica lag is reported both in seconds since the last ACK (lag, as in
+// Redis) and in writes not acknowledged yet (behind).
+func (s *Server) infoReplication(b *strings.Builder) {
+	switch s.role {
+	case "slave":
+		st := s.slave.Status()
+		host, port := splitHostPort(st.MasterAddr)
+		linkStatus := "down"
+		if st.State == replication.LinkConnected {
+			linkStatus = "up"
+		}
+		lastIO := int64(-1)
+		if !st.LastIO.IsZero() {
+			lastIO = int64(time.Since(st.LastIO).Seconds())
+		}
+		syncing := 0
+		if st.State == replication.LinkSync {
+			syncing = 1
+		}
+		fmt.Fprintf(b, "role:slave\r\n")
+		fmt.Fprintf(b, "master_host:%s\r\n", host)
+		fmt.Fprintf(b, "master_port:%d\r\n", port)
+		fmt.Fprintf(b, "master_link_status:%s\r\n", linkStatus)
+		fmt.Fprintf(b, "master_link_state:%s\r\n", st.State)
+		fmt.Fprintf(b, "master_last_io_seconds_ago:%d\r\n", lastIO)
+		fmt.Fprintf(b, "master_missed_pings:%d\r\n", st.MissedPings)
+		fmt.Fprintf(b, "master_sync_in_progress:%d\r\n", syncing)
+		if linkStatus == "down" {
+			downSince := int64(-1)
+			if !st.LinkDownSince.IsZero() {
+				downSince = int64(time.Since(st.LinkDownSince).Seconds())
+			}
+			fmt.Fprintf(b, "master_link_down_since_seconds:%d\r\n", downSince)
+		}
+		fmt.Fprintf(b, "slave_repl_offset:%d\r\n", st.Offset)
+		writeReplicas(b, s.slave.Replicas())
+		fmt.Fprintf(b, "master_replid:%s\r\n", st.ReplID)
+		fmt.Fprintf(b, "master_repl_offset:%d\r\n", st.Offset)
+
+	case "master":
+		fmt.Fprintf(b, "role:master\r\n")
+		writeReplicas(b, s.master.Replicas())
+		replID2, offset2 := s.master.SecondaryReplID()
+		if replID2 == "" {
+			replID2 = strings.Repeat("0", 40)
+		}
+		stats := s.master.SyncStats()
+		fmt.Fprintf(b, "master_replid:%s\r\n", s.master.ReplID())
+		fmt.Fprintf(b, "master_replid2:%s\r\n", replID2)
+		fmt.Fprintf(b, "master_repl_offset:%d\r\n", s.master.Offset())
+		fmt.Fprintf(b, "second_repl_offset:%d\r\n", offset2)
+		fmt.Fprintf(b, "sync_full:%d\r\n", stats.Full)
+		fmt.Fprintf(b, "sync_partial_ok:%d\r\n", stats.PartialOK)
+		fmt.Fprintf(b, "sync_partial_err:%d\r\n", stats.PartialErr)
+		fmt.Fprintf(b, "client_output_buffer_limit_disconnections:%d\r\n", s.master.OutputBufferDisconnects())
+		if s.minReplicas > 0 {
+			fmt.Fprintf(b, "min_slaves_good_slaves:%d\r\n", s.master.GoodReplicas())
+		}
+
+	case "raft":
+		// Followers report the leader as their master
+		st := s.raft.Status()
+		if st.Role == raft.Leader {
+			fmt.Fprintf(b, "role:master\r\n")
+		} else {
+			host, port := splitHostPort(st.LeaderAddr)
+			fmt.Fprintf(b, "role:slave\r\n")
+			fmt.Fprintf(b, "master_host:%s\r\n", host)
+			fmt.Fprintf(b, "master_port:%d\r\n", port)
+		}
+		fmt.Fprintf(b, "connected_slaves:0\r\n")
+		fmt.Fprintf(b, "master_repl_offset:%d\r\n", st.LastApplied)
+
+	default:
+		fmt.Fprintf(b, "role:master\r\n")
+		fmt.Fprintf(b, "connected_slaves:0\r\n")
+		fmt.Fprintf(b, "master_repl_offset:0\r\n")
+	}
+}
+
+// infoRaft reports the node's part in its Raft group, or raft_enabled:0
+// outside raft mode, like Redis' cluster_enabled
+func (s *Server) infoRaft(b *strings.Builder) {
+	if s.role != "raft" {
+		fmt.Fprintf(b, "raft_enabled:0\r\n")
+		return
+	}
+	st := s.raft.Status()
+	fmt.Fprintf(b, "raft_enabled:1\r\n")
+	fmt.Fprintf(b, "raft_node_id:%s\r\n", st.ID)
+	fmt.Fprintf(b, "raft_role:%s\r\n", st.Role)
+	fmt.Fprintf(b, "raft_current_term:%d\r\n", st.Term)
+	fmt.Fprintf(b, "raft_leader_id:%s\r\n", st.Leader)
+	fmt.Fprintf(b, "raft_leader_addr:%s\r\n", st.LeaderAddr)
+	fmt.Fprintf(b, "raft_peers:%d\r\n", st.Peers)
+	fmt.Fprintf(b, "raft_last_log_index:%d\r\n", st.LastIndex)
+	fmt.Fprintf(b, "raft_commit_index:%d\r\n", st.CommitIndex)
+	fmt.Fprintf(b, "raft_last_applied:%d\r\n", st.LastApplied)
+	fmt.Fprintf(b, "raft_snapshot_index:%d\r\n", st.SnapshotIndex)
+}
+
+// infoCluster reports whether the server is in cluster mode
+func (s *Server) infoCluster(b *strings.Builder) {
+	enabled := 0
+	if s.cluster != nil {
+		enabled = 1
+	}
+	fmt.Fprintf(b, "cluster_enabled:%d\r\n", enabled)
+}
+
+// writeReplicas writes connected_slaves and a slaveN line per replica. A
+// replica lists the replicas it relays the stream to.
+func writeReplicas(b *strings.Builder, replicas []replication.ReplicaStatus) {
+	fmt.Fprintf(b, "connected_slaves:%d\r\n", len(replicas))
+	for i, r := range replicas {
+		host, port := replicaHostPort(r)
+		health := "healthy"
+		if !r.Healthy {
+			health = "unhealthy"
+		}
+		lag := int64(-1)
+		if !r.LastAck.IsZero() {
+			lag = int64(time.Since(r.LastAck).Seconds())
+		}
+		fmt.Fprintf(b, "slave%d:ip=%s,port=%d,state=online,offset=%d,lag=%d,behind=%d,health=%s,missed_pings=%d,obuf=%d\r\n",
+			i, host, port, r.AckOffset, lag, r.Lag, health, r.MissedHeartbeats, r.OutputBuffer)
+	}
+}
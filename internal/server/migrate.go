@@ -0,0 +1,204 @@
+package server
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/kartikey-singh/redis/internal/protocol"
+)
+
+// defaultMigrateTimeout is used when MIGRATE is given a timeout of 0
+const defaultMigrateTimeout = time.Second
+
+// migratedKey is a key on its way to another node, with its remaining TTL
+type migratedKey struct {
+	key, value string
+	ttl        time.Duration // 0 if the key does not expire
+}
+
+// MIGRATE host port key|"" destination-db timeout [COPY] [REPLACE] [KEYS key [key ...]]
+// moves keys, with their remaining TTL, to the server at host:port and
+// deletes them here once it has stored them. With KEYS, key must be "" and
+// every key listed is moved. There is a single database, so destination-db
+// must be 0, and timeout is in milliseconds.
+//
+// Like in Redis, the node is blocked while keys move: the role lock is held
+// for writing from when the keys are read until they are deleted, so
+// clients see each key either here or there. The target is connected to
+// before that, and the whole command is bounded by timeout, so the lock is
+// held for less than timeout.
+func (s *Server) migrateCommand(c *client, args []string) {
+	if len(args) < 6 {
+		wrongArgs(c, "migrate")
+		return
+	}
+	if port, err := strconv.Atoi(args[2]); err != nil || port <= 0 || port > 65535 {
+		c.writer.WriteError("ERR Invalid port")
+		return
+	}
+	if args[4] != "0" {
+		c.writer.WriteError("ERR DB index is out of range")
+		return
+	}
+	timeoutMs, err := strconv.ParseInt(args[5], 10, 64)
+	if err != nil {
+		c.writer.WriteError("ERR timeout is not an integer or out of range")
+		return
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	if timeout <= 0 {
+		timeout = defaultMigrateTimeout
+	}
+
+	var copyKeys, replace bool
+	keys := []string{args[3]}
+	for i := 6; i < len(args); i++ {
+		switch strings.ToUpper(args[i]) {
+		case "COPY":
+			copyKeys = true
+		case "REPLACE":
+			replace = true
+		case "KEYS":
+			if args[3] != "" {
+				c.writer.WriteError("ERR When using MIGRATE KEYS option, the key argument must be set to the empty string")
+				return
+			}
+			keys = args[i+1:]
+			i = len(args)
+		default:
+			c.writer.WriteError("ERR syntax error")
+			return
+		}
+	}
+
+	deadline := time.Now().Add(timeout)
+	dialer := net.Dialer{Deadline: deadline}
+	conn, err := dialer.Dial("tcp", net.JoinHostPort(args[1], args[2]))
+	if err != nil {
+		c.writer.WriteError("IOERR error or timeout connecting to target instance: " + err.Error())
+		return
+	}
+	defer conn.Close()
+	conn.SetDeadline(deadline)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.role == "slave" && !copyKeys {
+		c.writer.WriteError("READONLY You can't write against a read only replica.")
+		return
+	}
+	if !copyKeys && !s.checkWritable(c) {
+		return
+	}
+	var moving []migratedKey
+	for _, key := range keys {
+		if value, ttl, found := s.cache.GetWithTTL(key); found {
+			moving = append(moving, migratedKey{key: key, value: value, ttl: ttl})
+		}
+	}
+	if len(moving) == 0 {
+		c.writer.WriteSimpleString("NOKEY")
+		return
+	}
+
+	replies, err := restoreOn(conn, moving, replace)
+	if err != nil {
+		c.writer.WriteError("IOERR error or timeout migrating to target instance: " + err.Error())
+		return
+	}
+	// Keys the target refused stay here
+	var refused string
+	for i, reply := range replies {
+		if reply.IsError() {
+			refused = reply.Str
+			continue
+		}
+		if !copyKeys {
+			// Only if writes stopped being allowed since checkWritable,
+			// leaving the key on both nodes
+			if _, ok := s.delete(c, moving[i].key); !ok {
+				return
+			}
+		}
+	}
+	if refused != "" {
+		c.writer.WriteError("ERR Target instance replied with error: " + refused)
+		return
+	}
+	c.writer.WriteSimpleString("OK")
+}
+
+// restoreOn sends keys to the server on conn with RESTORE-ASKING, so it
+// takes them in a slot it is importing, and returns its reply to each
+func restoreOn(conn net.Conn, keys []migratedKey, replace bool) ([]protocol.Value, error) {
+	w := protocol.NewWriter(conn)
+	for _, k := range keys {
+		// A key about to expire must not be sent without a TTL
+		ttl := int64(0)
+		if k.ttl > 0 {
+			ttl = max(1, k.ttl.Milliseconds())
+		}
+		args := []string{"RESTORE-ASKING", k.key, strconv.FormatInt(ttl, 10), k.value}
+		if replace {
+			args = append(args, "REPLACE")
+		}
+		w.WriteCommand(args...)
+	}
+	if err := w.Flush(); err != nil {
+		return nil, err
+	}
+	r := protocol.NewReader(conn)
+	replies := make([]protocol.Value, len(keys))
+	for i := range replies {
+		var err error
+		if replies[i], err = r.ReadValue(); err != nil {
+			return nil, err
+		}
+	}
+	return replies, nil
+}
+
+// RESTORE key ttl value [REPLACE]
+// stores a key sent by MIGRATE, expiring in ttl milliseconds unless ttl is
+// 0. Keys only hold strings, so value is the value itself rather than a
+// DUMP payload like in Redis.
+func (s *Server) restoreCommand(c *client, args []string) {
+	if len(args) != 4 && len(args) != 5 {
+		wrongArgs(c, strings.ToLower(args[0]))
+		return
+	}
+	key, value := args[1], args[3]
+	ttl, err := strconv.ParseInt(args[2], 10, 64)
+	if err != nil || ttl < 0 {
+		c.writer.WriteError("ERR Invalid TTL value, must be >= 0")
+		return
+	}
+	replace := false
+	if len(args) == 5 {
+		if !strings.EqualFold(args[4], "REPLACE") {
+			c.writer.WriteError("ERR syntax error")
+			return
+		}
+		replace = true
+	}
+	if !replace && s.cache.Exists(key) {
+		c.writer.WriteError("BUSYKEY Target key name already exists.")
+		return
+	}
+	if s.set(c, key, value, time.Duration(ttl)*time.Millisecond) {
+		c.writer.WriteSimpleString("OK")
+	}
+}
+
+// ASKING lets the client's next command use a slot this node is importing,
+// after the slot's owner redirected it here with ASK
+func (s *Server) askingCommand(c *client) {
+	if s.cluster == nil {
+		c.writer.WriteError("ERR This instance has cluster support disabled")
+		return
+	}
+	c.asking = true
+	c.writer.WriteSimpleString("OK")
+}
@@ -1,26 +1,48 @@
 package server
 
 import (
-	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/kartikey-singh/redis/internal/cache"
+	"github.com/kartikey-singh/redis/internal/cluster"
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/raft"
 	"github.com/kartikey-singh/redis/internal/replication"
 )
 
 type Server struct {
 	addr            string
 	cache           *cache.Cache
-	role            string
-	masterAddr      string
 	replicationPort int
-	master          *replication.Master
-	slave           *replication.Slave
+	startTime       time.Time
+	listener        net.Listener // set by Start, guarded by mu
+	closed          bool         // set by Close, guarded by mu
+
+	// REPLICAOF can change the role at runtime. Commands hold mu for
+	// reading while they run, so they see one role from start to end.
+	mu         sync.RWMutex
+	role       string
+	masterAddr string
+	master     *replication.Master
+	slave      *replication.Slave
+	raft       *raft.Node       // in raft mode, which REPLICAOF can't leave
+	cluster    *cluster.Cluster // in cluster mode, which node serves each slot
+
+	// min-replicas-to-write settings, applied to the master on promotion too
+	minReplicas       int
+	minReplicasMaxLag time.Duration
+	// replica output buffer limits, also applied on promotion
+	outputBufferLimits replication.OutputBufferLimits
+	// serveStaleData lets a replica answer reads while its master link is
+	// down, like replica-serve-stale-data
+	serveStaleData bool
 }
 
 func New(addr string, cache *cache.Cache, role string, masterAddr string, replicationPort int) *Server {
@@ -30,15 +52,41 @@ func New(addr string, cache *cache.Cache, role string, masterAddr string, replic
 		role:            role,
 		masterAddr:      masterAddr,
 		replicationPort: replicationPort,
+		startTime:       time.Now(),
+
+		outputBufferLimits: replication.DefaultOutputBufferLimits,
+		serveStaleData:     true,
 	}
 	if role == "master" {
 		s.master = replication.NewMaster(cache)
 	} else if role == "slave" {
 		s.slave = replication.NewSlave(cache, masterAddr)
+		s.slave.SetListeningPort(s.clientPort())
 	}
 	return s
 }
 
+// NewRaft creates a server in raft mode, whose writes go through node. The
+// node must apply to c, which must have no size limit.
+func NewRaft(addr string, c *cache.Cache, node *raft.Node) *Server {
+	return &Server{
+		addr:      addr,
+		cache:     c,
+		role:      "raft",
+		raft:      node,
+		startTime: time.Now(),
+
+		outputBufferLimits: replication.DefaultOutputBufferLimits,
+		serveStaleData:     true,
+	}
+}
+
+// clientPort is the port clients connect to, announced to our master
+func (s *Server) clientPort() int {
+	_, port := splitHostPort(s.addr)
+	return int(port)
+}
+
 func (s *Server) Start() error {
 	listener, err := net.Listen("tcp", s.addr)
 	if err != nil {
@@ -48,20 +96,38 @@ func (s *Server) Start() error {
 
 	log.Printf("Server listening on %s", s.addr)
 
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		return net.ErrClosed
+	}
+	s.listener = listener
+	s.mu.Unlock()
+
+	s.mu.RLock()
 	switch s.role {
 	case "master":
-		go s.master.ListenForSlaves(fmt.Sprintf(":%d", s.replicationPort))
+		go s.listenForSlaves(s.master.ListenForSlaves)
 	case "slave":
-		if err := s.slave.ConnectToMaster(); err != nil {
-			log.Printf("Error connecting to master: %v", err)
+		// Run keeps retrying, so a master that is down or restarting
+		// doesn't stop the replica from serving reads
+		go s.slave.Run()
+		go s.listenForSlaves(s.slave.ListenForReplicas)
+	}
+	cl := s.cluster
+	s.mu.RUnlock()
+	if cl != nil {
+		if err := cl.Start(clusterRole{s}); err != nil {
 			return err
 		}
-		go s.slave.StartReplication()
 	}
 
 	for {
 		conn, err := listener.Accept()
 		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
 			log.Printf("Error accepting connection: %v", err)
 			continue // Don't exit on accept error
 		}
@@ -70,154 +136,143 @@ func (s *Server) Start() error {
 	}
 }
 
-func (s *Server) handleConnection(conn net.Conn) {
-	defer func() {
-		log.Printf("Connection closed from %s", conn.RemoteAddr())
-		conn.Close()
-	}()
+// Close stops accepting clients and shuts replication down, as if the
+// server had gone away: replicas lose their master, this server's own
+// master loses a replica, and in cluster mode the other nodes lose touch
+// with it. Connected clients are not disconnected.
+func (s *Server) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	if s.cluster != nil {
+		s.cluster.Close()
+	}
+	switch s.role {
+	case "master":
+		s.master.Close()
+	case "slave":
+		s.slave.Stop()
+	case "raft":
+		s.raft.Close()
+	}
+	if s.listener != nil {
+		return s.listener.Close()
+	}
+	return nil
+}
 
-	scanner := bufio.NewScanner(conn)
-	for scanner.Scan() {
-		line := scanner.Text()
-		parts := strings.Fields(line)
+// SetMinReplicas makes the server, while it is a master, refuse writes
+// unless n replicas are healthy and have acknowledged within maxLag
+func (s *Server) SetMinReplicas(n int, maxLag time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.minReplicas = n
+	s.minReplicasMaxLag = maxLag
+	if s.master != nil {
+		s.master.SetMinReplicas(n, maxLag)
+	}
+}
 
-		if len(parts) == 0 {
-			continue
-		}
+// SetReplicaOutputBufferLimits bounds the stream the server, while it is a
+// master, queues for each replica
+func (s *Server) SetReplicaOutputBufferLimits(limits replication.OutputBufferLimits) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.outputBufferLimits = limits
+	if s.master != nil {
+		s.master.SetOutputBufferLimits(limits)
+	}
+}
 
-		command := strings.ToUpper(parts[0])
-		log.Printf("[%s] Command: %s", conn.RemoteAddr(), line)
+// SetReplicaServeStaleData decides whether the server, while it is a replica
+// whose master link is down, keeps serving the data it has. When off, such a
+// replica answers everything but a few introspection commands with
+// MASTERDOWN.
+func (s *Server) SetReplicaServeStaleData(on bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.serveStaleData = on
+}
 
-		switch command {
-		case "SET":
-			if len(parts) < 3 {
-				conn.Write([]byte("ERR wrong number of arguments for 'set' command\n"))
-				continue
-			}
-			key := parts[1]
-			var value string
-			var ttl time.Duration
-
-			// Check for TTL
-			if len(parts) >= 5 && strings.ToUpper(parts[len(parts)-2]) == "EX" {
-				ttlValue := parts[len(parts)-1]
-				t, err := strconv.Atoi(ttlValue)
-				if err != nil || t <= 0 {
-					conn.Write([]byte("ERR invalid TTL value\n"))
-					continue
-				}
-				value = strings.Join(parts[2:len(parts)-2], " ")
-				ttl = time.Duration(t) * time.Second
-			} else {
-				value = strings.Join(parts[2:], " ")
-				ttl = 0
-			}
-			switch s.role {
-			case "master":
-				err := s.master.Set(key, value, ttl)
-				if err != nil {
-					conn.Write([]byte("ERR " + err.Error() + "\n"))
-					continue
-				}
-				conn.Write([]byte("+OK\n"))
-			case "slave":
-				conn.Write([]byte("+ERR: Slave is not allowed to set keys\n"))
-			case "standalone":
-				s.cache.SetWithTTL(key, value, ttl)
-				conn.Write([]byte("+OK\n"))
-			}
+// listenForSlaves serves replicas on the replication port with listen, a
+// master's ListenForSlaves or a replica's ListenForReplicas, until that
+// master or replica is shut down
+func (s *Server) listenForSlaves(listen func(addr string) error) {
+	if err := listen(fmt.Sprintf(":%d", s.replicationPort)); err != nil {
+		log.Printf("Replication listener error: %v", err)
+	}
+}
 
-		case "GET":
-			if len(parts) < 2 {
-				conn.Write([]byte("ERR wrong number of arguments for 'get' command\n"))
-				continue
-			}
-			switch s.role {
-			case "master":
-				value, found := s.master.Get(parts[1])
-				if !found {
-					conn.Write([]byte("(nil)\n"))
-				} else {
-					conn.Write([]byte(value + "\n"))
-				}
-			case "slave":
-				value, found := s.slave.Get(parts[1])
-				if !found {
-					conn.Write([]byte("(nil)\n"))
-				} else {
-					conn.Write([]byte(value + "\n"))
-				}
-			case "standalone":
-				value, found := s.cache.Get(parts[1])
-				if !found {
-					conn.Write([]byte("(nil)\n"))
-				} else {
-					conn.Write([]byte(value + "\n"))
-				}
-			}
+// promote turns a replica into a master that continues its master's
+// history. Callers must hold mu.
+func (s *Server) promote() {
+	replID, offset := s.slave.ReplID(), s.slave.Offset()
+	s.slave.Stop()
+	s.slave = nil
+	s.masterAddr = ""
+	s.master = replication.NewMasterFrom(s.cache, replID, offset)
+	s.master.SetMinReplicas(s.minReplicas, s.minReplicasMaxLag)
+	s.master.SetOutputBufferLimits(s.outputBufferLimits)
+	s.role = "master"
+	go s.listenForSlaves(s.master.ListenForSlaves)
+	log.Printf("Promoted to master at offset %d", offset)
+}
 
-		case "DEL":
-			if len(parts) < 2 {
-				conn.Write([]byte("ERR wrong number of arguments for 'del' command\n"))
-				continue
-			}
-			switch s.role {
-			case "master":
-				deleted := s.master.Delete(parts[1])
-				if deleted == nil {
-					conn.Write([]byte("+OK\n"))
-				} else {
-					conn.Write([]byte("+ERR: " + deleted.Error() + "\n"))
-				}
-			case "slave":
-				conn.Write([]byte("+ERR: Slave is not allowed to delete keys\n"))
-
-			case "standalone":
-				deleted := s.cache.Delete(parts[1])
-				if deleted {
-					conn.Write([]byte("+OK\n"))
-				} else {
-					conn.Write([]byte("+ERR: Key not found\n"))
-				}
-			}
+// follow makes the server a replica of the master at addr, keeping its
+// replication ID and offset so it can try a partial resync. Callers must
+// hold mu.
+func (s *Server) follow(addr string) {
+	var replID string
+	var offset int64
+	switch s.role {
+	case "master":
+		replID, offset = s.master.ReplID(), s.master.Offset()
+		s.master.Close()
+		s.master = nil
+	case "slave":
+		replID, offset = s.slave.ReplID(), s.slave.Offset()
+		s.slave.Stop()
+	}
+	s.slave = replication.NewSlaveFrom(s.cache, addr, replID, offset)
+	s.slave.SetListeningPort(s.clientPort())
+	s.masterAddr = addr
+	s.role = "slave"
+	go s.slave.Run()
+	go s.listenForSlaves(s.slave.ListenForReplicas)
+	log.Printf("Replicating from %s", addr)
+}
 
-		case "PING":
-			conn.Write([]byte("+PONG\n"))
+func (s *Server) handleConnection(conn net.Conn) {
+	defer func() {
+		log.Printf("Connection closed from %s", conn.RemoteAddr())
+		conn.Close()
+	}()
 
-		case "KEYS":
-			keys := s.cache.Keys()
-			if len(keys) == 0 {
-				conn.Write([]byte("(empty)\n"))
-			} else {
-				response := strings.Join(keys, ", ") + "\n"
-				conn.Write([]byte(response))
+	c := newClient(conn)
+	for {
+		args, err := c.reader.ReadCommand()
+		if err != nil {
+			var protoErr *protocol.ProtocolError
+			if errors.As(err, &protoErr) {
+				// The stream can't be resynchronised, so reply and hang up
+				c.writer.WriteError("ERR " + protoErr.Error())
+				c.writer.Flush()
+			}
+			if err != io.EOF {
+				log.Printf("[%s] Read error: %v", conn.RemoteAddr(), err)
 			}
+			return
+		}
+
+		log.Printf("[%s] Command: %s", conn.RemoteAddr(), strings.Join(args, " "))
+		s.execute(c, args)
 
-		case "FLUSH":
-			switch s.role {
-			case "master":
-				err := s.master.Flush()
-				if err != nil {
-					conn.Write([]byte("+ERR: " + err.Error() + "\n"))
-					continue
-				}
-				conn.Write([]byte("+OK\n"))
-			case "slave":
-				conn.Write([]byte("+ERR: Slave is not allowed to flush the cache\n"))
-			case "standalone":
-				s.cache.Flush()
-				conn.Write([]byte("+OK\n"))
+		// Only flush once every pipelined command has been answered
+		if c.reader.Buffered() == 0 {
+			if err := c.writer.Flush(); err != nil {
+				log.Printf("[%s] Write error: %v", conn.RemoteAddr(), err)
+				return
 			}
-		case "SIZE":
-			size := s.cache.Size()
-			conn.Write([]byte(fmt.Sprintf("%d\n", size)))
-		default:
-			conn.Write([]byte("ERR unknown command '" + command + "'\n"))
 		}
 	}
-	// Check for scanner errors
-	if err := scanner.Err(); err != nil {
-		log.Printf("[%s] Scanner error: %v", conn.RemoteAddr(), err)
-		return
-	}
 }
@@ -1,14 +1,17 @@
 package server
 
 import (
-	"bufio"
 	"fmt"
 	"net"
+	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/kartikey-singh/redis/internal/cache"
+	"github.com/kartikey-singh/redis/internal/cluster"
+	"github.com/kartikey-singh/redis/internal/protocol"
+	"github.com/kartikey-singh/redis/internal/raft"
 )
 
 // Helper function to start test server
@@ -32,16 +35,50 @@ func startTestServer(t *testing.T) (*Server, string, func()) {
 	// Give server time to start
 	time.Sleep(100 * time.Millisecond)
 
-	// Cleanup function
+	// Cleanup function. done is left open: Start sends on it once the
+	// server is closed, which a test may still do after cleanup.
 	cleanup := func() {
 		srv.cache.Flush()
-		close(done)
 	}
 
 	return srv, addr, cleanup
 }
 
-// Helper function to connect and send command
+// replicatedServers are the client and replication addresses of a master
+// server and one replica of it
+type replicatedServers struct {
+	master, masterRepl   string
+	replica, replicaRepl string
+	masterServer         *Server
+	replicaServer        *Server
+}
+
+// startReplicatedServers starts a master server and a replica of it. The
+// replica gets a replication port too, so it can be promoted.
+func startReplicatedServers(t *testing.T) replicatedServers {
+	addrs := make([]string, 4)
+	for i := range addrs {
+		testPortCounter++
+		addrs[i] = fmt.Sprintf("localhost:%d", testPortCounter)
+	}
+	rs := replicatedServers{master: addrs[0], masterRepl: addrs[1], replica: addrs[2], replicaRepl: addrs[3]}
+
+	masterCache := cache.New(1000)
+	t.Cleanup(masterCache.Close)
+	rs.masterServer = New(rs.master, masterCache, "master", "", testPortCounter-2)
+	go rs.masterServer.Start()
+	time.Sleep(100 * time.Millisecond)
+
+	replicaCache := cache.New(1000)
+	t.Cleanup(replicaCache.Close)
+	rs.replicaServer = New(rs.replica, replicaCache, "slave", rs.masterRepl, testPortCounter)
+	go rs.replicaServer.Start()
+	time.Sleep(200 * time.Millisecond)
+	return rs
+}
+
+// Helper function to connect and send an inline command (like nc does)
+// The reply is rendered the way redis-cli prints it
 func sendCommand(t *testing.T, addr, command string) string {
 	conn, err := net.Dial("tcp", addr)
 	if err != nil {
@@ -56,12 +93,85 @@ func sendCommand(t *testing.T, addr, command string) string {
 	}
 
 	// Read response
-	scanner := bufio.NewScanner(conn)
-	if scanner.Scan() {
-		return scanner.Text()
+	reply, err := protocol.NewReader(conn).ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return formatReply(reply)
+}
+
+// Helper function to send a command as a RESP array of bulk strings
+func sendRESP(t *testing.T, addr string, args ...string) protocol.Value {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	w := protocol.NewWriter(conn)
+	w.WriteCommand(args...)
+	if err := w.Flush(); err != nil {
+		t.Fatalf("Failed to write: %v", err)
+	}
+	reply, err := protocol.NewReader(conn).ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	return reply
+}
+
+// testConn is a persistent client connection for tests that need
+// per-connection state, e.g. the protocol negotiated by HELLO
+type testConn struct {
+	t      *testing.T
+	conn   net.Conn
+	reader *protocol.Reader
+	writer *protocol.Writer
+}
+
+func dialTest(t *testing.T, addr string) *testConn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return &testConn{t: t, conn: conn, reader: protocol.NewReader(conn), writer: protocol.NewWriter(conn)}
+}
+
+func (c *testConn) do(args ...string) protocol.Value {
+	c.writer.WriteCommand(args...)
+	if err := c.writer.Flush(); err != nil {
+		c.t.Fatalf("Failed to write: %v", err)
+	}
+	c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	reply, err := c.reader.ReadValue()
+	if err != nil {
+		c.t.Fatalf("Failed to read reply to %v: %v", args, err)
 	}
+	return reply
+}
 
-	return ""
+func formatReply(v protocol.Value) string {
+	switch v.Type {
+	case protocol.Error:
+		return "(error) " + v.Str
+	case protocol.Integer:
+		return fmt.Sprintf("(integer) %d", v.Int)
+	case protocol.Array:
+		if len(v.Array) == 0 {
+			return "(empty array)"
+		}
+		items := make([]string, len(v.Array))
+		for i, elem := range v.Array {
+			items[i] = formatReply(elem)
+		}
+		return strings.Join(items, "\n")
+	default:
+		if v.Null {
+			return "(nil)"
+		}
+		return v.Str
+	}
 }
 
 func TestServerBasicCommands(t *testing.T) {
@@ -71,8 +181,8 @@ func TestServerBasicCommands(t *testing.T) {
 
 	// Test PING
 	response := sendCommand(t, addr, "PING")
-	if response != "+PONG" {
-		t.Errorf("PING failed: expected '+PONG', got '%s'", response)
+	if response != "PONG" {
+		t.Errorf("PING failed: expected 'PONG', got '%s'", response)
 	}
 
 	// Test SET
@@ -95,8 +205,8 @@ func TestServerBasicCommands(t *testing.T) {
 
 	// Test DEL
 	response = sendCommand(t, addr, "DEL testkey")
-	if !strings.Contains(response, "OK") {
-		t.Errorf("DEL failed: expected 'OK', got '%s'", response)
+	if response != "(integer) 1" {
+		t.Errorf("DEL failed: expected '(integer) 1', got '%s'", response)
 	}
 
 	// Verify key is deleted
@@ -132,8 +242,8 @@ func TestServerSIZECommand(t *testing.T) {
 
 	// Test SIZE on empty cache
 	response := sendCommand(t, addr, "SIZE")
-	if response != "0" {
-		t.Errorf("SIZE on empty cache: expected '0', got '%s'", response)
+	if response != "(integer) 0" {
+		t.Errorf("SIZE on empty cache: expected '(integer) 0', got '%s'", response)
 	}
 
 	// Add some keys
@@ -142,8 +252,8 @@ func TestServerSIZECommand(t *testing.T) {
 
 	// Test SIZE
 	response = sendCommand(t, addr, "SIZE")
-	if response != "2" {
-		t.Errorf("SIZE after 2 sets: expected '2', got '%s'", response)
+	if response != "(integer) 2" {
+		t.Errorf("SIZE after 2 sets: expected '(integer) 2', got '%s'", response)
 	}
 }
 
@@ -158,8 +268,8 @@ func TestServerFLUSHCommand(t *testing.T) {
 
 	// Verify they exist
 	response := sendCommand(t, addr, "SIZE")
-	if response != "2" {
-		t.Errorf("SIZE before FLUSH: expected '2', got '%s'", response)
+	if response != "(integer) 2" {
+		t.Errorf("SIZE before FLUSH: expected '(integer) 2', got '%s'", response)
 	}
 
 	// FLUSH
@@ -170,8 +280,8 @@ func TestServerFLUSHCommand(t *testing.T) {
 
 	// Verify cache is empty
 	response = sendCommand(t, addr, "SIZE")
-	if response != "0" {
-		t.Errorf("SIZE after FLUSH: expected '0', got '%s'", response)
+	if response != "(integer) 0" {
+		t.Errorf("SIZE after FLUSH: expected '(integer) 0', got '%s'", response)
 	}
 }
 
@@ -180,13 +290,53 @@ func TestServerValuesWithSpaces(t *testing.T) {
 	defer cleanup()
 	_ = srv
 
-	// Set value with spaces
-	sendCommand(t, addr, "SET greeting hello world from redis")
+	// Set value with spaces (quoted, like redis-cli)
+	sendCommand(t, addr, `SET greeting "hello world  from redis"`)
 
-	// Get it back
+	// Get it back, whitespace preserved
 	response := sendCommand(t, addr, "GET greeting")
-	if response != "hello world from redis" {
-		t.Errorf("GET with spaces: expected 'hello world from redis', got '%s'", response)
+	if response != "hello world  from redis" {
+		t.Errorf("GET with spaces: expected 'hello world  from redis', got '%s'", response)
+	}
+
+	// Unquoted extra words are a syntax error rather than being joined
+	response = sendCommand(t, addr, "SET greeting hello world")
+	if !strings.Contains(response, "ERR syntax error") {
+		t.Errorf("SET with unquoted spaces: expected syntax error, got '%s'", response)
+	}
+}
+
+func TestServerBinarySafe(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	key := "bin\x00key with spaces\r\n"
+	value := "\x00\x01  \r\n\xff value"
+	if reply := sendRESP(t, addr, "SET", key, value); reply.Str != "OK" {
+		t.Fatalf("SET binary: expected OK, got %+v", reply)
+	}
+	reply := sendRESP(t, addr, "GET", key)
+	if reply.Str != value {
+		t.Errorf("GET binary: expected %q, got %q", value, reply.Str)
+	}
+	reply = sendRESP(t, addr, "KEYS")
+	if len(reply.Array) != 1 || reply.Array[0].Str != key {
+		t.Errorf("KEYS binary: expected [%q], got %+v", key, reply)
+	}
+
+	// Inline commands can express the same bytes with escapes
+	response := sendCommand(t, addr, `GET "bin\x00key with spaces\r\n"`)
+	if response != value {
+		t.Errorf("inline GET binary: expected %q, got %q", value, response)
+	}
+
+	// Value and EX may be combined with a value that looks like an option
+	if reply := sendRESP(t, addr, "SET", "k", "EX", "EX", "10"); reply.Str != "OK" {
+		t.Errorf("SET k EX EX 10: expected OK, got %+v", reply)
+	}
+	if reply := sendRESP(t, addr, "GET", "k"); reply.Str != "EX" {
+		t.Errorf("GET k: expected 'EX', got %+v", reply)
 	}
 }
 
@@ -226,8 +376,8 @@ func TestServerConcurrentConnections(t *testing.T) {
 
 	// Verify all keys exist
 	response := sendCommand(t, addr, "SIZE")
-	if response != "10" {
-		t.Errorf("SIZE after concurrent writes: expected '10', got '%s'", response)
+	if response != "(integer) 10" {
+		t.Errorf("SIZE after concurrent writes: expected '(integer) 10', got '%s'", response)
 	}
 }
 
@@ -273,7 +423,7 @@ func TestServerCaseInsensitivity(t *testing.T) {
 
 	// Test mixed case
 	response = sendCommand(t, addr, "DeL mykey")
-	if !strings.Contains(response, "OK") {
+	if response != "(integer) 1" {
 		t.Errorf("Mixed case DEL failed: got '%s'", response)
 	}
 }
@@ -288,4 +438,872 @@ func TestServerTTL(t *testing.T) {
 	if !strings.Contains(response, "OK") {
 		t.Errorf("SET with TTL failed: got '%s'", response)
 	}
-}
\ No newline at end of file
+}
+func TestServerRESPCommands(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	reply := sendRESP(t, addr, "SET", "key1", "value1")
+	if reply.Type != protocol.SimpleString || reply.Str != "OK" {
+		t.Errorf("SET: expected +OK, got %+v", reply)
+	}
+
+	reply = sendRESP(t, addr, "GET", "key1")
+	if reply.Type != protocol.BulkString || reply.Str != "value1" {
+		t.Errorf("GET: expected bulk 'value1', got %+v", reply)
+	}
+
+	reply = sendRESP(t, addr, "GET", "missing")
+	if reply.Type != protocol.BulkString || !reply.Null {
+		t.Errorf("GET missing: expected null bulk, got %+v", reply)
+	}
+
+	sendRESP(t, addr, "SET", "key2", "value2")
+	reply = sendRESP(t, addr, "DEL", "key1", "key2", "missing")
+	if reply.Type != protocol.Integer || reply.Int != 2 {
+		t.Errorf("DEL: expected :2, got %+v", reply)
+	}
+
+	sendRESP(t, addr, "SET", "key3", "value3")
+	reply = sendRESP(t, addr, "KEYS")
+	if reply.Type != protocol.Array || len(reply.Array) != 1 || reply.Array[0].Str != "key3" {
+		t.Errorf("KEYS: expected [key3], got %+v", reply)
+	}
+
+	reply = sendRESP(t, addr, "NOPE")
+	if !reply.IsError() || !strings.HasPrefix(reply.Str, "ERR unknown command") {
+		t.Errorf("unknown command: expected error, got %+v", reply)
+	}
+}
+
+func TestServerPipelining(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Send several commands in one write, mixing RESP and inline
+	w := protocol.NewWriter(conn)
+	w.WriteCommand("SET", "k", "v")
+	w.WriteCommand("GET", "k")
+	w.Flush()
+	conn.Write([]byte("PING\r\n"))
+
+	r := protocol.NewReader(conn)
+	want := []string{"OK", "v", "PONG"}
+	for i, expected := range want {
+		reply, err := r.ReadValue()
+		if err != nil {
+			t.Fatalf("reply %d: %v", i, err)
+		}
+		if reply.Str != expected {
+			t.Errorf("reply %d: expected %q, got %+v", i, expected, reply)
+		}
+	}
+}
+
+func TestServerProtocolError(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	conn.Write([]byte("*1\r\n+PING\r\n"))
+	r := protocol.NewReader(conn)
+	reply, err := r.ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if !reply.IsError() || !strings.Contains(reply.Str, "Protocol error") {
+		t.Errorf("expected protocol error, got %+v", reply)
+	}
+
+	// The server closes the connection after a protocol error
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	if _, err := r.ReadValue(); err == nil {
+		t.Error("expected connection to be closed after protocol error")
+	}
+}
+
+func TestServerEmptyMultibulk(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("Failed to connect: %v", err)
+	}
+	defer conn.Close()
+
+	// Empty and null multibulks are skipped, not answered
+	conn.Write([]byte("*0\r\n*-1\r\nPING\r\n"))
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	reply, err := protocol.NewReader(conn).ReadValue()
+	if err != nil {
+		t.Fatalf("Failed to read reply: %v", err)
+	}
+	if reply.Str != "PONG" {
+		t.Errorf("expected PONG, got %+v", reply)
+	}
+}
+
+func TestServerHELLO(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	c := dialTest(t, addr)
+	c.do("SET", "key1", "value1")
+
+	// RESP2 by default: KEYS is an array and a missing key a null bulk string
+	if reply := c.do("KEYS"); reply.Type != protocol.Array {
+		t.Errorf("KEYS before HELLO: expected array, got %+v", reply)
+	}
+	if reply := c.do("GET", "missing"); reply.Type != protocol.BulkString || !reply.Null {
+		t.Errorf("GET before HELLO: expected null bulk, got %+v", reply)
+	}
+
+	reply := c.do("HELLO", "3", "SETNAME", "tester")
+	if reply.Type != protocol.Map {
+		t.Fatalf("HELLO 3: expected map, got %+v", reply)
+	}
+	fields := map[string]protocol.Value{}
+	for i := 0; i+1 < len(reply.Array); i += 2 {
+		fields[reply.Array[i].Str] = reply.Array[i+1]
+	}
+	if fields["proto"].Int != 3 {
+		t.Errorf("HELLO 3: expected proto 3, got %+v", fields["proto"])
+	}
+	if fields["server"].Str != "redis" || fields["role"].Str != "master" {
+		t.Errorf("HELLO 3: unexpected fields %+v", fields)
+	}
+
+	// RESP3 from now on: KEYS is a set and a missing key the null type
+	if reply := c.do("KEYS"); reply.Type != protocol.Set || len(reply.Array) != 1 {
+		t.Errorf("KEYS after HELLO 3: expected set of 1, got %+v", reply)
+	}
+	if reply := c.do("GET", "missing"); reply.Type != protocol.Null {
+		t.Errorf("GET after HELLO 3: expected null, got %+v", reply)
+	}
+
+	// Other connections are unaffected
+	if reply := sendRESP(t, addr, "KEYS"); reply.Type != protocol.Array {
+		t.Errorf("KEYS on another connection: expected array, got %+v", reply)
+	}
+
+	// Switching back to RESP2
+	if reply := c.do("HELLO", "2"); reply.Type != protocol.Array || len(reply.Array) != 14 {
+		t.Errorf("HELLO 2: expected flat array of 14, got %+v", reply)
+	}
+	if reply := c.do("KEYS"); reply.Type != protocol.Array {
+		t.Errorf("KEYS after HELLO 2: expected array, got %+v", reply)
+	}
+}
+
+func TestServerHELLOErrors(t *testing.T) {
+	srv, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	_ = srv
+
+	c := dialTest(t, addr)
+	if reply := c.do("HELLO", "4"); !reply.IsError() || !strings.HasPrefix(reply.Str, "NOPROTO") {
+		t.Errorf("HELLO 4: expected NOPROTO, got %+v", reply)
+	}
+	if reply := c.do("HELLO", "three"); !reply.IsError() {
+		t.Errorf("HELLO three: expected error, got %+v", reply)
+	}
+	if reply := c.do("HELLO", "3", "SETNAME"); !reply.IsError() {
+		t.Errorf("HELLO 3 SETNAME: expected syntax error, got %+v", reply)
+	}
+
+	// A failed HELLO leaves the connection in RESP2
+	if reply := c.do("GET", "missing"); reply.Type != protocol.BulkString || !reply.Null {
+		t.Errorf("expected RESP2 null bulk after failed HELLO, got %+v", reply)
+	}
+}
+
+func TestServerROLE(t *testing.T) {
+	rs := startReplicatedServers(t)
+
+	sendRESP(t, rs.master, "SET", "k", "v")
+	time.Sleep(100 * time.Millisecond)
+
+	reply := sendRESP(t, rs.replica, "ROLE")
+	if len(reply.Array) != 5 {
+		t.Fatalf("replica ROLE: expected 5 elements, got %+v", reply)
+	}
+	_, port, _ := net.SplitHostPort(rs.masterRepl)
+	if got := formatReply(reply); got != "slave\nlocalhost\n(integer) "+port+"\nconnected\n(integer) 1" {
+		t.Errorf("replica ROLE: got\n%s", got)
+	}
+
+	reply = sendRESP(t, rs.master, "ROLE")
+	if len(reply.Array) != 3 || reply.Array[0].Str != "master" || reply.Array[1].Int != 1 {
+		t.Fatalf("master ROLE: unexpected reply %+v", reply)
+	}
+	replicas := reply.Array[2].Array
+	if len(replicas) != 1 || len(replicas[0].Array) != 3 {
+		t.Fatalf("master ROLE: expected one replica entry, got %+v", reply.Array[2])
+	}
+	// Replicas announce the port they serve clients on
+	if _, clientPort, _ := net.SplitHostPort(rs.replica); replicas[0].Array[1].Str != clientPort {
+		t.Errorf("master ROLE: replica port %q, want its client port %s", replicas[0].Array[1].Str, clientPort)
+	}
+
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	if got := formatReply(sendRESP(t, addr, "ROLE")); got != "master\n(integer) 0\n(empty array)" {
+		t.Errorf("standalone ROLE: got\n%s", got)
+	}
+}
+
+// waitForReply polls a command until its formatted reply is want
+func waitForReply(t *testing.T, addr, want string, args ...string) {
+	t.Helper()
+	deadline := time.Now().Add(3 * time.Second)
+	for {
+		got := formatReply(sendRESP(t, addr, args...))
+		if got == want {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v on %s: got %q, want %q", args, addr, got, want)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestServerREPLICAOF(t *testing.T) {
+	rs := startReplicatedServers(t)
+
+	sendRESP(t, rs.master, "SET", "before", "1")
+	waitForReply(t, rs.replica, "1", "GET", "before")
+
+	// Promote the replica
+	if got := formatReply(sendRESP(t, rs.replica, "REPLICAOF", "NO", "ONE")); got != "OK" {
+		t.Fatalf("REPLICAOF NO ONE: got %q", got)
+	}
+	if reply := sendRESP(t, rs.replica, "ROLE"); reply.Array[0].Str != "master" {
+		t.Errorf("promoted replica ROLE: got %+v", reply)
+	}
+	if got := formatReply(sendRESP(t, rs.replica, "SET", "after", "2")); got != "OK" {
+		t.Fatalf("SET on promoted replica: got %q", got)
+	}
+
+	// Demote the old master under the new one
+	host, port, _ := net.SplitHostPort(rs.replicaRepl)
+	if got := formatReply(sendRESP(t, rs.master, "SLAVEOF", host, port)); got != "OK" {
+		t.Fatalf("SLAVEOF: got %q", got)
+	}
+	waitForReply(t, rs.master, "2", "GET", "after")
+	if got := formatReply(sendRESP(t, rs.master, "SET", "x", "y")); !strings.HasPrefix(got, "(error) READONLY") {
+		t.Errorf("SET on demoted master: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, rs.master, "REPLICAOF", host, port)); got != "OK Already connected to specified master" {
+		t.Errorf("repeated REPLICAOF: got %q", got)
+	}
+
+	errorCases := [][]string{
+		{"REPLICAOF", "localhost"},
+		{"REPLICAOF", "localhost", "notaport"},
+		{"REPLICAOF", "localhost", "70000"},
+	}
+	for _, args := range errorCases {
+		if reply := sendRESP(t, rs.master, args...); reply.Type != protocol.Error {
+			t.Errorf("%v: expected error, got %+v", args, reply)
+		}
+	}
+}
+
+// infoFields parses an INFO reply into its field:value pairs
+func infoFields(v protocol.Value) map[string]string {
+	fields := map[string]string{}
+	for _, line := range strings.Split(v.Str, "\r\n") {
+		if key, value, ok := strings.Cut(line, ":"); ok && !strings.HasPrefix(line, "#") {
+			fields[key] = value
+		}
+	}
+	return fields
+}
+
+func TestServerINFO(t *testing.T) {
+	rs := startReplicatedServers(t)
+	sendRESP(t, rs.master, "SET", "k", "v")
+	time.Sleep(100 * time.Millisecond)
+
+	reply := sendRESP(t, rs.master, "INFO", "replication")
+	if reply.Type != protocol.BulkString || !strings.HasPrefix(reply.Str, "# Replication\r\n") {
+		t.Fatalf("INFO replication: unexpected reply %+v", reply)
+	}
+	fields := infoFields(reply)
+	if fields["role"] != "master" || fields["connected_slaves"] != "1" || fields["master_repl_offset"] != "1" {
+		t.Errorf("master INFO: unexpected fields %v", fields)
+	}
+	// The replica acknowledges once a second
+	deadline := time.Now().Add(3 * time.Second)
+	for !strings.Contains(fields["slave0"], "offset=1,") && time.Now().Before(deadline) {
+		time.Sleep(50 * time.Millisecond)
+		fields = infoFields(sendRESP(t, rs.master, "INFO", "replication"))
+	}
+	if !strings.Contains(fields["slave0"], "offset=1,") || !strings.Contains(fields["slave0"], "health=healthy") {
+		t.Errorf("master INFO: unexpected replica line %q", fields["slave0"])
+	}
+	if _, ok := fields["redis_version"]; ok {
+		t.Error("INFO replication should not include the server section")
+	}
+
+	fields = infoFields(sendRESP(t, rs.replica, "INFO"))
+	want := map[string]string{
+		"role":                       "slave",
+		"master_link_status":         "up",
+		"master_last_io_seconds_ago": "0",
+		"slave_repl_offset":          "1",
+		"redis_version":              protocol.RedisVersion,
+	}
+	for key, value := range want {
+		if fields[key] != value {
+			t.Errorf("replica INFO %s: got %q, want %q", key, fields[key], value)
+		}
+	}
+
+	// RESP3 clients get a verbatim string
+	c := dialTest(t, rs.replica)
+	c.do("HELLO", "3")
+	if reply := c.do("INFO", "replication"); reply.Type != protocol.VerbatimString || reply.Format != "txt" {
+		t.Errorf("INFO over RESP3: expected verbatim txt, got %+v", reply)
+	}
+	if reply := c.do("INFO", "nosuchsection"); reply.Str != "" {
+		t.Errorf("INFO with unknown section: expected empty, got %q", reply.Str)
+	}
+}
+
+func TestServerWAIT(t *testing.T) {
+	rs := startReplicatedServers(t)
+
+	c := dialTest(t, rs.master)
+	c.do("SET", "k", "v")
+	if got := formatReply(c.do("WAIT", "1", "2000")); got != "(integer) 1" {
+		t.Errorf("WAIT 1: got %q", got)
+	}
+	start := time.Now()
+	if got := formatReply(c.do("WAIT", "2", "100")); got != "(integer) 1" {
+		t.Errorf("WAIT 2: got %q", got)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		t.Error("WAIT 2 should have waited for its timeout")
+	}
+
+	if reply := sendRESP(t, rs.replica, "WAIT", "1", "0"); !strings.HasPrefix(reply.Str, "ERR WAIT cannot be used") {
+		t.Errorf("WAIT on replica: got %+v", reply)
+	}
+	for _, args := range [][]string{{"WAIT", "1"}, {"WAIT", "x", "0"}, {"WAIT", "1", "-1"}} {
+		if reply := c.do(args...); reply.Type != protocol.Error {
+			t.Errorf("%v: expected error, got %+v", args, reply)
+		}
+	}
+
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	if got := formatReply(sendRESP(t, addr, "WAIT", "1", "0")); got != "(integer) 0" {
+		t.Errorf("WAIT on standalone: got %q", got)
+	}
+}
+
+func TestServerMinReplicasToWrite(t *testing.T) {
+	rs := startReplicatedServers(t)
+	sendRESP(t, rs.master, "SET", "moving", "v")
+	rs.masterServer.SetMinReplicas(2, 10*time.Second)
+
+	for _, args := range [][]string{{"SET", "k", "v"}, {"DEL", "k"}, {"DEL", "k", "moving"}, {"FLUSH"}} {
+		reply := sendRESP(t, rs.master, args...)
+		if reply.Type != protocol.Error || reply.Str != "NOREPLICAS Not enough good replicas to write." {
+			t.Errorf("%v: expected NOREPLICAS, got %+v", args, reply)
+		}
+	}
+
+	// MIGRATE finds out before sending a key it couldn't delete here
+	target, targetAddr, cleanup := startTestServer(t)
+	defer cleanup()
+	defer target.Close()
+	_, port := splitHostPort(targetAddr)
+	if got := formatReply(sendRESP(t, rs.master, "MIGRATE", "localhost", strconv.FormatInt(port, 10), "moving", "0", "1000")); !strings.Contains(got, "NOREPLICAS") {
+		t.Errorf("MIGRATE: expected NOREPLICAS, got %q", got)
+	}
+	if target.cache.Exists("moving") {
+		t.Error("MIGRATE sent a key it couldn't delete")
+	}
+
+	// The replica ACKs once a second, so it soon counts as good
+	rs.masterServer.SetMinReplicas(1, 10*time.Second)
+	waitForReply(t, rs.master, "OK", "SET", "k", "v")
+	if fields := infoFields(sendRESP(t, rs.master, "INFO", "replication")); fields["min_slaves_good_slaves"] != "1" {
+		t.Errorf("INFO: expected 1 good replica, got %q", fields["min_slaves_good_slaves"])
+	}
+}
+
+func TestServerReplicaServeStaleData(t *testing.T) {
+	rs := startReplicatedServers(t)
+	rs.replicaServer.SetReplicaServeStaleData(false)
+
+	sendRESP(t, rs.master, "SET", "k", "v")
+	waitForReply(t, rs.replica, "v", "GET", "k")
+
+	// Follow a master that isn't there, so the link stays down
+	testPortCounter++
+	if got := formatReply(sendRESP(t, rs.replica, "REPLICAOF", "localhost", strconv.Itoa(testPortCounter))); got != "OK" {
+		t.Fatalf("REPLICAOF: got %q", got)
+	}
+	want := "(error) MASTERDOWN Link with MASTER is down and replica-serve-stale-data is set to 'no'."
+	for _, args := range [][]string{{"GET", "k"}, {"KEYS"}, {"SIZE"}} {
+		if got := formatReply(sendRESP(t, rs.replica, args...)); got != want {
+			t.Errorf("%v: got %q, want MASTERDOWN", args, got)
+		}
+	}
+	if got := formatReply(sendRESP(t, rs.replica, "PING")); got != "PONG" {
+		t.Errorf("PING should still work, got %q", got)
+	}
+	if fields := infoFields(sendRESP(t, rs.replica, "INFO", "replication")); fields["master_link_status"] != "down" {
+		t.Errorf("INFO: expected the link down, got %q", fields["master_link_status"])
+	}
+
+	// With the default, the replica serves what it has
+	rs.replicaServer.SetReplicaServeStaleData(true)
+	if got := formatReply(sendRESP(t, rs.replica, "GET", "k")); got != "v" {
+		t.Errorf("GET with stale data allowed: got %q", got)
+	}
+}
+
+func TestServerChainedReplica(t *testing.T) {
+	rs := startReplicatedServers(t)
+
+	// A replica of the replica, fed through its replication port
+	testPortCounter += 2
+	leafAddr := fmt.Sprintf("localhost:%d", testPortCounter-1)
+	leafCache := cache.New(1000)
+	t.Cleanup(leafCache.Close)
+	leaf := New(leafAddr, leafCache, "slave", rs.replicaRepl, testPortCounter)
+	go leaf.Start()
+
+	sendRESP(t, rs.master, "SET", "k", "v")
+	waitForReply(t, leafAddr, "v", "GET", "k")
+
+	if fields := infoFields(sendRESP(t, rs.master, "INFO", "replication")); fields["connected_slaves"] != "1" {
+		t.Errorf("master should only serve the first replica, INFO says %q", fields["connected_slaves"])
+	}
+	fields := infoFields(sendRESP(t, rs.replica, "INFO", "replication"))
+	if fields["role"] != "slave" || fields["connected_slaves"] != "1" || fields["slave0"] == "" {
+		t.Errorf("replica INFO should list its own replica: %v", fields)
+	}
+	if got := formatReply(sendRESP(t, leafAddr, "SET", "x", "y")); !strings.HasPrefix(got, "(error) READONLY") {
+		t.Errorf("SET on a chained replica: got %q", got)
+	}
+}
+
+func TestServerRaft(t *testing.T) {
+	network := raft.NewInmemNetwork()
+	addrs := make([]string, 3)
+	for i := range addrs {
+		testPortCounter++
+		addrs[i] = fmt.Sprintf("localhost:%d", testPortCounter)
+	}
+	for i, addr := range addrs {
+		var peers []string
+		for j, peer := range addrs {
+			if j != i {
+				peers = append(peers, peer)
+			}
+		}
+		c := cache.New(0)
+		t.Cleanup(c.Close)
+		node, err := raft.NewNode(c, raft.Config{
+			ID:                addr,
+			Peers:             peers,
+			ClientAddr:        addr,
+			Transport:         network.Transport(addr),
+			ElectionTimeout:   50 * time.Millisecond,
+			HeartbeatInterval: 10 * time.Millisecond,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		network.Register(addr, node)
+		srv := NewRaft(addr, c, node)
+		t.Cleanup(func() { srv.Close() })
+		go srv.Start()
+	}
+	time.Sleep(100 * time.Millisecond)
+
+	// Every node names the same leader once one is elected
+	var leader string
+	deadline := time.Now().Add(3 * time.Second)
+	for leader == "" {
+		if time.Now().After(deadline) {
+			t.Fatal("no Raft leader was elected")
+		}
+		time.Sleep(20 * time.Millisecond)
+		role := sendRESP(t, addrs[0], "ROLE")
+		if len(role.Array) != 4 || role.Array[0].Str != "raft" {
+			t.Fatalf("ROLE in raft mode: got %s", formatReply(role))
+		}
+		leader = role.Array[3].Str
+	}
+
+	if got := formatReply(sendRESP(t, leader, "SET", "k", "v")); got != "OK" {
+		t.Fatalf("SET on the leader: got %q", got)
+	}
+	for _, addr := range addrs {
+		if addr == leader {
+			continue
+		}
+		waitForReply(t, addr, "v", "GET", "k")
+		if got := formatReply(sendRESP(t, addr, "SET", "k", "w")); got != "(error) REDIRECT "+leader {
+			t.Errorf("SET on a follower: got %q, want a redirect to %s", got, leader)
+		}
+		fields := infoFields(sendRESP(t, addr, "INFO", "raft"))
+		if fields["raft_role"] != "follower" || fields["raft_leader_addr"] != leader {
+			t.Errorf("follower INFO raft: %v", fields)
+		}
+	}
+	if got := formatReply(sendRESP(t, leader, "DEL", "k", "missing")); got != "(integer) 1" {
+		t.Errorf("DEL on the leader: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, leader, "REPLICAOF", "NO", "ONE")); !strings.HasPrefix(got, "(error) ERR") {
+		t.Errorf("REPLICAOF in raft mode: got %q", got)
+	}
+	if fields := infoFields(sendRESP(t, leader, "INFO", "raft")); fields["raft_enabled"] != "1" || fields["raft_role"] != "leader" {
+		t.Errorf("leader INFO raft: %v", fields)
+	}
+}
+
+// startClusterServers starts standalone servers in cluster mode, all told
+// the layout in config, in which %d stands for their ports in turn
+func startClusterServers(t *testing.T, n int, config string) ([]*Server, []string) {
+	addrs := make([]string, n)
+	ports := make([]any, n)
+	for i := range addrs {
+		testPortCounter++
+		addrs[i] = fmt.Sprintf("localhost:%d", testPortCounter)
+		ports[i] = testPortCounter
+	}
+	config = fmt.Sprintf(config, ports...)
+	servers := make([]*Server, n)
+	for i, addr := range addrs {
+		c := cache.New(1000)
+		t.Cleanup(c.Close)
+		cl := cluster.New(cluster.Config{Addr: addr})
+		if err := cl.LoadConfig(strings.NewReader(config)); err != nil {
+			t.Fatal(err)
+		}
+		srv := New(addr, c, "standalone", "", 0)
+		srv.SetCluster(cl)
+		t.Cleanup(func() { srv.Close() })
+		go srv.Start()
+		servers[i] = srv
+	}
+	time.Sleep(100 * time.Millisecond)
+	return servers, addrs
+}
+
+func TestServerCluster(t *testing.T) {
+	_, addrs := startClusterServers(t, 2, "localhost:%d 0-8191\nlocalhost:%d 8192-16000\n")
+
+	// foo is in slot 12182, served by the second node
+	if got := formatReply(sendRESP(t, addrs[0], "SET", "foo", "1")); got != "(error) MOVED 12182 "+addrs[1] {
+		t.Errorf("SET on the wrong node: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[1], "SET", "foo", "1")); got != "OK" {
+		t.Errorf("SET on the owner: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "GET", "foo")); got != "(error) MOVED 12182 "+addrs[1] {
+		t.Errorf("GET on the wrong node: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[1], "GET", "foo")); got != "1" {
+		t.Errorf("GET on the owner: got %q", got)
+	}
+
+	// Keys of one command must share a slot, which a hashtag ensures
+	sendRESP(t, addrs[0], "SET", "{bar}.a", "1")
+	if got := formatReply(sendRESP(t, addrs[0], "DEL", "{bar}.a", "{bar}.b")); got != "(integer) 1" {
+		t.Errorf("DEL of keys with one hashtag: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "DEL", "foo", "bar")); !strings.HasPrefix(got, "(error) CROSSSLOT") {
+		t.Errorf("DEL across slots: got %q", got)
+	}
+
+	// Slots 16001 and up have no owner until a node claims them
+	key := "key:0"
+	for i := 1; cluster.KeySlot(key) <= 16000; i++ {
+		key = fmt.Sprintf("key:%d", i)
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "GET", key)); !strings.HasPrefix(got, "(error) CLUSTERDOWN") {
+		t.Errorf("GET of an unserved slot: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[1], "CLUSTER", "ADDSLOTS", "8192")); !strings.HasPrefix(got, "(error) ERR Slot 8192 is already busy") {
+		t.Errorf("ADDSLOTS of a busy slot: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "CLUSTER", "ADDSLOTS", strconv.Itoa(cluster.KeySlot(key)))); got != "OK" {
+		t.Errorf("ADDSLOTS: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "GET", key)); got != "(nil)" {
+		t.Errorf("GET of a claimed slot: got %q", got)
+	}
+
+	if got := formatReply(sendRESP(t, addrs[0], "CLUSTER", "KEYSLOT", "{user1000}.following")); got != "(integer) 3443" {
+		t.Errorf("CLUSTER KEYSLOT: got %q", got)
+	}
+
+	slots := sendRESP(t, addrs[1], "CLUSTER", "SLOTS")
+	if len(slots.Array) != 2 {
+		t.Fatalf("CLUSTER SLOTS: got\n%s", formatReply(slots))
+	}
+	host, port, _ := net.SplitHostPort(addrs[1])
+	second := slots.Array[1]
+	if second.Array[0].Int != 8192 || second.Array[1].Int != 16000 ||
+		second.Array[2].Array[0].Str != host || strconv.FormatInt(second.Array[2].Array[1].Int, 10) != port {
+		t.Errorf("CLUSTER SLOTS second range: got\n%s", formatReply(second))
+	}
+
+	myID := sendRESP(t, addrs[1], "CLUSTER", "MYID").Str
+	nodes := sendRESP(t, addrs[1], "CLUSTER", "NODES").Str
+	if !strings.Contains(nodes, myID+" "+addrs[1]+"@0 myself,master - 0 0 0 connected 8192-16000\n") {
+		t.Errorf("CLUSTER NODES: got\n%s", nodes)
+	}
+
+	shards := dialTest(t, addrs[1])
+	hello := shards.do("HELLO", "3")
+	for i := 0; i+1 < len(hello.Array); i += 2 {
+		if hello.Array[i].Str == "mode" && hello.Array[i+1].Str != "cluster" {
+			t.Errorf("HELLO mode: got %q", hello.Array[i+1].Str)
+		}
+	}
+	reply := shards.do("CLUSTER", "SHARDS")
+	if len(reply.Array) != 2 || reply.Array[0].Type != protocol.Map {
+		t.Fatalf("CLUSTER SHARDS: got %+v", reply)
+	}
+
+	if fields := infoFields(sendRESP(t, addrs[0], "CLUSTER", "INFO")); fields["cluster_state"] != "fail" || fields["cluster_known_nodes"] != "2" {
+		t.Errorf("CLUSTER INFO: %v", fields)
+	}
+	if fields := infoFields(sendRESP(t, addrs[0], "INFO", "cluster")); fields["cluster_enabled"] != "1" {
+		t.Errorf("INFO cluster: %v", fields)
+	}
+}
+
+func TestServerClusterDisabled(t *testing.T) {
+	_, addr, cleanup := startTestServer(t)
+	defer cleanup()
+	if got := formatReply(sendRESP(t, addr, "CLUSTER", "SLOTS")); !strings.HasPrefix(got, "(error) ERR This instance has cluster support disabled") {
+		t.Errorf("CLUSTER SLOTS without cluster mode: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addr, "CLUSTER", "KEYSLOT", "foo")); got != "(integer) 12182" {
+		t.Errorf("CLUSTER KEYSLOT without cluster mode: got %q", got)
+	}
+	if fields := infoFields(sendRESP(t, addr, "INFO", "cluster")); fields["cluster_enabled"] != "0" {
+		t.Errorf("INFO cluster: %v", fields)
+	}
+}
+
+func TestServerClusterMigration(t *testing.T) {
+	servers, addrs := startClusterServers(t, 2, "localhost:%d 0-16383\nlocalhost:%d\n")
+	source, target := addrs[0], addrs[1]
+	sourceID := sendRESP(t, source, "CLUSTER", "MYID").Str
+	targetID := sendRESP(t, target, "CLUSTER", "MYID").Str
+	slot := strconv.Itoa(cluster.KeySlot("{m}"))
+	for _, key := range []string{"{m}1", "{m}2", "{m}3"} {
+		sendRESP(t, source, "SET", key, "v"+key)
+	}
+	sendRESP(t, source, "SET", "{m}ttl", "t", "EX", "100")
+	if got := formatReply(sendRESP(t, source, "CLUSTER", "COUNTKEYSINSLOT", slot)); got != "(integer) 4" {
+		t.Errorf("COUNTKEYSINSLOT: got %q", got)
+	}
+	if keys := sendRESP(t, source, "CLUSTER", "GETKEYSINSLOT", slot, "3"); len(keys.Array) != 3 {
+		t.Errorf("GETKEYSINSLOT with a count of 3: got %+v", keys)
+	}
+
+	if got := formatReply(sendRESP(t, target, "CLUSTER", "SETSLOT", slot, "IMPORTING", sourceID)); got != "OK" {
+		t.Fatalf("SETSLOT IMPORTING: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, source, "CLUSTER", "SETSLOT", slot, "MIGRATING", targetID)); got != "OK" {
+		t.Fatalf("SETSLOT MIGRATING: got %q", got)
+	}
+	if nodes := sendRESP(t, source, "CLUSTER", "NODES").Str; !strings.Contains(nodes, "["+slot+"->-"+targetID+"]") {
+		t.Errorf("CLUSTER NODES on the source doesn't show the migration:\n%s", nodes)
+	}
+	if got := formatReply(sendRESP(t, source, "CLUSTER", "SETSLOT", slot, "NODE", targetID)); !strings.HasPrefix(got, "(error) ERR Can't assign") {
+		t.Errorf("SETSLOT NODE with keys left: got %q", got)
+	}
+
+	if got := formatReply(sendRESP(t, source, "MIGRATE", "localhost", strconv.Itoa(servers[1].clientPort()), "", "0", "5000", "KEYS", "{m}1", "{m}ttl", "{m}missing")); got != "OK" {
+		t.Fatalf("MIGRATE: got %q", got)
+	}
+	if _, ttl, found := servers[1].cache.GetWithTTL("{m}ttl"); !found || ttl <= 90*time.Second || ttl > 100*time.Second {
+		t.Errorf("migrated key's TTL: got %v, %v", ttl, found)
+	}
+	if got := formatReply(sendRESP(t, source, "CLUSTER", "COUNTKEYSINSLOT", slot)); got != "(integer) 2" {
+		t.Errorf("COUNTKEYSINSLOT after MIGRATE: got %q", got)
+	}
+
+	// Keys still on the source are served there, the others are asked for
+	// on the target
+	if got := formatReply(sendRESP(t, source, "GET", "{m}2")); got != "v{m}2" {
+		t.Errorf("GET of a key not moved yet: got %q", got)
+	}
+	ask := "(error) ASK " + slot + " localhost:" + strconv.Itoa(servers[1].clientPort())
+	for _, args := range [][]string{{"GET", "{m}1"}, {"SET", "{m}new", "v"}} {
+		if got := formatReply(sendRESP(t, source, args...)); got != ask {
+			t.Errorf("%v on the source: got %q, want %q", args, got, ask)
+		}
+	}
+	if got := formatReply(sendRESP(t, source, "DEL", "{m}1", "{m}2")); !strings.HasPrefix(got, "(error) TRYAGAIN") {
+		t.Errorf("DEL of keys split between nodes: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, target, "GET", "{m}1")); got != "(error) MOVED "+slot+" "+source {
+		t.Errorf("GET on the target without ASKING: got %q", got)
+	}
+	conn := dialTest(t, target)
+	if got := formatReply(conn.do("ASKING")); got != "OK" {
+		t.Fatalf("ASKING: got %q", got)
+	}
+	if got := formatReply(conn.do("GET", "{m}1")); got != "v{m}1" {
+		t.Errorf("GET on the target after ASKING: got %q", got)
+	}
+	if got := formatReply(conn.do("GET", "{m}1")); !strings.HasPrefix(got, "(error) MOVED") {
+		t.Errorf("ASKING let a second command through: got %q", got)
+	}
+
+	// A key already on the target is only replaced with REPLACE
+	conn.do("ASKING")
+	if got := formatReply(conn.do("SET", "{m}2", "there")); got != "OK" {
+		t.Fatalf("SET on the target after ASKING: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, source, "MIGRATE", "localhost", strconv.Itoa(servers[1].clientPort()), "{m}2", "0", "5000")); !strings.Contains(got, "BUSYKEY") {
+		t.Errorf("MIGRATE of a key the target has: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, source, "MIGRATE", "localhost", strconv.Itoa(servers[1].clientPort()), "", "0", "5000", "REPLACE", "KEYS", "{m}2", "{m}3")); got != "OK" {
+		t.Fatalf("MIGRATE of the remaining keys: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, source, "MIGRATE", "localhost", strconv.Itoa(servers[1].clientPort()), "{m}1", "0", "5000")); got != "NOKEY" {
+		t.Errorf("MIGRATE of a missing key: got %q", got)
+	}
+
+	for _, addr := range addrs {
+		if got := formatReply(sendRESP(t, addr, "CLUSTER", "SETSLOT", slot, "NODE", targetID)); got != "OK" {
+			t.Fatalf("SETSLOT NODE on %s: got %q", addr, got)
+		}
+	}
+	if got := formatReply(sendRESP(t, target, "GET", "{m}2")); got != "v{m}2" {
+		t.Errorf("GET on the new owner: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, source, "GET", "{m}1")); got != "(error) MOVED "+slot+" "+target {
+		t.Errorf("GET on the old owner: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, target, "CLUSTER", "COUNTKEYSINSLOT", slot)); got != "(integer) 4" {
+		t.Errorf("COUNTKEYSINSLOT on the new owner: got %q", got)
+	}
+}
+
+func TestServerClusterFailover(t *testing.T) {
+	// Three masters and a replica, which meet over the cluster bus
+	var servers []*Server
+	var addrs []string
+	for i := range 4 {
+		testPortCounter++
+		addr := fmt.Sprintf("localhost:%d", testPortCounter)
+		replPort := 19100 + i
+		c := cache.New(1000)
+		t.Cleanup(c.Close)
+		cl := cluster.New(cluster.Config{
+			Addr:        addr,
+			BusAddr:     fmt.Sprintf("localhost:%d", 18400+i),
+			ReplAddr:    fmt.Sprintf("localhost:%d", replPort),
+			NodeTimeout: 300 * time.Millisecond,
+		})
+		role := "master"
+		if i == 3 {
+			role = "standalone"
+		}
+		srv := New(addr, c, role, "", replPort)
+		srv.SetCluster(cl)
+		t.Cleanup(func() { srv.Close() })
+		go srv.Start()
+		servers = append(servers, srv)
+		addrs = append(addrs, addr)
+	}
+	time.Sleep(100 * time.Millisecond)
+	for i, slots := range [][]string{{"0", "1"}, {"5061"}, {"12182"}} {
+		if got := formatReply(sendRESP(t, addrs[i], append([]string{"CLUSTER", "ADDSLOTS"}, slots...)...)); got != "OK" {
+			t.Fatalf("ADDSLOTS: got %q", got)
+		}
+	}
+	for i := 1; i < 4; i++ {
+		_, port := splitHostPort(addrs[i])
+		if got := formatReply(sendRESP(t, addrs[0], "CLUSTER", "MEET", "127.0.0.1", strconv.FormatInt(port, 10), strconv.Itoa(18400+i))); got != "OK" {
+			t.Fatalf("CLUSTER MEET: got %q", got)
+		}
+	}
+	for _, i := range []int{0, 1, 3} {
+		waitForReply(t, addrs[i], "(error) MOVED 12182 "+addrs[2], "GET", "foo")
+	}
+	if got := formatReply(sendRESP(t, addrs[0], "CLUSTER", "MEET", "127.0.0.1", "0")); !strings.HasPrefix(got, "(error) ERR Invalid base port") {
+		t.Errorf("CLUSTER MEET with a bad port: got %q", got)
+	}
+
+	masterID := sendRESP(t, addrs[2], "CLUSTER", "MYID").Str
+	if got := formatReply(sendRESP(t, addrs[0], "CLUSTER", "REPLICATE", masterID)); !strings.HasPrefix(got, "(error) ERR To set a master") {
+		t.Errorf("REPLICATE on a master with slots: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[3], "CLUSTER", "REPLICATE", masterID)); got != "OK" {
+		t.Fatalf("REPLICATE: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[2], "SET", "foo", "bar")); got != "OK" {
+		t.Fatalf("SET on the master: got %q", got)
+	}
+	deadline := time.Now().Add(3 * time.Second)
+	for value, _ := servers[3].cache.Get("foo"); value != "bar"; value, _ = servers[3].cache.Get("foo") {
+		if time.Now().After(deadline) {
+			t.Fatal("the replica didn't get foo")
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	replicaID := sendRESP(t, addrs[3], "CLUSTER", "MYID").Str
+	deadline = time.Now().Add(3 * time.Second)
+	for nodes := ""; !strings.Contains(nodes, replicaID+" "+addrs[3]+"@18403 slave "+masterID+" "); {
+		if time.Now().After(deadline) {
+			t.Fatalf("CLUSTER NODES doesn't show the replica:\n%s", nodes)
+		}
+		time.Sleep(20 * time.Millisecond)
+		nodes = sendRESP(t, addrs[0], "CLUSTER", "NODES").Str
+	}
+	if slots := sendRESP(t, addrs[0], "CLUSTER", "SLOTS"); len(slots.Array) != 3 || len(slots.Array[2].Array) != 4 {
+		t.Errorf("CLUSTER SLOTS doesn't show the replica: %+v", slots)
+	}
+
+	// The master goes away and the replica takes over its slots
+	servers[2].Close()
+	for _, addr := range addrs[:2] {
+		waitForReply(t, addr, "(error) MOVED 12182 "+addrs[3], "GET", "foo")
+	}
+	if got := formatReply(sendRESP(t, addrs[3], "GET", "foo")); got != "bar" {
+		t.Errorf("GET on the new master: got %q", got)
+	}
+	if got := formatReply(sendRESP(t, addrs[3], "SET", "foo", "baz")); got != "OK" {
+		t.Errorf("SET on the new master: got %q", got)
+	}
+	if nodes := sendRESP(t, addrs[0], "CLUSTER", "NODES").Str; !strings.Contains(nodes, masterID+" "+addrs[2]+"@18402 master,fail - ") {
+		t.Errorf("CLUSTER NODES doesn't show the failed master:\n%s", nodes)
+	}
+	if fields := infoFields(sendRESP(t, addrs[3], "CLUSTER", "INFO")); fields["cluster_my_epoch"] == "0" || fields["cluster_known_nodes"] != "4" {
+		t.Errorf("CLUSTER INFO on the new master: %v", fields)
+	}
+}
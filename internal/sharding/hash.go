@@ -0,0 +1,63 @@
+package sharding
+
+import (
+	"hash/crc32"
+	"hash/fnv"
+)
+
+// HashFunc maps a key, or a virtual node's name, to a position on the ring
+type HashFunc func(data []byte) uint32
+
+// FNV1a is the 32-bit FNV-1a hash. It is fast, but similar inputs, like the
+// names of one node's virtual nodes, land close together, so spread them
+// with more virtual nodes or use Murmur3.
+func FNV1a(data []byte) uint32 {
+	h := fnv.New32a()
+	h.Write(data)
+	return h.Sum32()
+}
+
+// CRC32 is the IEEE CRC-32 checksum. Like FNV1a, it spreads similar inputs
+// poorly.
+func CRC32(data []byte) uint32 {
+	return crc32.ChecksumIEEE(data)
+}
+
+// Murmur3 is the 32-bit MurmurHash3 with seed 0. It mixes well, so it is
+// the default.
+func Murmur3(data []byte) uint32 {
+	const c1, c2 = 0xcc9e2d51, 0x1b873593
+	var h uint32
+	n := len(data)
+	for ; len(data) >= 4; data = data[4:] {
+		k := uint32(data[0]) | uint32(data[1])<<8 | uint32(data[2])<<16 | uint32(data[3])<<24
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+		h = h<<13 | h>>19
+		h = h*5 + 0xe6546b64
+	}
+	var k uint32
+	switch len(data) {
+	case 3:
+		k ^= uint32(data[2]) << 16
+		fallthrough
+	case 2:
+		k ^= uint32(data[1]) << 8
+		fallthrough
+	case 1:
+		k ^= uint32(data[0])
+		k *= c1
+		k = k<<15 | k>>17
+		k *= c2
+		h ^= k
+	}
+	h ^= uint32(n)
+	h ^= h >> 16
+	h *= 0x85ebca6b
+	h ^= h >> 13
+	h *= 0xc2b2ae35
+	h ^= h >> 16
+	return h
+}
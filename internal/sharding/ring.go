@@ -0,0 +1,252 @@
+// Package sharding spreads keys over nodes with a consistent-hash ring.
+//
+// Each node is placed on a ring of 2^32 positions at several points, its
+// virtual nodes. A key belongs to the node of the first point at or after
+// the key's hash, going round. Adding or removing a node only moves the
+// keys between its points and their neighbours', about 1/n of them, and
+// Add and Remove report exactly which ranges of the ring changed owner.
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"slices"
+	"strconv"
+	"sync"
+)
+
+// DefaultVirtualNodes is how many points a node gets on the ring by default
+const DefaultVirtualNodes = 160
+
+var (
+	ErrNodeExists  = errors.New("sharding: node already on the ring")
+	ErrNoSuchNode  = errors.New("sharding: node not on the ring")
+	ErrInvalidNode = errors.New("sharding: node needs a name and at least one virtual node")
+)
+
+// Range is the part of the ring after Start, up to and including End. It
+// wraps past the top of the ring when End <= Start, and is the whole ring
+// when they are equal.
+type Range struct {
+	Start, End uint32
+}
+
+// Contains reports whether position h is in the range
+func (r Range) Contains(h uint32) bool {
+	if r.Start < r.End {
+		return r.Start < h && h <= r.End
+	}
+	return h > r.Start || h <= r.End
+}
+
+// Size is the number of positions in the range
+func (r Range) Size() uint64 {
+	if r.Start == r.End {
+		return 1 << 32
+	}
+	return uint64(r.End - r.Start) // wraps around for End < Start
+}
+
+func (r Range) String() string {
+	return fmt.Sprintf("(%d, %d]", r.Start, r.End)
+}
+
+// Move is a range of the ring whose keys change owner. From is "" for keys
+// that had no owner, on a ring that was empty, and To is "" for keys left
+// without one.
+type Move struct {
+	Range    Range
+	From, To string
+}
+
+// point is one virtual node
+type point struct {
+	hash uint32
+	node string
+}
+
+// Ring is a consistent-hash ring, safe for concurrent use
+type Ring struct {
+	hash   HashFunc
+	vnodes int
+
+	mu     sync.RWMutex
+	points []point        // sorted by hash, then node
+	nodes  map[string]int // virtual nodes of each node
+}
+
+// NewRing creates an empty ring that gives nodes vnodes points each, or
+// DefaultVirtualNodes if vnodes is 0, and hashes with hash, or Murmur3 if
+// hash is nil
+func NewRing(vnodes int, hash HashFunc) *Ring {
+	if vnodes <= 0 {
+		vnodes = DefaultVirtualNodes
+	}
+	if hash == nil {
+		hash = Murmur3
+	}
+	return &Ring{hash: hash, vnodes: vnodes, nodes: make(map[string]int)}
+}
+
+// Add puts node on the ring with the ring's number of virtual nodes
+func (r *Ring) Add(node string) ([]Move, error) {
+	return r.AddWeighted(node, r.vnodes)
+}
+
+// AddWeighted puts node on the ring with vnodes virtual nodes, so it gets
+// a share of the keys in proportion to vnodes. It returns the ranges that
+// move to node.
+func (r *Ring) AddWeighted(node string, vnodes int) ([]Move, error) {
+	if node == "" || vnodes <= 0 {
+		return nil, ErrInvalidNode
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; ok {
+		return nil, ErrNodeExists
+	}
+	points := slices.Clone(r.points)
+	for i := range vnodes {
+		points = append(points, point{hash: r.hash([]byte(node + "#" + strconv.Itoa(i))), node: node})
+	}
+	slices.SortFunc(points, comparePoints)
+	moves := diff(r.points, points)
+	r.points = points
+	r.nodes[node] = vnodes
+	return moves, nil
+}
+
+// Remove takes node off the ring and returns the ranges that move from it
+func (r *Ring) Remove(node string) ([]Move, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.nodes[node]; !ok {
+		return nil, ErrNoSuchNode
+	}
+	points := slices.DeleteFunc(slices.Clone(r.points), func(p point) bool { return p.node == node })
+	moves := diff(r.points, points)
+	r.points = points
+	delete(r.nodes, node)
+	return moves, nil
+}
+
+func comparePoints(a, b point) int {
+	if a.hash != b.hash {
+		if a.hash < b.hash {
+			return -1
+		}
+		return 1
+	}
+	// Two nodes on the same position: the first by name owns it, on every
+	// ring that has both
+	switch {
+	case a.node < b.node:
+		return -1
+	case a.node > b.node:
+		return 1
+	}
+	return 0
+}
+
+// Get returns the node key belongs to, or false if the ring is empty
+func (r *Ring) Get(key string) (string, bool) {
+	h := r.Hash(key)
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	node := owner(r.points, h)
+	return node, node != ""
+}
+
+// Hash returns key's position on the ring
+func (r *Ring) Hash(key string) uint32 {
+	return r.hash([]byte(key))
+}
+
+// Nodes returns the nodes on the ring, sorted
+func (r *Ring) Nodes() []string {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	nodes := make([]string, 0, len(r.nodes))
+	for node := range r.nodes {
+		nodes = append(nodes, node)
+	}
+	slices.Sort(nodes)
+	return nodes
+}
+
+// Shares returns the fraction of the ring, and so of keys with evenly
+// spread hashes, each node owns
+func (r *Ring) Shares() map[string]float64 {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	shares := make(map[string]float64, len(r.nodes))
+	for node := range r.nodes {
+		shares[node] = 0 // listed even if all its points are taken
+	}
+	for i, p := range r.points {
+		prev := r.points[(i+len(r.points)-1)%len(r.points)]
+		if i > 0 && prev.hash == p.hash {
+			continue // a later point on a taken position owns nothing
+		}
+		shares[p.node] += float64(Range{Start: prev.hash, End: p.hash}.Size()) / (1 << 32)
+	}
+	return shares
+}
+
+// owner returns the node of the first point at or after h, going round, or
+// "" if there are no points
+func owner(points []point, h uint32) string {
+	if len(points) == 0 {
+		return ""
+	}
+	i, _ := slices.BinarySearchFunc(points, h, func(p point, h uint32) int {
+		if p.hash < h {
+			return -1
+		}
+		if p.hash > h {
+			return 1
+		}
+		return 0
+	})
+	if i == len(points) {
+		i = 0
+	}
+	return points[i].node
+}
+
+// diff returns the ranges whose owner differs between two rings. Between
+// two consecutive positions of either ring the owner is the same on each,
+// so it compares owners one such segment at a time and merges neighbouring
+// segments with the same change.
+func diff(before, after []point) []Move {
+	var bounds []uint32
+	for _, p := range before {
+		bounds = append(bounds, p.hash)
+	}
+	for _, p := range after {
+		bounds = append(bounds, p.hash)
+	}
+	slices.Sort(bounds)
+	bounds = slices.Compact(bounds)
+
+	var moves []Move
+	for i, end := range bounds {
+		from, to := owner(before, end), owner(after, end)
+		if from == to {
+			continue
+		}
+		start := bounds[(i+len(bounds)-1)%len(bounds)]
+		if n := len(moves); n > 0 && moves[n-1].Range.End == start && moves[n-1].From == from && moves[n-1].To == to {
+			moves[n-1].Range.End = end
+			continue
+		}
+		moves = append(moves, Move{Range: Range{Start: start, End: end}, From: from, To: to})
+	}
+	// The last move may continue into the first, across the top of the ring
+	if n := len(moves); n > 1 && moves[n-1].Range.End == moves[0].Range.Start &&
+		moves[n-1].From == moves[0].From && moves[n-1].To == moves[0].To {
+		moves[0].Range.Start = moves[n-1].Range.Start
+		moves = moves[:n-1]
+	}
+	return moves
+}
@@ -0,0 +1,273 @@
+package sharding
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+)
+
+var hashes = map[string]HashFunc{"FNV1a": FNV1a, "CRC32": CRC32, "Murmur3": Murmur3}
+
+func TestMurmur3(t *testing.T) {
+	tests := []struct {
+		in   string
+		want uint32
+	}{
+		{"", 0},
+		{"a", 0x3c2569b2},
+		{"hello", 0x248bfa47},
+		{"The quick brown fox jumps over the lazy dog", 0x2e4ff723},
+	}
+	for _, tt := range tests {
+		if got := Murmur3([]byte(tt.in)); got != tt.want {
+			t.Errorf("Murmur3(%q) = %#x, want %#x", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		r    Range
+		h    uint32
+		want bool
+	}{
+		{Range{10, 20}, 10, false},
+		{Range{10, 20}, 15, true},
+		{Range{10, 20}, 20, true},
+		{Range{10, 20}, 21, false},
+		{Range{math.MaxUint32 - 5, 5}, math.MaxUint32, true},
+		{Range{math.MaxUint32 - 5, 5}, 0, true},
+		{Range{math.MaxUint32 - 5, 5}, 6, false},
+		{Range{7, 7}, 7, true},
+		{Range{7, 7}, 8, true},
+	}
+	for _, tt := range tests {
+		if got := tt.r.Contains(tt.h); got != tt.want {
+			t.Errorf("%v.Contains(%d) = %v, want %v", tt.r, tt.h, got, tt.want)
+		}
+	}
+	if got := (Range{math.MaxUint32 - 5, 5}).Size(); got != 11 {
+		t.Errorf("wrapping range size = %d, want 11", got)
+	}
+}
+
+func TestRingErrors(t *testing.T) {
+	r := NewRing(0, nil)
+	if _, ok := r.Get("k"); ok {
+		t.Error("an empty ring should own no keys")
+	}
+	if _, err := r.Add("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := r.Add("a"); !errors.Is(err, ErrNodeExists) {
+		t.Errorf("adding a node twice: got %v", err)
+	}
+	if _, err := r.Remove("b"); !errors.Is(err, ErrNoSuchNode) {
+		t.Errorf("removing a missing node: got %v", err)
+	}
+	if _, err := r.AddWeighted("b", 0); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("adding a node without virtual nodes: got %v", err)
+	}
+	if _, err := r.Add(""); !errors.Is(err, ErrInvalidNode) {
+		t.Errorf("adding a node without a name: got %v", err)
+	}
+}
+
+func TestFirstAndLastNodeOwnTheWholeRing(t *testing.T) {
+	r := NewRing(8, nil)
+	moves, _ := r.Add("a")
+	if len(moves) != 1 || moves[0].From != "" || moves[0].To != "a" || moves[0].Range.Size() != 1<<32 {
+		t.Fatalf("first node should take the whole ring, got %v", moves)
+	}
+	if node, _ := r.Get("any key"); node != "a" {
+		t.Errorf("single node ring gave %q", node)
+	}
+	moves, _ = r.Remove("a")
+	if len(moves) != 1 || moves[0].From != "a" || moves[0].To != "" || moves[0].Range.Size() != 1<<32 {
+		t.Fatalf("last node should give up the whole ring, got %v", moves)
+	}
+}
+
+// owners maps each of keys to its node
+func owners(r *Ring, keys []string) map[string]string {
+	m := make(map[string]string, len(keys))
+	for _, k := range keys {
+		m[k], _ = r.Get(k)
+	}
+	return m
+}
+
+// checkMoves verifies that exactly the keys whose owner changed are in a
+// reported move, with the right source and destination
+func checkMoves(t *testing.T, r *Ring, keys []string, before, after map[string]string, moves []Move) int {
+	t.Helper()
+	moved := 0
+	for _, k := range keys {
+		h := r.Hash(k)
+		var in *Move
+		for i := range moves {
+			if moves[i].Range.Contains(h) {
+				in = &moves[i]
+				break
+			}
+		}
+		switch {
+		case before[k] == after[k] && in != nil:
+			t.Fatalf("key %q stays on %s but is in move %v", k, before[k], *in)
+		case before[k] != after[k] && in == nil:
+			t.Fatalf("key %q moves from %s to %s outside any reported move", k, before[k], after[k])
+		case before[k] != after[k] && (in.From != before[k] || in.To != after[k]):
+			t.Fatalf("key %q moves from %s to %s, reported as %v", k, before[k], after[k], *in)
+		}
+		if before[k] != after[k] {
+			moved++
+		}
+	}
+	return moved
+}
+
+func TestAddAndRemoveReportExactMoves(t *testing.T) {
+	keys := make([]string, 20000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key:%d", i)
+	}
+	for name, hash := range hashes {
+		t.Run(name, func(t *testing.T) {
+			r := NewRing(50, hash)
+			for i := range 5 {
+				r.Add(fmt.Sprintf("node-%d", i))
+			}
+
+			before := owners(r, keys)
+			moves, err := r.Add("node-5")
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := owners(r, keys)
+			moved := checkMoves(t, r, keys, before, after, moves)
+			for _, m := range moves {
+				if m.To != "node-5" {
+					t.Fatalf("adding node-5 moved %v elsewhere", m)
+				}
+			}
+			// Only the new node's share of keys moves, about 1/6 of them
+			if frac := float64(moved) / float64(len(keys)); frac < 0.05 || frac > 0.35 {
+				t.Errorf("adding a sixth node moved %.2f of the keys", frac)
+			}
+
+			moves, err = r.Remove("node-2")
+			if err != nil {
+				t.Fatal(err)
+			}
+			final := owners(r, keys)
+			checkMoves(t, r, keys, after, final, moves)
+			for _, m := range moves {
+				if m.From != "node-2" {
+					t.Fatalf("removing node-2 moved %v", m)
+				}
+			}
+		})
+	}
+}
+
+// relativeStdDev is the standard deviation of loads over their mean: 0
+// when every node has the same load
+func relativeStdDev(loads []float64) float64 {
+	var sum float64
+	for _, l := range loads {
+		sum += l
+	}
+	mean := sum / float64(len(loads))
+	var sq float64
+	for _, l := range loads {
+		sq += (l - mean) * (l - mean)
+	}
+	return math.Sqrt(sq/float64(len(loads))) / mean
+}
+
+func TestDistribution(t *testing.T) {
+	keys := make([]string, 200000)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("user:%d", i)
+	}
+	for _, n := range []int{3, 10, 25, 50, 100} {
+		t.Run(fmt.Sprintf("%d nodes", n), func(t *testing.T) {
+			r := NewRing(0, nil)
+			for i := range n {
+				r.Add(fmt.Sprintf("10.0.0.%d:6379", i))
+			}
+
+			var shares []float64
+			var total float64
+			for _, s := range r.Shares() {
+				shares = append(shares, s)
+				total += s
+			}
+			if math.Abs(total-1) > 1e-9 {
+				t.Fatalf("shares add up to %v", total)
+			}
+			if sd := relativeStdDev(shares); sd > 0.12 {
+				t.Errorf("ring shares vary by %.3f of the mean", sd)
+			}
+
+			counts := make(map[string]float64)
+			for _, k := range keys {
+				node, _ := r.Get(k)
+				counts[node]++
+			}
+			var loads []float64
+			for _, node := range r.Nodes() {
+				loads = append(loads, counts[node])
+			}
+			if sd := relativeStdDev(loads); sd > 0.15 {
+				t.Errorf("keys per node vary by %.3f of the mean", sd)
+			}
+		})
+	}
+}
+
+func TestVirtualNodesEvenOutLoad(t *testing.T) {
+	spread := func(vnodes int) float64 {
+		r := NewRing(vnodes, nil)
+		for i := range 20 {
+			r.Add(fmt.Sprintf("node-%d", i))
+		}
+		var shares []float64
+		for _, s := range r.Shares() {
+			shares = append(shares, s)
+		}
+		return relativeStdDev(shares)
+	}
+	one, many := spread(1), spread(DefaultVirtualNodes)
+	if many*3 > one {
+		t.Errorf("%d virtual nodes should spread load far better than 1: %.3f vs %.3f", DefaultVirtualNodes, many, one)
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	r := NewRing(0, nil)
+	r.AddWeighted("small", 100)
+	r.AddWeighted("big", 300)
+	shares := r.Shares()
+	if ratio := shares["big"] / shares["small"]; ratio < 2.4 || ratio > 3.6 {
+		t.Errorf("a node with 3x the virtual nodes got %.2fx the share", ratio)
+	}
+}
+
+// go test -bench=. -benchmem
+func BenchmarkRingGet(b *testing.B) {
+	r := NewRing(0, nil)
+	for i := range 100 {
+		r.Add(fmt.Sprintf("node-%d", i))
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			r.Get(fmt.Sprintf("key%d", i%1000))
+			i++
+		}
+	})
+}